@@ -3,15 +3,25 @@ package cachedpath
 import (
 	"archive/tar"
 	"archive/zip"
+	"compress/bzip2"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"github.com/ulikunitz/xz"
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/CezarGarrido/cachedpath/internal/bufpool"
 )
 
-// IsArchive checks if a file is an archive (zip or tar.gz)
+// IsArchive checks if a file is an archive (zip, tar.gz or a format
+// registered with RegisterArchiveFormat)
 func IsArchive(path string) bool {
 	ext := strings.ToLower(filepath.Ext(path))
 	if ext == ".zip" {
@@ -23,63 +33,218 @@ func IsArchive(path string) bool {
 	if ext == ".tgz" {
 		return true
 	}
-	return false
+	return findArchiveExtractor(path) != nil
+}
+
+// ExtractArchive extracts a compressed file to a directory.
+// Extraction limits (WithMaxExtractSize, WithMaxExtractFileSize and
+// WithMaxExtractFiles) can be passed as options. If extraction fails and
+// destDir was created by this call, it is removed.
+func ExtractArchive(archivePath, destDir string, opts ...Option) error {
+	options := defaultOptions()
+	for _, opt := range opts {
+		opt(options)
+	}
+	return extractArchive(archivePath, destDir, options)
 }
 
-// ExtractArchive extracts a compressed file to a directory
-func ExtractArchive(archivePath, destDir string) error {
+// extractArchive extracts a compressed file to a directory using the given
+// options, verifying it first with WithVerifyBeforeExtract
+func extractArchive(archivePath, destDir string, opts *Options) error {
+	if opts.VerifyBeforeExtract {
+		if err := VerifyArchive(archivePath); err != nil {
+			return err
+		}
+	}
+
+	_, statErr := os.Stat(destDir)
 	if err := EnsureDir(destDir); err != nil {
 		return fmt.Errorf("failed to create destination directory: %w", err)
 	}
 
+	err := extractArchiveFormat(archivePath, destDir, opts)
+	if err != nil && os.IsNotExist(statErr) {
+		os.RemoveAll(destDir)
+	}
+	return corruptionError(archivePath, err)
+}
+
+// extractArchiveFormat dispatches extractArchive by archive format
+func extractArchiveFormat(archivePath, destDir string, opts *Options) error {
 	ext := strings.ToLower(filepath.Ext(archivePath))
 
 	if ext == ".zip" {
-		return extractZip(archivePath, destDir)
+		return extractZip(archivePath, destDir, opts)
 	}
 
 	if ext == ".gz" || ext == ".tgz" {
-		return extractTarGz(archivePath, destDir)
+		return extractTarGz(archivePath, destDir, opts)
+	}
+
+	if extractor := findArchiveExtractor(archivePath); extractor != nil {
+		return extractor.ExtractAll(archivePath, destDir)
 	}
 
 	return fmt.Errorf("unsupported archive format: %s", ext)
 }
 
+// VerifyArchive reads a whole zip or tar.gz archive without writing
+// anything, to detect truncation and checksum errors before extracting it.
+// A damaged archive fails with ErrArchiveCorrupted. Archives of formats
+// registered with RegisterArchiveFormat are only listed.
+func VerifyArchive(archivePath string) error {
+	ext := strings.ToLower(filepath.Ext(archivePath))
+
+	var err error
+	switch {
+	case ext == ".zip":
+		err = verifyZip(archivePath)
+	case ext == ".gz" || ext == ".tgz":
+		err = verifyTarGz(archivePath)
+	default:
+		extractor := findArchiveExtractor(archivePath)
+		if extractor == nil {
+			return fmt.Errorf("unsupported archive format: %s", ext)
+		}
+		_, err = extractor.List(archivePath)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s: %w", ErrArchiveCorrupted, archivePath, err)
+	}
+	return err
+}
+
+// verifyZip reads every zip member, which checks its CRC-32
+func verifyZip(zipPath string) error {
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(io.Discard, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// verifyTarGz reads the whole tar stream, checking the gzip CRC-32 and size
+// at its end
+func verifyTarGz(tarGzPath string) error {
+	file, err := os.Open(tarGzPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gzr, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return fmt.Errorf("%s: %w", header.Name, err)
+		}
+	}
+
+	// Trailing data after the tar end marker still belongs to the gzip stream
+	_, err = io.Copy(io.Discard, gzr)
+	return err
+}
+
+// corruptionError marks errors that mean the archive itself is damaged
+// with ErrArchiveCorrupted
+func corruptionError(archivePath string, err error) error {
+	if err == nil || errors.Is(err, ErrArchiveCorrupted) {
+		return err
+	}
+	for _, target := range []error{zip.ErrChecksum, zip.ErrFormat, gzip.ErrChecksum, gzip.ErrHeader, tar.ErrHeader, io.ErrUnexpectedEOF} {
+		if errors.Is(err, target) {
+			return fmt.Errorf("%w: %s: %w", ErrArchiveCorrupted, archivePath, err)
+		}
+	}
+	return err
+}
+
 // extractZip extrai um arquivo ZIP
-func extractZip(zipPath, destDir string) error {
+func extractZip(zipPath, destDir string, opts *Options) error {
+	limits := newExtractLimiter(opts)
+
 	r, err := zip.OpenReader(zipPath)
 	if err != nil {
 		return fmt.Errorf("failed to open zip: %w", err)
 	}
 	defer r.Close()
 
+	// The central directory tells us the entry count up front
+	if limits.maxFiles > 0 && len(r.File) > limits.maxFiles {
+		return fmt.Errorf("%w: %d entries exceeds limit of %d", ErrArchiveTooLarge, len(r.File), limits.maxFiles)
+	}
+
 	for _, f := range r.File {
-		err := extractZipFile(f, destDir)
+		err := extractZipFile(f, destDir, limits, opts)
 		if err != nil {
-			return err
+			return &ExtractionError{Entry: f.Name, Underlying: err}
 		}
 	}
 
 	return nil
 }
 
-func extractZipFile(f *zip.File, destDir string) error {
-	filePath := filepath.Join(destDir, f.Name)
+func extractZipFile(f *zip.File, destDir string, limits *extractLimiter, opts *Options) error {
+	filePath := filepath.Join(destDir, opts.entryName(f.Name))
 
 	// Previne path traversal
 	if !strings.HasPrefix(filePath, filepath.Clean(destDir)+string(os.PathSeparator)) {
 		return fmt.Errorf("invalid file path: %s", filePath)
 	}
 
+	if err := limits.addFile(); err != nil {
+		return err
+	}
+
+	if err := checkResolvedPath(destDir, filePath); err != nil {
+		return err
+	}
+
 	if f.FileInfo().IsDir() {
 		return os.MkdirAll(filePath, os.ModePerm)
 	}
 
+	if f.Mode()&os.ModeSymlink != 0 {
+		if opts.DisallowSymlinks {
+			return nil
+		}
+		linkname, err := readZipLink(f)
+		if err != nil {
+			return err
+		}
+		return extractSymlink(destDir, filePath, opts.entryName(linkname), opts)
+	}
+
 	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
 		return err
 	}
 
-	dstFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+	dstFile, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		return err
 	}
@@ -91,19 +256,50 @@ func extractZipFile(f *zip.File, destDir string) error {
 	}
 	defer srcFile.Close()
 
-	_, err = io.Copy(dstFile, srcFile)
-	return err
+	if err := limits.copy(dstFile, srcFile, f.Name); err != nil {
+		return err
+	}
+
+	return restoreFileInfo(filePath, f.Mode(), f.Modified, opts)
+}
+
+// maxLinkTarget bounds the target of a zip symlink, stored as the entry's content
+const maxLinkTarget = 4096
+
+// readZipLink returns the target of a zip symlink entry
+func readZipLink(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	target, err := io.ReadAll(io.LimitReader(rc, maxLinkTarget+1))
+	if err != nil {
+		return "", err
+	}
+	if len(target) == 0 || len(target) > maxLinkTarget {
+		return "", fmt.Errorf("invalid symlink target: %s", f.Name)
+	}
+	return string(target), nil
 }
 
 // extractTarGz extrai um arquivo tar.gz
-func extractTarGz(tarGzPath, destDir string) error {
+func extractTarGz(tarGzPath, destDir string, opts *Options) error {
 	file, err := os.Open(tarGzPath)
 	if err != nil {
 		return fmt.Errorf("failed to open tar.gz: %w", err)
 	}
 	defer file.Close()
 
-	gzr, err := gzip.NewReader(file)
+	return extractTarGzReader(file, destDir, opts)
+}
+
+// extractTarGzReader extracts a tar.gz stream, such as a download in progress
+func extractTarGzReader(r io.Reader, destDir string, opts *Options) error {
+	limits := newExtractLimiter(opts)
+
+	gzr, err := gzip.NewReader(r)
 	if err != nil {
 		return fmt.Errorf("failed to create gzip reader: %w", err)
 	}
@@ -120,86 +316,299 @@ func extractTarGz(tarGzPath, destDir string) error {
 			return fmt.Errorf("failed to read tar: %w", err)
 		}
 
-		target := filepath.Join(destDir, header.Name)
-
-		// Previne path traversal
-		if !strings.HasPrefix(target, filepath.Clean(destDir)+string(os.PathSeparator)) {
-			return fmt.Errorf("invalid file path: %s", target)
+		if err := extractTarEntry(tr, header, destDir, limits, opts); err != nil {
+			return &ExtractionError{Entry: header.Name, Underlying: err}
 		}
+	}
 
-		switch header.Typeflag {
-		case tar.TypeDir:
-			if err := os.MkdirAll(target, 0755); err != nil {
-				return err
-			}
-		case tar.TypeReg:
-			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-				return err
-			}
+	return nil
+}
 
-			outFile, err := os.Create(target)
-			if err != nil {
-				return err
-			}
+// extractTarEntry extracts the entry of header, whose content tr is at
+func extractTarEntry(tr *tar.Reader, header *tar.Header, destDir string, limits *extractLimiter, opts *Options) error {
+	target := filepath.Join(destDir, opts.entryName(header.Name))
 
-			if _, err := io.Copy(outFile, tr); err != nil {
-				outFile.Close()
-				return err
-			}
+	// Previne path traversal
+	if !strings.HasPrefix(target, filepath.Clean(destDir)+string(os.PathSeparator)) {
+		return fmt.Errorf("invalid file path: %s", target)
+	}
+
+	if err := limits.addFile(); err != nil {
+		return err
+	}
+
+	if err := checkResolvedPath(destDir, target); err != nil {
+		return err
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		if err := restoreOwner(target, header, opts); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+
+		outFile, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+
+		if err := limits.copy(outFile, tr, header.Name); err != nil {
 			outFile.Close()
+			return err
+		}
+		outFile.Close()
+
+		if err := restoreFileInfo(target, header.FileInfo().Mode(), header.ModTime, opts); err != nil {
+			return err
+		}
+		if err := restoreOwner(target, header, opts); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if opts.DisallowSymlinks {
+			return nil
+		}
+		if err := extractSymlink(destDir, target, opts.entryName(header.Linkname), opts); err != nil {
+			return err
+		}
+		if err := restoreOwner(target, header, opts); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		if opts.DisallowSymlinks {
+			return nil
+		}
+		if err := extractHardLink(destDir, target, opts.entryName(header.Linkname)); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-// ExtractSpecificFile extracts a specific file from an archive
-func ExtractSpecificFile(archivePath, internalPath, destDir string) (string, error) {
-	if err := EnsureDir(destDir); err != nil {
-		return "", fmt.Errorf("failed to create destination directory: %w", err)
+// restoreFileInfo applies the permission bits, unless PreservePermissions is
+// off, and the modification time recorded in the archive to an extracted file
+func restoreFileInfo(path string, mode os.FileMode, modTime time.Time, opts *Options) error {
+	if opts.PreservePermissions {
+		if err := os.Chmod(path, mode.Perm()); err != nil {
+			return err
+		}
+	}
+	if modTime.IsZero() {
+		return nil
 	}
+	return os.Chtimes(path, modTime, modTime)
+}
+
+// restoreOwner gives an extracted entry the owner and group recorded in the
+// tar header. Only root can change ownership, so it does nothing for other
+// users or when PreservePermissions is off.
+func restoreOwner(path string, header *tar.Header, opts *Options) error {
+	if !opts.PreservePermissions || os.Geteuid() != 0 {
+		return nil
+	}
+	if err := os.Lchown(path, header.Uid, header.Gid); err != nil {
+		return fmt.Errorf("failed to set owner of %s: %w", header.Name, err)
+	}
+	return nil
+}
 
+// extractSymlink creates a symbolic link, refusing targets that resolve
+// outside destDir. Absolute targets are only allowed with
+// AllowAbsoluteSymlinks.
+func extractSymlink(destDir, target, linkname string, opts *Options) error {
+	if filepath.IsAbs(linkname) && !opts.AllowAbsoluteSymlinks {
+		return fmt.Errorf("invalid symlink target: %s -> %s", target, linkname)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	if !filepath.IsAbs(linkname) {
+		// Resolve on disk so links created earlier cannot be chained to escape destDir
+		root, err := filepath.EvalSymlinks(destDir)
+		if err != nil {
+			return err
+		}
+		parent, err := filepath.EvalSymlinks(filepath.Dir(target))
+		if err != nil {
+			return err
+		}
+		if !isWithinDir(root, filepath.Join(parent, linkname)) {
+			return fmt.Errorf("invalid symlink target: %s -> %s", target, linkname)
+		}
+	}
+
+	os.Remove(target)
+	return os.Symlink(linkname, target)
+}
+
+// checkResolvedPath refuses to extract to target when an already extracted
+// symlink, such as an absolute one, would redirect the write outside
+// destDir. A symlink at target itself is replaced rather than followed.
+func checkResolvedPath(destDir, target string) error {
+	if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+
+	// The deepest directory that already exists decides where the write lands
+	dir := filepath.Dir(target)
+	for !isWithinDir(dir, destDir) {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+
+	root, err := filepath.EvalSymlinks(destDir)
+	if err != nil {
+		return err
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if !isWithinDir(root, resolved) {
+		return fmt.Errorf("invalid file path: %s is outside the destination through a symlink", target)
+	}
+	return nil
+}
+
+// extractHardLink creates a hard link to a previously extracted file inside destDir
+func extractHardLink(destDir, target, linkname string) error {
+	root, err := filepath.EvalSymlinks(destDir)
+	if err != nil {
+		return err
+	}
+
+	source, err := filepath.EvalSymlinks(filepath.Join(destDir, linkname))
+	if err != nil {
+		return fmt.Errorf("invalid hard link target: %s -> %s: %w", target, linkname, err)
+	}
+	if !isWithinDir(root, source) {
+		return fmt.Errorf("invalid hard link target: %s -> %s", target, linkname)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	os.Remove(target)
+	return os.Link(source, target)
+}
+
+// isWithinDir reports whether path is dir itself or located inside it
+func isWithinDir(dir, path string) bool {
+	dir = filepath.Clean(dir)
+	path = filepath.Clean(path)
+	return path == dir || strings.HasPrefix(path, dir+string(os.PathSeparator))
+}
+
+// ExtractSpecificFile extracts a specific file from an archive.
+// The per-file extraction limit (WithMaxExtractFileSize) can be passed as an option.
+func ExtractSpecificFile(archivePath, internalPath, destDir string, opts ...Option) (string, error) {
+	options := defaultOptions()
+	for _, opt := range opts {
+		opt(options)
+	}
+	return extractSpecificFile(archivePath, internalPath, destDir, options)
+}
+
+// extractSpecificFile extracts a specific file from an archive using the
+// given options. destDir is only created once the member is found, and
+// removed again if it was created for a failed extraction, so probing for
+// missing members leaves nothing behind.
+func extractSpecificFile(archivePath, internalPath, destDir string, opts *Options) (string, error) {
+	_, statErr := os.Stat(destDir)
+	path, err := extractSpecificMember(archivePath, internalPath, destDir, opts)
+	if err != nil && os.IsNotExist(statErr) {
+		// Fails unless the directory is empty
+		os.Remove(destDir)
+	}
+	return path, err
+}
+
+// extractSpecificMember dispatches extractSpecificFile by archive format
+func extractSpecificMember(archivePath, internalPath, destDir string, opts *Options) (string, error) {
 	ext := strings.ToLower(filepath.Ext(archivePath))
 
 	if ext == ".zip" {
-		return extractSpecificFromZip(archivePath, internalPath, destDir)
+		return extractSpecificFromZip(archivePath, internalPath, destDir, opts)
 	}
 
 	if ext == ".gz" || ext == ".tgz" {
-		return extractSpecificFromTarGz(archivePath, internalPath, destDir)
+		return extractSpecificFromTarGz(archivePath, internalPath, destDir, opts)
+	}
+
+	if extractor := findArchiveExtractor(archivePath); extractor != nil {
+		if err := makeDestDir(destDir, opts); err != nil {
+			return "", err
+		}
+		return extractor.ExtractFile(archivePath, internalPath, destDir)
 	}
 
 	return "", fmt.Errorf("unsupported archive format: %s", ext)
 }
 
-func extractSpecificFromZip(zipPath, internalPath, destDir string) (string, error) {
+// makeDestDir creates the destination directory of a specific-file
+// extraction and its parent, such as the cache's extracted directory
+func makeDestDir(destDir string, opts *Options) error {
+	if err := opts.mkdirAll(filepath.Dir(destDir)); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	if err := EnsureDir(destDir); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
+	return nil
+}
+
+func extractSpecificFromZip(zipPath, internalPath, destDir string, opts *Options) (string, error) {
+	limits := newExtractLimiter(opts)
+
 	r, err := zip.OpenReader(zipPath)
 	if err != nil {
 		return "", fmt.Errorf("failed to open zip: %w", err)
 	}
 	defer r.Close()
 
+	internalPath = opts.entryName(internalPath)
 	for _, f := range r.File {
-		if f.Name == internalPath {
+		if opts.entryName(f.Name) == internalPath {
 			destPath := filepath.Join(destDir, filepath.Base(internalPath))
 
-			if err := os.MkdirAll(filepath.Dir(destPath), os.ModePerm); err != nil {
+			srcFile, err := f.Open()
+			if err != nil {
 				return "", err
 			}
+			defer srcFile.Close()
 
-			dstFile, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
+			if err := makeDestDir(destDir, opts); err != nil {
+				return "", err
+			}
+
+			dstFile, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 			if err != nil {
 				return "", err
 			}
 			defer dstFile.Close()
 
-			srcFile, err := f.Open()
-			if err != nil {
+			if err := limits.copy(dstFile, srcFile, f.Name); err != nil {
+				dstFile.Close()
+				os.Remove(destPath)
 				return "", err
 			}
-			defer srcFile.Close()
 
-			if _, err := io.Copy(dstFile, srcFile); err != nil {
+			if err := restoreFileInfo(destPath, f.Mode(), f.Modified, opts); err != nil {
 				return "", err
 			}
 
@@ -210,7 +619,9 @@ func extractSpecificFromZip(zipPath, internalPath, destDir string) (string, erro
 	return "", fmt.Errorf("file not found in archive: %s", internalPath)
 }
 
-func extractSpecificFromTarGz(tarGzPath, internalPath, destDir string) (string, error) {
+func extractSpecificFromTarGz(tarGzPath, internalPath, destDir string, opts *Options) (string, error) {
+	limits := newExtractLimiter(opts)
+
 	file, err := os.Open(tarGzPath)
 	if err != nil {
 		return "", fmt.Errorf("failed to open tar.gz: %w", err)
@@ -225,6 +636,7 @@ func extractSpecificFromTarGz(tarGzPath, internalPath, destDir string) (string,
 
 	tr := tar.NewReader(gzr)
 
+	internalPath = opts.entryName(internalPath)
 	for {
 		header, err := tr.Next()
 		if err == io.EOF {
@@ -234,10 +646,10 @@ func extractSpecificFromTarGz(tarGzPath, internalPath, destDir string) (string,
 			return "", fmt.Errorf("failed to read tar: %w", err)
 		}
 
-		if header.Name == internalPath && header.Typeflag == tar.TypeReg {
+		if opts.entryName(header.Name) == internalPath && header.Typeflag == tar.TypeReg {
 			destPath := filepath.Join(destDir, filepath.Base(internalPath))
 
-			if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+			if err := makeDestDir(destDir, opts); err != nil {
 				return "", err
 			}
 
@@ -247,7 +659,16 @@ func extractSpecificFromTarGz(tarGzPath, internalPath, destDir string) (string,
 			}
 			defer outFile.Close()
 
-			if _, err := io.Copy(outFile, tr); err != nil {
+			if err := limits.copy(outFile, tr, header.Name); err != nil {
+				outFile.Close()
+				os.Remove(destPath)
+				return "", err
+			}
+
+			if err := restoreFileInfo(destPath, header.FileInfo().Mode(), header.ModTime, opts); err != nil {
+				return "", err
+			}
+			if err := restoreOwner(destPath, header, opts); err != nil {
 				return "", err
 			}
 
@@ -257,3 +678,194 @@ func extractSpecificFromTarGz(tarGzPath, internalPath, destDir string) (string,
 
 	return "", fmt.Errorf("file not found in archive: %s", internalPath)
 }
+
+// StreamFromArchive returns a reader over a single archive member without
+// extracting it to disk. Supported formats are .zip, .tar.gz (.tgz),
+// .tar.bz2 (.tbz2) and .tar.xz (.txz). Member names match whether they are
+// stored composed (NFC) or decomposed (NFD). Closing the reader releases
+// the archive.
+func StreamFromArchive(archivePath, internalPath string) (io.ReadCloser, error) {
+	lower := strings.ToLower(archivePath)
+	if strings.HasSuffix(lower, ".zip") {
+		return streamFromZip(archivePath, internalPath)
+	}
+
+	tr, closeAll, err := openTar(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("failed to read tar: %w", err)
+		}
+
+		if sameEntryName(header.Name, internalPath) && header.Typeflag == tar.TypeReg {
+			return &archiveEntryReader{Reader: tr, close: closeAll}, nil
+		}
+	}
+
+	closeAll()
+	return nil, fmt.Errorf("%w: %s in archive %s", ErrFileNotFound, internalPath, archivePath)
+}
+
+// openTar opens a compressed tar archive (.tar.gz, .tar.bz2 or .tar.xz) for
+// sequential reading. The returned function releases the archive.
+func openTar(archivePath string) (*tar.Reader, func() error, error) {
+	lower := strings.ToLower(archivePath)
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+
+	var decompressed io.Reader
+	var closeDecompressor func() error
+	switch {
+	case strings.HasSuffix(lower, ".tar.gz") || strings.HasSuffix(lower, ".tgz"):
+		gzr, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("failed to create gzip reader: %w", err)
+		}
+		decompressed, closeDecompressor = gzr, gzr.Close
+	case strings.HasSuffix(lower, ".tar.bz2") || strings.HasSuffix(lower, ".tbz2"):
+		decompressed = bzip2.NewReader(file)
+	case strings.HasSuffix(lower, ".tar.xz") || strings.HasSuffix(lower, ".txz"):
+		xzr, err := xz.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("failed to create xz reader: %w", err)
+		}
+		decompressed = xzr
+	default:
+		file.Close()
+		return nil, nil, fmt.Errorf("unsupported archive format: %s", filepath.Ext(archivePath))
+	}
+
+	closeAll := func() error {
+		if closeDecompressor != nil {
+			closeDecompressor()
+		}
+		return file.Close()
+	}
+	return tar.NewReader(decompressed), closeAll, nil
+}
+
+// streamFromZip returns a reader over a zip member
+func streamFromZip(zipPath, internalPath string) (io.ReadCloser, error) {
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zip: %w", err)
+	}
+
+	for _, f := range r.File {
+		if !sameEntryName(f.Name, internalPath) || f.FileInfo().IsDir() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		return &archiveEntryReader{Reader: rc, close: func() error {
+			rc.Close()
+			return r.Close()
+		}}, nil
+	}
+
+	r.Close()
+	return nil, fmt.Errorf("%w: %s in archive %s", ErrFileNotFound, internalPath, zipPath)
+}
+
+// entryName returns the name an archive member is extracted and looked up
+// under: its NFC form, so names stored decomposed (as macOS does) match
+// those typed on other systems, unless WithNormalizeFilenames(false) is set
+func (o *Options) entryName(name string) string {
+	if !o.NormalizeFilenames {
+		return name
+	}
+	return norm.NFC.String(name)
+}
+
+// sameEntryName reports whether two archive member names are the same once
+// normalized to NFC
+func sameEntryName(a, b string) bool {
+	return a == b || norm.NFC.String(a) == norm.NFC.String(b)
+}
+
+// archiveEntryReader reads an archive member and releases the archive on Close
+type archiveEntryReader struct {
+	io.Reader
+	close func() error
+}
+
+// Close releases the underlying archive
+func (r *archiveEntryReader) Close() error {
+	return r.close()
+}
+
+// extractLimiter enforces size and entry count limits while extracting an archive
+type extractLimiter struct {
+	maxTotal int64
+	maxFile  int64
+	maxFiles int
+	total    int64
+	files    int
+}
+
+// newExtractLimiter creates an extractLimiter from the extraction options
+func newExtractLimiter(opts *Options) *extractLimiter {
+	return &extractLimiter{
+		maxTotal: opts.MaxExtractSize,
+		maxFile:  opts.MaxExtractFileSize,
+		maxFiles: opts.MaxExtractFiles,
+	}
+}
+
+// addFile counts a new archive entry against the entry limit
+func (l *extractLimiter) addFile() error {
+	l.files++
+	if l.maxFiles > 0 && l.files > l.maxFiles {
+		return fmt.Errorf("%w: more than %d entries", ErrArchiveTooLarge, l.maxFiles)
+	}
+	return nil
+}
+
+// copy copies an archive member, failing once the per-file or total limit is exceeded
+func (l *extractLimiter) copy(dst io.Writer, src io.Reader, name string) error {
+	limit := int64(-1)
+	if l.maxFile > 0 {
+		limit = l.maxFile
+	}
+	if l.maxTotal > 0 {
+		remaining := l.maxTotal - l.total
+		if limit < 0 || remaining < limit {
+			limit = remaining
+		}
+	}
+
+	if limit < 0 {
+		n, err := bufpool.Copy(dst, src)
+		l.total += n
+		return err
+	}
+
+	// Read one byte past the limit so an oversized member can be detected
+	n, err := bufpool.Copy(dst, io.LimitReader(src, limit+1))
+	l.total += n
+	if err != nil {
+		return err
+	}
+	if n > limit {
+		if l.maxFile > 0 && n > l.maxFile {
+			return fmt.Errorf("%w: %s exceeds per-file limit of %d bytes", ErrArchiveTooLarge, name, l.maxFile)
+		}
+		return fmt.Errorf("%w: total extracted size exceeds limit of %d bytes", ErrArchiveTooLarge, l.maxTotal)
+	}
+	return nil
+}
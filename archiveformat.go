@@ -0,0 +1,107 @@
+package cachedpath
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// ArchiveExtractor extracts archives of a custom format registered with
+// RegisterArchiveFormat. Extractors are responsible for keeping members
+// inside destDir; the extraction limits options only apply to the built-in
+// zip and tar.gz formats.
+type ArchiveExtractor interface {
+	// ExtractAll extracts every member of the archive into destDir
+	ExtractAll(archivePath, destDir string) error
+
+	// ExtractFile extracts a single member into destDir and returns the
+	// path of the extracted file, which should be the member's base name
+	// inside destDir so later calls find it already extracted
+	ExtractFile(archivePath, internalPath, destDir string) (string, error)
+
+	// List returns the names of the archive members
+	List(archivePath string) ([]string, error)
+}
+
+// archiveFormat is a registered custom archive format
+type archiveFormat struct {
+	name      string
+	detect    func(path string, header []byte) bool
+	extractor ArchiveExtractor
+}
+
+// archiveHeaderSize is how many leading bytes of a file are passed to detect
+const archiveHeaderSize = 512
+
+var (
+	archiveFormatsMu sync.RWMutex
+	archiveFormats   []archiveFormat
+)
+
+// RegisterArchiveFormat registers a custom archive format. detect receives
+// the file path and up to its first 512 bytes and reports whether the file
+// is in this format. Registered formats are consulted in registration order,
+// after the built-in zip and tar.gz formats. Registering a name again
+// replaces the previous handler.
+func RegisterArchiveFormat(name string, detect func(path string, header []byte) bool, extractor ArchiveExtractor) {
+	archiveFormatsMu.Lock()
+	defer archiveFormatsMu.Unlock()
+
+	format := archiveFormat{name: name, detect: detect, extractor: extractor}
+	for i := range archiveFormats {
+		if archiveFormats[i].name == name {
+			archiveFormats[i] = format
+			return
+		}
+	}
+	archiveFormats = append(archiveFormats, format)
+}
+
+// UnregisterArchiveFormat removes a custom archive format
+func UnregisterArchiveFormat(name string) {
+	archiveFormatsMu.Lock()
+	defer archiveFormatsMu.Unlock()
+
+	for i := range archiveFormats {
+		if archiveFormats[i].name == name {
+			archiveFormats = append(archiveFormats[:i], archiveFormats[i+1:]...)
+			return
+		}
+	}
+}
+
+// findArchiveExtractor returns the extractor of the first registered format
+// that detects path, or nil
+func findArchiveExtractor(path string) ArchiveExtractor {
+	archiveFormatsMu.RLock()
+	formats := append([]archiveFormat(nil), archiveFormats...)
+	archiveFormatsMu.RUnlock()
+
+	if len(formats) == 0 {
+		return nil
+	}
+
+	header := readHeader(path)
+	for _, format := range formats {
+		if format.detect(path, header) {
+			return format.extractor
+		}
+	}
+	return nil
+}
+
+// readHeader returns the first bytes of a file, or nil if it can't be read
+func readHeader(path string) []byte {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	header := make([]byte, archiveHeaderSize)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil
+	}
+	return header[:n]
+}
@@ -0,0 +1,127 @@
+package cachedpath
+
+import (
+	"fmt"
+	"sync"
+)
+
+// batchWorkers is how many URLs of a batch are resolved at the same time
+// by default
+const batchWorkers = 4
+
+// BatchResult is the outcome of one URL of a batch
+type BatchResult struct {
+	// Index is the position of the URL in the batch
+	Index int
+
+	// URL is the URL or local path that was resolved
+	URL string
+
+	// Path is the resolved path, empty if Err is set
+	Path string
+
+	// Err is the error resolving URL, or nil
+	Err error
+}
+
+// BatchError reports a batch in which at least one URL failed. It holds the
+// results of every URL, so callers can go on with the ones that worked.
+// errors.Is and errors.As look into the error of each failed URL.
+type BatchError struct {
+	// Results holds one result per URL, in batch order
+	Results []BatchResult
+}
+
+// Error implements error
+func (e *BatchError) Error() string {
+	failed := e.Failed()
+	if len(failed) == 0 {
+		return fmt.Sprintf("batch of %d URLs failed", len(e.Results))
+	}
+	msg := fmt.Sprintf("%d of %d URLs failed: %s: %v", len(failed), len(e.Results), failed[0].URL, failed[0].Err)
+	if len(failed) > 1 {
+		msg += fmt.Sprintf(" (and %d more)", len(failed)-1)
+	}
+	return msg
+}
+
+// Unwrap returns the errors of the failed URLs
+func (e *BatchError) Unwrap() []error {
+	var errs []error
+	for _, r := range e.Results {
+		if r.Err != nil {
+			errs = append(errs, r.Err)
+		}
+	}
+	return errs
+}
+
+// Failed returns the results of the URLs that failed
+func (e *BatchError) Failed() []BatchResult {
+	var failed []BatchResult
+	for _, r := range e.Results {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// Succeeded returns the results of the URLs that were resolved
+func (e *BatchError) Succeeded() []BatchResult {
+	var succeeded []BatchResult
+	for _, r := range e.Results {
+		if r.Err == nil {
+			succeeded = append(succeeded, r)
+		}
+	}
+	return succeeded
+}
+
+// CachedPaths resolves several URLs or local paths like CachedPath, a few at
+// a time, and returns their paths in the same order. If any of them fails
+// the error is a *BatchError and the paths of the failed URLs are empty;
+// the others are still returned. WithMaxConcurrency sets how many URLs are
+// resolved at the same time.
+func CachedPaths(urlsOrFilenames []string, opts ...Option) ([]string, error) {
+	options := defaultOptions()
+	for _, opt := range opts {
+		opt(options)
+	}
+	results := runBatch(urlsOrFilenames, options.MaxConcurrency, func(i int) (string, error) {
+		return CachedPath(urlsOrFilenames[i], opts...)
+	})
+
+	paths := make([]string, len(results))
+	failed := false
+	for i, r := range results {
+		paths[i] = r.Path
+		failed = failed || r.Err != nil
+	}
+	if failed {
+		return paths, &BatchError{Results: results}
+	}
+	return paths, nil
+}
+
+// runBatch calls resolve for each URL of a batch, at most workers at a time,
+// and returns the results in batch order
+func runBatch(urls []string, workers int, resolve func(i int) (string, error)) []BatchResult {
+	results := make([]BatchResult, len(urls))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+	for i, url := range urls {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, url string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			path, err := resolve(i)
+			results[i] = BatchResult{Index: i, URL: url, Path: path, Err: err}
+		}(i, url)
+	}
+	wg.Wait()
+
+	return results
+}
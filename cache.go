@@ -0,0 +1,26 @@
+package cachedpath
+
+import "github.com/CezarGarrido/cachedpath/internal/fsys"
+
+// Cache stores cached files and their metadata under CacheDir. It has the
+// file operations CachedPath needs: MkdirAll, CreateTemp, Rename, Stat,
+// Remove, Chmod, Open, WriteFile and Glob. Implementations that can't use
+// lock files may also provide Lock(path) (func(), error).
+type Cache = fsys.FS
+
+// CacheFile is a file being written to a Cache
+type CacheFile = fsys.File
+
+// NewMemoryCache returns a Cache that keeps everything in memory, for
+// short-lived processes and tests. Paths returned by CachedPath don't exist
+// on disk: read them with CachedReader. Archive extraction and
+// WithMaxCacheSize are not supported.
+func NewMemoryCache() Cache {
+	return fsys.NewMem()
+}
+
+// virtual reports whether the cache backend keeps files off disk
+func (o *Options) virtual() bool {
+	_, ok := o.fs.(fsys.Virtual)
+	return ok
+}
@@ -1,10 +1,19 @@
 package cachedpath
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"os"
 	"path/filepath"
+	"time"
 
+	"golang.org/x/sync/singleflight"
+
+	"github.com/CezarGarrido/cachedpath/internal/bufpool"
 	"github.com/CezarGarrido/cachedpath/schemes"
 )
 
@@ -24,77 +33,458 @@ import (
 //	    cachedpath.WithTimeout(60 * time.Second),
 //	)
 func CachedPath(urlOrFilename string, opts ...Option) (string, error) {
+	result, err := CachedPathResult(urlOrFilename, opts...)
+	if err != nil {
+		return "", err
+	}
+	return result.Path, nil
+}
+
+// CachedReader works like CachedPath but opens the resulting file for
+// reading. Archive members accessed with the "archive!path" syntax are read
+// from the extracted file. It fails if the result is a directory, such as an
+// archive extracted with WithExtractArchive.
+//
+//	r, err := cachedpath.CachedReader("https://example.com/data.csv")
+//	if err != nil {
+//	    return err
+//	}
+//	defer r.Close()
+func CachedReader(urlOrFilename string, opts ...Option) (io.ReadCloser, error) {
+	options := defaultOptions()
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	result, err := cachedPathResult(urlOrFilename, options)
+	if err != nil {
+		return nil, err
+	}
+	path := result.Path
+
+	// Files in a cache backend off disk are read through it
+	if options.virtual() {
+		if info, err := options.fs.Stat(path); err == nil && !info.IsDir() {
+			return options.fs.Open(path)
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		file.Close()
+		return nil, fmt.Errorf("cannot read %s: is a directory", path)
+	}
+	return file, nil
+}
+
+// Result describes the outcome of CachedPathResult
+type Result struct {
+	// Path is the path CachedPath returns: the file itself, the extraction
+	// directory, or the file extracted from an archive
+	Path string
+
+	// ArchivePath is the local or cached archive, set whenever extraction occurs
+	ArchivePath string
+
+	// ExtractedDir is the extraction directory, set whenever extraction occurs
+	ExtractedDir string
+
+	// LockWait is the time the call waited for cache locks held by other
+	// callers
+	LockWait time.Duration
+}
+
+// CachedPathResult works like CachedPath but also reports the archive path
+// and extraction directory when an archive is extracted.
+func CachedPathResult(urlOrFilename string, opts ...Option) (*Result, error) {
 	// Apply default options
 	options := defaultOptions()
 	for _, opt := range opts {
 		opt(options)
 	}
+	return cachedPathResult(urlOrFilename, options)
+}
 
-	// Ensure cache directory exists
-	if err := EnsureDir(options.CacheDir); err != nil {
-		return "", fmt.Errorf("failed to create cache directory: %w", err)
+// cachedPathResult implements CachedPathResult with resolved options
+func cachedPathResult(urlOrFilename string, options *Options) (*Result, error) {
+	result, err := resolveResult(urlOrFilename, options)
+	if result != nil {
+		result.LockWait = options.lockWait
+	}
+	return result, err
+}
+
+// resolveResult resolves urlOrFilename for cachedPathResult
+func resolveResult(urlOrFilename string, options *Options) (*Result, error) {
+	urlOrFilename, err := normalizeURL(urlOrFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	// data: URIs carry their content inline; "!" is a valid data character
+	if isDataURI(urlOrFilename) {
+		return handleDataURI(urlOrFilename, options)
 	}
 
 	// Check for special archive syntax (file.tar.gz!internal/path)
 	archivePath, internalPath, hasInternalPath := ParseArchivePath(urlOrFilename)
 
+	// file:// URLs are local paths
+	if path, ok, err := fileURLPath(archivePath); ok {
+		if err != nil {
+			return nil, err
+		}
+		return handleLocalPath(path, internalPath, hasInternalPath, options)
+	}
+
 	// Determine if it's a URL or local path
 	if !IsURL(archivePath) {
 		// It's a local path
 		return handleLocalPath(archivePath, internalPath, hasInternalPath, options)
 	}
 
+	// Remote URLs resolved recently are answered from memory
+	key := options.memoryKey(urlOrFilename)
+	if key != "" {
+		if result, ok := resolved.get(key); ok {
+			if err := options.beforeDownload(archivePath); err != nil {
+				return nil, err
+			}
+			options.cacheHit(archivePath, result.Path)
+			if err := options.afterDownload(archivePath, result.Path, true); err != nil {
+				return nil, err
+			}
+			return result, nil
+		}
+	}
+
 	// It's a remote URL
-	return handleRemoteURL(archivePath, internalPath, hasInternalPath, options)
+	result, err := handleRemoteURL(archivePath, internalPath, hasInternalPath, options)
+	if err == nil && key != "" {
+		resolved.put(key, options.cacheKey(archivePath), result, options.MemoryCacheEntries)
+	}
+	return result, err
+}
+
+// ExtractionDirFor returns the directory CachedPath extracts urlOrPath into
+// with the same options, without downloading or extracting anything. Local
+// paths, file:// URLs and the "archive!path" syntax are supported. For remote
+// URLs it is the directory of the latest cached version; ErrFileNotFound is
+// returned when the URL is not in the cache.
+func ExtractionDirFor(urlOrPath string, opts ...Option) (string, error) {
+	options := defaultOptions()
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	urlOrPath, err := normalizeURL(urlOrPath)
+	if err != nil {
+		return "", err
+	}
+	if isDataURI(urlOrPath) {
+		return "", fmt.Errorf("%w: data URIs are not extracted", ErrInvalidURL)
+	}
+
+	archivePath, _, _ := ParseArchivePath(urlOrPath)
+	if path, ok, err := fileURLPath(archivePath); ok {
+		if err != nil {
+			return "", err
+		}
+		return extractedDirFor(options.CacheDir, path), nil
+	}
+	if !IsURL(archivePath) {
+		return extractedDirFor(options.CacheDir, archivePath), nil
+	}
+
+	cachePath, meta := findLatestCached(options, options.cacheKey(archivePath))
+	if meta == nil {
+		return "", fmt.Errorf("%w: %s is not cached", ErrFileNotFound, archivePath)
+	}
+	return extractedDirFor(options.CacheDir, options.contentPath(cachePath)), nil
+}
+
+// EnsureDownloaded makes sure a URL is in the cache, as CachedPath does,
+// and returns the path of the cached file. Archives are never extracted;
+// see EnsureExtracted. Local paths and file:// URLs are returned as they
+// are if the file exists.
+//
+//	archive, err := cachedpath.EnsureDownloaded("https://example.com/data.tar.gz")
+//	// ... later, possibly on another machine sharing the cache
+//	dir, err := cachedpath.EnsureExtracted(archive)
+func EnsureDownloaded(url string, opts ...Option) (string, error) {
+	options := defaultOptions()
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	url, err := normalizeURL(url)
+	if err != nil {
+		return "", err
+	}
+
+	if isDataURI(url) {
+		result, err := handleDataURI(url, options)
+		if err != nil {
+			return "", err
+		}
+		return result.Path, nil
+	}
+
+	path, ok, err := fileURLPath(url)
+	if err != nil {
+		return "", err
+	}
+	if !ok && IsURL(url) {
+		if err := options.beforeDownload(url); err != nil {
+			return "", err
+		}
+		client, err := remoteClient(url, options)
+		if err != nil {
+			return "", err
+		}
+		return downloadToCache(client, url, true, options)
+	}
+	if !ok {
+		path = url
+	}
+	if !FileExists(path) {
+		return "", fmt.Errorf("%w: %s", ErrFileNotFound, path)
+	}
+	return path, nil
+}
+
+// EnsureExtracted extracts an archive, either a file in the cache or any
+// local archive, and returns the extraction directory. As with
+// WithExtractArchive, an existing extraction is reused unless
+// WithForceExtract is set, and concurrent callers extract it only once.
+func EnsureExtracted(archivePath string, opts ...Option) (string, error) {
+	options := defaultOptions()
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	path, ok, err := fileURLPath(archivePath)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		path = archivePath
+	}
+	if !FileExists(path) {
+		return "", fmt.Errorf("%w: %s", ErrFileNotFound, path)
+	}
+	if !IsArchive(path) {
+		return "", fmt.Errorf("file is not an archive: %s", path)
+	}
+	if err := validateCacheDir(options.CacheDir); err != nil {
+		return "", err
+	}
+	return ensureExtracted(path, options)
 }
 
 // handleLocalPath processes local paths
-func handleLocalPath(path, internalPath string, hasInternalPath bool, opts *Options) (string, error) {
+func handleLocalPath(path, internalPath string, hasInternalPath bool, opts *Options) (*Result, error) {
 	// Check if file exists
 	if !FileExists(path) {
-		return "", fmt.Errorf("%w: %s", ErrFileNotFound, path)
+		return nil, fmt.Errorf("%w: %s", ErrFileNotFound, path)
 	}
 
+	// Only extraction uses the cache for local files
+	if hasInternalPath || opts.ExtractArchive {
+		if err := validateCacheDir(opts.CacheDir); err != nil {
+			return nil, err
+		}
+	}
+
+	return resolveArchive(path, internalPath, hasInternalPath, opts)
+}
+
+// resolveArchive extracts path if requested (or a specific file from it) and
+// builds the Result
+func resolveArchive(path, internalPath string, hasInternalPath bool, opts *Options) (*Result, error) {
+	extractDir := extractedDirFor(opts.CacheDir, path)
+
 	// If there's an internal path, extract the specific file from the archive
 	if hasInternalPath {
 		if !IsArchive(path) {
-			return "", fmt.Errorf("file is not an archive: %s", path)
+			return nil, fmt.Errorf("file is not an archive: %s", path)
+		}
+		if opts.virtual() {
+			return nil, fmt.Errorf("%w: extracting %s", ErrUnsupportedByCache, path)
 		}
 
-		extractDir := filepath.Join(opts.CacheDir, "extracted", filepath.Base(path))
-		extractedPath, err := ExtractSpecificFile(path, internalPath, extractDir)
+		// Reuse a previously extracted copy
+		extractedPath := filepath.Join(extractDir, filepath.Base(opts.entryName(internalPath)))
+		if !opts.ForceExtract && !opts.ForceRefresh && FileExists(extractedPath) {
+			return &Result{Path: extractedPath, ArchivePath: path, ExtractedDir: extractDir}, nil
+		}
+
+		extractedPath, err := extractSpecificFile(path, internalPath, extractDir, opts)
 		if err != nil {
-			return "", fmt.Errorf("%w: %v", ErrExtractionFailed, err)
+			return nil, extractionError(path, internalPath, err)
 		}
-		return extractedPath, nil
+		opts.shareTree(extractDir)
+		return &Result{Path: extractedPath, ArchivePath: path, ExtractedDir: extractDir}, nil
 	}
 
 	// If should extract archive
 	if opts.ExtractArchive && IsArchive(path) {
-		extractDir := filepath.Join(opts.CacheDir, "extracted", filepath.Base(path))
-
-		// Check if already extracted
-		if !opts.ForceExtract && FileExists(extractDir) {
-			return extractDir, nil
+		if opts.virtual() {
+			return nil, fmt.Errorf("%w: extracting %s", ErrUnsupportedByCache, path)
 		}
+		result := &Result{Path: extractDir, ArchivePath: path, ExtractedDir: extractDir}
 
-		if err := ExtractArchive(path, extractDir); err != nil {
-			return "", fmt.Errorf("%w: %v", ErrExtractionFailed, err)
+		if _, err := ensureExtracted(path, opts); err != nil {
+			return nil, err
 		}
+		return result, nil
+	}
+
+	return &Result{Path: path}, nil
+}
+
+// ensureExtracted extracts the archive at path into its extraction
+// directory unless it is already extracted. The archive is extracted into
+// a temporary directory that is renamed into place, under a lock.
+func ensureExtracted(path string, opts *Options) (string, error) {
+	extractDir := extractedDirFor(opts.CacheDir, path)
+	if !opts.ForceExtract && !opts.ForceRefresh && FileExists(extractDir) {
 		return extractDir, nil
 	}
 
-	return path, nil
+	if err := opts.mkdirAll(filepath.Dir(extractDir)); err != nil {
+		return "", fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	err := opts.withLock(LockFilePath(extractDir), func() error {
+		// Another process may have extracted it while we waited for the lock
+		if !opts.ForceExtract && !opts.ForceRefresh && FileExists(extractDir) {
+			return nil
+		}
+
+		tmpDir, err := os.MkdirTemp(filepath.Dir(extractDir), ".extract-*")
+		if err != nil {
+			return fmt.Errorf("failed to create temp directory: %w", err)
+		}
+		defer os.RemoveAll(tmpDir) // Remove on error
+		opts.chmodDir(tmpDir)
+
+		if err := extractArchive(path, tmpDir, opts); err != nil {
+			return extractionError(path, "", err)
+		}
+		opts.shareTree(tmpDir)
+
+		if err := os.RemoveAll(extractDir); err != nil {
+			return fmt.Errorf("failed to replace extracted files: %w", err)
+		}
+		if err := os.Rename(tmpDir, extractDir); err != nil {
+			return fmt.Errorf("failed to move extracted files: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return extractDir, nil
 }
 
 // handleRemoteURL processes remote URLs
-func handleRemoteURL(url, internalPath string, hasInternalPath bool, opts *Options) (string, error) {
+func handleRemoteURL(url, internalPath string, hasInternalPath bool, opts *Options) (result *Result, err error) {
+	if err := opts.beforeDownload(url); err != nil {
+		return nil, err
+	}
+
+	// The checksum file is fetched first, with the options of this call
+	expectedSum := ""
+	if opts.ChecksumFile != "" {
+		if expectedSum, err = expectedChecksum(url, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := remoteClient(url, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkManifest(url, opts); err != nil {
+		return nil, err
+	}
+	evictExpired(opts)
+
+	// Hosts that keep failing are left alone until their circuit resets
+	if breaker := opts.CircuitBreaker; breaker != nil && !opts.OfflineMode {
+		host := circuitHost(url)
+		if err := breaker.Allow(host); err != nil {
+			return nil, err
+		}
+		defer func() { breaker.record(host, err) }()
+	}
+
+	// tar.gz archives can be extracted while they download; manifests and
+	// checksum files need the digest of the archive
+	needDigest := opts.Manifest != "" || expectedSum != ""
+	if opts.StreamingExtract && opts.ExtractArchive && !hasInternalPath && !opts.OfflineMode && !opts.virtual() && !needDigest {
+		if isStreamableArchive(url) {
+			result, err := streamExtract(client, url, opts)
+			if !errors.Is(err, ErrNetworkDisabled) {
+				rememberFailure(url, err, opts)
+				return result, err
+			}
+			// Without network access, fall back to the cache below
+		} else {
+			opts.Logger.Debugf("streaming extraction not supported for %s, downloading the archive first", url)
+		}
+	}
+
+	// Streamed extractions have no archive, so they only serve full extraction
+	cachePath, err := downloadToCache(client, url, !opts.ExtractArchive || hasInternalPath || needDigest, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyManifest(url, cachePath, opts); err != nil {
+		return nil, err
+	}
+	if expectedSum != "" {
+		if err := verifyChecksum(url, cachePath, expectedSum, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.ExtractArchive && !hasInternalPath && !fileExists(opts.fs, cachePath) {
+		if dir := extractedDirFor(opts.CacheDir, cachePath); fileExists(opts.fs, dir) {
+			return &Result{Path: dir, ExtractedDir: dir}, nil
+		}
+	}
+
+	return resolveArchive(cachePath, internalPath, hasInternalPath, opts)
+}
+
+// remoteClient returns the scheme client of url configured with opts. It
+// fails with a recent permanent failure of url from the negative cache.
+func remoteClient(url string, opts *Options) (schemes.SchemeClient, error) {
+	if !opts.virtual() {
+		if err := validateCacheDir(opts.CacheDir); err != nil {
+			return nil, err
+		}
+	}
+
 	// Get URL scheme
 	scheme := GetScheme(url)
 	if scheme == "" {
-		return "", ErrInvalidURL
+		return nil, ErrInvalidURL
 	}
 
+	opts.applyHostHeaders(url)
+	opts.applyNetrc(url)
+
 	// Normalize scheme (https also uses http client)
 	if scheme == "https" {
 		scheme = "http"
@@ -103,106 +493,480 @@ func handleRemoteURL(url, internalPath string, hasInternalPath bool, opts *Optio
 	// Get appropriate client
 	client, ok := schemes.GetClient(scheme)
 	if !ok {
-		return "", fmt.Errorf("%w: %s", ErrUnsupportedScheme, scheme)
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedScheme, scheme)
+	}
+
+	// Configure a copy of the client, so concurrent calls with different
+	// options don't race
+	client, err := configureClient(client, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	// Configure HTTP client if it's HTTPClient
-	if httpClient, ok := client.(*schemes.HTTPClient); ok {
-		httpClient.SetHTTPClient(opts.getHTTPClient())
-		httpClient.SetRetryConfig(opts.MaxRetries, opts.RetryDelay)
+	// Recent permanent failures are returned without contacting the server
+	if id := opts.failureID(url); id != "" && !opts.ForceRefresh {
+		if err := failures.get(id); err != nil {
+			opts.Logger.Debugf("returning recent failure of %s: %v", url, err)
+			return nil, err
+		}
 	}
 
+	return client, nil
+}
+
+// downloadToCache makes sure the current version of url is cached, or in
+// offline mode the latest cached one, and returns its cache path. When
+// needArchive is set, streamed extractions, which only cached the
+// extracted files, are not accepted.
+func downloadToCache(client schemes.SchemeClient, url string, needArchive bool, opts *Options) (string, error) {
+	if opts.OfflineMode {
+		// Only the local cache may be used
+		latestPath, meta := findLatestCached(opts, opts.cacheKey(url))
+		if meta == nil || (meta.ExtractedOnly && needArchive) {
+			return "", fmt.Errorf("%w: %s", ErrOfflineAndNotCached, url)
+		}
+		if !meta.ExtractedOnly && !verifyHit(latestPath, meta, opts) {
+			return "", fmt.Errorf("%w: cached copy of %s", ErrChecksumMismatch, url)
+		}
+		if opts.MaxCacheSize > 0 {
+			touchMeta(latestPath, opts)
+		}
+		opts.cacheHit(url, latestPath)
+		return hookedPath(url, opts.contentPath(latestPath), true, opts)
+	}
+
+	result, err := fetchRemote(client, url, opts)
+	if errors.Is(err, ErrNetworkDisabled) {
+		// Without network access cached versions are used as in offline mode
+		if latestPath, meta := findLatestCached(opts, opts.cacheKey(url)); meta != nil && !(meta.ExtractedOnly && needArchive) {
+			if meta.ExtractedOnly || verifyHit(latestPath, meta, opts) {
+				result, err = &fetchResult{path: latestPath, etag: meta.Version()}, nil
+			} else {
+				err = fmt.Errorf("%w: cached copy of %s", ErrChecksumMismatch, url)
+			}
+		}
+	}
+	if err != nil {
+		rememberFailure(url, err, opts)
+		return "", err
+	}
+
+	if result.downloaded {
+		saveMeta(url, result, opts)
+		return hookedPath(url, opts.contentPath(result.path), false, opts)
+	}
+	if opts.MaxCacheSize > 0 {
+		// Hits only touch the metadata when LRU eviction needs access times
+		touchMeta(result.path, opts)
+	}
+	opts.cacheHit(url, result.path)
+	return hookedPath(url, opts.contentPath(result.path), true, opts)
+}
+
+// hookedPath returns the cached path of url after running the AfterDownload hook
+func hookedPath(url, path string, cached bool, opts *Options) (string, error) {
+	if err := opts.afterDownload(url, path, cached); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// saveMeta writes the metadata of a fetched resource under its cache key,
+// keeping the creation time of an existing entry
+func saveMeta(url string, result *fetchResult, opts *Options) {
+	key := opts.cacheKey(url)
+	meta := NewMeta(key, result.path, result.etag)
+	meta.Filename = result.filename
+	meta.FinalURL = result.finalURL
+	meta.SHA256 = result.sha256
+	if info, err := opts.fs.Stat(result.path); err == nil {
+		meta.Size = info.Size()
+	}
+	if opts.ContentAddressable && sharesContent(result.path, result.sha256, opts) {
+		meta.ContentHash = result.sha256
+	}
+	metaPath := MetaFilePath(result.path)
+	if existing, err := loadMeta(opts.fs, metaPath); err == nil && existing.URL == key {
+		meta.CreatedAt = existing.CreatedAt
+	}
+	if err := meta.save(opts.fs, metaPath, opts.fileMode()); err != nil {
+		// Not critical if fails to save metadata
+		opts.Logger.Warnf("failed to save metadata: %v", err)
+	}
+}
+
+// touchMeta records a cache hit in the metadata of cachePath
+func touchMeta(cachePath string, opts *Options) {
+	metaPath := MetaFilePath(cachePath)
+	meta, err := loadMeta(opts.fs, metaPath)
+	if err == nil {
+		meta.LastAccessedAt = time.Now()
+		err = meta.save(opts.fs, metaPath, opts.fileMode())
+	}
+	if err != nil {
+		opts.Logger.Warnf("failed to update access time: %v", err)
+	}
+}
+
+// fetchResult describes the cached version of a remote resource
+type fetchResult struct {
+	path       string
+	etag       string
+	filename   string
+	finalURL   string
+	sha256     string
+	downloaded bool
+}
+
+// inflight shares a fetch of a resource between the goroutines of this
+// process requesting it at the same time
+var inflight singleflight.Group
+
+// fetchRemote makes sure the current version of url is cached. Concurrent
+// calls for the same resource with the same options share a single fetch;
+// only the caller that made it sees the result as downloaded. Joined
+// callers run their BeforeDownload, OnCacheHit and AfterDownload hooks,
+// but not Progress, OnDownloadStart or OnDownloadComplete, which belong to
+// the download.
+func fetchRemote(client schemes.SchemeClient, url string, opts *Options) (*fetchResult, error) {
+	made := false
+	v, err, _ := inflight.Do(opts.inflightKey(url), func() (any, error) {
+		made = true
+		return fetchOnce(client, url, opts)
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := *v.(*fetchResult)
+	result.downloaded = result.downloaded && made
+	return &result, nil
+}
+
+// inflightKey returns the key of the fetches of url that can be shared:
+// the resource, cache directory and headers, and every option that checks
+// or changes what a fetch stores, so a caller never gets a result made
+// without its own checks
+func (o *Options) inflightKey(url string) string {
+	key := o.CacheDir + "\x00" + failureKey(url, o)
+	if o.ForceRefresh {
+		key += "\x00refresh"
+	}
+	if o.virtual() {
+		// Separate backends may share a cache directory
+		key += fmt.Sprintf("\x00%p", o.fs)
+	}
+	if o.Context != nil && o.Context.Done() != nil {
+		// Cancelling one call must not fail the others
+		key += fmt.Sprintf("\x00%p", o.Context.Done())
+	}
+	key += fmt.Sprintf("\x00types=%q\x00max=%d\x00verify=%t\x00digest=%t,%t\x00s3=%t\x00tmp=%s",
+		o.ExpectedContentTypes, o.MaxDownloadSize, o.VerifyOnHit,
+		o.ContentDigest, o.ContentAddressable, o.S3StyleErrorDetection, o.TempDir)
+	for _, detector := range o.ErrorDocumentDetectors {
+		key += fmt.Sprintf("\x00detector=%p", detector)
+	}
+	return key
+}
+
+// fetchOnce implements fetchRemote
+func fetchOnce(client schemes.SchemeClient, url string, opts *Options) (*fetchResult, error) {
+	if !opts.ForceRefresh && schemes.ClientCapabilities(client).Has(schemes.CapImmutable) {
+		// Immutable stores never change what they served: no need to ask
+		if latestPath, meta := findLatestCached(opts, opts.cacheKey(url)); meta != nil && !meta.ExtractedOnly && verifyHit(latestPath, meta, opts) {
+			return &fetchResult{path: latestPath, etag: meta.Version()}, nil
+		}
+	}
+	if !opts.ForceRefresh {
+		// Revalidate a previously cached version with a single conditional request
+		if result, ok := fetchConditional(client, url, opts); ok {
+			return result, nil
+		}
+	}
+	return fetchWithHead(client, url, opts)
+}
+
+// fetchWithHead resolves the ETag with a HEAD request and downloads the
+// resource unless that version is already cached
+func fetchWithHead(client schemes.SchemeClient, url string, opts *Options) (*fetchResult, error) {
+	result, err := headAndDownload(client, url, opts, opts.ETagMismatch)
+	if errors.Is(err, errETagChanged) {
+		// The resource changed between HEAD and GET: retry once with the fresh
+		// ETag, keeping whatever the second GET returns
+		result, err = headAndDownload(client, url, opts, ETagMismatchRekey)
+	}
+	return result, err
+}
+
+// headAndDownload performs a single HEAD + GET round
+func headAndDownload(client schemes.SchemeClient, url string, opts *Options, mismatch ETagMismatchPolicy) (*fetchResult, error) {
 	// Get ETag for versioning
-	etag, err := client.GetETag(url, opts.Headers)
+	info, err := getMetadata(client, url, opts.Headers)
 	if err != nil {
 		// If fails to get ETag, continue without it
-		etag = ""
+		info = schemes.ResourceInfo{}
 	}
+	etag := info.Version()
 
 	// Generate cache filename
-	filename := ResourceToFilename(url, etag)
+	filename := cacheFilename(url, info, opts)
 	cachePath := filepath.Join(opts.CacheDir, filename)
 
+	// Cache hits are answered without creating directories or lock files
+	if !opts.ForceRefresh && isCached(opts, cachePath, etag) {
+		opts.Logger.Debugf("cache hit for %s: %s", url, cachePath)
+		return &fetchResult{path: cachePath, etag: etag}, nil
+	}
+
+	if err := opts.mkdirAll(opts.CacheDir); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
 	// Use file lock to prevent concurrent downloads
 	lockPath := LockFilePath(cachePath)
 
-	err = WithLock(lockPath, func() error {
-		// Check if already in cache
-		if FileExists(cachePath) {
-			// Check metadata
-			metaPath := MetaFilePath(cachePath)
-			if FileExists(metaPath) {
-				meta, err := LoadMetaFromFile(metaPath)
-				if err == nil && meta.ETag == etag {
-					// Cache is up to date
-					return nil
-				}
-			}
+	result := &fetchResult{path: cachePath, etag: etag, filename: info.Filename, finalURL: info.FinalURL}
+	err = opts.withLock(lockPath, func() error {
+		// Another process may have downloaded it while we waited for the lock,
+		// perhaps without the checks of this call
+		if !opts.ForceRefresh && isCached(opts, cachePath, etag) {
+			return checkCachedDownload(url, info, cachePath, opts)
 		}
 
 		// Download the file
-		return downloadFile(client, url, cachePath, opts)
+		var err error
+		result.path, result.etag, result.sha256, err = downloadFile(client, url, info, cachePath, opts, mismatch)
+		result.downloaded = err == nil
+		return err
 	})
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	// Save metadata
-	meta := NewMeta(url, cachePath, etag)
-	metaPath := MetaFilePath(cachePath)
-	if err := meta.SaveToFile(metaPath); err != nil {
-		// Not critical if fails to save metadata
-		fmt.Fprintf(os.Stderr, "Warning: failed to save metadata: %v\n", err)
+	return result, nil
+}
+
+// checkCachedDownload applies the per-call download checks to a file
+// another caller downloaded: the size and content type reported by the
+// server, and the error document detectors
+func checkCachedDownload(url string, info schemes.ResourceInfo, cachePath string, opts *Options) error {
+	if err := opts.checkSize(url, info.Size); err != nil {
+		return err
+	}
+	if err := checkContentType(url, info.ContentType, opts); err != nil {
+		return err
 	}
+	stat, err := opts.fs.Stat(cachePath)
+	if err != nil {
+		return err
+	}
+	return checkErrorDocument(url, cachePath, stat.Size(), opts)
+}
 
-	// If there's an internal path, extract the specific file
-	if hasInternalPath {
-		if !IsArchive(cachePath) {
-			return "", fmt.Errorf("file is not an archive: %s", cachePath)
+// getMetadata returns the version and size of a resource, with a single
+// request when the client supports it. Otherwise only the version is
+// fetched and the size is left for downloadFile to discover.
+func getMetadata(client schemes.SchemeClient, url string, headers map[string]string) (schemes.ResourceInfo, error) {
+	if metadata, ok := metadataClient(client); ok {
+		return metadata.GetMetadata(url, headers)
+	}
+	etag, err := client.GetETag(url, headers)
+	return schemes.ResourceInfo{ETag: etag}, err
+}
+
+// isCached reports whether cachePath holds the given version of its
+// resource, intact if WithVerifyOnHit is set
+func isCached(opts *Options, cachePath, etag string) bool {
+	if !fileExists(opts.fs, cachePath) {
+		return false
+	}
+	meta, err := loadMeta(opts.fs, MetaFilePath(cachePath))
+	if err != nil {
+		discardCorruptMeta(opts, MetaFilePath(cachePath), err)
+		return false
+	}
+	return meta.Version() == etag && verifyHit(cachePath, meta, opts)
+}
+
+// verifyHit reports whether a cached file still has the digest recorded
+// when it was downloaded. It only checks with WithVerifyOnHit, and files
+// cached without a digest are trusted. With WithNFSSafe the recorded size
+// is checked first, allowing for stale attributes.
+func verifyHit(cachePath string, meta *Meta, opts *Options) bool {
+	if opts.NFSSafe && meta.Size > 0 && !coherentSize(cachePath, meta.Size, opts) {
+		return false
+	}
+	if !opts.VerifyOnHit || meta.SHA256 == "" {
+		return true
+	}
+	sum, err := fileSHA256(opts.fs, cachePath)
+	if err != nil || sum != meta.SHA256 {
+		opts.Logger.Warnf("cached file %s does not match its recorded digest", cachePath)
+		return false
+	}
+	return true
+}
+
+// fetchConditional revalidates the latest cached version of a URL with a
+// conditional GET, downloading the body only if the resource changed.
+// It returns false when there is no cached version to revalidate or the
+// request failed, in which case the caller should fall back to fetchWithHead.
+func fetchConditional(client schemes.SchemeClient, url string, opts *Options) (*fetchResult, bool) {
+	conditional, ok := conditionalClient(client)
+	if !ok {
+		return nil, false
+	}
+
+	// Streamed extractions have no archive to return, so they are downloaded again
+	cachedPath, meta := findLatestCached(opts, opts.cacheKey(url))
+	if meta == nil || meta.Version() == "" || meta.ExtractedOnly {
+		return nil, false
+	}
+
+	body, info, err := conditional.GetResourceIfModified(url, meta.ETag, meta.LastModified, opts.Headers)
+	if err != nil {
+		opts.Logger.Debugf("conditional request for %s failed, falling back to HEAD: %v", url, err)
+		return nil, false
+	}
+
+	// Not modified: the cached copy is still valid
+	if body == nil {
+		if !verifyHit(cachedPath, meta, opts) {
+			return nil, false
 		}
+		opts.Logger.Debugf("cache hit for %s (not modified): %s", url, cachedPath)
+		return &fetchResult{path: cachedPath, etag: meta.Version()}, true
+	}
+	defer body.Close()
 
-		extractDir := filepath.Join(opts.CacheDir, "extracted", filename)
-		extractedPath, err := ExtractSpecificFile(cachePath, internalPath, extractDir)
-		if err != nil {
-			return "", fmt.Errorf("%w: %v", ErrExtractionFailed, err)
+	// Servers that ignore conditional headers still report the current
+	// version, so an unchanged resource can be detected without reading the body
+	if info.Version() == meta.Version() && verifyHit(cachedPath, meta, opts) {
+		opts.Logger.Debugf("cache hit for %s (unchanged version): %s", url, cachedPath)
+		return &fetchResult{path: cachedPath, etag: meta.Version()}, true
+	}
+
+	if err := checkContentType(url, info.ContentType, opts); err != nil {
+		opts.Logger.Debugf("conditional download of %s rejected: %v", url, err)
+		return nil, false
+	}
+
+	result := &fetchResult{
+		path:       filepath.Join(opts.CacheDir, cacheFilename(url, info, opts)),
+		etag:       info.Version(),
+		filename:   info.Filename,
+		finalURL:   info.FinalURL,
+		downloaded: true,
+	}
+	err = opts.withLock(LockFilePath(result.path), func() error {
+		var err error
+		result.sha256, err = saveToCache(url, result.path, info.Size, info.ContentType, opts, func(w io.Writer) error {
+			_, err := bufpool.Copy(w, body)
+			return err
+		})
+		return err
+	})
+	if err != nil {
+		opts.Logger.Debugf("conditional download of %s failed, falling back to HEAD: %v", url, err)
+		return nil, false
+	}
+
+	return result, true
+}
+
+// downloadFile downloads a file using the appropriate client.
+// When the client reports the version of the download and it differs from
+// the one in head, the file is stored under the new version
+// (ETagMismatchRekey) or errETagChanged is returned (ETagMismatchRetry).
+// It returns the path and version the file was stored under, and its
+// SHA-256 digest.
+func downloadFile(client schemes.SchemeClient, url string, head schemes.ResourceInfo, destPath string, opts *Options, mismatch ETagMismatchPolicy) (string, string, string, error) {
+	etag := head.Version()
+	if ranger, ok := rangeClient(client); ok && opts.multipart(head) {
+		if err := checkContentType(url, head.ContentType, opts); err != nil {
+			return "", "", "", err
 		}
-		return extractedPath, nil
+		sum, err := saveToCache(url, destPath, head.Size, head.ContentType, opts, func(w io.Writer) error {
+			return downloadParts(ranger, url, etag, opts.tempDirFor(destPath), head.Size, w, opts)
+		})
+		if errors.Is(err, schemes.ErrVersionChanged) && mismatch == ETagMismatchRetry {
+			// A part came from a newer version than the HEAD request saw
+			return "", "", "", errETagChanged
+		}
+		return destPath, etag, sum, err
 	}
+	if opener, ok := resourceOpener(client); ok {
+		body, info, err := opener.OpenResource(url, opts.Headers)
+		if err != nil {
+			return "", "", "", downloadError(url, err)
+		}
+		defer body.Close()
 
-	// If should extract archive
-	if opts.ExtractArchive && IsArchive(cachePath) {
-		extractDir := filepath.Join(opts.CacheDir, "extracted", filename)
+		if err := checkContentType(url, info.ContentType, opts); err != nil {
+			return "", "", "", err
+		}
 
-		// Check if already extracted
-		if !opts.ForceExtract && FileExists(extractDir) {
-			return extractDir, nil
+		if version := info.Version(); version != "" && version != etag {
+			opts.Logger.Warnf("ETag of %s changed between HEAD and GET: %q -> %q", url, etag, version)
+			if mismatch == ETagMismatchRetry && etag != "" {
+				return "", "", "", errETagChanged
+			}
+			etag = version
+			destPath = filepath.Join(filepath.Dir(destPath), cacheFilename(url, info, opts))
 		}
 
-		if err := ExtractArchive(cachePath, extractDir); err != nil {
-			return "", fmt.Errorf("%w: %v", ErrExtractionFailed, err)
+		sum, err := saveToCache(url, destPath, info.Size, info.ContentType, opts, func(w io.Writer) error {
+			_, err := bufpool.Copy(w, body)
+			return err
+		})
+		return destPath, etag, sum, err
+	}
+
+	// Only the metadata request reports the content type here
+	if err := checkContentType(url, head.ContentType, opts); err != nil {
+		return "", "", "", err
+	}
+
+	// Get file size, unless the metadata request already reported it
+	size := head.Size
+	if _, ok := metadataClient(client); !ok {
+		var err error
+		size, err = client.GetSize(url, opts.Headers)
+		if err != nil {
+			size = 0 // Continue without size
 		}
-		return extractDir, nil
 	}
 
-	return cachePath, nil
+	sum, err := saveToCache(url, destPath, size, head.ContentType, opts, func(w io.Writer) error {
+		return client.GetResource(url, w, opts.Headers)
+	})
+	return destPath, etag, sum, err
 }
 
-// downloadFile downloads a file using the appropriate client
-func downloadFile(client schemes.SchemeClient, url, destPath string, opts *Options) error {
-	// Get file size
-	size, err := client.GetSize(url, opts.Headers)
-	if err != nil {
-		size = 0 // Continue without size
+// saveToCache writes the data produced by fetch to destPath through a temporary
+// file, reporting progress along the way. It returns the hex SHA-256 digest
+// of the data, or "" if digests are disabled with WithContentDigest. When
+// the response had no contentType, the expected content types are checked
+// against the start of the data before it is committed.
+func saveToCache(url, destPath string, size int64, contentType string, opts *Options, fetch func(io.Writer) error) (string, error) {
+	// Reject files known to be too large before downloading anything
+	if err := opts.checkSize(url, size); err != nil {
+		return "", err
 	}
 
 	// Create temporary file
-	tmpFile, err := os.CreateTemp(filepath.Dir(destPath), ".download-*")
+	tmpDir := opts.tempDirFor(destPath)
+	if opts.TempDir != "" {
+		if err := opts.mkdirAll(tmpDir); err != nil {
+			return "", fmt.Errorf("failed to create temp directory: %w", err)
+		}
+	}
+	tmpFile, err := opts.fs.CreateTemp(tmpDir, ".download-*")
 	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
+		return "", fmt.Errorf("failed to create temp file: %w", err)
 	}
 	tmpPath := tmpFile.Name()
-	defer os.Remove(tmpPath) // Remove on error
+	defer opts.fs.Remove(tmpPath) // Remove on error
 
 	// Configure progress
 	progress := opts.Progress
@@ -210,24 +974,117 @@ func downloadFile(client schemes.SchemeClient, url, destPath string, opts *Optio
 		progress = NewSimpleProgress(opts.Quiet)
 	}
 
+	start := opts.downloadStarted(url, size)
 	progress.Start(size, url)
 	defer progress.Finish()
 
-	// Create writer with progress
-	writer := NewProgressWriter(tmpFile, progress)
+	// Create writer with progress, hashing the data on the way
+	var dest io.Writer = tmpFile
+	var digest hash.Hash
+	if opts.ContentDigest || opts.ContentAddressable {
+		digest = sha256.New()
+		dest = io.MultiWriter(tmpFile, digest)
+	}
+	var sniff *sniffWriter
+	if contentType == "" && len(opts.ExpectedContentTypes) > 0 {
+		sniff = &sniffWriter{}
+		dest = io.MultiWriter(dest, sniff)
+	}
+	counter := NewProgressWriter(dest, progress)
 
-	// Download the file
-	err = client.GetResource(url, writer, opts.Headers)
-	tmpFile.Close()
+	// Download the file; the reported size may be missing or wrong
+	err = fetch(opts.limitWriter(url, counter))
+	closeErr := tmpFile.Close()
 
 	if err != nil {
-		return fmt.Errorf("%w: %v", ErrDownloadFailed, err)
+		return "", downloadError(url, err)
+	}
+	// Buffered writes can fail when the file is closed
+	if closeErr != nil {
+		return "", fmt.Errorf("failed to write downloaded file: %w", closeErr)
+	}
+
+	// Some CDNs serve the error document of a missing object with status 200
+	if err := checkErrorDocument(url, tmpPath, counter.Written(), opts); err != nil {
+		return "", err
+	}
+
+	// A truncated file would be served from the cache until deleted
+	if size > 0 && counter.Written() != size {
+		return "", &IncompleteDownloadError{URL: url, Expected: size, Written: counter.Written()}
+	}
+
+	// An error page served without a Content-Type must not be cached
+	if sniff != nil {
+		if err := checkSniffedContentType(url, sniff.head, opts); err != nil {
+			return "", err
+		}
+	}
+
+	// Temporary files are private; cached files are readable per FileMode
+	if err := opts.fs.Chmod(tmpPath, opts.fileMode()); err != nil {
+		return "", fmt.Errorf("failed to set file mode: %w", err)
 	}
 
 	// Move temporary file to final destination
-	if err := os.Rename(tmpPath, destPath); err != nil {
-		return fmt.Errorf("failed to move downloaded file: %w", err)
+	if err := moveFile(opts.fs, tmpPath, destPath, opts.fileMode()); err != nil {
+		return "", fmt.Errorf("failed to move downloaded file: %w", err)
+	}
+
+	opts.Logger.Infof("downloaded %s to %s", url, destPath)
+	opts.downloadCompleted(url, destPath, counter.Written(), start)
+
+	var sum string
+	if digest != nil {
+		sum = hex.EncodeToString(digest.Sum(nil))
+		if opts.ContentAddressable {
+			shareContent(destPath, sum, opts)
+		}
 	}
 
+	// Keep the cache under its size limit, never evicting the new file
+	if opts.MaxCacheSize > 0 && !opts.virtual() {
+		evicted, err := lruEvict(opts.CacheDir, opts.MaxCacheSize, destPath)
+		if err != nil {
+			opts.Logger.Warnf("failed to evict cache entries: %v", err)
+		} else if evicted > 0 {
+			opts.Logger.Debugf("evicted %d cache entries", evicted)
+		}
+	}
+
+	return sum, nil
+}
+
+// checkSize rejects a download whose reported size is over MaxDownloadSize
+func (o *Options) checkSize(url string, size int64) error {
+	if o.MaxDownloadSize > 0 && size > o.MaxDownloadSize {
+		return &SizeLimitError{URL: url, Limit: o.MaxDownloadSize, Reported: size}
+	}
 	return nil
 }
+
+// limitWriter wraps w to abort downloads going over MaxDownloadSize
+func (o *Options) limitWriter(url string, w io.Writer) io.Writer {
+	if o.MaxDownloadSize <= 0 {
+		return w
+	}
+	return &limitedWriter{w: w, url: url, limit: o.MaxDownloadSize}
+}
+
+// limitedWriter fails with a *SizeLimitError once more than limit bytes
+// would have been written
+type limitedWriter struct {
+	w       io.Writer
+	url     string
+	limit   int64
+	written int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.written+int64(len(p)) > l.limit {
+		return 0, &SizeLimitError{URL: l.url, Limit: l.limit, Received: l.written + int64(len(p))}
+	}
+	n, err := l.w.Write(p)
+	l.written += int64(n)
+	return n, err
+}
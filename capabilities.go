@@ -0,0 +1,59 @@
+package cachedpath
+
+import "github.com/CezarGarrido/cachedpath/schemes"
+
+// The helpers below return the optional interface of a scheme client when
+// it both implements it and has the matching capability, so clients can
+// turn features off by declaring their capabilities
+
+func metadataClient(client schemes.SchemeClient) (schemes.MetadataClient, bool) {
+	c, ok := client.(schemes.MetadataClient)
+	return c, ok && schemes.ClientCapabilities(client).Has(schemes.CapMetadata)
+}
+
+func conditionalClient(client schemes.SchemeClient) (schemes.ConditionalClient, bool) {
+	c, ok := client.(schemes.ConditionalClient)
+	return c, ok && schemes.ClientCapabilities(client).Has(schemes.CapConditional)
+}
+
+func resourceOpener(client schemes.SchemeClient) (schemes.ResourceOpener, bool) {
+	c, ok := client.(schemes.ResourceOpener)
+	return c, ok && schemes.ClientCapabilities(client).Has(schemes.CapStreaming)
+}
+
+func rangeClient(client schemes.SchemeClient) (schemes.RangeClient, bool) {
+	c, ok := client.(schemes.RangeClient)
+	return c, ok && schemes.ClientCapabilities(client).Has(schemes.CapRanges)
+}
+
+// configureClient returns a copy of client configured with opts, or client
+// itself if it doesn't take configuration
+func configureClient(client schemes.SchemeClient, opts *Options) (schemes.SchemeClient, error) {
+	configurable, ok := client.(schemes.ConfigurableClient)
+	if !ok {
+		return client, nil
+	}
+	httpClient, err := opts.getHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := opts.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return configurable.Configure(schemes.Config{
+		HTTPClient:           httpClient,
+		Timeout:              opts.Timeout,
+		TLSConfig:            tlsConfig,
+		MaxRetries:           opts.MaxRetries,
+		RetryDelay:           opts.RetryDelay,
+		MaxRetryWait:         opts.MaxRetryWait,
+		RetryableStatusCodes: opts.retryableStatusCodes(),
+		RetryIf:              opts.RetryIf,
+		RateLimit:            opts.DomainRateLimit,
+		SSHKey:               opts.SSHKey,
+		KnownHostsFile:       opts.KnownHostsFile,
+		Context:              opts.Context,
+		StallTimeout:         opts.StallTimeout,
+	}), nil
+}
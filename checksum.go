@@ -0,0 +1,100 @@
+package cachedpath
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// ParseChecksumFile reads a SHA-256 checksum file, such as a .sha256 file or
+// SHA256SUMS, and returns the hex digests by file name. Lines are either
+// "<hash>  <filename>", as written by sha256sum (a "*" before the name marks
+// binary mode and is dropped), or a bare "<hash>", which is returned under
+// the empty name. Blank lines and lines starting with "#" are skipped.
+func ParseChecksumFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hash, name, _ := strings.Cut(line, " ")
+		if !isHexDigest(hash) {
+			return nil, fmt.Errorf("%w: line %d of %s is not a SHA-256 checksum", ErrInvalidChecksumFile, n, path)
+		}
+		name = strings.TrimPrefix(strings.TrimLeft(name, " "), "*")
+		sums[name] = strings.ToLower(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(sums) == 0 {
+		return nil, fmt.Errorf("%w: %s has no checksums", ErrInvalidChecksumFile, path)
+	}
+	return sums, nil
+}
+
+// expectedChecksum downloads the checksum file set with WithChecksumFile
+// and returns the digest it lists for url
+func expectedChecksum(url string, opts *Options) (string, error) {
+	// The checksum file is a plain download of its own
+	sumOpts := *opts
+	sumOpts.ChecksumFile = ""
+	sumOpts.ExtractArchive = false
+	sumOpts.ExpectedContentTypes = nil
+	result, err := cachedPathResult(opts.ChecksumFile, &sumOpts)
+	opts.lockWait = sumOpts.lockWait
+	if err != nil {
+		return "", fmt.Errorf("failed to get checksum file: %w", err)
+	}
+	sums, err := ParseChecksumFile(result.Path)
+	if err != nil {
+		return "", err
+	}
+
+	name := checksumName(url)
+	if sum, ok := sums[name]; ok {
+		return sum, nil
+	}
+	if sum, ok := sums[""]; ok {
+		return sum, nil
+	}
+	if len(sums) == 1 {
+		// A .sha256 file for a single file, whatever name it gives
+		for _, sum := range sums {
+			return sum, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s does not list %s", ErrInvalidChecksumFile, opts.ChecksumFile, name)
+}
+
+// checksumName returns the file name checksum files list url under
+func checksumName(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return path.Base(rawURL)
+	}
+	return path.Base(u.Path)
+}
+
+// verifyChecksum checks the digest of the cached copy of url against sum
+func verifyChecksum(url, cachePath, sum string, opts *Options) error {
+	actual, err := cachedDigest(opts.fs, cachePath)
+	if err != nil {
+		return err
+	}
+	if actual != sum {
+		return fmt.Errorf("%w: %s has sha256 %s, %s lists %s", ErrChecksumMismatch, url, actual, opts.ChecksumFile, sum)
+	}
+	return nil
+}
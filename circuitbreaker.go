@@ -0,0 +1,203 @@
+package cachedpath
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of the circuit of a host in a CircuitBreaker
+type CircuitState int
+
+const (
+	// CircuitClosed lets requests to the host through
+	CircuitClosed CircuitState = iota
+
+	// CircuitOpen fails calls for the host with ErrCircuitOpen without a request
+	CircuitOpen
+
+	// CircuitHalfOpen lets a single probe request through; its outcome
+	// closes or opens the circuit again
+	CircuitHalfOpen
+)
+
+// String implements fmt.Stringer
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("CircuitState(%d)", int(s))
+}
+
+// CircuitBreaker stops calls to hosts that keep failing. After maxFailures
+// consecutive failures to a host its circuit opens, and calls for the host
+// fail with ErrCircuitOpen without contacting it. Once resetTimeout has
+// passed the circuit is half-open: the next call is let through as a probe,
+// and closes the circuit if it succeeds or opens it again if it fails.
+//
+// Only network errors and 5xx responses count as failures: a host that
+// answers 404 is reachable. A CircuitBreaker is safe for concurrent use.
+type CircuitBreaker struct {
+	maxFailures  int
+	resetTimeout time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*circuit
+}
+
+// circuit is the state of one host
+type circuit struct {
+	state    CircuitState
+	failures int       // consecutive failures while closed
+	openedAt time.Time // when the circuit last opened
+	probing  bool      // a half-open probe is in flight
+}
+
+// NewCircuitBreaker returns a CircuitBreaker that opens the circuit of a
+// host after maxFailures consecutive failures and probes it again after
+// resetTimeout
+func NewCircuitBreaker(maxFailures int, resetTimeout time.Duration) *CircuitBreaker {
+	if maxFailures < 1 {
+		maxFailures = 1
+	}
+	return &CircuitBreaker{
+		maxFailures:  maxFailures,
+		resetTimeout: resetTimeout,
+		hosts:        make(map[string]*circuit),
+	}
+}
+
+// Allow reports whether a request to host may be made. It fails with
+// ErrCircuitOpen while the circuit is open, or half-open with a probe in
+// flight. A nil error must be followed by RecordSuccess or RecordFailure.
+func (b *CircuitBreaker) Allow(host string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.hosts[host]
+	if !ok {
+		return nil
+	}
+	switch c.state {
+	case CircuitOpen:
+		if wait := b.resetTimeout - time.Since(c.openedAt); wait > 0 {
+			return fmt.Errorf("%w: %s (retry in %s)", ErrCircuitOpen, host, wait.Round(time.Millisecond))
+		}
+		c.state, c.probing = CircuitHalfOpen, true
+	case CircuitHalfOpen:
+		if c.probing {
+			return fmt.Errorf("%w: %s (probe in progress)", ErrCircuitOpen, host)
+		}
+		c.probing = true
+	}
+	return nil
+}
+
+// RecordSuccess closes the circuit of host
+func (b *CircuitBreaker) RecordSuccess(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.hosts, host)
+}
+
+// RecordFailure counts a failure of host, opening its circuit after
+// maxFailures consecutive ones or when a half-open probe fails
+func (b *CircuitBreaker) RecordFailure(host string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.hosts[host]
+	if !ok {
+		c = &circuit{}
+		b.hosts[host] = c
+	}
+	c.failures++
+	if c.state == CircuitHalfOpen || c.failures >= b.maxFailures {
+		c.state, c.openedAt, c.probing = CircuitOpen, time.Now(), false
+	}
+}
+
+// State returns the state of the circuit of host. An open circuit whose
+// reset timeout has passed is reported as half-open.
+func (b *CircuitBreaker) State(host string) CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.hosts[host]
+	if !ok {
+		return CircuitClosed
+	}
+	if c.state == CircuitOpen && time.Since(c.openedAt) >= b.resetTimeout {
+		return CircuitHalfOpen
+	}
+	return c.state
+}
+
+// Reset closes the circuit of host
+func (b *CircuitBreaker) Reset(host string) {
+	b.RecordSuccess(host)
+}
+
+// record counts the outcome of a call for host
+func (b *CircuitBreaker) record(host string, err error) {
+	if isHostFailure(err) {
+		b.RecordFailure(host)
+	} else {
+		b.RecordSuccess(host)
+	}
+}
+
+// breakerConfig identifies the breakers shared by WithCircuitBreaker
+type breakerConfig struct {
+	maxFailures  int
+	resetTimeout time.Duration
+}
+
+// breakers holds the CircuitBreaker of each configuration, so calls with
+// the same WithCircuitBreaker settings share the state of their hosts
+var breakers sync.Map
+
+// sharedBreaker returns the process-wide breaker of a configuration
+func sharedBreaker(maxFailures int, resetTimeout time.Duration) *CircuitBreaker {
+	config := breakerConfig{maxFailures, resetTimeout}
+	if b, ok := breakers.Load(config); ok {
+		return b.(*CircuitBreaker)
+	}
+	b, _ := breakers.LoadOrStore(config, NewCircuitBreaker(maxFailures, resetTimeout))
+	return b.(*CircuitBreaker)
+}
+
+// circuitHost returns the host whose circuit guards resourceURL
+func circuitHost(resourceURL string) string {
+	u, err := url.Parse(resourceURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Host)
+}
+
+// isHostFailure reports whether err suggests the host is unreachable or
+// broken: a network error or a 5xx response. Other failures, such as a
+// missing resource or a checksum mismatch, come from a reachable host.
+func isHostFailure(err error) bool {
+	if err == nil || errors.Is(err, ErrNetworkDisabled) || errors.Is(err, ErrCircuitOpen) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var status *HTTPError
+	if errors.As(err, &status) {
+		return status.StatusCode >= 500
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
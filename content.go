@@ -0,0 +1,99 @@
+package cachedpath
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/CezarGarrido/cachedpath/internal/fsys"
+)
+
+// contentFilename names the content-addressed file of a download with
+// digest sum, keeping the extension of its cache file
+func contentFilename(sum, cachePath string) string {
+	ext := fileExt(filepath.Base(cachePath))
+	if !safeExt(ext) {
+		ext = ""
+	}
+	return sum + ext
+}
+
+// shareContent makes the cache file at cachePath a hard link to the
+// content-addressed file of its digest, creating that file from it if no
+// other URL downloaded the same content yet. Failures only cost the
+// deduplication.
+func shareContent(cachePath, sum string, opts *Options) {
+	linker, ok := opts.fs.(fsys.Linker)
+	if !ok || opts.virtual() {
+		opts.Logger.Debugf("content-addressable storage not supported by the cache backend")
+		return
+	}
+	contentPath := filepath.Join(filepath.Dir(cachePath), contentFilename(sum, cachePath))
+
+	if !fileExists(opts.fs, contentPath) {
+		if err := linker.Link(cachePath, contentPath); err != nil && !os.IsExist(err) {
+			opts.Logger.Warnf("failed to store %s by content: %v", cachePath, err)
+		}
+		return
+	}
+
+	// Same content from another URL: replace the new copy with a link
+	tmpPath := cachePath + ".link"
+	opts.fs.Remove(tmpPath)
+	if err := linker.Link(contentPath, tmpPath); err != nil {
+		opts.Logger.Warnf("failed to link %s to %s: %v", cachePath, contentPath, err)
+		return
+	}
+	if err := opts.fs.Rename(tmpPath, cachePath); err != nil {
+		opts.fs.Remove(tmpPath)
+		opts.Logger.Warnf("failed to link %s to %s: %v", cachePath, contentPath, err)
+	}
+}
+
+// sharesContent reports whether the cache file at cachePath is the
+// content-addressed file of digest sum
+func sharesContent(cachePath, sum string, opts *Options) bool {
+	if sum == "" {
+		return false
+	}
+	contentPath := filepath.Join(filepath.Dir(cachePath), contentFilename(sum, cachePath))
+	cacheInfo, err1 := opts.fs.Stat(cachePath)
+	contentInfo, err2 := opts.fs.Stat(contentPath)
+	return err1 == nil && err2 == nil && os.SameFile(cacheInfo, contentInfo)
+}
+
+// contentPath returns the path CachedPath reports for the cache file at
+// cachePath: with WithContentAddressable, its content-addressed file
+func (o *Options) contentPath(cachePath string) string {
+	if !o.ContentAddressable {
+		return cachePath
+	}
+	meta, err := loadMeta(o.fs, MetaFilePath(cachePath))
+	if err != nil || meta.ContentHash == "" {
+		return cachePath
+	}
+	contentPath := filepath.Join(filepath.Dir(cachePath), contentFilename(meta.ContentHash, cachePath))
+	if !fileExists(o.fs, contentPath) {
+		return cachePath
+	}
+	return contentPath
+}
+
+// removeUnsharedContent deletes the content-addressed file of digest sum,
+// and its extracted files, once no cache entry in cacheDir refers to it
+func removeUnsharedContent(cacheDir, cachePath, sum string) error {
+	metaPaths, err := filepath.Glob(filepath.Join(cacheDir, "*.meta.json"))
+	if err != nil {
+		return err
+	}
+	for _, metaPath := range metaPaths {
+		if meta, err := LoadMetaFromFile(metaPath); err == nil && meta.ContentHash == sum {
+			return nil
+		}
+	}
+
+	contentPath := filepath.Join(cacheDir, contentFilename(sum, cachePath))
+	if err := os.Remove(contentPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(extractedDirFor(cacheDir, contentPath))
+}
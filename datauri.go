@@ -0,0 +1,89 @@
+package cachedpath
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// isDataURI reports whether s is an RFC 2397 data URI
+func isDataURI(s string) bool {
+	return len(s) >= 5 && strings.EqualFold(s[:5], "data:")
+}
+
+// decodeDataURI decodes the payload of an RFC 2397 data URI of the form
+// "data:[<mediatype>][;base64],<data>". Percent-escapes are decoded in both
+// encodings.
+func decodeDataURI(uri string) ([]byte, error) {
+	header, payload, ok := strings.Cut(uri[len("data:"):], ",")
+	if !ok {
+		return nil, fmt.Errorf("%w: data URI without a comma", ErrInvalidURL)
+	}
+
+	data, err := url.PathUnescape(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: data URI: %w", ErrInvalidURL, err)
+	}
+
+	if !strings.HasSuffix(strings.ToLower(header), ";base64") {
+		return []byte(data), nil
+	}
+
+	// Whitespace and missing padding are common in hand-written URIs
+	data = strings.Join(strings.Fields(data), "")
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		decoded, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(data, "="))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: data URI: %w", ErrInvalidURL, err)
+	}
+	return decoded, nil
+}
+
+// handleDataURI writes the decoded content of a data URI to a cache file
+// named by the hash of the URI. An existing file is returned as is.
+func handleDataURI(uri string, opts *Options) (*Result, error) {
+	data, err := decodeDataURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateCacheDir(opts.CacheDir); err != nil {
+		return nil, err
+	}
+
+	cachePath := filepath.Join(opts.CacheDir, urlHash(uri))
+	if fileExists(opts.fs, cachePath) {
+		return &Result{Path: cachePath}, nil
+	}
+
+	if err := opts.mkdirAll(opts.CacheDir); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	tmpFile, err := opts.fs.CreateTemp(opts.CacheDir, ".download-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	defer opts.fs.Remove(tmpPath) // Remove on error
+
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write data URI: %w", err)
+	}
+	if err := opts.fs.Chmod(tmpPath, opts.fileMode()); err != nil {
+		return nil, fmt.Errorf("failed to set file mode: %w", err)
+	}
+
+	if err := opts.fs.Rename(tmpPath, cachePath); err != nil {
+		return nil, fmt.Errorf("failed to move data URI file: %w", err)
+	}
+	return &Result{Path: cachePath}, nil
+}
@@ -0,0 +1,103 @@
+package cachedpath
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// maxErrorDocument is the largest download checked for an error document;
+// the error bodies of object stores are a few hundred bytes
+const maxErrorDocument = 16 << 10
+
+// ErrorDocumentDetector recognizes the start of a download as an error
+// document served with a successful status, such as a "NoSuchKey" body
+// from a bucket behind a CDN, returning its error code and message
+type ErrorDocumentDetector func(body []byte) (code, message string, ok bool)
+
+// S3ErrorDocument detects the error documents of S3 and compatible stores,
+// Google Cloud Storage and Azure Blob Storage: an XML <Error> element with
+// a Code, or a JSON object with an "error" object or a "Code" field
+func S3ErrorDocument(body []byte) (code, message string, ok bool) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return "", "", false
+	}
+
+	switch body[0] {
+	case '<':
+		var doc struct {
+			XMLName xml.Name
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		if err := xml.Unmarshal(body, &doc); err != nil || doc.XMLName.Local != "Error" || doc.Code == "" {
+			return "", "", false
+		}
+		return strings.TrimSpace(doc.Code), strings.TrimSpace(doc.Message), true
+
+	case '{':
+		var doc struct {
+			Error *struct {
+				Code    json.RawMessage `json:"code"`
+				Status  string          `json:"status"`
+				Message string          `json:"message"`
+			} `json:"error"`
+			Code    string `json:"Code"`
+			Message string `json:"Message"`
+		}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return "", "", false
+		}
+		if doc.Error != nil && doc.Error.Message != "" {
+			code := doc.Error.Status
+			if code == "" {
+				code = strings.Trim(string(doc.Error.Code), `"`)
+			}
+			return code, doc.Error.Message, true
+		}
+		if doc.Code != "" && doc.Message != "" {
+			return doc.Code, doc.Message, true
+		}
+	}
+	return "", "", false
+}
+
+// errorDocumentDetectors returns the detectors enabled by the options
+func (o *Options) errorDocumentDetectors() []ErrorDocumentDetector {
+	detectors := o.ErrorDocumentDetectors
+	if o.S3StyleErrorDetection {
+		detectors = append(detectors[:len(detectors):len(detectors)], S3ErrorDocument)
+	}
+	return detectors
+}
+
+// checkErrorDocument fails a download of written bytes, saved at path, that
+// is an error document. Downloads larger than any error document aren't
+// read. This runs before the size reported by the server is checked, so a
+// short error body is reported as such rather than as incomplete.
+func checkErrorDocument(url, path string, written int64, opts *Options) error {
+	detectors := opts.errorDocumentDetectors()
+	if len(detectors) == 0 || written > maxErrorDocument {
+		return nil
+	}
+
+	file, err := opts.fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	body, err := io.ReadAll(io.LimitReader(file, maxErrorDocument))
+	if err != nil {
+		return err
+	}
+
+	for _, detect := range detectors {
+		if code, message, ok := detect(body); ok {
+			return &ErrorDocumentError{URL: url, Code: code, Message: message}
+		}
+	}
+	return nil
+}
@@ -1,6 +1,14 @@
 package cachedpath
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/CezarGarrido/cachedpath/schemes"
+)
 
 var (
 	// ErrInvalidURL indicates that the provided URL is invalid
@@ -12,12 +20,341 @@ var (
 	// ErrUnsupportedScheme indicates that the URL scheme is not supported
 	ErrUnsupportedScheme = errors.New("unsupported URL scheme")
 
+	// ErrInvalidCacheDir indicates that the cache directory can't be used
+	ErrInvalidCacheDir = errors.New("invalid cache directory")
+
 	// ErrDownloadFailed indicates that the download failed
-	ErrDownloadFailed = errors.New("download failed")
+	ErrDownloadFailed = schemes.ErrDownloadFailed
+
+	// ErrIncompleteDownload is returned when a download is shorter or longer
+	// than the size reported by the server
+	ErrIncompleteDownload = errors.New("incomplete download")
+
+	// ErrChecksumMismatch indicates that a file does not have the expected digest
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+
+	// ErrCorruptMetadata indicates a metadata file that can't be parsed
+	ErrCorruptMetadata = errors.New("corrupt cache metadata")
+
+	// ErrInvalidChecksumFile indicates a checksum file that can't be parsed
+	// or doesn't list the file being verified
+	ErrInvalidChecksumFile = errors.New("invalid checksum file")
+
+	// ErrNotInManifest indicates a URL missing from the manifest set with WithManifest
+	ErrNotInManifest = errors.New("URL not in manifest")
+
+	// ErrManifestDigestMismatch indicates a resource whose digest differs
+	// from the one listed in the manifest
+	ErrManifestDigestMismatch = errors.New("digest does not match manifest")
+
+	// ErrFileTooLarge indicates that a download exceeds the configured maximum size
+	ErrFileTooLarge = errors.New("file exceeds maximum download size")
+
+	// ErrSizeLimitExceeded is ErrFileTooLarge, under the name of WithMaxSize
+	ErrSizeLimitExceeded = ErrFileTooLarge
+
+	// ErrUnexpectedContentType indicates that a response's Content-Type is not
+	// one of those set with WithExpectedContentType
+	ErrUnexpectedContentType = errors.New("unexpected content type")
+
+	// ErrErrorDocument indicates that a server answered with a successful
+	// status but the body is an error document
+	ErrErrorDocument = errors.New("server returned an error document")
+
+	// ErrUnsupportedByCache indicates an operation the cache backend can't
+	// perform, such as extracting archives kept in memory
+	ErrUnsupportedByCache = errors.New("not supported by the cache backend")
+
+	// ErrDownloadAborted indicates that the hook set with WithBeforeDownload
+	// refused a URL
+	ErrDownloadAborted = errors.New("download aborted by hook")
+
+	// ErrCircuitOpen indicates a call for a host whose circuit breaker, set
+	// with WithCircuitBreaker, is open after repeated failures
+	ErrCircuitOpen = errors.New("circuit breaker open")
 
 	// ErrExtractionFailed indicates that file extraction failed
 	ErrExtractionFailed = errors.New("extraction failed")
 
+	// ErrArchiveCorrupted indicates that an archive is truncated or fails a checksum
+	ErrArchiveCorrupted = errors.New("archive corrupted")
+
+	// ErrArchiveTooLarge indicates that an archive exceeds the configured extraction limits
+	ErrArchiveTooLarge = errors.New("archive exceeds extraction limits")
+
+	// ErrCertificatePinMismatch indicates that no certificate presented by
+	// a server matches the pins set with WithPinnedCertificates
+	ErrCertificatePinMismatch = errors.New("certificate pin mismatch")
+
 	// ErrLockFailed indicates that it was not possible to acquire the file lock
 	ErrLockFailed = errors.New("failed to acquire file lock")
+
+	// ErrOfflineAndNotCached indicates that offline mode is enabled and the URL is not in the cache
+	ErrOfflineAndNotCached = errors.New("offline mode and resource not cached")
+
+	// ErrProxyAuthRequired indicates that the proxy requires (different) credentials
+	ErrProxyAuthRequired = schemes.ErrProxyAuthRequired
+
+	// ErrTooManyRedirects indicates that a request exceeded the redirect limit
+	ErrTooManyRedirects = schemes.ErrTooManyRedirects
+
+	// ErrRedirectNotAllowed indicates that a redirect was refused by the RedirectPolicy
+	ErrRedirectNotAllowed = schemes.ErrRedirectNotAllowed
+
+	// ErrNetworkDisabled indicates that a network request was attempted while
+	// network access is disabled with SetNetworkAllowed or DisableNetworkEnv
+	ErrNetworkDisabled = schemes.ErrNetworkDisabled
+
+	// ErrStalled indicates that a download received no data for longer than
+	// the timeout set with WithStallTimeout
+	ErrStalled = schemes.ErrStalled
+
+	// ErrResponseRejected indicates a successful response that the predicate
+	// set with WithRetryIf still rejected after the last retry
+	ErrResponseRejected = schemes.ErrResponseRejected
+
+	// errETagChanged indicates that the ETag changed between HEAD and GET
+	errETagChanged = errors.New("ETag changed between HEAD and GET")
 )
+
+// HTTPError reports an unexpected HTTP response status, with the response
+// headers and the start of its body. Downloads return it wrapped under
+// ErrDownloadFailed; use errors.As to inspect the status code.
+type HTTPError = schemes.HTTPError
+
+// DownloadError describes a failed download: the URL, the HTTP status if
+// there was a response, the number of requests made and the underlying
+// error. Failed downloads return it; it unwraps to ErrDownloadFailed and
+// to the underlying error, so errors.As also finds an *HTTPError.
+type DownloadError = schemes.DownloadError
+
+// downloadError describes err as the failure to download resource, unless
+// it already holds a *DownloadError
+func downloadError(resource string, err error) error {
+	var download *DownloadError
+	if err == nil || errors.As(err, &download) {
+		return err
+	}
+	e := &DownloadError{URL: resource, Underlying: err}
+	if u, parseErr := url.Parse(resource); parseErr == nil {
+		e.URL = u.Redacted()
+	}
+	var status *HTTPError
+	if errors.As(err, &status) {
+		e.StatusCode = status.StatusCode
+	}
+	return e
+}
+
+// ExtractionError describes a failure to extract an archive. It unwraps to
+// ErrExtractionFailed and to the underlying error.
+type ExtractionError struct {
+	// ArchivePath is the archive, or the URL of an archive extracted while
+	// it was downloaded
+	ArchivePath string
+
+	// Entry is the archive member that failed, empty if the failure wasn't
+	// specific to one
+	Entry string
+
+	// Underlying is why the extraction failed
+	Underlying error
+}
+
+// Error implements error
+func (e *ExtractionError) Error() string {
+	msg := ErrExtractionFailed.Error()
+	if e.ArchivePath != "" {
+		msg += ": " + e.ArchivePath
+	}
+	if e.Entry != "" {
+		msg += ": entry " + e.Entry
+	}
+	if e.Underlying != nil {
+		msg += ": " + e.Underlying.Error()
+	}
+	return msg
+}
+
+// Unwrap allows errors.Is(err, ErrExtractionFailed) and errors.As on the
+// underlying error
+func (e *ExtractionError) Unwrap() []error {
+	if e.Underlying == nil {
+		return []error{ErrExtractionFailed}
+	}
+	return []error{ErrExtractionFailed, e.Underlying}
+}
+
+// extractionError describes err as the failure to extract entry, or the
+// whole archive if entry is empty, from archivePath. An *ExtractionError
+// already in err gets the fields it doesn't name yet.
+func extractionError(archivePath, entry string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var extraction *ExtractionError
+	if errors.As(err, &extraction) {
+		if extraction.ArchivePath == "" {
+			extraction.ArchivePath = archivePath
+		}
+		if extraction.Entry == "" {
+			extraction.Entry = entry
+		}
+		return err
+	}
+	return &ExtractionError{ArchivePath: archivePath, Entry: entry, Underlying: err}
+}
+
+// LockError describes a failure to acquire a file lock, because of
+// contention or because the lock file couldn't be opened or locked
+type LockError struct {
+	// Path is the lock file path
+	Path string
+
+	// Waited is how long we waited before giving up
+	Waited time.Duration
+
+	// Holder identifies the process that appears to hold the lock (may be empty)
+	Holder string
+
+	// Underlying is the error of the file system, nil when the lock was
+	// held by another process for too long
+	Underlying error
+}
+
+// Error implements error
+func (e *LockError) Error() string {
+	if e.Underlying != nil {
+		return fmt.Sprintf("%v: %s: %v", ErrLockFailed, e.Path, e.Underlying)
+	}
+	msg := fmt.Sprintf("%v: %s (waited %s)", ErrLockFailed, e.Path, e.Waited.Round(time.Millisecond))
+	if e.Holder != "" {
+		msg += ", held by " + e.Holder
+	}
+	return msg
+}
+
+// Unwrap allows errors.Is(err, ErrLockFailed) and errors.As on the
+// underlying error
+func (e *LockError) Unwrap() []error {
+	if e.Underlying == nil {
+		return []error{ErrLockFailed}
+	}
+	return []error{ErrLockFailed, e.Underlying}
+}
+
+// IncompleteDownloadError describes a download whose length differs from
+// the size reported by the server
+type IncompleteDownloadError struct {
+	// URL is the downloaded resource
+	URL string
+
+	// Expected is the size reported by the server
+	Expected int64
+
+	// Written is the number of bytes received
+	Written int64
+}
+
+// Error implements error
+func (e *IncompleteDownloadError) Error() string {
+	return fmt.Sprintf("%v: %s: received %d of %d bytes", ErrIncompleteDownload, e.URL, e.Written, e.Expected)
+}
+
+// Unwrap allows errors.Is(err, ErrIncompleteDownload)
+func (e *IncompleteDownloadError) Unwrap() error {
+	return ErrIncompleteDownload
+}
+
+// SizeLimitError describes a download rejected or aborted because it
+// exceeds the size set with WithMaxSize
+type SizeLimitError struct {
+	// URL is the downloaded resource
+	URL string
+
+	// Limit is the maximum size in bytes
+	Limit int64
+
+	// Reported is the size reported by the server when the download was
+	// rejected before it started, 0 otherwise
+	Reported int64
+
+	// Received is how many bytes were received when the download was
+	// aborted, 0 if it never started
+	Received int64
+}
+
+// Error implements error
+func (e *SizeLimitError) Error() string {
+	if e.Received > 0 {
+		return fmt.Sprintf("%v: %s: aborted after receiving %d bytes, limit is %d", ErrSizeLimitExceeded, e.URL, e.Received, e.Limit)
+	}
+	return fmt.Sprintf("%v: %s is %d bytes, limit is %d", ErrSizeLimitExceeded, e.URL, e.Reported, e.Limit)
+}
+
+// Unwrap allows errors.Is(err, ErrSizeLimitExceeded)
+func (e *SizeLimitError) Unwrap() error {
+	return ErrSizeLimitExceeded
+}
+
+// ContentTypeError describes a download whose media type is not one of
+// those set with WithExpectedContentType
+type ContentTypeError struct {
+	// URL is the downloaded resource
+	URL string
+
+	// Expected are the accepted media types
+	Expected []string
+
+	// Actual is the Content-Type of the response, or the media type
+	// detected from the content when Sniffed is set
+	Actual string
+
+	// Sniffed reports that the response had no Content-Type and Actual was
+	// detected from the first bytes of the content
+	Sniffed bool
+}
+
+// Error implements error
+func (e *ContentTypeError) Error() string {
+	msg := fmt.Sprintf("%v: %s is %q, expected %s", ErrUnexpectedContentType, e.URL, e.Actual, strings.Join(e.Expected, ", "))
+	if e.Sniffed {
+		msg += " (detected from the content)"
+	}
+	return msg
+}
+
+// Unwrap allows errors.Is(err, ErrUnexpectedContentType)
+func (e *ContentTypeError) Unwrap() error {
+	return ErrUnexpectedContentType
+}
+
+// ErrorDocumentError describes a download whose body is an error document,
+// as detected with WithS3StyleErrorDetection or WithErrorDocumentDetector
+type ErrorDocumentError struct {
+	// URL is the downloaded resource
+	URL string
+
+	// Code is the error code of the document, such as "NoSuchKey"
+	Code string
+
+	// Message is the error message of the document
+	Message string
+}
+
+// Error implements error
+func (e *ErrorDocumentError) Error() string {
+	msg := fmt.Sprintf("%v: %s", ErrErrorDocument, e.URL)
+	if e.Code != "" {
+		msg += ": " + e.Code
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// Unwrap allows errors.Is(err, ErrErrorDocument)
+func (e *ErrorDocumentError) Unwrap() error {
+	return ErrErrorDocument
+}
@@ -0,0 +1,260 @@
+package cachedpath
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheEntry is a cached file together with its metadata and extracted files
+type cacheEntry struct {
+	path     string
+	size     int64
+	lastUsed time.Time
+}
+
+// LRUEvict removes the least recently used entries from cacheDir until the
+// total cache size is at most maxBytes. It returns the number of evicted entries.
+// Entries that are locked by a download in progress are skipped. Empty
+// extraction directories left behind by failed extractions are removed too.
+func LRUEvict(cacheDir string, maxBytes int64) (int, error) {
+	return lruEvict(cacheDir, maxBytes, "")
+}
+
+// lruEvict implements LRUEvict, never evicting the entry at keep
+func lruEvict(cacheDir string, maxBytes int64, keep string) (int, error) {
+	removeEmptyExtractDirs(cacheDir)
+
+	entries, err := listCacheEntries(cacheDir)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	keepCounted := false
+	for _, entry := range entries {
+		total += entry.size
+		if entry.path == keep {
+			keepCounted = true
+		}
+	}
+	// A fresh download has no metadata yet but still takes up space
+	if keep != "" && !keepCounted {
+		if info, err := os.Stat(keep); err == nil {
+			total += info.Size()
+		}
+	}
+
+	if total <= maxBytes {
+		return 0, nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastUsed.Before(entries[j].lastUsed)
+	})
+
+	evicted := 0
+	for _, entry := range entries {
+		if total <= maxBytes {
+			break
+		}
+		if entry.path == keep {
+			continue
+		}
+
+		removed, err := removeCacheEntry(cacheDir, entry.path)
+		if err != nil {
+			return evicted, err
+		}
+		if removed {
+			total -= entry.size
+			evicted++
+		}
+	}
+
+	return evicted, nil
+}
+
+// EvictOldEntries removes the entries of cacheDir that were downloaded more
+// than maxAge ago, however recently they were used, along with their metadata
+// and extracted files. It returns the number of evicted entries. Entries that
+// are locked by a download in progress are skipped.
+func EvictOldEntries(cacheDir string, maxAge time.Duration) (int, error) {
+	metaPaths, err := filepath.Glob(filepath.Join(cacheDir, "*.meta.json"))
+	if err != nil {
+		return 0, err
+	}
+
+	evicted := 0
+	for _, metaPath := range metaPaths {
+		meta, err := LoadMetaFromFile(metaPath)
+		if err != nil || time.Since(meta.CreatedAt) <= maxAge {
+			continue
+		}
+		removed, err := removeCacheEntry(cacheDir, strings.TrimSuffix(metaPath, ".meta.json"))
+		if err != nil {
+			return evicted, err
+		}
+		if removed {
+			evicted++
+		}
+	}
+
+	return evicted, nil
+}
+
+// ageSweepInterval is how often WithMaxCacheAge scans a cache directory
+const ageSweepInterval = time.Minute
+
+// ageSweeps holds when each cache directory was last scanned for old entries
+var ageSweeps sync.Map // cacheDir -> time.Time
+
+// evictExpired applies WithMaxCacheAge to the cache directory, at most once
+// per ageSweepInterval
+func evictExpired(opts *Options) {
+	if opts.MaxCacheAge <= 0 || opts.OfflineMode || opts.virtual() {
+		return
+	}
+	now := time.Now()
+	if last, ok := ageSweeps.Load(opts.CacheDir); ok && now.Sub(last.(time.Time)) < ageSweepInterval {
+		return
+	}
+	ageSweeps.Store(opts.CacheDir, now)
+
+	evicted, err := EvictOldEntries(opts.CacheDir, opts.MaxCacheAge)
+	if err != nil {
+		opts.Logger.Warnf("failed to evict old cache entries: %v", err)
+	} else if evicted > 0 {
+		opts.Logger.Debugf("evicted %d cache entries older than %v", evicted, opts.MaxCacheAge)
+	}
+}
+
+// listCacheEntries returns every cached file in cacheDir that has metadata
+func listCacheEntries(cacheDir string) ([]cacheEntry, error) {
+	metaPaths, err := filepath.Glob(filepath.Join(cacheDir, "*.meta.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]cacheEntry, 0, len(metaPaths))
+	for _, metaPath := range metaPaths {
+		cachePath := strings.TrimSuffix(metaPath, ".meta.json")
+
+		var size int64
+		info, err := os.Stat(cachePath)
+		if err == nil {
+			size = info.Size()
+		} else if info, err = os.Stat(extractedDirFor(cacheDir, cachePath)); err != nil {
+			// Streamed extractions only keep the extracted files
+			continue
+		}
+
+		if metaInfo, err := os.Stat(metaPath); err == nil {
+			size += metaInfo.Size()
+		}
+		size += dirSize(extractedDirFor(cacheDir, cachePath))
+
+		lastUsed := info.ModTime()
+		if meta, err := LoadMetaFromFile(metaPath); err == nil {
+			lastUsed = meta.lastUsed()
+		}
+
+		entries = append(entries, cacheEntry{
+			path:     cachePath,
+			size:     size,
+			lastUsed: lastUsed,
+		})
+	}
+
+	return entries, nil
+}
+
+// removeCacheEntry deletes a cached file, its metadata, its lock file and
+// its extracted files. It returns false without deleting anything if the
+// entry is locked.
+func removeCacheEntry(cacheDir, cachePath string) (bool, error) {
+	lock := NewFileLock(LockFilePath(cachePath))
+	locked, err := lock.TryLock()
+	if err != nil || !locked {
+		return false, err
+	}
+	defer lock.Unlock()
+
+	// Paths remembered by WithMemoryCache must not outlive the files
+	extractDir := extractedDirFor(cacheDir, cachePath)
+	resolved.forgetPaths(cachePath, extractDir)
+
+	meta, _ := LoadMetaFromFile(MetaFilePath(cachePath))
+	for _, path := range []string{cachePath, MetaFilePath(cachePath)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	if err := os.RemoveAll(extractDir); err != nil {
+		return false, err
+	}
+	if meta != nil && meta.ContentHash != "" {
+		if err := removeUnsharedContent(cacheDir, cachePath, meta.ContentHash); err != nil {
+			return false, err
+		}
+	}
+
+	// The lock file goes last, while it is still held
+	if err := os.Remove(LockFilePath(cachePath)); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// emptyDirGrace is how old an empty extraction directory must be before it
+// is removed, so directories about to receive a file are left alone
+const emptyDirGrace = time.Minute
+
+// removeEmptyExtractDirs deletes empty directories directly under the
+// cache's extracted directory. Temporary directories of extractions in
+// progress are skipped.
+func removeEmptyExtractDirs(cacheDir string) {
+	root := filepath.Join(cacheDir, "extracted")
+	dirs, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	for _, d := range dirs {
+		if !d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		info, err := d.Info()
+		if err != nil || time.Since(info.ModTime()) < emptyDirGrace {
+			continue
+		}
+		// Fails unless the directory is empty
+		os.Remove(filepath.Join(root, d.Name()))
+	}
+}
+
+// extractedDirFor returns the extraction directory of a cached file
+func extractedDirFor(cacheDir, cachePath string) string {
+	return filepath.Join(cacheDir, "extracted", filepath.Base(cachePath))
+}
+
+// dirSize returns the total size of the regular files under dir
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,85 @@
+// Command memoryscheme shows how to add a URL scheme to cachedpath. Files
+// of memory://bucket/key URLs are served from a map.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/CezarGarrido/cachedpath"
+)
+
+// memoryClient serves memory:// URLs from a map of bucket/key to content
+type memoryClient struct {
+	files map[string]string
+}
+
+// lookup returns the content of a memory:// URL
+func (c memoryClient) lookup(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	content, ok := c.files[u.Host+u.Path]
+	if !ok {
+		return "", fmt.Errorf("%s: %w", rawURL, os.ErrNotExist)
+	}
+	return content, nil
+}
+
+func (c memoryClient) GetResource(rawURL string, w io.Writer, headers map[string]string) error {
+	content, err := c.lookup(rawURL)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, strings.NewReader(content))
+	return err
+}
+
+func (c memoryClient) GetSize(rawURL string, headers map[string]string) (int64, error) {
+	content, err := c.lookup(rawURL)
+	return int64(len(content)), err
+}
+
+// GetETag versions files by their content, so changed files are downloaded again
+func (c memoryClient) GetETag(rawURL string, headers map[string]string) (string, error) {
+	content, err := c.lookup(rawURL)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+func (c memoryClient) Scheme() string {
+	return "memory"
+}
+
+func main() {
+	cachedpath.RegisterScheme(memoryClient{files: map[string]string{
+		"config/settings.json": `{"debug": true}`,
+	}})
+	fmt.Println("supported schemes:", cachedpath.SupportedSchemes())
+
+	cacheDir, err := os.MkdirTemp("", "memoryscheme")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	path, err := cachedpath.CachedPath("memory://config/settings.json", cachedpath.WithCacheDir(cacheDir))
+	if err != nil {
+		log.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s: %s\n", path, data)
+}
@@ -0,0 +1,115 @@
+// Command pakformat shows how to plug a custom archive format into
+// cachedpath. A .pak file here is a zip archive with a different extension.
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/CezarGarrido/cachedpath"
+)
+
+// pakExtractor extracts .pak files
+type pakExtractor struct{}
+
+// detectPak recognizes .pak files by extension and zip signature
+func detectPak(path string, header []byte) bool {
+	return strings.EqualFold(filepath.Ext(path), ".pak") && bytes.HasPrefix(header, []byte("PK\x03\x04"))
+}
+
+func (pakExtractor) ExtractAll(archivePath, destDir string) error {
+	r, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if _, err := extractMember(f, filepath.Join(destDir, f.Name), destDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pakExtractor) ExtractFile(archivePath, internalPath, destDir string) (string, error) {
+	r, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if f.Name == internalPath {
+			return extractMember(f, filepath.Join(destDir, filepath.Base(internalPath)), destDir)
+		}
+	}
+	return "", fmt.Errorf("file not found in pak: %s", internalPath)
+}
+
+func (pakExtractor) List(archivePath string) ([]string, error) {
+	r, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	names := make([]string, 0, len(r.File))
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	return names, nil
+}
+
+// extractMember writes a zip member to destPath, refusing paths that
+// escape destDir
+func extractMember(f *zip.File, destPath, destDir string) (string, error) {
+	rel, err := filepath.Rel(destDir, destPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("illegal file path: %s", f.Name)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return "", err
+	}
+
+	src, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(destPath)
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return "", err
+	}
+	return destPath, nil
+}
+
+func main() {
+	cachedpath.RegisterArchiveFormat("pak", detectPak, pakExtractor{})
+
+	if len(os.Args) < 2 {
+		log.Fatalf("usage: %s <file.pak>[!member]", os.Args[0])
+	}
+
+	path, err := cachedpath.CachedPath(os.Args[1], cachedpath.WithExtractArchive(true))
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	fmt.Println(path)
+}
@@ -1,54 +1,143 @@
 package cachedpath
 
 import (
+	"fmt"
 	"os"
+	"strings"
 	"syscall"
 	"time"
+
+	"github.com/CezarGarrido/cachedpath/internal/fsys"
 )
 
+// DefaultLockTimeout is how long Lock waits for a lock held by another
+// process before failing with a *LockError
+const DefaultLockTimeout = 60 * time.Second
+
+// lockPollInterval is how often Lock tries again to take a held lock
+const lockPollInterval = 100 * time.Millisecond
+
 // FileLock implementa um sistema de lock de arquivo para prevenir race conditions
 type FileLock struct {
-	path string
-	file *os.File
+	path    string
+	mode    os.FileMode
+	timeout time.Duration
+	file    *os.File
+	waited  time.Duration
 }
 
 // NewFileLock cria um novo FileLock
 func NewFileLock(path string) *FileLock {
 	return &FileLock{
-		path: path,
+		path:    path,
+		mode:    0644,
+		timeout: DefaultLockTimeout,
 	}
 }
 
+// SetTimeout sets how long Lock waits for the lock (default:
+// DefaultLockTimeout)
+func (fl *FileLock) SetTimeout(timeout time.Duration) {
+	fl.timeout = timeout
+}
+
+// open opens the lock file, creating it with the lock's mode regardless of
+// the umask. An existing lock file keeps its mode.
+func (fl *FileLock) open() (*os.File, error) {
+	file, err := os.OpenFile(fl.path, os.O_CREATE|os.O_EXCL|os.O_RDWR, fl.mode)
+	if err == nil {
+		file.Chmod(fl.mode)
+		return file, nil
+	}
+	if !os.IsExist(err) {
+		return nil, err
+	}
+	return os.OpenFile(fl.path, os.O_RDWR, 0)
+}
+
 // Lock acquires the file lock (with retry)
 func (fl *FileLock) Lock() error {
 	// Create lock file if it doesn't exist
-	file, err := os.OpenFile(fl.path, os.O_CREATE|os.O_RDWR, 0644)
+	file, err := fl.open()
 	if err != nil {
-		return err
+		return &LockError{Path: fl.path, Underlying: err}
 	}
 	fl.file = file
 
-	// Try to acquire exclusive lock with retry
-	maxRetries := 60
-	for i := 0; i < maxRetries; i++ {
+	start := time.Now()
+	defer func() { fl.waited = time.Since(start) }()
+
+	// Try to acquire exclusive lock until the timeout
+	for {
 		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
 		if err == nil {
+			fl.writeHolder()
 			return nil
 		}
+		if err != syscall.EWOULDBLOCK {
+			file.Close()
+			return &LockError{Path: fl.path, Waited: time.Since(start), Underlying: err}
+		}
 
-		// If lock is being used by another process, wait
-		if err == syscall.EWOULDBLOCK {
-			time.Sleep(1 * time.Second)
-			continue
+		// The lock is held by another process: wait, up to the timeout
+		remaining := fl.timeout - time.Since(start)
+		if remaining <= 0 {
+			break
 		}
+		time.Sleep(min(lockPollInterval, remaining))
+	}
+
+	holder := fl.readHolder()
+	file.Close()
+	return &LockError{
+		Path:   fl.path,
+		Waited: time.Since(start),
+		Holder: holder,
+	}
+}
 
-		// Other error
+// TryLock acquires the file lock without waiting.
+// It returns false if the lock is held by someone else.
+func (fl *FileLock) TryLock() (bool, error) {
+	file, err := fl.open()
+	if err != nil {
+		return false, &LockError{Path: fl.path, Underlying: err}
+	}
+
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
 		file.Close()
-		return err
+		return false, nil
+	}
+	if err != nil {
+		file.Close()
+		return false, &LockError{Path: fl.path, Underlying: err}
 	}
 
-	file.Close()
-	return ErrLockFailed
+	fl.file = file
+	fl.writeHolder()
+	return true, nil
+}
+
+// WaitTime returns how long the last Lock call waited for the lock
+func (fl *FileLock) WaitTime() time.Duration {
+	return fl.waited
+}
+
+// writeHolder records the current process as the lock holder
+func (fl *FileLock) writeHolder() {
+	host, _ := os.Hostname()
+	if err := fl.file.Truncate(0); err != nil {
+		return
+	}
+	fl.file.WriteAt([]byte(fmt.Sprintf("pid=%d host=%s", os.Getpid(), host)), 0)
+}
+
+// readHolder returns the holder recorded in the lock file, if any
+func (fl *FileLock) readHolder() string {
+	buf := make([]byte, 256)
+	n, _ := fl.file.ReadAt(buf, 0)
+	return strings.TrimSpace(string(buf[:n]))
 }
 
 // Unlock libera o lock do arquivo
@@ -78,3 +167,31 @@ func WithLock(lockPath string, fn func() error) error {
 
 	return fn()
 }
+
+// withLock runs fn holding the lock of lockPath, using the cache
+// backend's locks when it has its own. The time spent waiting for the lock
+// is added to the lock wait of the call and observed by the Metrics.
+func (o *Options) withLock(lockPath string, fn func() error) error {
+	start := time.Now()
+	unlock, err := o.lock(lockPath)
+	waited := time.Since(start)
+	o.lockWait += waited
+	o.observe(MetricLockWait, waited.Seconds())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return fn()
+}
+
+// lock takes the lock of lockPath and returns the function releasing it
+func (o *Options) lock(lockPath string) (func(), error) {
+	if locker, ok := o.fs.(fsys.Locker); ok {
+		return locker.Lock(lockPath)
+	}
+	lock := &FileLock{path: lockPath, mode: o.fileMode(), timeout: o.LockTimeout}
+	if err := lock.Lock(); err != nil {
+		return nil, err
+	}
+	return func() { lock.Unlock() }, nil
+}
@@ -0,0 +1,75 @@
+package cachedpath
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// fileMode returns the permission of files created in the cache
+func (o *Options) fileMode() os.FileMode {
+	mode := o.FileMode.Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+	if o.GroupCache {
+		mode |= 0660
+	}
+	return mode
+}
+
+// dirMode returns the permission of directories created in the cache: the
+// file mode plus search access wherever it grants read access
+func (o *Options) dirMode() os.FileMode {
+	mode := o.fileMode()
+	return mode | (mode&0444)>>2
+}
+
+// mkdirAll creates dir and sets dirMode on it if it didn't exist
+func (o *Options) mkdirAll(dir string) error {
+	_, statErr := o.fs.Stat(dir)
+	if err := o.fs.MkdirAll(dir, o.dirMode()); err != nil {
+		return err
+	}
+	if os.IsNotExist(statErr) {
+		o.chmodDir(dir)
+	}
+	return nil
+}
+
+// chmodDir sets dirMode on a directory created by CachedPath, keeping the
+// setgid bit inherited from its parent so new entries keep the cache's group
+func (o *Options) chmodDir(dir string) {
+	info, err := o.fs.Stat(dir)
+	if err != nil {
+		return
+	}
+	if err := o.fs.Chmod(dir, o.dirMode()|info.Mode()&os.ModeSetgid); err != nil {
+		o.Logger.Warnf("failed to set mode of %s: %v", dir, err)
+	}
+}
+
+// shareTree makes extracted files group-readable and -writable on group
+// caches. Modes from the archive are otherwise kept.
+func (o *Options) shareTree(dir string) {
+	if !o.GroupCache {
+		return
+	}
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		mode := info.Mode() | 0060
+		if d.IsDir() {
+			mode |= 0010
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			o.Logger.Warnf("failed to set mode of %s: %v", path, err)
+		}
+		return nil
+	})
+}
@@ -1,3 +1,14 @@
 module github.com/CezarGarrido/cachedpath
 
 go 1.23.4
+
+require (
+	github.com/ulikunitz/xz v0.5.12
+	golang.org/x/crypto v0.41.0
+	golang.org/x/net v0.42.0
+	golang.org/x/sync v0.16.0
+	golang.org/x/text v0.28.0
+	golang.org/x/time v0.12.0
+)
+
+require golang.org/x/sys v0.35.0 // indirect
@@ -0,0 +1,66 @@
+package cachedpath
+
+import (
+	"fmt"
+	"time"
+)
+
+// beforeDownload runs the BeforeDownload hook. Its error aborts the call.
+func (o *Options) beforeDownload(url string) error {
+	if o.BeforeDownload == nil {
+		return nil
+	}
+	if err := o.BeforeDownload(url); err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrDownloadAborted, url, err)
+	}
+	return nil
+}
+
+// afterDownload runs the AfterDownload hook with the local path of url and
+// whether it came from the cache. Its error fails the call.
+func (o *Options) afterDownload(url, path string, cached bool) error {
+	if o.AfterDownload == nil {
+		return nil
+	}
+	return o.AfterDownload(url, path, cached)
+}
+
+// cacheHit reports a cache hit to the OnCacheHit hook
+func (o *Options) cacheHit(url, path string) {
+	if o.OnCacheHit != nil {
+		o.OnCacheHit(url, path, o.lockWait)
+	}
+}
+
+// downloadStarted reports a download to the OnDownloadStart hook and
+// returns its start time
+func (o *Options) downloadStarted(url string, size int64) time.Time {
+	if o.OnDownloadStart != nil {
+		o.OnDownloadStart(url, size)
+	}
+	return time.Now()
+}
+
+// downloadCompleted reports a finished download to the OnDownloadComplete hook
+func (o *Options) downloadCompleted(url, path string, size int64, start time.Time) {
+	if o.OnDownloadComplete != nil {
+		o.OnDownloadComplete(url, path, size, time.Since(start), o.lockWait)
+	}
+}
+
+// MetricLockWait is the Metrics observation of the seconds spent waiting for
+// a cache lock, taken or not
+const MetricLockWait = "cachedpath_lock_wait_seconds"
+
+// Metrics receives measurements, for instance to feed histograms
+type Metrics interface {
+	// Observe records value for the metric name
+	Observe(name string, value float64)
+}
+
+// observe records value for the metric name if the options have Metrics
+func (o *Options) observe(name string, value float64) {
+	if o.Metrics != nil {
+		o.Metrics.Observe(name, value)
+	}
+}
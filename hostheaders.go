@@ -0,0 +1,70 @@
+package cachedpath
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// hostHeaders returns the headers set with WithHostHeader for the host of
+// u. Hosts match by name, or by name and port when registered with one.
+func (o *Options) hostHeaders(u *url.URL) map[string]string {
+	if len(o.HostHeaders) == 0 {
+		return nil
+	}
+	if headers, ok := o.HostHeaders[strings.ToLower(u.Host)]; ok {
+		return headers
+	}
+	return o.HostHeaders[strings.ToLower(u.Hostname())]
+}
+
+// applyHostHeaders layers the headers of the host of resourceURL over the
+// global headers, the host-specific values winning
+func (o *Options) applyHostHeaders(resourceURL string) {
+	u, err := url.Parse(resourceURL)
+	if err != nil {
+		return
+	}
+	hostHeaders := o.hostHeaders(u)
+	if len(hostHeaders) == 0 {
+		return
+	}
+
+	// Don't modify a map the caller may share between calls
+	headers := make(map[string]string, len(o.Headers)+len(hostHeaders))
+	for key, value := range o.Headers {
+		headers[key] = value
+	}
+	for key, value := range hostHeaders {
+		headers[key] = value
+	}
+	o.Headers = headers
+}
+
+// redirectHostHeaders replaces the host-specific headers of the original
+// request with those of the redirect target when it is another host, so
+// they are never sent to a host they were not set for
+func (o *Options) redirectHostHeaders(req *http.Request, via []*http.Request) {
+	if len(o.HostHeaders) == 0 || sameHost(req.URL, via[0].URL) {
+		return
+	}
+	target := o.hostHeaders(req.URL)
+	for key := range o.hostHeaders(via[0].URL) {
+		if _, ok := target[key]; !ok {
+			req.Header.Del(key)
+		}
+	}
+	for key, value := range target {
+		req.Header.Set(key, value)
+	}
+}
+
+// afterRedirect runs the redirect steps that also apply to custom HTTP
+// clients: host-specific headers, then OnRedirect
+func (o *Options) afterRedirect(req *http.Request, via []*http.Request) error {
+	o.redirectHostHeaders(req, via)
+	if o.OnRedirect != nil {
+		return o.OnRedirect(req, via)
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+// Package bufpool shares copy buffers between downloads, so memory grows
+// with the number of copies in flight rather than the number of downloads
+// made.
+package bufpool
+
+import (
+	"io"
+	"sync"
+)
+
+// Size is the size of a pooled buffer, the same as io.Copy's
+const Size = 32 * 1024
+
+var pool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, Size)
+		return &buf
+	},
+}
+
+// Copy works like io.Copy with a pooled buffer
+func Copy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := pool.Get().(*[]byte)
+	defer pool.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
@@ -0,0 +1,165 @@
+package fsys
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// Op identifies a filesystem operation for fault injection
+type Op string
+
+const (
+	OpMkdirAll   Op = "mkdirall"
+	OpCreateTemp Op = "createtemp"
+	OpWrite      Op = "write"
+	OpClose      Op = "close"
+	OpRename     Op = "rename"
+	OpStat       Op = "stat"
+	OpRemove     Op = "remove"
+	OpChmod      Op = "chmod"
+	OpOpen       Op = "open"
+)
+
+// FaultFS wraps an FS and returns injected errors for selected operations.
+// It is meant for tests that need deterministic I/O failures.
+type FaultFS struct {
+	FS
+
+	mu     sync.Mutex
+	faults map[Op]error
+	calls  map[Op]int
+}
+
+// NewFaultFS wraps fs (the OS filesystem if nil)
+func NewFaultFS(fs FS) *FaultFS {
+	if fs == nil {
+		fs = OS{}
+	}
+	return &FaultFS{
+		FS:     fs,
+		faults: make(map[Op]error),
+		calls:  make(map[Op]int),
+	}
+}
+
+// Fail makes every subsequent call of op return err (nil clears the fault)
+func (f *FaultFS) Fail(op Op, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		delete(f.faults, op)
+		return
+	}
+	f.faults[op] = err
+}
+
+// Calls returns how many times op was called
+func (f *FaultFS) Calls(op Op) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// check records a call of op and returns its injected error, if any
+func (f *FaultFS) check(op Op) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[op]++
+	return f.faults[op]
+}
+
+// MkdirAll implements FS
+func (f *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	if err := f.check(OpMkdirAll); err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+	return f.FS.MkdirAll(path, perm)
+}
+
+// CreateTemp implements FS
+func (f *FaultFS) CreateTemp(dir, pattern string) (File, error) {
+	if err := f.check(OpCreateTemp); err != nil {
+		return nil, &os.PathError{Op: "createtemp", Path: dir, Err: err}
+	}
+	file, err := f.FS.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: file, fs: f}, nil
+}
+
+// Rename implements FS
+func (f *FaultFS) Rename(oldpath, newpath string) error {
+	if err := f.check(OpRename); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	return f.FS.Rename(oldpath, newpath)
+}
+
+// Stat implements FS
+func (f *FaultFS) Stat(name string) (os.FileInfo, error) {
+	if err := f.check(OpStat); err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return f.FS.Stat(name)
+}
+
+// Remove implements FS
+func (f *FaultFS) Remove(name string) error {
+	if err := f.check(OpRemove); err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return f.FS.Remove(name)
+}
+
+// Chmod implements FS
+func (f *FaultFS) Chmod(name string, mode os.FileMode) error {
+	if err := f.check(OpChmod); err != nil {
+		return &os.PathError{Op: "chmod", Path: name, Err: err}
+	}
+	return f.FS.Chmod(name, mode)
+}
+
+// Open implements FS
+func (f *FaultFS) Open(name string) (io.ReadCloser, error) {
+	if err := f.check(OpOpen); err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return f.FS.Open(name)
+}
+
+// WriteFile implements FS. An OpWrite fault leaves the first half of data
+// in the file, as a write interrupted by a full disk would.
+func (f *FaultFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	if err := f.check(OpWrite); err != nil {
+		f.FS.WriteFile(name, data[:len(data)/2], perm)
+		return &os.PathError{Op: "write", Path: name, Err: err}
+	}
+	return f.FS.WriteFile(name, data, perm)
+}
+
+// faultFile injects OpWrite and OpClose faults into a File
+type faultFile struct {
+	File
+	fs *FaultFS
+}
+
+// Write implements io.Writer. An injected fault is a short write: half of
+// p is written before the error, as when a disk fills up.
+func (f *faultFile) Write(p []byte) (int, error) {
+	if err := f.fs.check(OpWrite); err != nil {
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, &os.PathError{Op: "write", Path: f.Name(), Err: err}
+	}
+	return f.File.Write(p)
+}
+
+// Close implements io.Closer. The file is closed even when a fault is injected.
+func (f *faultFile) Close() error {
+	err := f.File.Close()
+	if fault := f.fs.check(OpClose); fault != nil {
+		return &os.PathError{Op: "close", Path: f.Name(), Err: fault}
+	}
+	return err
+}
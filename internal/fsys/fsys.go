@@ -0,0 +1,131 @@
+// Package fsys abstracts the filesystem operations used for cache I/O so
+// tests can substitute failures such as full disks or cross-device renames.
+package fsys
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// File is a writable file created by FS.CreateTemp
+type File interface {
+	io.Writer
+	io.Closer
+
+	// Name returns the path of the file
+	Name() string
+}
+
+// FS is the set of filesystem operations used for cache I/O
+type FS interface {
+	// MkdirAll creates a directory and any missing parents
+	MkdirAll(path string, perm os.FileMode) error
+
+	// CreateTemp creates a new temporary file in dir
+	CreateTemp(dir, pattern string) (File, error)
+
+	// Rename promotes oldpath to newpath
+	Rename(oldpath, newpath string) error
+
+	// Stat returns file information
+	Stat(name string) (os.FileInfo, error)
+
+	// Remove removes a file
+	Remove(name string) error
+
+	// Chmod changes the mode of a file
+	Chmod(name string, mode os.FileMode) error
+
+	// Open opens a file for reading
+	Open(name string) (io.ReadCloser, error)
+
+	// WriteFile writes a small file such as metadata in one call. A file
+	// it creates gets perm; an existing file keeps its mode.
+	WriteFile(name string, data []byte, perm os.FileMode) error
+
+	// Glob returns the names of the files matching pattern
+	// (filepath.Match syntax)
+	Glob(pattern string) ([]string, error)
+}
+
+// Locker is implemented by filesystems that lock paths themselves instead
+// of using lock files
+type Locker interface {
+	// Lock acquires the lock of path and returns the function releasing it
+	Lock(path string) (func(), error)
+}
+
+// Virtual is implemented by filesystems whose files don't exist on disk,
+// so they can't be extracted or evicted with the os package
+type Virtual interface {
+	Virtual()
+}
+
+// OS implements FS using the os package
+type OS struct{}
+
+// MkdirAll implements FS
+func (OS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+// CreateTemp implements FS
+func (OS) CreateTemp(dir, pattern string) (File, error) {
+	return os.CreateTemp(dir, pattern)
+}
+
+// Rename implements FS
+func (OS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// Stat implements FS
+func (OS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// Remove implements FS
+func (OS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// Chmod implements FS
+func (OS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+// Open implements FS
+func (OS) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+// WriteFile implements FS. The mode of a new file is set explicitly so the
+// umask can't narrow it; an existing file may belong to another user of a
+// shared cache.
+func (OS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	_, statErr := os.Stat(name)
+	if err := os.WriteFile(name, data, perm); err != nil {
+		return err
+	}
+	if os.IsNotExist(statErr) {
+		return os.Chmod(name, perm)
+	}
+	return nil
+}
+
+// Glob implements FS
+func (OS) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
+// Linker is implemented by filesystems that support hard links
+type Linker interface {
+	// Link creates newname as a hard link to oldname
+	Link(oldname, newname string) error
+}
+
+// Link implements Linker
+func (OS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
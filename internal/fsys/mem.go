@@ -0,0 +1,249 @@
+package fsys
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mem is an FS that keeps files in memory. Directories are implicit in
+// MkdirAll and paths are cleaned, so they only need to be consistent.
+type Mem struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+	dirs  map[string]bool
+	locks map[string]*sync.Mutex
+}
+
+// memFile is the content and attributes of a file in Mem
+type memFile struct {
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// NewMem returns an empty in-memory filesystem
+func NewMem() *Mem {
+	return &Mem{
+		files: make(map[string]*memFile),
+		dirs:  make(map[string]bool),
+		locks: make(map[string]*sync.Mutex),
+	}
+}
+
+// Virtual implements Virtual
+func (m *Mem) Virtual() {}
+
+// MkdirAll implements FS
+func (m *Mem) MkdirAll(path string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return &os.PathError{Op: "mkdir", Path: path, Err: fmt.Errorf("%s is a file", dir)}
+		}
+		m.dirs[dir] = true
+		if parent := filepath.Dir(dir); parent == dir {
+			return nil
+		}
+	}
+}
+
+// CreateTemp implements FS
+func (m *Mem) CreateTemp(dir, pattern string) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir = filepath.Clean(dir)
+	if !m.dirs[dir] {
+		return nil, &os.PathError{Op: "createtemp", Path: dir, Err: os.ErrNotExist}
+	}
+	random := fmt.Sprintf("%d", rand.Uint32())
+	if strings.Contains(pattern, "*") {
+		pattern = strings.Replace(pattern, "*", random, 1)
+	} else {
+		pattern += random
+	}
+	name := filepath.Join(dir, pattern)
+	m.files[name] = &memFile{mode: 0600, modTime: time.Now()}
+	return &memWriter{fs: m, name: name}, nil
+}
+
+// Rename implements FS
+func (m *Mem) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	f, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	delete(m.files, oldpath)
+	m.files[newpath] = f
+	return nil
+}
+
+// Stat implements FS
+func (m *Mem) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if f, ok := m.files[name]; ok {
+		return memInfo{name: filepath.Base(name), size: int64(len(f.data)), mode: f.mode, modTime: f.modTime}, nil
+	}
+	if m.dirs[name] {
+		return memInfo{name: filepath.Base(name), mode: os.ModeDir | 0755}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+// Remove implements FS
+func (m *Mem) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := m.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+// Chmod implements FS
+func (m *Mem) Chmod(name string, mode os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if f, ok := m.files[name]; ok {
+		f.mode = mode.Perm()
+		return nil
+	}
+	if m.dirs[name] {
+		return nil
+	}
+	return &os.PathError{Op: "chmod", Path: name, Err: os.ErrNotExist}
+}
+
+// Open implements FS
+func (m *Mem) Open(name string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.files[filepath.Clean(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	// Writes replace the slice, so readers keep a consistent snapshot
+	return io.NopCloser(bytes.NewReader(f.data)), nil
+}
+
+// WriteFile implements FS
+func (m *Mem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if !m.dirs[filepath.Dir(name)] {
+		return &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	f, ok := m.files[name]
+	if !ok {
+		f = &memFile{mode: perm.Perm()}
+		m.files[name] = f
+	}
+	f.data = append([]byte(nil), data...)
+	f.modTime = time.Now()
+	return nil
+}
+
+// Glob implements FS
+func (m *Mem) Glob(pattern string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var matches []string
+	for name := range m.files {
+		ok, err := filepath.Match(pattern, name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// Lock implements Locker
+func (m *Mem) Lock(path string) (func(), error) {
+	m.mu.Lock()
+	path = filepath.Clean(path)
+	lock, ok := m.locks[path]
+	if !ok {
+		lock = &sync.Mutex{}
+		m.locks[path] = lock
+	}
+	m.mu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock, nil
+}
+
+// memWriter is a File writing to a file in Mem
+type memWriter struct {
+	fs   *Mem
+	name string
+}
+
+// Name implements File
+func (w *memWriter) Name() string {
+	return w.name
+}
+
+// Write implements io.Writer
+func (w *memWriter) Write(p []byte) (int, error) {
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+
+	f, ok := w.fs.files[w.name]
+	if !ok {
+		return 0, &os.PathError{Op: "write", Path: w.name, Err: os.ErrClosed}
+	}
+	// Appending never changes the bytes open readers see
+	f.data = append(f.data, p...)
+	f.modTime = time.Now()
+	return len(p), nil
+}
+
+// Close implements io.Closer
+func (w *memWriter) Close() error {
+	return nil
+}
+
+// memInfo describes a file in Mem
+type memInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() os.FileMode  { return i.mode }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memInfo) Sys() any           { return nil }
@@ -0,0 +1,172 @@
+package cachedpath
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/CezarGarrido/cachedpath/internal/fsys"
+)
+
+// Lockfile pins a set of artifacts by logical name, for FetchLockfile
+type Lockfile struct {
+	// Artifacts maps logical names to the artifacts they stand for
+	Artifacts map[string]LockedArtifact `json:"artifacts"`
+}
+
+// LockedArtifact is an artifact listed in a Lockfile
+type LockedArtifact struct {
+	// URL is the URL or local path of the artifact
+	URL string `json:"url"`
+
+	// SHA256 is the hex SHA-256 digest the download must have; empty means
+	// any content is accepted
+	SHA256 string `json:"sha256,omitempty"`
+
+	// ETag is the version seen when the lockfile was written. It is only
+	// informative: the digest is what FetchLockfile checks.
+	ETag string `json:"etag,omitempty"`
+
+	// Extract resolves the artifact to its extraction directory
+	Extract bool `json:"extract,omitempty"`
+
+	// Path is a file inside the archive to resolve to, as with the
+	// "archive!path" syntax
+	Path string `json:"path,omitempty"`
+}
+
+// FetchLockfile resolves every artifact of the JSON lockfile at path and
+// returns their local paths by logical name. Artifacts are resolved a few at
+// a time like CachedPaths, and those with a digest must match it or fail with
+// ErrChecksumMismatch. If any artifact fails the error is a *BatchError whose
+// failed results name the artifact; the paths of the others are returned.
+//
+//	{
+//	  "artifacts": {
+//	    "model": {"url": "https://example.com/model.tar.gz", "sha256": "9f86...", "extract": true},
+//	    "vocab": {"url": "https://example.com/data.zip", "path": "vocab.txt"}
+//	  }
+//	}
+func FetchLockfile(path string, opts ...Option) (map[string]string, error) {
+	lock, err := loadLockfile(path)
+	if err != nil {
+		return nil, err
+	}
+	names, results := resolveArtifacts(lock, opts, func(name string, artifact LockedArtifact, digest, etag string) (string, error) {
+		if artifact.SHA256 != "" && digest != artifact.SHA256 {
+			return "", fmt.Errorf("%w: %s has sha256 %s, lockfile lists %s", ErrChecksumMismatch, artifact.URL, digest, artifact.SHA256)
+		}
+		resource := artifact.URL
+		if artifact.Path != "" {
+			resource += "!" + artifact.Path
+		}
+		return CachedPath(resource, append(opts[:len(opts):len(opts)], WithExtractArchive(artifact.Extract))...)
+	})
+
+	paths := make(map[string]string, len(names))
+	failed := false
+	for i, r := range results {
+		if r.Err != nil {
+			failed = true
+			continue
+		}
+		paths[names[i]] = r.Path
+	}
+	if failed {
+		return paths, &BatchError{Results: results}
+	}
+	return paths, nil
+}
+
+// WriteLockfile downloads every artifact of lock and writes it to path as
+// JSON, with the digest and version of what was downloaded, so that
+// FetchLockfile gets the same content later. Digests already set are
+// replaced. Nothing is written if an artifact fails.
+func WriteLockfile(path string, lock *Lockfile, opts ...Option) error {
+	pinned := &Lockfile{Artifacts: make(map[string]LockedArtifact, len(lock.Artifacts))}
+	var mu sync.Mutex
+	_, results := resolveArtifacts(lock, opts, func(name string, artifact LockedArtifact, digest, etag string) (string, error) {
+		artifact.SHA256, artifact.ETag = digest, etag
+		mu.Lock()
+		pinned.Artifacts[name] = artifact
+		mu.Unlock()
+		return "", nil
+	})
+	for _, r := range results {
+		if r.Err != nil {
+			return &BatchError{Results: results}
+		}
+	}
+
+	data, err := json.MarshalIndent(pinned, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(fsys.OS{}, path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write lockfile: %w", err)
+	}
+	return nil
+}
+
+// loadLockfile reads the lockfile at path
+func loadLockfile(path string) (*Lockfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lockfile: %w", err)
+	}
+	var lock Lockfile
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("failed to parse lockfile %s: %w", path, err)
+	}
+	for name, artifact := range lock.Artifacts {
+		if artifact.URL == "" {
+			return nil, fmt.Errorf("%w: artifact %q of %s has no url", ErrInvalidURL, name, path)
+		}
+	}
+	return &lock, nil
+}
+
+// resolveArtifacts downloads the artifacts of lock as a batch, in name order,
+// and calls resolve with the digest and version of each download. It returns
+// the sorted names and the batch results; errors are prefixed with the name.
+func resolveArtifacts(lock *Lockfile, opts []Option, resolve func(name string, artifact LockedArtifact, digest, etag string) (string, error)) ([]string, []BatchResult) {
+	options := defaultOptions()
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	names := make([]string, 0, len(lock.Artifacts))
+	urls := make([]string, 0, len(lock.Artifacts))
+	for name := range lock.Artifacts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		urls = append(urls, lock.Artifacts[name].URL)
+	}
+
+	results := runBatch(urls, options.MaxConcurrency, func(i int) (string, error) {
+		name, artifact := names[i], lock.Artifacts[names[i]]
+		cachePath, err := EnsureDownloaded(artifact.URL, opts...)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", name, err)
+		}
+		digest, err := cachedDigest(options.fs, cachePath)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", name, err)
+		}
+		etag := ""
+		if meta, err := loadMeta(options.fs, MetaFilePath(cachePath)); err == nil {
+			etag = meta.Version()
+		}
+
+		path, err := resolve(name, artifact, digest, etag)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", name, err)
+		}
+		return path, nil
+	})
+	return names, results
+}
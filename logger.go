@@ -0,0 +1,54 @@
+package cachedpath
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+// Logger receives diagnostic messages from cachedpath
+type Logger interface {
+	Debugf(format string, args ...any)
+	Infof(format string, args ...any)
+	Warnf(format string, args ...any)
+}
+
+// nopLogger discards all messages
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...any) {}
+func (nopLogger) Infof(format string, args ...any)  {}
+func (nopLogger) Warnf(format string, args ...any)  {}
+
+// NopLogger returns a Logger that discards all messages
+func NopLogger() Logger {
+	return nopLogger{}
+}
+
+// slogLogger adapts a *slog.Logger to Logger
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger returns a Logger that writes to the given slog.Logger
+// (slog.Default() if nil)
+func NewSlogLogger(logger *slog.Logger) Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &slogLogger{logger: logger}
+}
+
+// Debugf logs a message at debug level
+func (l *slogLogger) Debugf(format string, args ...any) {
+	l.logger.Debug(fmt.Sprintf(format, args...))
+}
+
+// Infof logs a message at info level
+func (l *slogLogger) Infof(format string, args ...any) {
+	l.logger.Info(fmt.Sprintf(format, args...))
+}
+
+// Warnf logs a message at warning level
+func (l *slogLogger) Warnf(format string, args ...any) {
+	l.logger.Warn(fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,182 @@
+package cachedpath
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/CezarGarrido/cachedpath/internal/fsys"
+)
+
+// ManifestMode controls how the manifest set with WithManifest is used
+type ManifestMode int
+
+const (
+	// ManifestEnforce fails requests for URLs missing from the manifest and
+	// downloads whose digest differs from the one listed
+	ManifestEnforce ManifestMode = iota
+
+	// ManifestRecord adds every remote URL resolved, with its digest, to the
+	// manifest, creating it if needed
+	ManifestRecord
+)
+
+// Manifest lists the remote resources a build may fetch
+type Manifest struct {
+	// Entries are the allowed resources, sorted by URL
+	Entries []ManifestEntry `json:"entries"`
+}
+
+// ManifestEntry is a resource listed in a Manifest
+type ManifestEntry struct {
+	// URL is the resource URL
+	URL string `json:"url"`
+
+	// SHA256 is the hex SHA-256 digest of the resource
+	SHA256 string `json:"sha256"`
+}
+
+// manifestLocks serializes manifest reads and writes within the process
+var manifestLocks sync.Map // path -> *sync.Mutex
+
+// lockManifest locks the manifest at path and returns the unlock function
+func lockManifest(path string) func() {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	mu, _ := manifestLocks.LoadOrStore(path, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// loadManifest reads the manifest at path; a missing file is an empty manifest
+func loadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Manifest{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %w", path, err)
+	}
+	return &m, nil
+}
+
+// save writes the manifest to path through a temporary file
+func (m *Manifest) save(path string) error {
+	sort.Slice(m.Entries, func(i, j int) bool { return m.Entries[i].URL < m.Entries[j].URL })
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".manifest-*")
+	if err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // Remove on error
+	_, err = tmp.Write(append(data, '\n'))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// lookup returns the entry of url
+func (m *Manifest) lookup(url string) (*ManifestEntry, bool) {
+	for i := range m.Entries {
+		if m.Entries[i].URL == url {
+			return &m.Entries[i], true
+		}
+	}
+	return nil, false
+}
+
+// cachedDigest returns the hex SHA-256 digest of a cached file, from its
+// metadata when it was recorded at download time
+func cachedDigest(fs fsys.FS, cachePath string) (string, error) {
+	if meta, err := loadMeta(fs, MetaFilePath(cachePath)); err == nil && meta.SHA256 != "" {
+		return meta.SHA256, nil
+	}
+	sum, err := fileSHA256(fs, cachePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", cachePath, err)
+	}
+	return sum, nil
+}
+
+// checkManifest fails if url may not be fetched in ManifestEnforce mode
+func checkManifest(url string, opts *Options) error {
+	if opts.Manifest == "" || opts.ManifestMode != ManifestEnforce {
+		return nil
+	}
+	unlock := lockManifest(opts.Manifest)
+	defer unlock()
+
+	m, err := loadManifest(opts.Manifest)
+	if err != nil {
+		return err
+	}
+	if _, ok := m.lookup(opts.cacheKey(url)); !ok {
+		return fmt.Errorf("%w: %s", ErrNotInManifest, url)
+	}
+	return nil
+}
+
+// applyManifest checks the digest of the cached copy of url against the
+// manifest, or records it
+func applyManifest(url, cachePath string, opts *Options) error {
+	if opts.Manifest == "" {
+		return nil
+	}
+
+	sum, err := cachedDigest(opts.fs, cachePath)
+	if err != nil {
+		return err
+	}
+
+	unlock := lockManifest(opts.Manifest)
+	defer unlock()
+
+	m, err := loadManifest(opts.Manifest)
+	if err != nil {
+		return err
+	}
+	key := opts.cacheKey(url)
+	entry, ok := m.lookup(key)
+
+	if opts.ManifestMode == ManifestRecord {
+		if ok && entry.SHA256 == sum {
+			return nil
+		}
+		if ok {
+			entry.SHA256 = sum
+		} else {
+			m.Entries = append(m.Entries, ManifestEntry{URL: key, SHA256: sum})
+		}
+		return m.save(opts.Manifest)
+	}
+
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotInManifest, url)
+	}
+	if entry.SHA256 != sum {
+		return fmt.Errorf("%w: %s has sha256 %s, manifest lists %s", ErrManifestDigestMismatch, url, sum, entry.SHA256)
+	}
+	return nil
+}
@@ -2,48 +2,195 @@ package cachedpath
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
+
+	"github.com/CezarGarrido/cachedpath/internal/fsys"
 )
 
 // Meta armazena metadados sobre arquivos em cache
 type Meta struct {
-	URL        string    `json:"url"`
-	ETag       string    `json:"etag"`
-	CachedPath string    `json:"cached_path"`
-	CreatedAt  time.Time `json:"created_at"`
+	URL            string    `json:"url"`
+	ETag           string    `json:"etag"`
+	LastModified   time.Time `json:"last_modified"`
+	CachedPath     string    `json:"cached_path"`
+	CreatedAt      time.Time `json:"created_at"`
+	LastAccessedAt time.Time `json:"last_accessed_at"`
+
+	// Filename is the file name sent by the server in Content-Disposition
+	Filename string `json:"filename,omitempty"`
+
+	// FinalURL is the URL the file was served from after redirects
+	FinalURL string `json:"final_url,omitempty"`
+
+	// SHA256 is the hex digest of the downloaded file, checked on cache
+	// hits with WithVerifyOnHit
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Size is the size of the downloaded file in bytes
+	Size int64 `json:"size,omitempty"`
+
+	// ContentHash is set when the cached file is a hard link to the file
+	// named after its digest, shared by every URL with the same content
+	// (WithContentAddressable)
+	ContentHash string `json:"content_hash,omitempty"`
+
+	// ExtractedOnly is set when the archive was extracted while streaming
+	// (WithStreamingExtract) and only the extracted files are cached
+	ExtractedOnly bool `json:"extracted_only,omitempty"`
+}
+
+// NewMeta creates a new Meta instance.
+// A version in HTTP date format (the Last-Modified fallback used when a
+// server sends no ETag) is stored as LastModified instead of ETag.
+func NewMeta(url, cachedPath, version string) *Meta {
+	now := time.Now()
+	meta := &Meta{
+		URL:            url,
+		CachedPath:     cachedPath,
+		CreatedAt:      now,
+		LastAccessedAt: now,
+	}
+	if t, err := http.ParseTime(version); err == nil {
+		meta.LastModified = t
+	} else {
+		meta.ETag = version
+	}
+	return meta
 }
 
-// NewMeta creates a new Meta instance
-func NewMeta(url, cachedPath, etag string) *Meta {
-	return &Meta{
-		URL:        url,
-		ETag:       etag,
-		CachedPath: cachedPath,
-		CreatedAt:  time.Now(),
+// Version returns the ETag, or the Last-Modified time in HTTP date format
+// when there is no ETag
+func (m *Meta) Version() string {
+	if m.ETag != "" {
+		return m.ETag
 	}
+	if !m.LastModified.IsZero() {
+		return m.LastModified.UTC().Format(http.TimeFormat)
+	}
+	return ""
+}
+
+// lastUsed returns when the cached file was last accessed, falling back to
+// its creation time for metadata written before access tracking
+func (m *Meta) lastUsed() time.Time {
+	if m.LastAccessedAt.After(m.CreatedAt) {
+		return m.LastAccessedAt
+	}
+	return m.CreatedAt
+}
+
+// Touch records an access to the cached file and saves the metadata to path
+func (m *Meta) Touch(path string) error {
+	m.LastAccessedAt = time.Now()
+	return m.SaveToFile(path)
 }
 
-// SaveToFile saves metadata to a file
+// SaveToFile saves metadata to a file, replacing it atomically
 func (m *Meta) SaveToFile(path string) error {
+	return m.save(fsys.OS{}, path, 0644)
+}
+
+// save saves metadata to a file through fs, creating it with the given
+// permission. The file is replaced atomically, so a crash or a full disk
+// leaves either the old or the new metadata, never a truncated file.
+func (m *Meta) save(fs fsys.FS, path string, perm os.FileMode) error {
 	data, err := json.MarshalIndent(m, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, data, 0644)
+	return writeFileAtomic(fs, path, data, perm)
 }
 
 // LoadMetaFromFile loads metadata from a file
 func LoadMetaFromFile(path string) (*Meta, error) {
-	data, err := os.ReadFile(path)
+	return loadMeta(fsys.OS{}, path)
+}
+
+// loadMeta loads metadata from a file through fs
+func loadMeta(fs fsys.FS, path string) (*Meta, error) {
+	file, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
 	if err != nil {
 		return nil, err
 	}
 
 	var meta Meta
 	if err := json.Unmarshal(data, &meta); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %s: %w", ErrCorruptMetadata, path, err)
+	}
+
+	// Older metadata stored the Last-Modified fallback in ETag
+	if meta.LastModified.IsZero() {
+		if t, err := http.ParseTime(meta.ETag); err == nil {
+			meta.ETag = ""
+			meta.LastModified = t
+		}
 	}
 
 	return &meta, nil
 }
+
+// discardCorruptMeta deletes the metadata file at path if err reports it
+// can't be parsed, so the next download writes it again instead of every
+// call reading the broken file
+func discardCorruptMeta(opts *Options, path string, err error) {
+	if !errors.Is(err, ErrCorruptMetadata) {
+		return
+	}
+	opts.Logger.Warnf("removing %v", err)
+	if err := opts.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+		opts.Logger.Warnf("failed to remove corrupt metadata %s: %v", path, err)
+	}
+}
+
+// findLatestCached returns the most recently cached version of a URL.
+// It returns an empty path and nil metadata when the URL is not in the cache.
+func findLatestCached(opts *Options, url string) (string, *Meta) {
+	fs, cacheDir := opts.fs, opts.CacheDir
+
+	// Default names start with the URL hash; custom names can be anything
+	pattern := urlHash(url) + "*.meta.json"
+	if opts.FilenameStrategy != nil {
+		pattern = "*.meta.json"
+	}
+	matches, err := fs.Glob(filepath.Join(cacheDir, pattern))
+	if err != nil {
+		return "", nil
+	}
+
+	var latestPath string
+	var latest *Meta
+	for _, metaPath := range matches {
+		meta, err := loadMeta(fs, metaPath)
+		if err != nil {
+			discardCorruptMeta(opts, metaPath, err)
+			continue
+		}
+		if meta.URL != url {
+			continue
+		}
+
+		cachePath := strings.TrimSuffix(metaPath, ".meta.json")
+		if !fileExists(fs, cachePath) && !(meta.ExtractedOnly && fileExists(fs, extractedDirFor(cacheDir, cachePath))) {
+			continue
+		}
+
+		if latest == nil || meta.CreatedAt.After(latest.CreatedAt) {
+			latestPath, latest = cachePath, meta
+		}
+	}
+
+	return latestPath, latest
+}
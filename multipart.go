@@ -0,0 +1,109 @@
+package cachedpath
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/CezarGarrido/cachedpath/internal/bufpool"
+	"github.com/CezarGarrido/cachedpath/schemes"
+)
+
+// multipart reports whether the resource described by head is downloaded in
+// parts, as set with WithMultipartDownload
+func (o *Options) multipart(head schemes.ResourceInfo) bool {
+	return o.MultipartChunkSize > 0 && head.AcceptRanges && head.Size > o.MultipartChunkSize
+}
+
+// part is a range of a multipart download and the temporary file holding it
+type part struct {
+	offset, length int64
+	path           string
+	err            error
+	done           chan struct{}
+}
+
+// downloadParts downloads the size bytes of url with concurrent range
+// requests and writes them to w in order. Each part is kept in a temporary
+// file in dir until the parts before it have been written.
+func downloadParts(client schemes.RangeClient, url, version, dir string, size int64, w io.Writer, opts *Options) error {
+	var parts []*part
+	for offset := int64(0); offset < size; offset += opts.MultipartChunkSize {
+		length := min(opts.MultipartChunkSize, size-offset)
+		parts = append(parts, &part{offset: offset, length: length, done: make(chan struct{})})
+	}
+
+	// Parts not started yet are skipped once one fails
+	stop := make(chan struct{})
+	cancel := sync.OnceFunc(func() { close(stop) })
+	defer cancel()
+
+	go func() {
+		sem := make(chan struct{}, opts.MultipartConcurrency)
+		for _, p := range parts {
+			select {
+			case sem <- struct{}{}:
+			case <-stop:
+				p.err = errPartSkipped
+				close(p.done)
+				continue
+			}
+			go func(p *part) {
+				defer func() { <-sem }()
+				p.path, p.err = downloadPart(client, url, version, dir, p, opts)
+				close(p.done)
+			}(p)
+		}
+	}()
+
+	// Wait for every part, so that no temporary file is left behind
+	var err error
+	for _, p := range parts {
+		<-p.done
+		if err == nil {
+			if err = p.err; err == nil {
+				err = appendPart(w, p.path, opts)
+			}
+			if err != nil {
+				cancel()
+			}
+		}
+		if p.path != "" {
+			opts.fs.Remove(p.path)
+		}
+	}
+	return err
+}
+
+// errPartSkipped marks the parts not downloaded because another one failed
+var errPartSkipped = errors.New("part skipped")
+
+// downloadPart fetches one part into a temporary file in dir and returns
+// its path
+func downloadPart(client schemes.RangeClient, url, version, dir string, p *part, opts *Options) (string, error) {
+	tmp, err := opts.fs.CreateTemp(dir, ".part-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp file: %w", err)
+	}
+	err = client.GetRange(url, version, p.offset, p.length, tmp, opts.Headers)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		opts.fs.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// appendPart copies the part at path to w
+func appendPart(w io.Writer, path string, opts *Options) error {
+	f, err := opts.fs.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open part: %w", err)
+	}
+	defer f.Close()
+	_, err = bufpool.Copy(w, f)
+	return err
+}
@@ -0,0 +1,116 @@
+package cachedpath
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// failureCache remembers recent permanent failures of remote requests so
+// repeated calls for a missing resource don't hit the origin every time
+type failureCache struct {
+	mu      sync.Mutex
+	entries map[string]failure
+}
+
+// failure is a remembered error and when it expires
+type failure struct {
+	err     error
+	expires time.Time
+}
+
+// maxFailures bounds the failure cache; expired entries are pruned beyond it
+const maxFailures = 1024
+
+var failures = &failureCache{entries: make(map[string]failure)}
+
+// get returns the remembered error of key, if it hasn't expired
+func (c *failureCache) get(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(f.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return f.err
+}
+
+// put remembers err for key during ttl
+func (c *failureCache) put(key string, err error, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= maxFailures {
+		for k, f := range c.entries {
+			if now.After(f.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[key] = failure{err: err, expires: now.Add(ttl)}
+}
+
+// forget drops the remembered error of key
+func (c *failureCache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
+
+// failureKey identifies a request: the same URL with other headers, such
+// as credentials, may succeed
+func failureKey(url string, opts *Options) string {
+	keys := make([]string, 0, len(opts.Headers))
+	for k := range opts.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(opts.cacheKey(url))
+	for _, k := range keys {
+		b.WriteString("\x00" + k + "=" + opts.Headers[k])
+	}
+	return urlHash(b.String())
+}
+
+// isPermanentFailure reports whether err looks like it will happen again:
+// the resource is missing or access is denied. Timeouts and server errors
+// are transient.
+func isPermanentFailure(err error) bool {
+	var status *HTTPError
+	if !errors.As(err, &status) {
+		return false
+	}
+	switch status.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusGone:
+		return true
+	}
+	return false
+}
+
+// failureID returns the negative cache key of url, or "" when the negative
+// cache doesn't apply. Cookies may change the outcome, so sessions are
+// never short-circuited.
+func (o *Options) failureID(url string) string {
+	if o.NegativeCacheTTL <= 0 || o.OfflineMode || o.CookieJar != nil {
+		return ""
+	}
+	return failureKey(url, o)
+}
+
+// rememberFailure records err for url if it is a permanent failure
+func rememberFailure(url string, err error, opts *Options) {
+	if id := opts.failureID(url); id != "" && isPermanentFailure(err) {
+		failures.put(id, err, opts.NegativeCacheTTL)
+	}
+}
@@ -0,0 +1,136 @@
+package cachedpath
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// netrcEnv overrides the location of the .netrc file
+const netrcEnv = "NETRC"
+
+// netrcEntry holds the credentials of a machine (or the default entry)
+type netrcEntry struct {
+	machine  string
+	login    string
+	password string
+}
+
+// netrcPath returns the .netrc file location: $NETRC or ~/.netrc
+func netrcPath() string {
+	if path := os.Getenv(netrcEnv); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// parseNetrc parses machine, default, login and password tokens. account is
+// ignored, macdef bodies are skipped up to the next blank line and lines
+// starting with # are comments.
+func parseNetrc(data string) []netrcEntry {
+	var entries []netrcEntry
+	var current *netrcEntry
+
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	inMacro := false
+	var tokens []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inMacro {
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			if fields[i] == "macdef" {
+				// The macro body starts on the next line
+				inMacro = true
+				break
+			}
+			tokens = append(tokens, fields[i])
+		}
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		next := func() string {
+			if i+1 < len(tokens) {
+				i++
+				return tokens[i]
+			}
+			return ""
+		}
+		switch tokens[i] {
+		case "machine":
+			entries = append(entries, netrcEntry{machine: next()})
+			current = &entries[len(entries)-1]
+		case "default":
+			entries = append(entries, netrcEntry{})
+			current = &entries[len(entries)-1]
+		case "login":
+			if login := next(); current != nil {
+				current.login = login
+			}
+		case "password":
+			if password := next(); current != nil {
+				current.password = password
+			}
+		case "account":
+			next()
+		}
+	}
+	return entries
+}
+
+// netrcCredentials returns the credentials for host: its machine entry, or
+// the default entry, which must come last
+func netrcCredentials(entries []netrcEntry, host string) (netrcEntry, bool) {
+	for _, entry := range entries {
+		if entry.machine == "" || strings.EqualFold(entry.machine, host) {
+			return entry, entry.login != "" || entry.password != ""
+		}
+	}
+	return netrcEntry{}, false
+}
+
+// applyNetrc adds a Basic Authorization header with the .netrc credentials
+// of the host of resourceURL, unless the request already has one
+func (o *Options) applyNetrc(resourceURL string) {
+	if !o.NetrcAuth || o.Headers["Authorization"] != "" {
+		return
+	}
+	u, err := url.Parse(resourceURL)
+	if err != nil {
+		return
+	}
+
+	path := netrcPath()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		o.Logger.Debugf("netrc not used: %v", err)
+		return
+	}
+
+	entry, ok := netrcCredentials(parseNetrc(string(data)), u.Hostname())
+	if !ok {
+		return
+	}
+
+	// Don't modify a map the caller may share between calls
+	headers := make(map[string]string, len(o.Headers)+1)
+	for key, value := range o.Headers {
+		headers[key] = value
+	}
+	headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(entry.login+":"+entry.password))
+	o.Headers = headers
+	o.Logger.Debugf("using credentials from %s for %s", path, u.Hostname())
+}
@@ -0,0 +1,28 @@
+package cachedpath
+
+import "github.com/CezarGarrido/cachedpath/schemes"
+
+// DisableNetworkEnv is the environment variable that disables network
+// access at startup when set to a true value ("1", "true", ...)
+const DisableNetworkEnv = schemes.DisableNetworkEnv
+
+// SetNetworkAllowed enables or disables network access for the whole
+// process, which is useful to keep unit tests from reaching the network.
+// While disabled, every scheme client fails immediately with
+// ErrNetworkDisabled instead of connecting, and remote URLs resolve to their
+// latest cached version when there is one. Local paths, file:// and data:
+// URIs, custom scheme clients that don't connect anywhere and servers on
+// loopback addresses (such as httptest servers) keep working.
+//
+//	func TestMain(m *testing.M) {
+//	    cachedpath.SetNetworkAllowed(false)
+//	    os.Exit(m.Run())
+//	}
+func SetNetworkAllowed(allowed bool) {
+	schemes.SetNetworkAllowed(allowed)
+}
+
+// NetworkAllowed reports whether network access is enabled
+func NetworkAllowed() bool {
+	return schemes.NetworkAllowed()
+}
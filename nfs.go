@@ -0,0 +1,54 @@
+package cachedpath
+
+import (
+	"os"
+	"time"
+)
+
+// How often and how long a cache hit whose size disagrees with its
+// metadata is checked again with WithNFSSafe
+const (
+	nfsRetries    = 5
+	nfsRetryDelay = 50 * time.Millisecond
+)
+
+// coherentSize reports whether the file at path has the given size. On a
+// mismatch the file is opened, which makes NFS clients revalidate cached
+// attributes, and stat'ed again, a few times over a short period, so a
+// rename by another node is seen before the entry is declared corrupt.
+func coherentSize(path string, size int64, opts *Options) bool {
+	for attempt := 0; ; attempt++ {
+		if info, err := opts.fs.Stat(path); err == nil && info.Size() == size {
+			return true
+		}
+		if openedSize(path, opts) == size {
+			return true
+		}
+		if attempt == nfsRetries {
+			opts.Logger.Warnf("cached file %s does not have its recorded size %d", path, size)
+			return false
+		}
+		opts.Logger.Debugf("size of %s disagrees with its metadata, checking again", path)
+		time.Sleep(nfsRetryDelay)
+	}
+}
+
+// openedSize returns the size of the file at path as seen through an open
+// file, or -1
+func openedSize(path string, opts *Options) int64 {
+	file, err := opts.fs.Open(path)
+	if err != nil {
+		return -1
+	}
+	defer file.Close()
+
+	statter, ok := file.(interface{ Stat() (os.FileInfo, error) })
+	if !ok {
+		return -1
+	}
+	info, err := statter.Stat()
+	if err != nil {
+		return -1
+	}
+	return info.Size()
+}
@@ -0,0 +1,145 @@
+package cachedpath
+
+import (
+	"container/list"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// pathCache is an in-process LRU of resolved remote URLs, consulted before
+// the cache on disk when WithMemoryCache is set
+type pathCache struct {
+	mu      sync.Mutex
+	order   *list.List // front is the most recently used
+	entries map[string]*list.Element
+}
+
+// pathEntry is a remembered result and the resource it was resolved from
+type pathEntry struct {
+	key      string
+	resource string
+	result   Result
+}
+
+var resolved = &pathCache{order: list.New(), entries: make(map[string]*list.Element)}
+
+// get returns the remembered result of key
+func (c *pathCache) get(key string) (*Result, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	result := elem.Value.(*pathEntry).result
+	return &result, true
+}
+
+// put remembers result for key, keeping at most maxEntries entries
+func (c *pathCache) put(key, resource string, result *Result, maxEntries int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*pathEntry).result = *result
+		c.order.MoveToFront(elem)
+	} else {
+		c.entries[key] = c.order.PushFront(&pathEntry{key: key, resource: resource, result: *result})
+	}
+	for c.order.Len() > maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*pathEntry).key)
+	}
+}
+
+// forget drops every entry resolved from resource
+func (c *pathCache) forget(resource string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, elem := range c.entries {
+		if elem.Value.(*pathEntry).resource == resource {
+			c.order.Remove(elem)
+			delete(c.entries, key)
+		}
+	}
+}
+
+// forgetPaths drops every entry whose result is under one of roots, such
+// as the file and extraction directory of an evicted cache entry
+func (c *pathCache) forgetPaths(roots ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, elem := range c.entries {
+		result := elem.Value.(*pathEntry).result
+		for _, root := range roots {
+			if isUnder(result.Path, root) || isUnder(result.ArchivePath, root) {
+				c.order.Remove(elem)
+				delete(c.entries, key)
+				break
+			}
+		}
+	}
+}
+
+// isUnder reports whether path is root or inside it
+func isUnder(path, root string) bool {
+	return path != "" && (path == root || strings.HasPrefix(path, root+string(filepath.Separator)))
+}
+
+// memoryKey returns the memory cache key of a call, or "" when the memory
+// cache doesn't apply. The key covers the options that change the result:
+// the cache directory and backend, verification, offline mode, extraction
+// and the request headers, host-specific and .netrc credentials included.
+func (o *Options) memoryKey(urlOrFilename string) string {
+	if o.MemoryCacheEntries <= 0 || o.ForceRefresh || o.ForceExtract {
+		return ""
+	}
+	key := o.CacheDir + "\x00" + o.Manifest + "\x00" + o.ChecksumFile + "\x00" + urlOrFilename
+	if o.virtual() {
+		// Caches off disk are told apart by identity, not directory
+		key += fmt.Sprintf("\x00%T/%p", o.fs, o.fs)
+	}
+	if o.ExtractArchive {
+		key += "\x00extract"
+	}
+	if o.VerifyOnHit {
+		key += "\x00verify"
+	}
+	if o.OfflineMode {
+		key += "\x00offline"
+	}
+	if o.NetrcAuth {
+		key += "\x00netrc"
+	}
+	// failureKey covers the headers, with those of the URL's host
+	withHost := *o
+	withHost.applyHostHeaders(urlOrFilename)
+	return key + "\x00" + failureKey(urlOrFilename, &withHost)
+}
+
+// InvalidateCache forgets what this process remembers about url: its
+// entries in the memory cache of WithMemoryCache and, for the same options,
+// a recent failure remembered by WithNegativeCacheTTL. The next call checks
+// the cache on disk and the server again. Cached files are kept.
+func InvalidateCache(url string, opts ...Option) {
+	options := defaultOptions()
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	if normalized, err := normalizeURL(url); err == nil {
+		url = normalized
+	}
+	archivePath, _, _ := ParseArchivePath(url)
+	resolved.forget(options.cacheKey(archivePath))
+	if id := options.failureID(archivePath); id != "" {
+		failures.forget(id)
+	}
+}
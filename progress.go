@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"sync/atomic"
+	"time"
 )
 
 // ProgressDisplay is the interface for displaying progress
@@ -19,6 +20,11 @@ type SimpleProgress struct {
 	written     int64
 	description string
 	quiet       bool
+
+	start       time.Time
+	lastSample  time.Time
+	lastWritten int64
+	rate        float64
 }
 
 // NewSimpleProgress creates a new SimpleProgress
@@ -33,6 +39,10 @@ func (p *SimpleProgress) Start(total int64, description string) {
 	p.total = total
 	p.written = 0
 	p.description = description
+	p.start = time.Now()
+	p.lastSample = p.start
+	p.lastWritten = 0
+	p.rate = 0
 
 	if !p.quiet && total > 0 {
 		fmt.Printf("Downloading %s: 0%%\n", description)
@@ -42,11 +52,45 @@ func (p *SimpleProgress) Start(total int64, description string) {
 // Update updates the progress
 func (p *SimpleProgress) Update(written int64) {
 	atomic.StoreInt64(&p.written, written)
+	p.updateRate(written)
+
+	if p.quiet {
+		return
+	}
 
-	if !p.quiet && p.total > 0 {
+	if p.total > 0 {
 		percentage := float64(written) / float64(p.total) * 100
-		fmt.Printf("\rDownloading %s: %.1f%%", p.description, percentage)
+		eta := "--:--"
+		if p.rate > 0 {
+			remaining := time.Duration(float64(p.total-written) / p.rate * float64(time.Second))
+			eta = formatETA(remaining)
+		}
+		fmt.Printf("\rDownloading %s: %.1f%% | %s/s | ETA %s", p.description, percentage, formatBytes(int64(p.rate)), eta)
+		return
+	}
+
+	// Unknown size: show the amount downloaded and the current rate
+	fmt.Printf("\rDownloading %s: %s | %s/s", p.description, formatBytes(written), formatBytes(int64(p.rate)))
+}
+
+// updateRate recomputes the transfer rate from the bytes written since the
+// last sample, at most once per second to keep the display steady
+func (p *SimpleProgress) updateRate(written int64) {
+	now := time.Now()
+	if p.rate == 0 {
+		// No sample yet: use the average since the start
+		if elapsed := now.Sub(p.start).Seconds(); elapsed > 0 {
+			p.rate = float64(written) / elapsed
+		}
+	}
+
+	elapsed := now.Sub(p.lastSample)
+	if elapsed < time.Second {
+		return
 	}
+	p.rate = float64(written-p.lastWritten) / elapsed.Seconds()
+	p.lastSample = now
+	p.lastWritten = written
 }
 
 // Finish finishes the progress display
@@ -56,6 +100,59 @@ func (p *SimpleProgress) Finish() {
 	}
 }
 
+// formatBytes formats a byte count using binary units (e.g. "12.3 MB")
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatETA formats a remaining duration as mm:ss, or hh:mm:ss above an hour
+func formatETA(d time.Duration) string {
+	seconds := int64(d.Round(time.Second) / time.Second)
+	if seconds >= 3600 {
+		return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds%3600/60, seconds%60)
+	}
+	return fmt.Sprintf("%02d:%02d", seconds/60, seconds%60)
+}
+
+// ProgressFunc receives the bytes written so far, the total size (0 if
+// unknown) and the time elapsed since the download started
+type ProgressFunc func(written, total int64, elapsed time.Duration)
+
+// funcProgress adapts a ProgressFunc to ProgressDisplay
+type funcProgress struct {
+	fn    ProgressFunc
+	total int64
+	start time.Time
+}
+
+// NewFuncProgress creates a ProgressDisplay that calls fn on every update
+func NewFuncProgress(fn ProgressFunc) ProgressDisplay {
+	return &funcProgress{fn: fn}
+}
+
+// Start starts the progress display
+func (p *funcProgress) Start(total int64, description string) {
+	p.total = total
+	p.start = time.Now()
+}
+
+// Update updates the progress
+func (p *funcProgress) Update(written int64) {
+	p.fn(written, p.total, time.Since(p.start))
+}
+
+// Finish finishes the progress display
+func (p *funcProgress) Finish() {}
+
 // ProgressWriter is a writer that updates progress
 type ProgressWriter struct {
 	writer   io.Writer
@@ -0,0 +1,110 @@
+package cachedpath
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KB"},
+		{1536, "1.5 KB"},
+		{3 << 20, "3.0 MB"},
+		{5 << 30, "5.0 GB"},
+	}
+	for _, tt := range tests {
+		if got := formatBytes(tt.n); got != tt.want {
+			t.Errorf("formatBytes(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestFormatETA(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "00:00"},
+		{400 * time.Millisecond, "00:00"},
+		{600 * time.Millisecond, "00:01"},
+		{59 * time.Second, "00:59"},
+		{90 * time.Second, "01:30"},
+		{time.Hour, "01:00:00"},
+		{2*time.Hour + 3*time.Minute + 4*time.Second, "02:03:04"},
+	}
+	for _, tt := range tests {
+		if got := formatETA(tt.d); got != tt.want {
+			t.Errorf("formatETA(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+// captureStdout returns what fn prints to standard output
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	fn()
+	w.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestSimpleProgressUpdate(t *testing.T) {
+	// 3 MB written in 2 seconds: 1.5 MB/s
+	started := func(total int64) *SimpleProgress {
+		p := NewSimpleProgress(false)
+		captureStdout(t, func() { p.Start(total, "file.bin") })
+		p.start = time.Now().Add(-2 * time.Second)
+		p.lastSample = p.start
+		return p
+	}
+
+	p := started(6 << 20)
+	out := captureStdout(t, func() { p.Update(3 << 20) })
+	if want := "\rDownloading file.bin: 50.0% | 1.5 MB/s | ETA 00:02"; out != want {
+		t.Errorf("Known total: got %q, want %q", out, want)
+	}
+
+	p = started(0)
+	out = captureStdout(t, func() { p.Update(3 << 20) })
+	if want := "\rDownloading file.bin: 3.0 MB | 1.5 MB/s"; out != want {
+		t.Errorf("Unknown total: got %q, want %q", out, want)
+	}
+
+	// Before any rate is known the ETA is a placeholder
+	p = NewSimpleProgress(false)
+	captureStdout(t, func() { p.Start(100, "file.bin") })
+	out = captureStdout(t, func() { p.Update(0) })
+	if !strings.HasSuffix(out, "0.0% | 0 B/s | ETA --:--") {
+		t.Errorf("No rate: got %q", out)
+	}
+
+	// Quiet progress prints nothing
+	p = NewSimpleProgress(true)
+	out = captureStdout(t, func() {
+		p.Start(100, "file.bin")
+		p.Update(50)
+		p.Finish()
+	})
+	if out != "" {
+		t.Errorf("Quiet: got %q", out)
+	}
+}
@@ -0,0 +1,112 @@
+package cachedpath
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// proxyFunc returns the Proxy function for the default transport. Without
+// WithProxy, the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables
+// are honored like http.DefaultTransport does.
+func (o *Options) proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	if o.Proxy == "" && o.ProxyUser == "" && len(o.NoProxy) == 0 {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	var fixed *url.URL
+	if o.Proxy != "" {
+		u, err := parseProxyURL(o.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		fixed = u
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL.Hostname(), o.NoProxy) {
+			return nil, nil
+		}
+
+		proxyURL := fixed
+		if proxyURL == nil {
+			// No proxy URL was given: use the environment proxy
+			envURL, err := http.ProxyFromEnvironment(req)
+			if err != nil || envURL == nil {
+				return envURL, err
+			}
+			proxyURL = envURL
+		}
+
+		if o.ProxyUser != "" {
+			// The transport turns proxy URL credentials into Proxy-Authorization,
+			// both on CONNECT and on plain HTTP requests
+			u := *proxyURL
+			u.User = url.UserPassword(o.ProxyUser, o.ProxyPassword)
+			proxyURL = &u
+		}
+		return proxyURL, nil
+	}, nil
+}
+
+// parseProxyURL parses a proxy URL, defaulting to http:// when no scheme is
+// given. Supported schemes are http, https, socks5 and socks5h; credentials
+// in the URL are used to authenticate with the proxy.
+func parseProxyURL(proxy string) (*url.URL, error) {
+	raw := proxy
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("%w: invalid proxy URL %q", ErrInvalidURL, proxy)
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "socks5", "socks5h":
+		return u, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported proxy scheme %q", ErrInvalidURL, u.Scheme)
+	}
+}
+
+// bypassProxy reports whether host matches one of the NO_PROXY style entries.
+// Entries may be "*", a host name (matching the host and its subdomains,
+// with or without a leading dot), an IP address or a CIDR range.
+func bypassProxy(host string, noProxy []string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, entry := range noProxy {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+
+		if ip != nil {
+			if _, cidr, err := net.ParseCIDR(entry); err == nil && cidr.Contains(ip) {
+				return true
+			}
+			if entryIP := net.ParseIP(entry); entryIP != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		// Strip an optional port from the entry
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		entry = strings.TrimPrefix(entry, ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
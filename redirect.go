@@ -0,0 +1,79 @@
+package cachedpath
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/CezarGarrido/cachedpath/schemes"
+)
+
+// sensitiveHeaders are removed from redirects to another host under
+// RedirectStripAuth
+var sensitiveHeaders = []string{"Authorization", "Cookie"}
+
+// checkRedirect is the CheckRedirect function of the default HTTP client.
+// It enforces MaxRedirects, the network guard and the RedirectPolicy, then
+// applies host-specific headers and calls OnRedirect.
+func (o *Options) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > o.MaxRedirects {
+		return fmt.Errorf("%w: stopped after %d redirects", ErrTooManyRedirects, o.MaxRedirects)
+	}
+	if err := schemes.CheckNetwork(req.URL.Hostname()); err != nil {
+		return err
+	}
+
+	original := via[0]
+	if !sameHost(req.URL, original.URL) {
+		switch {
+		case o.RedirectPolicy == RedirectSameHost:
+			return fmt.Errorf("%w: redirect from %s to %s", ErrRedirectNotAllowed, original.URL.Host, req.URL.Host)
+		case o.RedirectPolicy == RedirectForwardAuth:
+			// net/http drops the headers for other domains on its own
+			for _, header := range sensitiveHeaders {
+				if value := original.Header.Get(header); value != "" {
+					req.Header.Set(header, value)
+				}
+			}
+		default:
+			for _, header := range sensitiveHeaders {
+				req.Header.Del(header)
+			}
+		}
+	}
+
+	return o.afterRedirect(req, via)
+}
+
+// withOnRedirect wraps the CheckRedirect function of a custom HTTP client
+// so it also calls fn. A nil check follows net/http's default of at most
+// 10 redirects.
+func withOnRedirect(check, fn func(*http.Request, []*http.Request) error) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if check != nil {
+			if err := check(req, via); err != nil {
+				return err
+			}
+		} else if len(via) >= 10 {
+			return fmt.Errorf("%w: stopped after 10 redirects", ErrTooManyRedirects)
+		}
+		return fn(req, via)
+	}
+}
+
+// sameHost reports whether two URLs point at the same host and port
+func sameHost(a, b *url.URL) bool {
+	return strings.EqualFold(a.Hostname(), b.Hostname()) && hostPort(a) == hostPort(b)
+}
+
+// hostPort returns the port of a URL, defaulting it from the scheme
+func hostPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if u.Scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
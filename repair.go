@@ -0,0 +1,112 @@
+package cachedpath
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RepairReport lists what RepairCache removed
+type RepairReport struct {
+	// CorruptMeta are metadata files that could not be parsed, removed with
+	// their cached files
+	CorruptMeta []string
+
+	// OrphanedMeta are metadata files whose cached file is missing
+	OrphanedMeta []string
+
+	// OrphanedData are cached files without metadata
+	OrphanedData []string
+}
+
+// orphanGrace is how old a cached file without metadata must be before
+// RepairCache removes it, since downloads write the metadata last
+const orphanGrace = time.Minute
+
+// RepairCache removes the inconsistent entries of cacheDir: metadata that
+// can't be parsed, metadata whose cached file is missing and cached files
+// without metadata. Extracted files of removed entries go with them.
+// Entries locked by a download in progress, temporary files, data: URI
+// files and content-addressed files still in use are left alone.
+func RepairCache(cacheDir string) (*RepairReport, error) {
+	report := &RepairReport{}
+
+	metaPaths, err := filepath.Glob(filepath.Join(cacheDir, "*.meta.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool)   // cached files with valid metadata
+	content := make(map[string]bool) // digests of content-addressed files
+	for _, metaPath := range metaPaths {
+		cachePath := strings.TrimSuffix(metaPath, ".meta.json")
+		meta, err := LoadMetaFromFile(metaPath)
+		if errors.Is(err, ErrCorruptMetadata) {
+			if removed, err := removeCacheEntry(cacheDir, cachePath); err != nil {
+				return report, err
+			} else if removed {
+				report.CorruptMeta = append(report.CorruptMeta, metaPath)
+			}
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if !FileExists(cachePath) && !(meta.ExtractedOnly && FileExists(extractedDirFor(cacheDir, cachePath))) {
+			if removed, err := removeCacheEntry(cacheDir, cachePath); err != nil {
+				return report, err
+			} else if removed {
+				report.OrphanedMeta = append(report.OrphanedMeta, metaPath)
+			}
+			continue
+		}
+
+		known[cachePath] = true
+		if meta.ContentHash != "" {
+			content[meta.ContentHash] = true
+		}
+	}
+
+	files, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return report, err
+	}
+	for _, f := range files {
+		name := f.Name()
+		path := filepath.Join(cacheDir, name)
+		if !f.Type().IsRegular() || known[path] || strings.HasPrefix(name, ".") ||
+			strings.HasSuffix(name, ".meta.json") || strings.HasSuffix(name, ".lock") {
+			continue
+		}
+
+		// Files named after a digest hold data: URIs or shared content
+		ext := fileExt(name)
+		if digest := strings.TrimSuffix(name, ext); isHexDigest(digest) && (ext == "" || content[digest]) {
+			continue
+		}
+
+		info, err := f.Info()
+		if err != nil || time.Since(info.ModTime()) < orphanGrace {
+			continue
+		}
+		removed, err := removeCacheEntry(cacheDir, path)
+		if err != nil {
+			return report, err
+		}
+		if removed {
+			report.OrphanedData = append(report.OrphanedData, path)
+		}
+	}
+
+	return report, nil
+}
+
+// isHexDigest reports whether s is a hex SHA-256 digest
+func isHexDigest(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && len(s) == 64
+}
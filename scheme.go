@@ -0,0 +1,35 @@
+package cachedpath
+
+import (
+	"sort"
+
+	"github.com/CezarGarrido/cachedpath/schemes"
+)
+
+// RegisterScheme makes CachedPath use client for URLs with the scheme it
+// returns from Scheme(), replacing any client registered for it. Clients
+// implement schemes.SchemeClient and, optionally, the other interfaces of
+// the schemes package for cheaper metadata, conditional requests, range
+// requests and CachedPath options. https:// URLs always use the "http"
+// client. URLs need a host ("memory://bucket/key") to be told apart from
+// local paths.
+func RegisterScheme(client schemes.SchemeClient) {
+	schemes.Register(client)
+}
+
+// UnregisterScheme removes the client of a scheme
+func UnregisterScheme(scheme string) {
+	schemes.Unregister(scheme)
+}
+
+// SupportedSchemes returns the URL schemes CachedPath accepts, sorted: those
+// of the registered clients, plus https when http is registered and the
+// built-in file and data schemes
+func SupportedSchemes() []string {
+	supported := append([]string{"data", "file"}, schemes.GetSupportedSchemes()...)
+	if _, ok := schemes.GetClient("http"); ok {
+		supported = append(supported, "https")
+	}
+	sort.Strings(supported)
+	return supported
+}
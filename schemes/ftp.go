@@ -0,0 +1,439 @@
+package schemes
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CezarGarrido/cachedpath/internal/bufpool"
+)
+
+// FTPClient implements SchemeClient for FTP and FTPS (implicit TLS)
+type FTPClient struct {
+	secure    bool
+	timeout   time.Duration
+	tlsConfig *tls.Config
+}
+
+// NewFTPClient creates a client for ftp:// URLs
+func NewFTPClient() *FTPClient {
+	return &FTPClient{timeout: 30 * time.Second}
+}
+
+// NewFTPSClient creates a client for ftps:// URLs, which use TLS for both
+// the control and the data connections
+func NewFTPSClient() *FTPClient {
+	return &FTPClient{secure: true, timeout: 30 * time.Second}
+}
+
+// SetTimeout sets the timeout for connecting and for each command
+func (c *FTPClient) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// SetTLSConfig sets the TLS configuration used by FTPS connections
+func (c *FTPClient) SetTLSConfig(config *tls.Config) {
+	c.tlsConfig = config
+}
+
+// Configure implements ConfigurableClient
+func (c *FTPClient) Configure(cfg Config) SchemeClient {
+	clone := *c
+	clone.SetTimeout(cfg.Timeout)
+	clone.SetTLSConfig(cfg.TLSConfig)
+	return &clone
+}
+
+// GetResource downloads the file with RETR and writes it to the writer
+func (c *FTPClient) GetResource(rawURL string, writer io.Writer, headers map[string]string) error {
+	conn, path, err := c.open(rawURL)
+	if err != nil {
+		return err
+	}
+	defer conn.quit()
+
+	data, err := conn.retrieve(path)
+	if err != nil {
+		return fmt.Errorf("failed to download: %w", err)
+	}
+
+	_, copyErr := bufpool.Copy(writer, data)
+	closeErr := data.Close()
+	if copyErr != nil {
+		return fmt.Errorf("failed to write response: %w", copyErr)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("failed to download: %w", closeErr)
+	}
+
+	return nil
+}
+
+// GetSize returns the file size reported by SIZE
+func (c *FTPClient) GetSize(rawURL string, headers map[string]string) (int64, error) {
+	conn, path, err := c.open(rawURL)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.quit()
+
+	size, err := conn.size(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get size: %w", err)
+	}
+	return size, nil
+}
+
+// GetETag returns the modification time reported by MDTM in HTTP date
+// format. FTP has no ETags, so the modification time versions the file.
+func (c *FTPClient) GetETag(rawURL string, headers map[string]string) (string, error) {
+	conn, path, err := c.open(rawURL)
+	if err != nil {
+		return "", err
+	}
+	defer conn.quit()
+
+	modTime, err := conn.modTime(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to get ETag: %w", err)
+	}
+	return ResourceInfo{LastModified: modTime}.Version(), nil
+}
+
+// GetMetadata returns the modification time and size of the file from a
+// single session
+func (c *FTPClient) GetMetadata(rawURL string, headers map[string]string) (ResourceInfo, error) {
+	conn, path, err := c.open(rawURL)
+	if err != nil {
+		return ResourceInfo{}, err
+	}
+	defer conn.quit()
+
+	modTime, err := conn.modTime(path)
+	if err != nil {
+		return ResourceInfo{}, fmt.Errorf("failed to get metadata: %w", err)
+	}
+	// SIZE is an extension some servers lack; the size is only informative
+	size, _ := conn.size(path)
+
+	return ResourceInfo{LastModified: modTime, Size: size}, nil
+}
+
+// Scheme returns the scheme name
+func (c *FTPClient) Scheme() string {
+	if c.secure {
+		return "ftps"
+	}
+	return "ftp"
+}
+
+// open connects to the server in the URL, logs in and switches to binary
+// mode. It returns the connection and the path of the file on the server.
+func (c *FTPClient) open(rawURL string) (*ftpConn, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid URL: %w", err)
+	}
+
+	path := strings.TrimPrefix(u.Path, "/")
+	if path == "" {
+		return nil, "", fmt.Errorf("invalid URL: no file path in %s", rawURL)
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		port := "21"
+		if c.secure {
+			port = "990"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	// Anonymous login unless the URL has credentials
+	user, pass := "anonymous", "anonymous@"
+	if u.User != nil {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+	}
+	if strings.ContainsAny(path+user+pass, "\r\n") {
+		return nil, "", fmt.Errorf("invalid URL: line breaks in %s", rawURL)
+	}
+
+	if err := CheckNetwork(u.Hostname()); err != nil {
+		return nil, "", err
+	}
+
+	conn, err := c.dial(host)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to connect to %s: %w", host, err)
+	}
+
+	if err := conn.login(user, pass); err != nil {
+		conn.close()
+		return nil, "", err
+	}
+	if _, _, err := conn.cmd(200, "TYPE I"); err != nil {
+		conn.close()
+		return nil, "", err
+	}
+
+	return conn, path, nil
+}
+
+// dial opens the control connection and reads the server greeting
+func (c *FTPClient) dial(addr string) (*ftpConn, error) {
+	netConn, err := net.DialTimeout("tcp", addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &ftpConn{host: addr, timeout: c.timeout}
+	if c.secure {
+		conn.tlsConfig = c.tlsConfigFor(addr)
+		netConn = tls.Client(netConn, conn.tlsConfig)
+	}
+	conn.netConn = netConn
+	conn.text = textproto.NewConn(netConn)
+
+	conn.deadline()
+	if _, _, err := conn.text.ReadResponse(220); err != nil {
+		conn.close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// tlsConfigFor returns the TLS configuration for a server, defaulting the
+// server name to its host
+func (c *FTPClient) tlsConfigFor(addr string) *tls.Config {
+	config := &tls.Config{}
+	if c.tlsConfig != nil {
+		config = c.tlsConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	// Data connections resume the control connection's TLS session
+	if config.ClientSessionCache == nil {
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	}
+	return config
+}
+
+// ftpConn is a logged-in FTP control connection
+type ftpConn struct {
+	host      string
+	timeout   time.Duration
+	tlsConfig *tls.Config
+	netConn   net.Conn
+	text      *textproto.Conn
+}
+
+// deadline bounds the next exchange on the control connection
+func (c *ftpConn) deadline() {
+	if c.timeout > 0 {
+		c.netConn.SetDeadline(time.Now().Add(c.timeout))
+	}
+}
+
+// cmd sends a command and reads its response, which must have the
+// expected code
+func (c *ftpConn) cmd(expectCode int, format string, args ...any) (int, string, error) {
+	c.deadline()
+	if err := c.text.PrintfLine(format, args...); err != nil {
+		return 0, "", err
+	}
+	code, msg, err := c.text.ReadResponse(expectCode)
+	if err != nil {
+		return code, msg, fmt.Errorf("%s: %w", strings.Fields(format)[0], err)
+	}
+	return code, msg, nil
+}
+
+// size returns the file size reported by SIZE
+func (c *ftpConn) size(path string) (int64, error) {
+	_, msg, err := c.cmd(213, "SIZE %s", path)
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse size: %w", err)
+	}
+	return size, nil
+}
+
+// modTime returns the modification time reported by MDTM
+func (c *ftpConn) modTime(path string) (time.Time, error) {
+	_, msg, err := c.cmd(213, "MDTM %s", path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parseMDTM(msg)
+}
+
+// login authenticates with USER and, when asked for it, PASS
+func (c *ftpConn) login(user, pass string) error {
+	code, _, err := c.cmd(0, "USER %s", user)
+	if err != nil {
+		return fmt.Errorf("login failed: %w", err)
+	}
+	switch code {
+	case 230:
+		return nil
+	case 331:
+		if _, _, err := c.cmd(230, "PASS %s", pass); err != nil {
+			return fmt.Errorf("login failed: %w", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("login failed: unexpected response %d to USER", code)
+	}
+}
+
+// retrieve opens a passive data connection and starts a RETR. Closing the
+// returned reader waits for the server to confirm the transfer.
+func (c *ftpConn) retrieve(path string) (io.ReadCloser, error) {
+	data, err := c.openDataConn()
+	if err != nil {
+		return nil, err
+	}
+
+	// 125 (data connection already open) and 150 (about to open) both start the transfer
+	code, _, err := c.cmd(0, "RETR %s", path)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	if code != 125 && code != 150 {
+		data.Close()
+		return nil, fmt.Errorf("RETR failed with status: %d", code)
+	}
+
+	return &ftpDataReader{conn: c, data: data}, nil
+}
+
+// openDataConn enters passive mode, trying EPSV before PASV
+func (c *ftpConn) openDataConn() (net.Conn, error) {
+	addr, err := c.epsv()
+	if err != nil {
+		addr, err = c.pasv()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := net.DialTimeout("tcp", addr, c.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open data connection: %w", err)
+	}
+	if c.tlsConfig != nil {
+		data = tls.Client(data, c.tlsConfig)
+	}
+	return data, nil
+}
+
+// epsv returns the data address from "229 Entering Extended Passive Mode (|||port|)"
+func (c *ftpConn) epsv() (string, error) {
+	_, msg, err := c.cmd(229, "EPSV")
+	if err != nil {
+		return "", err
+	}
+	start := strings.Index(msg, "(")
+	end := strings.LastIndex(msg, ")")
+	if start < 0 || end < start {
+		return "", fmt.Errorf("invalid EPSV response: %s", msg)
+	}
+	fields := strings.Split(msg[start+1:end], "|")
+	if len(fields) != 5 {
+		return "", fmt.Errorf("invalid EPSV response: %s", msg)
+	}
+	host, _, err := net.SplitHostPort(c.host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, fields[3]), nil
+}
+
+// pasv returns the data address from "227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)".
+// The advertised host is ignored in favour of the control connection's host,
+// which also works behind NAT.
+func (c *ftpConn) pasv() (string, error) {
+	_, msg, err := c.cmd(227, "PASV")
+	if err != nil {
+		return "", err
+	}
+	start := strings.Index(msg, "(")
+	end := strings.LastIndex(msg, ")")
+	if start < 0 || end < start {
+		return "", fmt.Errorf("invalid PASV response: %s", msg)
+	}
+	fields := strings.Split(msg[start+1:end], ",")
+	if len(fields) != 6 {
+		return "", fmt.Errorf("invalid PASV response: %s", msg)
+	}
+	p1, err1 := strconv.Atoi(strings.TrimSpace(fields[4]))
+	p2, err2 := strconv.Atoi(strings.TrimSpace(fields[5]))
+	if err1 != nil || err2 != nil {
+		return "", fmt.Errorf("invalid PASV response: %s", msg)
+	}
+	host, _, err := net.SplitHostPort(c.host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p1<<8|p2)), nil
+}
+
+// quit ends the session politely and closes the connection
+func (c *ftpConn) quit() {
+	c.deadline()
+	c.text.PrintfLine("QUIT")
+	c.close()
+}
+
+func (c *ftpConn) close() {
+	c.text.Close()
+}
+
+// ftpDataReader reads a RETR transfer from the data connection
+type ftpDataReader struct {
+	conn *ftpConn
+	data net.Conn
+}
+
+func (r *ftpDataReader) Read(p []byte) (int, error) {
+	return r.data.Read(p)
+}
+
+// Close closes the data connection and reads the transfer result
+func (r *ftpDataReader) Close() error {
+	if err := r.data.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	r.conn.deadline()
+	if _, _, err := r.conn.text.ReadResponse(226); err != nil {
+		return fmt.Errorf("transfer failed: %w", err)
+	}
+	return nil
+}
+
+// parseMDTM parses an MDTM reply (YYYYMMDDHHMMSS, optionally with
+// fractional seconds), which is always in UTC
+func parseMDTM(msg string) (time.Time, error) {
+	value := strings.TrimSpace(msg)
+	if i := strings.Index(value, "."); i >= 0 {
+		value = value[:i]
+	}
+	t, err := time.Parse("20060102150405", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid MDTM response: %s", msg)
+	}
+	return t.UTC(), nil
+}
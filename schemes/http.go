@@ -1,36 +1,238 @@
 package schemes
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/CezarGarrido/cachedpath/internal/bufpool"
 )
 
+var (
+	// ErrProxyAuthRequired indicates that the proxy rejected the request with 407
+	ErrProxyAuthRequired = errors.New("proxy authentication required")
+
+	// ErrTooManyRedirects indicates that a request exceeded the redirect limit
+	ErrTooManyRedirects = errors.New("too many redirects")
+
+	// ErrRedirectNotAllowed indicates that the redirect policy refused a redirect
+	ErrRedirectNotAllowed = errors.New("redirect not allowed")
+
+	// ErrResponseRejected indicates a successful response that the predicate
+	// set with SetRetryIf still rejected after the last retry
+	ErrResponseRejected = errors.New("response rejected by retry predicate")
+
+	// ErrVersionChanged indicates that the resource changed while it was
+	// being downloaded in parts
+	ErrVersionChanged = errors.New("resource changed during download")
+
+	// ErrDownloadFailed indicates that the download failed
+	ErrDownloadFailed = errors.New("download failed")
+)
+
+// maxErrorBody is how much of an error response body HTTPError keeps
+const maxErrorBody = 1024
+
+// HTTPError reports an unexpected HTTP response status
+type HTTPError struct {
+	// StatusCode is the HTTP status code
+	StatusCode int
+
+	// Status is the HTTP status line, such as "404 Not Found"
+	Status string
+
+	// URL is the requested URL
+	URL string
+
+	// Header holds the response headers
+	Header http.Header
+
+	// Body holds up to the first KB of the response body, which often
+	// explains the failure
+	Body []byte
+
+	// op is the failed operation, such as "download" or "HEAD request"
+	op string
+}
+
+// newHTTPError builds an HTTPError from a response, reading the start of
+// its body. The caller still closes the body.
+func newHTTPError(op string, resp *http.Response) *HTTPError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	return &HTTPError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		URL:        resp.Request.URL.Redacted(),
+		Header:     resp.Header,
+		Body:       body,
+		op:         op,
+	}
+}
+
+// Error implements error
+func (e *HTTPError) Error() string {
+	op := e.op
+	if op == "" {
+		op = "request"
+	}
+	status := e.Status
+	if status == "" {
+		status = strconv.Itoa(e.StatusCode)
+	}
+	return fmt.Sprintf("%s of %s failed with status: %s", op, e.URL, status)
+}
+
+// DownloadError describes a failed download. It unwraps to ErrDownloadFailed
+// and to the underlying error, such as an *HTTPError or a network error.
+type DownloadError struct {
+	// URL is the downloaded resource, with any password redacted
+	URL string
+
+	// StatusCode is the HTTP status of the failed response, 0 if there
+	// was none
+	StatusCode int
+
+	// Attempt is the number of requests made, counting retries, 0 if
+	// unknown
+	Attempt int
+
+	// Underlying is why the download failed
+	Underlying error
+}
+
+// newDownloadError builds a DownloadError for a request that failed after
+// attempts requests
+func newDownloadError(req *http.Request, attempts int, err error) *DownloadError {
+	e := &DownloadError{URL: req.URL.Redacted(), Attempt: attempts, Underlying: err}
+	var status *HTTPError
+	if errors.As(err, &status) {
+		e.StatusCode = status.StatusCode
+	}
+	return e
+}
+
+// Error implements error
+func (e *DownloadError) Error() string {
+	if e.Underlying == nil {
+		return fmt.Sprintf("%v: %s", ErrDownloadFailed, e.URL)
+	}
+	return fmt.Sprintf("%v: %v", ErrDownloadFailed, e.Underlying)
+}
+
+// Unwrap allows errors.Is(err, ErrDownloadFailed) and errors.As on the
+// underlying error
+func (e *DownloadError) Unwrap() []error {
+	if e.Underlying == nil {
+		return []error{ErrDownloadFailed}
+	}
+	return []error{ErrDownloadFailed, e.Underlying}
+}
+
 // HTTPClient implementa SchemeClient para HTTP e HTTPS
 type HTTPClient struct {
-	client     *http.Client
-	maxRetries int
-	retryDelay time.Duration
+	client          *http.Client
+	maxRetries      int
+	retryDelay      time.Duration
+	maxRetryWait    time.Duration
+	retryableStatus map[int]bool
+
+	// retryIf, when set, decides which responses and errors are retried
+	// instead of retryableStatus
+	retryIf func(resp *http.Response, err error) bool
+
+	// rateLimit is the maximum requests per second per host (0 = unlimited)
+	rateLimit float64
+	// limiters holds a *rate.Limiter per host, shared with clones
+	limiters *sync.Map
+
+	// ctx is the context of the requests (nil for context.Background)
+	ctx context.Context
+
+	// stallTimeout is how long a read of a download may wait for data
+	// (0 = no limit)
+	stallTimeout time.Duration
+}
+
+// DefaultRetryableStatusCodes are the response statuses retried by default
+var DefaultRetryableStatusCodes = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
 }
 
+// DefaultStallTimeout is how long a download may receive no data before
+// it fails with ErrStalled
+const DefaultStallTimeout = 60 * time.Second
+
 // NewHTTPClient creates a new HTTPClient with default settings
 func NewHTTPClient() *HTTPClient {
 	return &HTTPClient{
+		// The timeout covers connecting and the response headers; a slow
+		// body is limited by the stall timeout instead
 		client: &http.Client{
-			Timeout: 30 * time.Second,
 			Transport: &http.Transport{
-				MaxIdleConns:        100,
-				MaxIdleConnsPerHost: 10,
-				IdleConnTimeout:     90 * time.Second,
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+				TLSHandshakeTimeout:   30 * time.Second,
+				ResponseHeaderTimeout: 30 * time.Second,
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   10,
+				IdleConnTimeout:       90 * time.Second,
 			},
 		},
-		maxRetries: 3,
-		retryDelay: 1 * time.Second,
+		maxRetries:      3,
+		retryDelay:      1 * time.Second,
+		maxRetryWait:    60 * time.Second,
+		retryableStatus: statusSet(DefaultRetryableStatusCodes),
+		limiters:        &sync.Map{},
+		stallTimeout:    DefaultStallTimeout,
 	}
 }
 
+// Clone returns a copy of the client that can be configured without
+// affecting other goroutines using the original. The copy shares the
+// per-host rate limiters with the original.
+func (c *HTTPClient) Clone() *HTTPClient {
+	clone := *c
+	if clone.limiters == nil {
+		clone.limiters = &sync.Map{}
+	}
+	return &clone
+}
+
+// Capabilities implements CapabilityClient
+func (c *HTTPClient) Capabilities() Capabilities {
+	return CapMetadata | CapConditional | CapStreaming | CapRanges
+}
+
+// Configure implements ConfigurableClient
+func (c *HTTPClient) Configure(cfg Config) SchemeClient {
+	clone := c.Clone()
+	clone.SetHTTPClient(cfg.HTTPClient)
+	clone.SetRetryConfig(cfg.MaxRetries, cfg.RetryDelay)
+	clone.SetMaxRetryWait(cfg.MaxRetryWait)
+	clone.SetRetryableStatusCodes(cfg.RetryableStatusCodes)
+	clone.SetRetryIf(cfg.RetryIf)
+	clone.SetRateLimit(cfg.RateLimit)
+	clone.SetContext(cfg.Context)
+	clone.SetStallTimeout(cfg.StallTimeout)
+	return clone
+}
+
 // SetHTTPClient define um cliente HTTP customizado
 func (c *HTTPClient) SetHTTPClient(client *http.Client) {
 	if client != nil {
@@ -38,60 +240,278 @@ func (c *HTTPClient) SetHTTPClient(client *http.Client) {
 	}
 }
 
+// SetContext makes requests, and the waits between their retries, stop
+// when ctx is done. A nil ctx means context.Background.
+func (c *HTTPClient) SetContext(ctx context.Context) {
+	c.ctx = ctx
+}
+
+// newRequest creates a request with the context of the client
+func (c *HTTPClient) newRequest(method, url string) (*http.Request, error) {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return http.NewRequestWithContext(ctx, method, url, nil)
+}
+
 // SetRetryConfig sets the retry configuration
 func (c *HTTPClient) SetRetryConfig(maxRetries int, retryDelay time.Duration) {
 	c.maxRetries = maxRetries
 	c.retryDelay = retryDelay
 }
 
+// SetMaxRetryWait caps how long a Retry-After header can make us wait
+// before a retry (0 means no cap)
+func (c *HTTPClient) SetMaxRetryWait(maxWait time.Duration) {
+	c.maxRetryWait = maxWait
+}
+
+// SetRetryableStatusCodes sets the response statuses that are retried
+func (c *HTTPClient) SetRetryableStatusCodes(codes []int) {
+	c.retryableStatus = statusSet(codes)
+}
+
+// SetRetryIf makes fn decide whether a response or a transport error is
+// retried, replacing the retryable statuses. fn can read the first
+// RetryPeekSize bytes of the response body; the caller of a response that
+// is not retried still gets the whole body.
+func (c *HTTPClient) SetRetryIf(fn func(resp *http.Response, err error) bool) {
+	c.retryIf = fn
+}
+
+// RetryPeekSize is how much of a response body the predicate set with
+// SetRetryIf can read
+const RetryPeekSize = 512
+
+// shouldRetry reports whether resp or err must be retried according to the
+// predicate set with SetRetryIf. The predicate gets a copy of resp reading
+// the start of the body, which is buffered and put back in front of resp.Body.
+func (c *HTTPClient) shouldRetry(resp *http.Response, err error) (bool, error) {
+	if resp == nil {
+		return c.retryIf(nil, err), nil
+	}
+
+	prefix := make([]byte, RetryPeekSize)
+	n, readErr := io.ReadFull(resp.Body, prefix)
+	if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+		return false, readErr
+	}
+	prefix = prefix[:n]
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), resp.Body), resp.Body}
+
+	peek := *resp
+	peek.Body = io.NopCloser(bytes.NewReader(prefix))
+	return c.retryIf(&peek, err), nil
+}
+
+// SetRateLimit limits requests to each host to requestsPerSecond, including
+// retries. Zero or less disables the limit.
+func (c *HTTPClient) SetRateLimit(requestsPerSecond float64) {
+	c.rateLimit = requestsPerSecond
+}
+
+// waitForHost blocks until the rate limit of host allows another request
+func (c *HTTPClient) waitForHost(ctx context.Context, host string) error {
+	limit := rate.Limit(c.rateLimit)
+	if limit <= 0 {
+		return nil
+	}
+
+	value, _ := c.limiters.LoadOrStore(host, rate.NewLimiter(limit, 1))
+	limiter := value.(*rate.Limiter)
+	if limiter.Limit() != limit {
+		limiter.SetLimit(limit)
+	}
+	return limiter.Wait(ctx)
+}
+
 // doRequestWithRetry executes a request with automatic retry
 func (c *HTTPClient) doRequestWithRetry(req *http.Request) (*http.Response, error) {
+	resp, _, err := c.doRequestAttempts(req)
+	return resp, err
+}
+
+// doRequestAttempts is doRequestWithRetry, also returning how many requests
+// were made
+func (c *HTTPClient) doRequestAttempts(req *http.Request) (*http.Response, int, error) {
 	var resp *http.Response
 	var err error
+	var wait time.Duration
+	attempts := 0
+
+	if err := CheckNetwork(req.URL.Hostname()); err != nil {
+		return nil, attempts, err
+	}
 
+	ctx := req.Context()
 	for attempt := 0; attempt <= c.maxRetries; attempt++ {
 		if attempt > 0 {
-			// Wait before retrying
-			time.Sleep(c.retryDelay * time.Duration(attempt))
+			// Wait before retrying, unless the caller gave up
+			if err := sleepContext(ctx, wait); err != nil {
+				return nil, attempts, err
+			}
+
+			// Requests with a body, such as PROPFIND, send it again
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, attempts, err
+				}
+				req.Body = body
+			}
+		}
+
+		if err := c.waitForHost(req.Context(), req.URL.Host); err != nil {
+			return nil, attempts, err
 		}
 
+		attempts++
 		resp, err = c.client.Do(req)
+		wait = c.retryDelay * time.Duration(attempt+1)
 
-		// Sucesso
-		if err == nil && resp.StatusCode == http.StatusOK {
-			return resp, nil
+		// A cancelled request is not retried
+		if err != nil && ctx.Err() != nil {
+			return nil, attempts, ctx.Err()
 		}
 
-		// If not a network error or timeout, don't retry
-		if err == nil {
-			// Status code different from 200
-			if resp.StatusCode >= 400 && resp.StatusCode < 500 {
-				// 4xx errors are generally not recoverable
-				return resp, nil
+		// Retrying can't fix missing or wrong proxy credentials. Plain requests
+		// get a 407 response; CONNECT failures surface as a transport error.
+		if err == nil && resp.StatusCode == http.StatusProxyAuthRequired {
+			resp.Body.Close()
+			return nil, attempts, ErrProxyAuthRequired
+		}
+		if err != nil && strings.Contains(err.Error(), "Proxy Authentication Required") {
+			return nil, attempts, fmt.Errorf("%w: %v", ErrProxyAuthRequired, err)
+		}
+
+		// Redirect loops, limits and policies don't go away on retry, nor does
+		// a redirect to a host that network access is disabled for
+		if errors.Is(err, ErrTooManyRedirects) || errors.Is(err, ErrRedirectNotAllowed) || errors.Is(err, ErrNetworkDisabled) {
+			return nil, attempts, err
+		}
+
+		retry := err != nil || c.retryableStatus[resp.StatusCode]
+		if c.retryIf != nil {
+			var peekErr error
+			if retry, peekErr = c.shouldRetry(resp, err); peekErr != nil {
+				resp.Body.Close()
+				return nil, attempts, fmt.Errorf("failed to read response: %w", peekErr)
+			}
+			if !retry && err != nil {
+				return nil, attempts, err
 			}
 		}
 
-		// Fecha response anterior se houver
-		if resp != nil {
+		if err == nil {
+			// Success, or an error status that retrying won't fix
+			if !retry {
+				return resp, attempts, nil
+			}
+
+			// Out of retries: let the caller report the status, unless the
+			// predicate rejected a successful response
+			if attempt == c.maxRetries {
+				if resp.StatusCode < 300 {
+					resp.Body.Close()
+					return nil, attempts, fmt.Errorf("failed after %d retries: %w", c.maxRetries, ErrResponseRejected)
+				}
+				return resp, attempts, nil
+			}
+
+			// Rate limited or unavailable: wait at least as long as the server asks
+			if retryAfter := parseRetryAfter(resp.Header.Get("Retry-After")); retryAfter > wait {
+				wait = retryAfter
+			}
+			if c.maxRetryWait > 0 && wait > c.maxRetryWait {
+				wait = c.maxRetryWait
+			}
+
+			// Fecha response anterior
 			resp.Body.Close()
 		}
+	}
 
-		// If it's the last attempt, return the error
-		if attempt == c.maxRetries {
-			break
-		}
+	return nil, attempts, fmt.Errorf("failed after %d retries: %w", c.maxRetries, err)
+}
+
+// sleepContext waits for d, or until ctx is done and returns its error
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
+// dispositionFilename returns the base name of the filename parameter of a
+// Content-Disposition header, or "" if there is none
+func dispositionFilename(header string) string {
+	if header == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(header)
 	if err != nil {
-		return nil, fmt.Errorf("failed after %d retries: %w", c.maxRetries, err)
+		return ""
+	}
+	name := params["filename"]
+	// Never trust directories in a server-provided name
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// finalURL returns the URL a response came from after redirects, or "" if
+// the request wasn't redirected
+func finalURL(resp *http.Response) string {
+	if resp.Request == nil || resp.Request.Response == nil {
+		return ""
+	}
+	return resp.Request.URL.String()
+}
+
+// statusSet converts a list of status codes into a lookup set
+func statusSet(codes []int) map[int]bool {
+	set := make(map[int]bool, len(codes))
+	for _, code := range codes {
+		set[code] = true
+	}
+	return set
+}
+
+// parseRetryAfter parses a Retry-After header in either delay-seconds or
+// HTTP-date form, returning 0 if it is missing or invalid
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
 	}
 
-	return resp, nil
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+
+	return 0
 }
 
 // GetResource baixa o recurso via HTTP/HTTPS
 func (c *HTTPClient) GetResource(url string, writer io.Writer, headers map[string]string) error {
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := c.newRequest("GET", url)
 	if err != nil {
 		return fmt.Errorf("failed to create request: %w", err)
 	}
@@ -106,17 +526,21 @@ func (c *HTTPClient) GetResource(url string, writer io.Writer, headers map[strin
 		req.Header.Set("User-Agent", "CachedPath-Go/1.0")
 	}
 
-	resp, err := c.doRequestWithRetry(req)
+	req, cancel := c.watchRequest(req)
+	defer cancel()
+
+	resp, attempts, err := c.doRequestAttempts(req)
 	if err != nil {
-		return fmt.Errorf("failed to download: %w", err)
+		return newDownloadError(req, attempts, err)
 	}
-	defer resp.Body.Close()
+	body := c.watchBody(resp.Body, cancel)
+	defer body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("download failed with status: %d %s", resp.StatusCode, resp.Status)
+		return newDownloadError(req, attempts, newHTTPError("download", resp))
 	}
 
-	_, err = io.Copy(writer, resp.Body)
+	_, err = bufpool.Copy(writer, body)
 	if err != nil {
 		return fmt.Errorf("failed to write response: %w", err)
 	}
@@ -124,11 +548,13 @@ func (c *HTTPClient) GetResource(url string, writer io.Writer, headers map[strin
 	return nil
 }
 
-// GetSize retorna o tamanho do recurso
-func (c *HTTPClient) GetSize(url string, headers map[string]string) (int64, error) {
-	req, err := http.NewRequest("HEAD", url, nil)
+// GetRange downloads length bytes of the resource starting at offset with
+// a Range request. If-Range makes the server send the whole resource
+// instead if it no longer has the given version, which fails the request.
+func (c *HTTPClient) GetRange(url, version string, offset, length int64, writer io.Writer, headers map[string]string) error {
+	req, err := c.newRequest("GET", url)
 	if err != nil {
-		return 0, fmt.Errorf("failed to create request: %w", err)
+		return fmt.Errorf("failed to create request: %w", err)
 	}
 
 	// Add custom headers
@@ -141,34 +567,50 @@ func (c *HTTPClient) GetSize(url string, headers map[string]string) (int64, erro
 		req.Header.Set("User-Agent", "CachedPath-Go/1.0")
 	}
 
-	resp, err := c.doRequestWithRetry(req)
-	if err != nil {
-		return 0, fmt.Errorf("failed to get size: %w", err)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	if version != "" && !strings.HasPrefix(version, "W/") {
+		req.Header.Set("If-Range", version)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("HEAD request failed with status: %d %s", resp.StatusCode, resp.Status)
+	req, cancel := c.watchRequest(req)
+	defer cancel()
+
+	resp, attempts, err := c.doRequestAttempts(req)
+	if err != nil {
+		return newDownloadError(req, attempts, err)
 	}
+	body := c.watchBody(resp.Body, cancel)
+	defer body.Close()
 
-	contentLength := resp.Header.Get("Content-Length")
-	if contentLength == "" {
-		return 0, nil
+	if resp.StatusCode == http.StatusOK {
+		return fmt.Errorf("%w: range request for %s answered with the whole resource", ErrVersionChanged, url)
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return newDownloadError(req, attempts, newHTTPError("download", resp))
 	}
 
-	size, err := strconv.ParseInt(contentLength, 10, 64)
+	n, err := bufpool.Copy(writer, io.LimitReader(body, length))
 	if err != nil {
-		return 0, fmt.Errorf("failed to parse content length: %w", err)
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	if n != length {
+		return newDownloadError(req, attempts, fmt.Errorf("range of %d bytes ended after %d", length, n))
 	}
+	return nil
+}
 
-	return size, nil
+// OpenResource performs a GET and returns the response body with its ETag,
+// Last-Modified time and size
+func (c *HTTPClient) OpenResource(url string, headers map[string]string) (io.ReadCloser, ResourceInfo, error) {
+	return c.GetResourceIfModified(url, "", time.Time{}, headers)
 }
 
-// GetETag retorna o ETag do recurso
-func (c *HTTPClient) GetETag(url string, headers map[string]string) (string, error) {
-	req, err := http.NewRequest("HEAD", url, nil)
+// GetResourceIfModified performs a conditional GET, sending If-None-Match
+// for the ETag and If-Modified-Since for the modification time
+func (c *HTTPClient) GetResourceIfModified(url, etag string, lastModified time.Time, headers map[string]string) (io.ReadCloser, ResourceInfo, error) {
+	req, err := c.newRequest("GET", url)
 	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+		return nil, ResourceInfo{}, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	// Add custom headers
@@ -181,23 +623,182 @@ func (c *HTTPClient) GetETag(url string, headers map[string]string) (string, err
 		req.Header.Set("User-Agent", "CachedPath-Go/1.0")
 	}
 
-	resp, err := c.doRequestWithRetry(req)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if !lastModified.IsZero() {
+		req.Header.Set("If-Modified-Since", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	req, cancel := c.watchRequest(req)
+	resp, attempts, err := c.doRequestAttempts(req)
+	if err != nil {
+		cancel()
+		return nil, ResourceInfo{}, newDownloadError(req, attempts, err)
+	}
+	body := c.watchBody(resp.Body, cancel)
+
+	if resp.StatusCode == http.StatusNotModified {
+		body.Close()
+		cancel()
+		return nil, ResourceInfo{ETag: etag, LastModified: lastModified}, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer cancel()
+		defer body.Close()
+		return nil, ResourceInfo{}, newDownloadError(req, attempts, newHTTPError("download", resp))
+	}
+
+	info := ResourceInfo{
+		ETag:        resp.Header.Get("ETag"),
+		Size:        resp.ContentLength,
+		ContentType: resp.Header.Get("Content-Type"),
+		Filename:    dispositionFilename(resp.Header.Get("Content-Disposition")),
+		FinalURL:    finalURL(resp),
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.LastModified = t
+	}
+	if info.Size < 0 || resp.Uncompressed {
+		// Decompressed bodies have no known length
+		info.Size = 0
+	}
+
+	// Closing the body ends the request
+	return body, info, nil
+}
+
+// GetSize retorna o tamanho do recurso
+func (c *HTTPClient) GetSize(url string, headers map[string]string) (int64, error) {
+	info, err := c.stat(url, headers)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get size: %w", err)
+	}
+	return info.Size, nil
+}
+
+// GetETag retorna o ETag do recurso
+func (c *HTTPClient) GetETag(url string, headers map[string]string) (string, error) {
+	info, err := c.stat(url, headers)
 	if err != nil {
 		return "", fmt.Errorf("failed to get ETag: %w", err)
 	}
+	// If no ETag, Version uses Last-Modified (in HTTP date format) as alternative
+	return info.Version(), nil
+}
+
+// GetMetadata returns the ETag, Last-Modified time, size and content type
+// of the resource from a single HEAD request
+func (c *HTTPClient) GetMetadata(url string, headers map[string]string) (ResourceInfo, error) {
+	info, err := c.stat(url, headers)
+	if err != nil {
+		return ResourceInfo{}, fmt.Errorf("failed to get metadata: %w", err)
+	}
+	return info, nil
+}
+
+// stat discovers the resource metadata with a HEAD request. Servers that
+// reject HEAD (403, 405, 501) are asked for the first byte with a ranged GET.
+func (c *HTTPClient) stat(url string, headers map[string]string) (ResourceInfo, error) {
+	resp, err := c.doMetadataRequest("HEAD", url, headers)
+	if err != nil {
+		return ResourceInfo{}, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusForbidden, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		resp.Body.Close()
+		resp, err = c.doMetadataRequest("GET", url, headers)
+		if err != nil {
+			return ResourceInfo{}, err
+		}
+	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("HEAD request failed with status: %d %s", resp.StatusCode, resp.Status)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return ResourceInfo{}, newHTTPError(resp.Request.Method+" request", resp)
+	}
+
+	info := ResourceInfo{
+		ETag:        resp.Header.Get("ETag"),
+		ContentType: resp.Header.Get("Content-Type"),
+		Filename:    dispositionFilename(resp.Header.Get("Content-Disposition")),
+		FinalURL:    finalURL(resp),
+	}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.LastModified = t
+	}
+
+	info.AcceptRanges = strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes")
+	if resp.StatusCode == http.StatusPartialContent {
+		info.AcceptRanges = true
+		// Content-Range: bytes 0-0/<total>
+		contentRange := resp.Header.Get("Content-Range")
+		if i := strings.LastIndex(contentRange, "/"); i >= 0 {
+			if size, err := strconv.ParseInt(contentRange[i+1:], 10, 64); err == nil {
+				info.Size = size
+			}
+		}
+	} else if contentLength := resp.Header.Get("Content-Length"); contentLength != "" {
+		size, err := strconv.ParseInt(contentLength, 10, 64)
+		if err != nil {
+			return ResourceInfo{}, fmt.Errorf("failed to parse content length: %w", err)
+		}
+		info.Size = size
+	}
+
+	// The length of an encoded body says nothing about the decoded bytes a
+	// download will write
+	if c.decompresses(resp.Header.Get("Content-Encoding"), headers) {
+		info.Size = 0
+	}
+
+	return info, nil
+}
+
+// decompresses reports whether a GET answered with the given
+// Content-Encoding would be decompressed by the transport: it is gzip and
+// neither compression is disabled nor Accept-Encoding set by the caller
+func (c *HTTPClient) decompresses(encoding string, headers map[string]string) bool {
+	if !strings.EqualFold(strings.TrimSpace(encoding), "gzip") {
+		return false
+	}
+	for key := range headers {
+		if strings.EqualFold(key, "Accept-Encoding") {
+			return false
+		}
+	}
+	transport, ok := c.client.Transport.(*http.Transport)
+	if c.client.Transport == nil {
+		transport, ok = http.DefaultTransport.(*http.Transport)
+	}
+	return !ok || !transport.DisableCompression
+}
+
+// doMetadataRequest sends a HEAD, or a GET for just the first byte, whose
+// headers describe the resource
+func (c *HTTPClient) doMetadataRequest(method, url string, headers map[string]string) (*http.Response, error) {
+	req, err := c.newRequest(method, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Add custom headers
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	// Add default User-Agent if not provided
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", "CachedPath-Go/1.0")
 	}
 
-	etag := resp.Header.Get("ETag")
-	if etag == "" {
-		// If no ETag, use Last-Modified as alternative
-		etag = resp.Header.Get("Last-Modified")
+	if method == "GET" {
+		req.Header.Set("Range", "bytes=0-0")
 	}
 
-	return etag, nil
+	return c.doRequestWithRetry(req)
 }
 
 // Scheme retorna o nome do esquema
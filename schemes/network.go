@@ -0,0 +1,59 @@
+package schemes
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ErrNetworkDisabled indicates that a network request was attempted while
+// network access is disabled
+var ErrNetworkDisabled = errors.New("network access disabled")
+
+// DisableNetworkEnv is the environment variable that disables network
+// access when set to a true value ("1", "true", ...)
+const DisableNetworkEnv = "CACHED_PATH_DISABLE_NETWORK"
+
+var networkDisabled atomic.Bool
+
+func init() {
+	if disabled, err := strconv.ParseBool(os.Getenv(DisableNetworkEnv)); err == nil {
+		networkDisabled.Store(disabled)
+	}
+}
+
+// SetNetworkAllowed enables or disables network access for every scheme
+// client. While disabled, requests fail immediately with ErrNetworkDisabled.
+func SetNetworkAllowed(allowed bool) {
+	networkDisabled.Store(!allowed)
+}
+
+// NetworkAllowed reports whether network access is enabled
+func NetworkAllowed() bool {
+	return !networkDisabled.Load()
+}
+
+// CheckNetwork returns ErrNetworkDisabled if network access is disabled and
+// host is not a loopback host, so local test servers keep working. Scheme
+// clients call it before connecting to a server.
+func CheckNetwork(host string) error {
+	if NetworkAllowed() || isLoopback(host) {
+		return nil
+	}
+	return fmt.Errorf("%w: connection to %s", ErrNetworkDisabled, host)
+}
+
+// isLoopback reports whether host (without port) is localhost or a
+// loopback IP address
+func isLoopback(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
@@ -1,8 +1,16 @@
 package schemes
 
-import "io"
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
 
-// SchemeClient is the interface that all scheme clients must implement
+// SchemeClient is the interface that all scheme clients must implement.
+// Clients that connect to a server must call CheckNetwork before connecting.
 type SchemeClient interface {
 	// GetResource downloads the resource and writes to the writer
 	GetResource(url string, writer io.Writer, headers map[string]string) error
@@ -17,22 +25,224 @@ type SchemeClient interface {
 	Scheme() string
 }
 
+// ResourceInfo describes a resource returned by a conditional request
+type ResourceInfo struct {
+	// ETag is the resource ETag (may be empty)
+	ETag string
+
+	// LastModified is the resource modification time (zero if unknown)
+	LastModified time.Time
+
+	// Size is the resource size in bytes (0 if unknown)
+	Size int64
+
+	// ContentType is the resource media type (may be empty)
+	ContentType string
+
+	// Filename is the file name suggested by the server in a
+	// Content-Disposition header (may be empty)
+	Filename string
+
+	// FinalURL is the URL the resource was served from after redirects
+	// (empty if the request wasn't redirected)
+	FinalURL string
+
+	// AcceptRanges is set when the server supports byte range requests
+	AcceptRanges bool
+}
+
+// Version returns the ETag, or the Last-Modified time in HTTP date format
+// when there is no ETag, matching what GetETag reports
+func (i ResourceInfo) Version() string {
+	if i.ETag != "" {
+		return i.ETag
+	}
+	if !i.LastModified.IsZero() {
+		return i.LastModified.UTC().Format(http.TimeFormat)
+	}
+	return ""
+}
+
+// MetadataClient is implemented by scheme clients that can report the
+// version and size of a resource with a single request
+type MetadataClient interface {
+	// GetMetadata returns the ETag, modification time, size and content type
+	// of the resource
+	GetMetadata(url string, headers map[string]string) (ResourceInfo, error)
+}
+
+// ConditionalClient is implemented by scheme clients that can revalidate
+// a cached resource and download it in a single request
+type ConditionalClient interface {
+	// GetResourceIfModified requests the resource only if it no longer matches
+	// etag or was modified after lastModified. It returns a nil body when the
+	// cached copy is still valid.
+	GetResourceIfModified(url, etag string, lastModified time.Time, headers map[string]string) (io.ReadCloser, ResourceInfo, error)
+}
+
+// ResourceOpener is implemented by scheme clients that can stream a resource
+// and report its version from the same response
+type ResourceOpener interface {
+	// OpenResource starts downloading the resource and returns its body
+	// together with the ETag, modification time and size of that response
+	OpenResource(url string, headers map[string]string) (io.ReadCloser, ResourceInfo, error)
+}
+
+// RangeClient is implemented by scheme clients that can download part of a
+// resource
+type RangeClient interface {
+	// GetRange writes length bytes of the resource starting at offset to
+	// writer. It fails if the resource no longer has the given version.
+	GetRange(url, version string, offset, length int64, writer io.Writer, headers map[string]string) error
+}
+
+// Capabilities are the optional features of a scheme client, as bit flags
+type Capabilities uint
+
+const (
+	// CapMetadata reports the version and size of a resource with a single
+	// request (MetadataClient)
+	CapMetadata Capabilities = 1 << iota
+
+	// CapConditional revalidates and downloads a resource with a single
+	// request (ConditionalClient)
+	CapConditional
+
+	// CapStreaming reports the version of a resource from the response that
+	// carries its content (ResourceOpener)
+	CapStreaming
+
+	// CapRanges downloads parts of a resource (RangeClient)
+	CapRanges
+
+	// CapImmutable marks stores whose resources never change once written,
+	// so a cached copy is used without asking the server for its version
+	CapImmutable
+)
+
+// Has reports whether all of flags are set
+func (c Capabilities) Has(flags Capabilities) bool {
+	return c&flags == flags
+}
+
+// CapabilityClient is implemented by scheme clients that declare their
+// capabilities. The declared set takes precedence over the optional
+// interfaces the client implements, so a wrapper can turn features off.
+type CapabilityClient interface {
+	// Capabilities returns the features the client supports
+	Capabilities() Capabilities
+}
+
+// ClientCapabilities returns the capabilities client declares or, if it
+// doesn't implement CapabilityClient, those of the optional interfaces it
+// implements. CapImmutable is never assumed.
+func ClientCapabilities(client SchemeClient) Capabilities {
+	if declared, ok := client.(CapabilityClient); ok {
+		return declared.Capabilities()
+	}
+	var caps Capabilities
+	if _, ok := client.(MetadataClient); ok {
+		caps |= CapMetadata
+	}
+	if _, ok := client.(ConditionalClient); ok {
+		caps |= CapConditional
+	}
+	if _, ok := client.(ResourceOpener); ok {
+		caps |= CapStreaming
+	}
+	if _, ok := client.(RangeClient); ok {
+		caps |= CapRanges
+	}
+	return caps
+}
+
+// Config holds the CachedPath options that apply to scheme clients. Each
+// client uses the fields relevant to its protocol.
+type Config struct {
+	// HTTPClient is the HTTP client to send requests with
+	HTTPClient *http.Client
+
+	// Timeout is the timeout for connecting and for each request
+	Timeout time.Duration
+
+	// TLSConfig is the TLS configuration of secure connections (nil for the
+	// defaults)
+	TLSConfig *tls.Config
+
+	// MaxRetries is the maximum number of retries of a failed request
+	MaxRetries int
+
+	// RetryDelay is the base delay between retries
+	RetryDelay time.Duration
+
+	// MaxRetryWait caps the wait requested by the server before a retry
+	// (0 means no cap)
+	MaxRetryWait time.Duration
+
+	// RetryableStatusCodes are the HTTP statuses that are retried
+	RetryableStatusCodes []int
+
+	// RetryIf, when set, decides which responses and errors are retried
+	RetryIf func(resp *http.Response, err error) bool
+
+	// RateLimit is the maximum requests per second to each host (0 = unlimited)
+	RateLimit float64
+
+	// SSHKey is the PEM encoded private key for SSH authentication
+	SSHKey []byte
+
+	// KnownHostsFile is the known_hosts file used to verify SSH host keys
+	KnownHostsFile string
+
+	// Context stops requests, and the waits between retries, when it is
+	// done (nil for context.Background)
+	Context context.Context
+
+	// StallTimeout is how long a download may receive no data before it
+	// fails (0 = no limit)
+	StallTimeout time.Duration
+}
+
+// ConfigurableClient is implemented by scheme clients that take the
+// CachedPath options, such as timeouts and retries
+type ConfigurableClient interface {
+	// Configure returns a copy of the client configured with cfg, leaving
+	// the registered client unchanged for concurrent calls
+	Configure(cfg Config) SchemeClient
+}
+
 // Registry maintains a registry of scheme clients
-var registry = make(map[string]SchemeClient)
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]SchemeClient)
+)
 
 // Register registers a new scheme client
 func Register(client SchemeClient) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
 	registry[client.Scheme()] = client
 }
 
+// Unregister removes the client of a scheme
+func Unregister(scheme string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	delete(registry, scheme)
+}
+
 // GetClient gets a scheme client by name
 func GetClient(scheme string) (SchemeClient, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
 	client, ok := registry[scheme]
 	return client, ok
 }
 
 // GetSupportedSchemes retorna lista de esquemas suportados
 func GetSupportedSchemes() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
 	schemes := make([]string, 0, len(registry))
 	for scheme := range registry {
 		schemes = append(schemes, scheme)
@@ -43,4 +253,9 @@ func GetSupportedSchemes() []string {
 func init() {
 	// Register default clients
 	Register(NewHTTPClient())
+	Register(NewFTPClient())
+	Register(NewFTPSClient())
+	Register(NewSFTPClient())
+	Register(NewWebDAVClient())
+	Register(NewWebDAVSClient())
 }
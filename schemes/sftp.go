@@ -0,0 +1,461 @@
+package schemes
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPClient implements SchemeClient for sftp:// URLs over SSH
+type SFTPClient struct {
+	timeout        time.Duration
+	privateKey     []byte
+	knownHostsFile string
+}
+
+// NewSFTPClient creates a client for sftp:// URLs
+func NewSFTPClient() *SFTPClient {
+	return &SFTPClient{timeout: 30 * time.Second}
+}
+
+// SetTimeout sets the timeout for establishing the SSH connection
+func (c *SFTPClient) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// SetPrivateKey sets the PEM encoded private key used for public key
+// authentication
+func (c *SFTPClient) SetPrivateKey(key []byte) {
+	c.privateKey = key
+}
+
+// SetKnownHostsFile sets the known_hosts file used to verify host keys
+// (default: ~/.ssh/known_hosts)
+func (c *SFTPClient) SetKnownHostsFile(path string) {
+	c.knownHostsFile = path
+}
+
+// Configure implements ConfigurableClient
+func (c *SFTPClient) Configure(cfg Config) SchemeClient {
+	clone := *c
+	clone.SetTimeout(cfg.Timeout)
+	clone.SetPrivateKey(cfg.SSHKey)
+	clone.SetKnownHostsFile(cfg.KnownHostsFile)
+	return &clone
+}
+
+// GetResource downloads the remote file and writes it to the writer
+func (c *SFTPClient) GetResource(rawURL string, writer io.Writer, headers map[string]string) error {
+	session, path, err := c.open(rawURL)
+	if err != nil {
+		return err
+	}
+	defer session.close()
+
+	if err := session.download(path, writer); err != nil {
+		return fmt.Errorf("failed to download: %w", err)
+	}
+	return nil
+}
+
+// GetSize returns the size of the remote file
+func (c *SFTPClient) GetSize(rawURL string, headers map[string]string) (int64, error) {
+	info, err := c.GetMetadata(rawURL, headers)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get size: %w", err)
+	}
+	return info.Size, nil
+}
+
+// GetETag returns a hash of the modification time and size of the remote
+// file, since SFTP has no ETags
+func (c *SFTPClient) GetETag(rawURL string, headers map[string]string) (string, error) {
+	info, err := c.GetMetadata(rawURL, headers)
+	if err != nil {
+		return "", fmt.Errorf("failed to get ETag: %w", err)
+	}
+	return info.ETag, nil
+}
+
+// GetMetadata stats the remote file, deriving its ETag from the
+// modification time and size
+func (c *SFTPClient) GetMetadata(rawURL string, headers map[string]string) (ResourceInfo, error) {
+	session, path, err := c.open(rawURL)
+	if err != nil {
+		return ResourceInfo{}, err
+	}
+	defer session.close()
+
+	attrs, err := session.stat(path)
+	if err != nil {
+		return ResourceInfo{}, err
+	}
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d:%d", attrs.mtime, attrs.size)))
+	return ResourceInfo{
+		ETag:         `"` + hex.EncodeToString(sum[:16]) + `"`,
+		LastModified: time.Unix(int64(attrs.mtime), 0).UTC(),
+		Size:         int64(attrs.size),
+	}, nil
+}
+
+// Scheme returns the scheme name
+func (c *SFTPClient) Scheme() string {
+	return "sftp"
+}
+
+// open connects to the server in the URL and starts the SFTP subsystem.
+// It returns the session and the path of the file on the server.
+func (c *SFTPClient) open(rawURL string) (*sftpSession, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid URL: %w", err)
+	}
+	if u.Path == "" || u.Path == "/" {
+		return nil, "", fmt.Errorf("invalid URL: no file path in %s", rawURL)
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	if err := CheckNetwork(u.Hostname()); err != nil {
+		return nil, "", err
+	}
+
+	config, err := c.sshConfig(u)
+	if err != nil {
+		return nil, "", err
+	}
+
+	conn, err := ssh.Dial("tcp", host, config)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to connect to %s: %w", host, err)
+	}
+
+	session, err := newSFTPSession(conn)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	return session, u.Path, nil
+}
+
+// sshConfig builds the SSH client configuration for a URL: the user comes
+// from the URL (default: the current user), authentication uses the private
+// key and the URL password, and host keys are checked against known_hosts
+func (c *SFTPClient) sshConfig(u *url.URL) (*ssh.ClientConfig, error) {
+	user := os.Getenv("USER")
+	var auth []ssh.AuthMethod
+	if u.User != nil {
+		user = u.User.Username()
+		if pass, ok := u.User.Password(); ok {
+			auth = append(auth, ssh.Password(pass))
+		}
+	}
+
+	if c.privateKey != nil {
+		signer, err := ssh.ParsePrivateKey(c.privateKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SSH key: %w", err)
+		}
+		auth = append([]ssh.AuthMethod{ssh.PublicKeys(signer)}, auth...)
+	}
+
+	knownHostsFile := c.knownHostsFile
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find known_hosts: %w", err)
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known_hosts: %w", err)
+	}
+
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         c.timeout,
+	}, nil
+}
+
+// SFTP protocol version 3 packet types and constants
+const (
+	sftpInit       = 1
+	sftpVersion    = 2
+	sftpOpen       = 3
+	sftpClose      = 4
+	sftpRead       = 5
+	sftpStat       = 17
+	sftpStatus     = 101
+	sftpHandle     = 102
+	sftpData       = 103
+	sftpAttrsReply = 105
+
+	sftpFlagRead = 0x1
+
+	sftpAttrSize        = 0x1
+	sftpAttrUIDGID      = 0x2
+	sftpAttrPermissions = 0x4
+	sftpAttrACModTime   = 0x8
+
+	sftpStatusOK  = 0
+	sftpStatusEOF = 1
+
+	// sftpChunkSize is the number of bytes requested per READ
+	sftpChunkSize = 32 * 1024
+)
+
+// sftpSession speaks the subset of SFTP version 3 needed to stat and read
+// files. Requests are sent one at a time.
+type sftpSession struct {
+	conn    *ssh.Client
+	session *ssh.Session
+	in      io.WriteCloser
+	out     io.Reader
+	nextID  uint32
+}
+
+// sftpAttrs are the file attributes used by the client
+type sftpAttrs struct {
+	size  uint64
+	mtime uint32
+}
+
+func newSFTPSession(conn *ssh.Client) (*sftpSession, error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SSH session: %w", err)
+	}
+	in, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	out, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to start SFTP subsystem: %w", err)
+	}
+
+	s := &sftpSession{conn: conn, session: session, in: in, out: out}
+
+	// INIT carries the version instead of a request id
+	if err := s.send(sftpInit, binary.BigEndian.AppendUint32(nil, 3)); err != nil {
+		s.close()
+		return nil, err
+	}
+	typ, _, err := s.recv()
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	if typ != sftpVersion {
+		s.close()
+		return nil, fmt.Errorf("unexpected SFTP packet %d during handshake", typ)
+	}
+	return s, nil
+}
+
+// close ends the SFTP session and the SSH connection
+func (s *sftpSession) close() {
+	s.in.Close()
+	s.session.Close()
+	s.conn.Close()
+}
+
+// send writes a packet of the given type
+func (s *sftpSession) send(typ byte, payload []byte) error {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	packet = append(packet, typ)
+	packet = append(packet, payload...)
+	_, err := s.in.Write(packet)
+	return err
+}
+
+// recv reads a packet and returns its type and payload
+func (s *sftpSession) recv() (byte, []byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(s.out, length[:]); err != nil {
+		return 0, nil, fmt.Errorf("failed to read SFTP packet: %w", err)
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n == 0 || n > 256*1024 {
+		return 0, nil, fmt.Errorf("invalid SFTP packet length %d", n)
+	}
+	packet := make([]byte, n)
+	if _, err := io.ReadFull(s.out, packet); err != nil {
+		return 0, nil, fmt.Errorf("failed to read SFTP packet: %w", err)
+	}
+	return packet[0], packet[1:], nil
+}
+
+// request sends a request with a fresh id and returns the response type and
+// the payload that follows the echoed id
+func (s *sftpSession) request(typ byte, payload []byte) (byte, []byte, error) {
+	s.nextID++
+	id := s.nextID
+	if err := s.send(typ, append(binary.BigEndian.AppendUint32(nil, id), payload...)); err != nil {
+		return 0, nil, err
+	}
+
+	respType, resp, err := s.recv()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(resp) < 4 || binary.BigEndian.Uint32(resp) != id {
+		return 0, nil, errors.New("SFTP response does not match request")
+	}
+	return respType, resp[4:], nil
+}
+
+// stat returns the attributes of a remote file
+func (s *sftpSession) stat(path string) (sftpAttrs, error) {
+	typ, resp, err := s.request(sftpStat, appendString(nil, path))
+	if err != nil {
+		return sftpAttrs{}, err
+	}
+	if typ != sftpAttrsReply {
+		return sftpAttrs{}, statusError("stat", typ, resp)
+	}
+	return parseAttrs(resp)
+}
+
+// download reads a remote file into w
+func (s *sftpSession) download(path string, w io.Writer) error {
+	payload := appendString(nil, path)
+	payload = binary.BigEndian.AppendUint32(payload, sftpFlagRead)
+	payload = binary.BigEndian.AppendUint32(payload, 0) // no attributes
+	typ, resp, err := s.request(sftpOpen, payload)
+	if err != nil {
+		return err
+	}
+	if typ != sftpHandle {
+		return statusError("open", typ, resp)
+	}
+	handle, _, err := readString(resp)
+	if err != nil {
+		return err
+	}
+	defer s.request(sftpClose, appendString(nil, string(handle)))
+
+	var offset uint64
+	for {
+		payload := appendString(nil, string(handle))
+		payload = binary.BigEndian.AppendUint64(payload, offset)
+		payload = binary.BigEndian.AppendUint32(payload, sftpChunkSize)
+		typ, resp, err := s.request(sftpRead, payload)
+		if err != nil {
+			return err
+		}
+
+		if typ == sftpStatus && len(resp) >= 4 && binary.BigEndian.Uint32(resp) == sftpStatusEOF {
+			return nil
+		}
+		if typ != sftpData {
+			return statusError("read", typ, resp)
+		}
+
+		data, _, err := readString(resp)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		offset += uint64(len(data))
+	}
+}
+
+// statusError describes an unexpected response, decoding STATUS packets
+func statusError(op string, typ byte, resp []byte) error {
+	if typ != sftpStatus || len(resp) < 4 {
+		return fmt.Errorf("%s: unexpected SFTP packet %d", op, typ)
+	}
+	code := binary.BigEndian.Uint32(resp)
+	msg, _, _ := readString(resp[4:])
+	if code == sftpStatusOK {
+		return fmt.Errorf("%s: unexpected SFTP status OK", op)
+	}
+	return fmt.Errorf("%s failed with SFTP status %d: %s", op, code, msg)
+}
+
+// parseAttrs decodes an ATTRS payload
+func parseAttrs(b []byte) (sftpAttrs, error) {
+	var attrs sftpAttrs
+	flags, b, err := readUint32(b)
+	if err != nil {
+		return attrs, err
+	}
+	if flags&sftpAttrSize != 0 {
+		if len(b) < 8 {
+			return attrs, errShortPacket
+		}
+		attrs.size = binary.BigEndian.Uint64(b)
+		b = b[8:]
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		if len(b) < 8 {
+			return attrs, errShortPacket
+		}
+		b = b[8:]
+	}
+	if flags&sftpAttrPermissions != 0 {
+		if len(b) < 4 {
+			return attrs, errShortPacket
+		}
+		b = b[4:]
+	}
+	if flags&sftpAttrACModTime != 0 {
+		if len(b) < 8 {
+			return attrs, errShortPacket
+		}
+		attrs.mtime = binary.BigEndian.Uint32(b[4:])
+	}
+	return attrs, nil
+}
+
+var errShortPacket = errors.New("short SFTP packet")
+
+func readUint32(b []byte) (uint32, []byte, error) {
+	if len(b) < 4 {
+		return 0, nil, errShortPacket
+	}
+	return binary.BigEndian.Uint32(b), b[4:], nil
+}
+
+func readString(b []byte) ([]byte, []byte, error) {
+	n, b, err := readUint32(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if uint32(len(b)) < n {
+		return nil, nil, errShortPacket
+	}
+	return b[:n], b[n:], nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
@@ -0,0 +1,75 @@
+package schemes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ErrStalled indicates that a download received no data for longer than
+// the stall timeout
+var ErrStalled = errors.New("download stalled")
+
+// SetStallTimeout makes downloads fail with ErrStalled when no data arrives
+// for d while the body is read. Slow but steady downloads are not limited
+// in time. 0 disables the check.
+func (c *HTTPClient) SetStallTimeout(d time.Duration) {
+	c.stallTimeout = d
+}
+
+// watchRequest returns req with a context that watchBody can cancel, and
+// the function cancelling it. Without a stall timeout req is unchanged.
+func (c *HTTPClient) watchRequest(req *http.Request) (*http.Request, context.CancelFunc) {
+	if c.stallTimeout <= 0 {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	return req.WithContext(ctx), cancel
+}
+
+// watchBody returns body, ending its request with cancel when a read waits
+// longer than the stall timeout. Closing it calls cancel.
+func (c *HTTPClient) watchBody(body io.ReadCloser, cancel context.CancelFunc) io.ReadCloser {
+	if c.stallTimeout <= 0 {
+		return body
+	}
+	r := &stallReader{body: body, timeout: c.stallTimeout, cancel: cancel}
+	r.timer = time.AfterFunc(c.stallTimeout, func() {
+		r.stalled.Store(true)
+		cancel()
+	})
+	r.timer.Stop()
+	return r
+}
+
+// stallReader is a response body whose reads are limited to a timeout each.
+// Time spent writing the data elsewhere doesn't count.
+type stallReader struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	stalled atomic.Bool
+}
+
+// Read implements io.Reader
+func (r *stallReader) Read(p []byte) (int, error) {
+	r.timer.Reset(r.timeout)
+	n, err := r.body.Read(p)
+	r.timer.Stop()
+	if err != nil && r.stalled.Load() {
+		err = fmt.Errorf("%w: no data received for %s", ErrStalled, r.timeout)
+	}
+	return n, err
+}
+
+// Close implements io.Closer
+func (r *stallReader) Close() error {
+	r.timer.Stop()
+	r.cancel()
+	return r.body.Close()
+}
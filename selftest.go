@@ -0,0 +1,171 @@
+package cachedpath
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// defaultMinFreeSpace is the free space SelfTest requires by default
+const defaultMinFreeSpace = 100 << 20
+
+// SelfTestFailure is a check of SelfTest that failed
+type SelfTestFailure struct {
+	// Check names the check, such as "free space"
+	Check string
+
+	// Err is why it failed
+	Err error
+}
+
+// SelfTestError reports every check of SelfTest that failed
+type SelfTestError struct {
+	// Failures holds the failed checks, in the order they ran
+	Failures []SelfTestFailure
+}
+
+// Error implements error
+func (e *SelfTestError) Error() string {
+	msgs := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		msgs[i] = fmt.Sprintf("%s: %v", f.Check, f.Err)
+	}
+	return fmt.Sprintf("self-test failed %d check(s): %s", len(e.Failures), strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the errors of the failed checks
+func (e *SelfTestError) Unwrap() []error {
+	errs := make([]error, len(e.Failures))
+	for i, f := range e.Failures {
+		errs[i] = f.Err
+	}
+	return errs
+}
+
+// SelfTest checks that the cache configured by opts can be used, so a long
+// job can fail before it starts. It checks that the cache directory can be
+// created and written, that file locks and renames work on its file system
+// (some network mounts support neither), and that it has at least
+// WithMinFreeSpace bytes free. With WithProbeURL it also fetches the
+// metadata of that URL through the configured client. Every check runs;
+// those that fail are reported together in a *SelfTestError.
+//
+// Caches kept off disk with WithCache only run the probe.
+func SelfTest(opts ...Option) error {
+	options := defaultOptions()
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	report := &SelfTestError{}
+	check := func(name string, err error) {
+		if err != nil {
+			report.Failures = append(report.Failures, SelfTestFailure{Check: name, Err: err})
+		}
+	}
+
+	if !options.virtual() {
+		dir := options.CacheDir
+		err := checkCacheDirWritable(dir, options)
+		check("cache directory", err)
+		if err == nil {
+			// The other checks need the directory
+			check("file locking", checkFileLock(dir))
+			check("rename", checkRename(dir))
+			check("free space", checkFreeSpace(dir, options.MinFreeSpace))
+		}
+	}
+
+	if options.ProbeURL != "" {
+		check("probe", checkProbe(options.ProbeURL, options))
+	}
+
+	if len(report.Failures) > 0 {
+		return report
+	}
+	return nil
+}
+
+// checkCacheDirWritable creates dir if needed and writes a file in it
+func checkCacheDirWritable(dir string, opts *Options) error {
+	if err := validateCacheDir(dir); err != nil {
+		return err
+	}
+	if err := opts.mkdirAll(dir); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, ".selftest-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write([]byte("cachedpath self-test\n"))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// checkFileLock takes and releases a file lock in dir, as downloads do
+func checkFileLock(dir string) error {
+	path := filepath.Join(dir, ".selftest.lock")
+	defer os.Remove(path)
+
+	lock := NewFileLock(path)
+	locked, err := lock.TryLock()
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return fmt.Errorf("%s is locked by another process", path)
+	}
+	return lock.Unlock()
+}
+
+// checkRename renames a temporary file in dir, as downloads do to publish
+// cached files
+func checkRename(dir string) error {
+	file, err := os.CreateTemp(dir, ".selftest-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	target := file.Name() + ".renamed"
+	if err := os.Rename(file.Name(), target); err != nil {
+		return err
+	}
+	return os.Remove(target)
+}
+
+// checkFreeSpace checks that the file system of dir has at least min bytes
+// available
+func checkFreeSpace(dir string, min int64) error {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return err
+	}
+	free := uint64(stat.Bavail) * uint64(stat.Bsize)
+	if free < uint64(min) {
+		return fmt.Errorf("%d bytes available in %s, need %d", free, dir, min)
+	}
+	return nil
+}
+
+// checkProbe fetches the metadata of probeURL with the configured client
+func checkProbe(probeURL string, opts *Options) error {
+	normalized, err := normalizeURL(probeURL)
+	if err != nil {
+		return err
+	}
+	client, err := remoteClient(normalized, opts)
+	if err != nil {
+		return err
+	}
+	_, err = getMetadata(client, normalized, opts.Headers)
+	return err
+}
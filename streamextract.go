@@ -0,0 +1,177 @@
+package cachedpath
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/CezarGarrido/cachedpath/schemes"
+)
+
+// isStreamableArchive reports whether the archive at url can be extracted
+// while it downloads. Zip archives can't: their central directory is at the end.
+func isStreamableArchive(url string) bool {
+	path := strings.ToLower(url)
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	return strings.HasSuffix(path, ".tar.gz") || strings.HasSuffix(path, ".tgz")
+}
+
+// streamExtract downloads a tar.gz archive and extracts it on the fly into a
+// temporary directory that is renamed into place once complete. Only the
+// extracted files and the metadata, marked ExtractedOnly, are cached.
+func streamExtract(client schemes.SchemeClient, url string, opts *Options) (*Result, error) {
+	info, err := getMetadata(client, url, opts.Headers)
+	if err != nil {
+		// If fails to get ETag, continue without it
+		info = schemes.ResourceInfo{}
+	}
+	etag := info.Version()
+
+	cachePath := filepath.Join(opts.CacheDir, cacheFilename(url, info, opts))
+	extractDir := extractedDirFor(opts.CacheDir, cachePath)
+	result := &Result{Path: extractDir, ExtractedDir: extractDir}
+
+	if !opts.ForceRefresh && !opts.ForceExtract {
+		if isExtractedOnly(opts, cachePath, etag) {
+			opts.Logger.Debugf("cache hit for %s (extracted): %s", url, extractDir)
+			if opts.MaxCacheSize > 0 {
+				touchMeta(cachePath, opts)
+			}
+			opts.cacheHit(url, extractDir)
+			if err := opts.afterDownload(url, extractDir, true); err != nil {
+				return nil, err
+			}
+			return result, nil
+		}
+
+		// An archive cached without streaming is extracted from disk
+		if isCached(opts, cachePath, etag) {
+			opts.cacheHit(url, cachePath)
+			if err := opts.afterDownload(url, cachePath, true); err != nil {
+				return nil, err
+			}
+			return resolveArchive(cachePath, "", false, opts)
+		}
+	}
+
+	if err := opts.mkdirAll(filepath.Dir(extractDir)); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	cached := true
+	err = opts.withLock(LockFilePath(cachePath), func() error {
+		// Another process may have extracted it while we waited for the lock
+		if !opts.ForceRefresh && !opts.ForceExtract && isExtractedOnly(opts, cachePath, etag) {
+			return nil
+		}
+		if err := downloadAndExtract(client, url, info.Size, extractDir, opts); err != nil {
+			return err
+		}
+		cached = false
+
+		// A previously cached archive of this version is superseded
+		opts.fs.Remove(cachePath)
+
+		meta := NewMeta(opts.cacheKey(url), cachePath, etag)
+		meta.Filename = info.Filename
+		meta.FinalURL = info.FinalURL
+		meta.ExtractedOnly = true
+		if err := meta.save(opts.fs, MetaFilePath(cachePath), opts.fileMode()); err != nil {
+			opts.Logger.Warnf("failed to save metadata: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.MaxCacheSize > 0 {
+		if _, err := lruEvict(opts.CacheDir, opts.MaxCacheSize, cachePath); err != nil {
+			opts.Logger.Warnf("failed to evict cache entries: %v", err)
+		}
+	}
+
+	if err := opts.afterDownload(url, extractDir, cached); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// downloadAndExtract streams the resource through the tar.gz extractor into
+// a temporary directory and moves it to extractDir
+func downloadAndExtract(client schemes.SchemeClient, url string, size int64, extractDir string, opts *Options) error {
+	if err := opts.checkSize(url, size); err != nil {
+		return err
+	}
+
+	body, info, err := openResource(client, url, opts.Headers)
+	if err != nil {
+		return downloadError(url, err)
+	}
+	defer body.Close()
+
+	if err := checkContentType(url, info.ContentType, opts); err != nil {
+		return err
+	}
+
+	tmpDir, err := os.MkdirTemp(filepath.Dir(extractDir), ".extract-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir) // Remove on error
+	opts.chmodDir(tmpDir)
+
+	progress := opts.Progress
+	if progress == nil {
+		progress = NewSimpleProgress(opts.Quiet)
+	}
+	start := opts.downloadStarted(url, size)
+	progress.Start(size, url)
+	defer progress.Finish()
+
+	written := NewProgressWriter(io.Discard, progress)
+	counter := opts.limitWriter(url, written)
+
+	if err := extractTarGzReader(io.TeeReader(body, counter), tmpDir, opts); err != nil {
+		return extractionError(url, "", err)
+	}
+	opts.shareTree(tmpDir)
+
+	if err := os.RemoveAll(extractDir); err != nil {
+		return fmt.Errorf("failed to replace extracted files: %w", err)
+	}
+	if err := os.Rename(tmpDir, extractDir); err != nil {
+		return fmt.Errorf("failed to move extracted files: %w", err)
+	}
+
+	opts.Logger.Infof("downloaded and extracted %s to %s", url, extractDir)
+	opts.downloadCompleted(url, extractDir, written.Written(), start)
+	return nil
+}
+
+// openResource starts downloading a resource and returns its body, with the
+// resource information when the client reports it
+func openResource(client schemes.SchemeClient, url string, headers map[string]string) (io.ReadCloser, schemes.ResourceInfo, error) {
+	if opener, ok := resourceOpener(client); ok {
+		return opener.OpenResource(url, headers)
+	}
+
+	// Closing the reader makes GetResource fail and return
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(client.GetResource(url, pw, headers))
+	}()
+	return pr, schemes.ResourceInfo{}, nil
+}
+
+// isExtractedOnly reports whether the given version of a resource is cached
+// as extracted files only
+func isExtractedOnly(opts *Options, cachePath, etag string) bool {
+	meta, err := loadMeta(opts.fs, MetaFilePath(cachePath))
+	return err == nil && meta.ExtractedOnly && meta.Version() == etag &&
+		fileExists(opts.fs, extractedDirFor(opts.CacheDir, cachePath))
+}
@@ -0,0 +1,1172 @@
+package tests
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ulikunitz/xz"
+
+	"github.com/CezarGarrido/cachedpath"
+)
+
+// tarEntry is an entry written by writeTarEntries
+type tarEntry struct {
+	header  tar.Header
+	content string
+}
+
+// writeTarGz creates a tar.gz file with the given regular file entries
+func writeTarGz(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+
+	var entries []tarEntry
+	for name, content := range files {
+		entries = append(entries, tarEntry{
+			header: tar.Header{
+				Name:     name,
+				Mode:     0644,
+				Size:     int64(len(content)),
+				Typeflag: tar.TypeReg,
+			},
+			content: content,
+		})
+	}
+	writeTarEntries(t, path, entries)
+}
+
+// writeTarEntries creates a tar.gz file with the given entries, in order
+func writeTarEntries(t *testing.T, path string, entries []tarEntry) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+
+	for _, entry := range entries {
+		header := entry.header
+		if err := tw.WriteHeader(&header); err != nil {
+			t.Fatalf("Failed to write tar header: %v", err)
+		}
+		if _, err := tw.Write([]byte(entry.content)); err != nil {
+			t.Fatalf("Failed to write tar content: %v", err)
+		}
+	}
+
+	tw.Close()
+	gzw.Close()
+
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write archive: %v", err)
+	}
+}
+
+// writeZip creates a zip file with the given file entries
+func writeZip(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("Failed to create zip entry: %v", err)
+		}
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatalf("Failed to write zip content: %v", err)
+		}
+	}
+
+	zw.Close()
+
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write archive: %v", err)
+	}
+}
+
+func TestExtractArchiveLimits(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	tarPath := filepath.Join(tmpDir, "bomb.tar.gz")
+	writeTarGz(t, tarPath, map[string]string{
+		"a.txt": strings.Repeat("a", 1024),
+		"b.txt": strings.Repeat("b", 1024),
+	})
+
+	zipPath := filepath.Join(tmpDir, "bomb.zip")
+	writeZip(t, zipPath, map[string]string{
+		"a.txt": strings.Repeat("a", 1024),
+		"b.txt": strings.Repeat("b", 1024),
+	})
+
+	tests := []struct {
+		name    string
+		archive string
+		opts    []cachedpath.Option
+		tooBig  bool
+	}{
+		{"tar no limits", tarPath, nil, false},
+		{"tar per-file limit", tarPath, []cachedpath.Option{cachedpath.WithMaxExtractFileSize(512)}, true},
+		{"tar total limit", tarPath, []cachedpath.Option{cachedpath.WithMaxExtractSize(1500)}, true},
+		{"tar file count", tarPath, []cachedpath.Option{cachedpath.WithMaxExtractFiles(1)}, true},
+		{"zip no limits", zipPath, nil, false},
+		{"zip per-file limit", zipPath, []cachedpath.Option{cachedpath.WithMaxExtractFileSize(512)}, true},
+		{"zip total limit", zipPath, []cachedpath.Option{cachedpath.WithMaxExtractSize(1500)}, true},
+		{"zip file count", zipPath, []cachedpath.Option{cachedpath.WithMaxExtractFiles(1)}, true},
+	}
+
+	for i, tt := range tests {
+		destDir := filepath.Join(tmpDir, "out", string(rune('a'+i)))
+		err := cachedpath.ExtractArchive(tt.archive, destDir, tt.opts...)
+		if tt.tooBig && !errors.Is(err, cachedpath.ErrArchiveTooLarge) {
+			t.Errorf("%s: expected ErrArchiveTooLarge, got %v", tt.name, err)
+		}
+		if !tt.tooBig && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+	}
+}
+
+func TestCachedPathExtractTooLarge(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	archivePath := filepath.Join(tmpDir, "data.tar.gz")
+	writeTarGz(t, archivePath, map[string]string{
+		"data.bin": strings.Repeat("x", 4096),
+	})
+
+	_, err := cachedpath.CachedPath(
+		archivePath,
+		cachedpath.WithCacheDir(filepath.Join(tmpDir, "cache")),
+		cachedpath.WithExtractArchive(true),
+		cachedpath.WithMaxExtractSize(1024),
+	)
+	if !errors.Is(err, cachedpath.ErrExtractionFailed) {
+		t.Errorf("Expected ErrExtractionFailed, got %v", err)
+	}
+	if !errors.Is(err, cachedpath.ErrArchiveTooLarge) {
+		t.Errorf("Expected ErrArchiveTooLarge, got %v", err)
+	}
+}
+
+func TestExtractTarSymlinks(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	archivePath := filepath.Join(tmpDir, "links.tar.gz")
+	writeTarEntries(t, archivePath, []tarEntry{
+		{header: tar.Header{Name: "lib/real.txt", Mode: 0644, Size: 4, Typeflag: tar.TypeReg}, content: "data"},
+		{header: tar.Header{Name: "lib/current.txt", Linkname: "real.txt", Typeflag: tar.TypeSymlink}},
+		{header: tar.Header{Name: "hard.txt", Linkname: "lib/real.txt", Typeflag: tar.TypeLink}},
+	})
+
+	destDir := filepath.Join(tmpDir, "out")
+	if err := cachedpath.ExtractArchive(archivePath, destDir); err != nil {
+		t.Fatalf("ExtractArchive failed: %v", err)
+	}
+
+	for _, name := range []string{"lib/current.txt", "hard.txt"} {
+		data, err := os.ReadFile(filepath.Join(destDir, name))
+		if err != nil || string(data) != "data" {
+			t.Errorf("Link %s not extracted correctly: %q, %v", name, data, err)
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(destDir, "lib/current.txt")); err != nil || link != "real.txt" {
+		t.Errorf("Expected symlink to real.txt, got %q, %v", link, err)
+	}
+
+	// Links are skipped when disallowed
+	skipDir := filepath.Join(tmpDir, "skip")
+	if err := cachedpath.ExtractArchive(archivePath, skipDir, cachedpath.WithDisallowSymlinks(true)); err != nil {
+		t.Fatalf("ExtractArchive failed: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(skipDir, "lib/current.txt")); !os.IsNotExist(err) {
+		t.Error("Symlink should have been skipped")
+	}
+}
+
+func TestExtractTarSymlinkEscape(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{"absolute", []tarEntry{
+			{header: tar.Header{Name: "evil", Linkname: "/etc/passwd", Typeflag: tar.TypeSymlink}},
+		}},
+		{"relative", []tarEntry{
+			{header: tar.Header{Name: "dir/evil", Linkname: "../../outside", Typeflag: tar.TypeSymlink}},
+		}},
+		{"chained", []tarEntry{
+			{header: tar.Header{Name: "a", Linkname: ".", Typeflag: tar.TypeSymlink}},
+			{header: tar.Header{Name: "a/a/a/evil", Linkname: "../../outside", Typeflag: tar.TypeSymlink}},
+		}},
+		{"hard link", []tarEntry{
+			{header: tar.Header{Name: "evil", Linkname: "../outside", Typeflag: tar.TypeLink}},
+		}},
+	}
+
+	for _, tt := range tests {
+		tmpDir := t.TempDir()
+		archivePath := filepath.Join(tmpDir, "evil.tar.gz")
+		writeTarEntries(t, archivePath, tt.entries)
+
+		if err := cachedpath.ExtractArchive(archivePath, filepath.Join(tmpDir, "out")); err == nil {
+			t.Errorf("%s: expected escaping link to be rejected", tt.name)
+		}
+	}
+}
+
+func TestExtractZipSymlinks(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	writeZipLinks := func(name string, links map[string]string) string {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		w, _ := zw.Create("lib/real.txt")
+		w.Write([]byte("data"))
+		for name, target := range links {
+			fh := &zip.FileHeader{Name: name}
+			fh.SetMode(os.ModeSymlink | 0777)
+			w, err := zw.CreateHeader(fh)
+			if err != nil {
+				t.Fatalf("Failed to create zip entry: %v", err)
+			}
+			w.Write([]byte(target))
+		}
+		zw.Close()
+		path := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	archive := writeZipLinks("links.zip", map[string]string{"lib/current.txt": "real.txt"})
+	destDir := filepath.Join(tmpDir, "out")
+	if err := cachedpath.ExtractArchive(archive, destDir); err != nil {
+		t.Fatalf("ExtractArchive failed: %v", err)
+	}
+	if link, err := os.Readlink(filepath.Join(destDir, "lib/current.txt")); err != nil || link != "real.txt" {
+		t.Errorf("Expected symlink to real.txt, got %q, %v", link, err)
+	}
+	if data, err := os.ReadFile(filepath.Join(destDir, "lib/current.txt")); err != nil || string(data) != "data" {
+		t.Errorf("Symlink not followed: %q, %v", data, err)
+	}
+
+	skipDir := filepath.Join(tmpDir, "skip")
+	if err := cachedpath.ExtractArchive(archive, skipDir, cachedpath.WithDisallowSymlinks(true)); err != nil {
+		t.Fatalf("ExtractArchive failed: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(skipDir, "lib/current.txt")); !os.IsNotExist(err) {
+		t.Error("Symlink should have been skipped")
+	}
+
+	escape := writeZipLinks("escape.zip", map[string]string{"lib/evil": "../../outside"})
+	if err := cachedpath.ExtractArchive(escape, filepath.Join(tmpDir, "escape")); err == nil {
+		t.Error("Expected escaping zip symlink to be rejected")
+	}
+}
+
+func TestAllowAbsoluteSymlinks(t *testing.T) {
+	tmpDir := t.TempDir()
+	outside := filepath.Join(tmpDir, "shared")
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	archivePath := filepath.Join(tmpDir, "links.tar.gz")
+	writeTarEntries(t, archivePath, []tarEntry{
+		{header: tar.Header{Name: "shared", Linkname: outside, Typeflag: tar.TypeSymlink}},
+	})
+
+	if err := cachedpath.ExtractArchive(archivePath, filepath.Join(tmpDir, "default")); err == nil {
+		t.Error("Absolute symlinks should be rejected by default")
+	}
+
+	destDir := filepath.Join(tmpDir, "out")
+	if err := cachedpath.ExtractArchive(archivePath, destDir, cachedpath.WithAllowAbsoluteSymlinks(true)); err != nil {
+		t.Fatalf("ExtractArchive failed: %v", err)
+	}
+	if link, err := os.Readlink(filepath.Join(destDir, "shared")); err != nil || link != outside {
+		t.Errorf("Expected symlink to %s, got %q, %v", outside, link, err)
+	}
+
+	// Later entries must not be written through the link
+	evilPath := filepath.Join(tmpDir, "evil.tar.gz")
+	writeTarEntries(t, evilPath, []tarEntry{
+		{header: tar.Header{Name: "shared", Linkname: outside, Typeflag: tar.TypeSymlink}},
+		{header: tar.Header{Name: "shared/planted.txt", Mode: 0644, Size: 4, Typeflag: tar.TypeReg}, content: "evil"},
+	})
+	if err := cachedpath.ExtractArchive(evilPath, filepath.Join(tmpDir, "evil"), cachedpath.WithAllowAbsoluteSymlinks(true)); err == nil {
+		t.Error("Expected a write through an absolute symlink to be rejected")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "planted.txt")); !os.IsNotExist(err) {
+		t.Error("File was written outside the destination")
+	}
+}
+
+func TestExtractPreservesModeAndTime(t *testing.T) {
+	tmpDir := t.TempDir()
+	modTime := time.Date(2020, 5, 17, 10, 30, 0, 0, time.UTC)
+
+	archivePath := filepath.Join(tmpDir, "bin.tar.gz")
+	writeTarEntries(t, archivePath, []tarEntry{
+		{header: tar.Header{Name: "bin/run.sh", Mode: 0700, Size: 9, ModTime: modTime, Typeflag: tar.TypeReg}, content: "#!/bin/sh"},
+	})
+
+	zipPath := filepath.Join(tmpDir, "bin.zip")
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	fh := &zip.FileHeader{Name: "bin/run.sh", Method: zip.Deflate, Modified: modTime}
+	fh.SetMode(0700)
+	w, err := zw.CreateHeader(fh)
+	if err != nil {
+		t.Fatalf("Failed to create zip entry: %v", err)
+	}
+	w.Write([]byte("#!/bin/sh"))
+	zw.Close()
+	if err := os.WriteFile(zipPath, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write archive: %v", err)
+	}
+
+	for _, archive := range []string{archivePath, zipPath} {
+		destDir := filepath.Join(tmpDir, "out-"+filepath.Ext(archive))
+		if err := cachedpath.ExtractArchive(archive, destDir); err != nil {
+			t.Fatalf("ExtractArchive(%s) failed: %v", archive, err)
+		}
+
+		info, err := os.Stat(filepath.Join(destDir, "bin/run.sh"))
+		if err != nil {
+			t.Fatalf("Extracted file missing: %v", err)
+		}
+		if info.Mode().Perm() != 0700 {
+			t.Errorf("%s: expected mode 0700, got %o", archive, info.Mode().Perm())
+		}
+		if !info.ModTime().Equal(modTime) {
+			t.Errorf("%s: expected mtime %v, got %v", archive, modTime, info.ModTime())
+		}
+	}
+}
+
+func TestPreservePermissions(t *testing.T) {
+	tmpDir := t.TempDir()
+	archivePath := filepath.Join(tmpDir, "venv.tar.gz")
+	writeTarEntries(t, archivePath, []tarEntry{
+		{header: tar.Header{Name: "venv/bin/", Mode: 0755, Uid: 1234, Gid: 5678, Typeflag: tar.TypeDir}},
+		{header: tar.Header{Name: "venv/bin/python", Mode: 0750, Size: 2, Uid: 1234, Gid: 5678, Typeflag: tar.TypeReg}, content: "py"},
+	})
+
+	umask := syscall.Umask(022)
+	defer syscall.Umask(umask)
+
+	tests := []struct {
+		preserve bool
+		mode     os.FileMode
+	}{
+		{true, 0750},
+		{false, 0644},
+	}
+	for _, tt := range tests {
+		destDir := filepath.Join(tmpDir, fmt.Sprintf("out-%v", tt.preserve))
+		if err := cachedpath.ExtractArchive(archivePath, destDir, cachedpath.WithPreservePermissions(tt.preserve)); err != nil {
+			t.Fatalf("ExtractArchive failed: %v", err)
+		}
+
+		info, err := os.Lstat(filepath.Join(destDir, "venv/bin/python"))
+		if err != nil {
+			t.Fatalf("Extracted file missing: %v", err)
+		}
+		if info.Mode().Perm() != tt.mode {
+			t.Errorf("preserve=%v: expected mode %o, got %o", tt.preserve, tt.mode, info.Mode().Perm())
+		}
+
+		// Only root can give files away
+		if os.Geteuid() != 0 {
+			continue
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		owned := stat.Uid == 1234 && stat.Gid == 5678
+		if owned != tt.preserve {
+			t.Errorf("preserve=%v: file owned by %d:%d", tt.preserve, stat.Uid, stat.Gid)
+		}
+	}
+}
+
+func TestCachedPathResultExtraction(t *testing.T) {
+	tmpDir := t.TempDir()
+	cacheDir := filepath.Join(tmpDir, "cache")
+
+	archivePath := filepath.Join(tmpDir, "data.tar.gz")
+	writeTarGz(t, archivePath, map[string]string{"data/file.txt": "content"})
+
+	result, err := cachedpath.CachedPathResult(
+		archivePath,
+		cachedpath.WithCacheDir(cacheDir),
+		cachedpath.WithExtractArchive(true),
+	)
+	if err != nil {
+		t.Fatalf("CachedPathResult failed: %v", err)
+	}
+	if result.ArchivePath != archivePath {
+		t.Errorf("Expected archive path %s, got %s", archivePath, result.ArchivePath)
+	}
+	if result.ExtractedDir == "" || result.Path != result.ExtractedDir {
+		t.Errorf("Expected Path to be the extraction dir, got %+v", result)
+	}
+	if !cachedpath.FileExists(filepath.Join(result.ExtractedDir, "data/file.txt")) {
+		t.Error("Extracted file missing")
+	}
+
+	// Specific file syntax reports the archive and extraction dir too
+	result, err = cachedpath.CachedPathResult(archivePath+"!data/file.txt", cachedpath.WithCacheDir(cacheDir))
+	if err != nil {
+		t.Fatalf("CachedPathResult with internal path failed: %v", err)
+	}
+	if result.ArchivePath != archivePath || result.ExtractedDir == "" {
+		t.Errorf("Expected archive path and extraction dir, got %+v", result)
+	}
+	if data, err := os.ReadFile(result.Path); err != nil || string(data) != "content" {
+		t.Errorf("Unexpected extracted content %q, %v", data, err)
+	}
+}
+
+func TestUnicodeFilenames(t *testing.T) {
+	// macOS archivers store names decomposed: "e" followed by a combining acute
+	const nfd, nfc = "data/cafe\u0301.txt", "data/caf\u00e9.txt"
+
+	for _, name := range []string{"macos.tar.gz", "macos.zip"} {
+		t.Run(name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			archivePath := filepath.Join(tmpDir, name)
+			if strings.HasSuffix(name, ".zip") {
+				writeZip(t, archivePath, map[string]string{nfd: "coffee"})
+			} else {
+				writeTarGz(t, archivePath, map[string]string{nfd: "coffee"})
+			}
+
+			// Full extraction writes the composed name
+			cacheDir := filepath.Join(tmpDir, "cache")
+			dir, err := cachedpath.CachedPath(archivePath, cachedpath.WithCacheDir(cacheDir), cachedpath.WithExtractArchive(true))
+			if err != nil {
+				t.Fatalf("Extraction failed: %v", err)
+			}
+			if data, err := os.ReadFile(filepath.Join(dir, nfc)); err != nil || string(data) != "coffee" {
+				t.Errorf("Expected the NFC name to be extracted, got %q, %v", data, err)
+			}
+
+			// Both forms find the member
+			for _, internal := range []string{nfc, nfd} {
+				path, err := cachedpath.CachedPath(archivePath+"!"+internal, cachedpath.WithCacheDir(cacheDir), cachedpath.WithForceExtract(true))
+				if err != nil {
+					t.Fatalf("Extracting %q failed: %v", internal, err)
+				}
+				if filepath.Base(path) != filepath.Base(nfc) {
+					t.Errorf("Expected the member under its NFC name, got %s", path)
+				}
+			}
+			if r, err := cachedpath.StreamFromArchive(archivePath, nfc); err != nil {
+				t.Errorf("StreamFromArchive failed: %v", err)
+			} else {
+				r.Close()
+			}
+
+			// Without normalization names are kept byte for byte
+			rawDir := filepath.Join(tmpDir, "raw")
+			raw := []cachedpath.Option{cachedpath.WithCacheDir(rawDir), cachedpath.WithNormalizeFilenames(false)}
+			dir, err = cachedpath.CachedPath(archivePath, append(raw, cachedpath.WithExtractArchive(true))...)
+			if err != nil {
+				t.Fatalf("Extraction failed: %v", err)
+			}
+			if !cachedpath.FileExists(filepath.Join(dir, nfd)) || cachedpath.FileExists(filepath.Join(dir, nfc)) {
+				t.Error("Expected the NFD name to be kept")
+			}
+			if _, err := cachedpath.CachedPath(archivePath+"!"+nfc, raw...); err == nil {
+				t.Error("Expected the NFC name not to match without normalization")
+			}
+		})
+	}
+}
+
+// lineArchive is a test archive format: a "LINES" header followed by
+// "name=content" lines
+type lineArchive struct{}
+
+func (lineArchive) members(archivePath string) (map[string]string, error) {
+	data, err := os.ReadFile(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	members := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimPrefix(string(data), "LINES\n"), "\n") {
+		if name, content, ok := strings.Cut(line, "="); ok {
+			members[name] = content
+		}
+	}
+	return members, nil
+}
+
+func (a lineArchive) ExtractAll(archivePath, destDir string) error {
+	members, err := a.members(archivePath)
+	if err != nil {
+		return err
+	}
+	for name, content := range members {
+		if err := os.WriteFile(filepath.Join(destDir, name), []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a lineArchive) ExtractFile(archivePath, internalPath, destDir string) (string, error) {
+	members, err := a.members(archivePath)
+	if err != nil {
+		return "", err
+	}
+	content, ok := members[internalPath]
+	if !ok {
+		return "", fmt.Errorf("no member %s", internalPath)
+	}
+	destPath := filepath.Join(destDir, internalPath)
+	return destPath, os.WriteFile(destPath, []byte(content), 0644)
+}
+
+func (a lineArchive) List(archivePath string) ([]string, error) {
+	members, err := a.members(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(members))
+	for name := range members {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func TestCustomArchiveFormat(t *testing.T) {
+	tmpDir := t.TempDir()
+	archivePath := filepath.Join(tmpDir, "bundle.lines")
+	if err := os.WriteFile(archivePath, []byte("LINES\na.txt=alpha\nb.txt=beta"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	plainPath := filepath.Join(tmpDir, "plain.lines")
+	if err := os.WriteFile(plainPath, []byte("not an archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if cachedpath.IsArchive(archivePath) {
+		t.Fatal("Unregistered format detected as archive")
+	}
+
+	cachedpath.RegisterArchiveFormat("lines", func(path string, header []byte) bool {
+		return strings.HasPrefix(string(header), "LINES\n")
+	}, lineArchive{})
+	defer cachedpath.UnregisterArchiveFormat("lines")
+
+	if !cachedpath.IsArchive(archivePath) {
+		t.Error("Registered format not detected")
+	}
+	if cachedpath.IsArchive(plainPath) {
+		t.Error("File without the header detected as archive")
+	}
+
+	cacheDir := filepath.Join(tmpDir, "cache")
+	dir, err := cachedpath.CachedPath(archivePath, cachedpath.WithCacheDir(cacheDir), cachedpath.WithExtractArchive(true))
+	if err != nil {
+		t.Fatalf("CachedPath extraction failed: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "b.txt")); err != nil || string(data) != "beta" {
+		t.Errorf("Unexpected extracted content %q, %v", data, err)
+	}
+
+	path, err := cachedpath.CachedPath(archivePath+"!a.txt", cachedpath.WithCacheDir(cacheDir), cachedpath.WithForceExtract(true))
+	if err != nil {
+		t.Fatalf("CachedPath member extraction failed: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "alpha" {
+		t.Errorf("Unexpected member content %q, %v", data, err)
+	}
+
+	cachedpath.UnregisterArchiveFormat("lines")
+	if cachedpath.IsArchive(archivePath) {
+		t.Error("Unregistered format still detected")
+	}
+}
+
+// tarBz2Member is a tar.bz2 archive holding dir/member.txt ("bzip2 member"),
+// since the standard library has no bzip2 writer
+const tarBz2Member = "QlpoOTFBWSZTWRfEotsAAHR7gMoAAQBAAfeAEAB2Il5QCAggAHUNUeKeoGjTID1NNqCSgIDRoABpTuwahB09CEObKI5rHoEMTCUC182IhFoCRgJFII0sFWZQRL1xQxFg8yHYdvRv5Q6WlV3rScskkH4u5IpwoSAviUW2"
+
+func TestStreamFromArchive(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{"dir/member.txt": "member content", "other.txt": "other"}
+
+	zipPath := filepath.Join(tmpDir, "data.zip")
+	writeZip(t, zipPath, files)
+
+	tarGzPath := filepath.Join(tmpDir, "data.tar.gz")
+	writeTarGz(t, tarGzPath, files)
+
+	tarBz2Path := filepath.Join(tmpDir, "data.tar.bz2")
+	bz2Data, err := base64.StdEncoding.DecodeString(tarBz2Member)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tarBz2Path, bz2Data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tarXzPath := filepath.Join(tmpDir, "data.tar.xz")
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	tw.WriteHeader(&tar.Header{Name: "dir/member.txt", Mode: 0644, Size: int64(len("xz member")), Typeflag: tar.TypeReg})
+	tw.Write([]byte("xz member"))
+	tw.Close()
+	var xzBuf bytes.Buffer
+	xw, err := xz.NewWriter(&xzBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xw.Write(tarBuf.Bytes())
+	xw.Close()
+	if err := os.WriteFile(tarXzPath, xzBuf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		archive string
+		want    string
+	}{
+		{zipPath, "member content"},
+		{tarGzPath, "member content"},
+		{tarBz2Path, "bzip2 member"},
+		{tarXzPath, "xz member"},
+	}
+
+	for _, tt := range tests {
+		t.Run(filepath.Base(tt.archive), func(t *testing.T) {
+			r, err := cachedpath.StreamFromArchive(tt.archive, "dir/member.txt")
+			if err != nil {
+				t.Fatalf("StreamFromArchive failed: %v", err)
+			}
+			data, err := io.ReadAll(r)
+			if err != nil || string(data) != tt.want {
+				t.Errorf("Expected %q, got %q, %v", tt.want, data, err)
+			}
+			if err := r.Close(); err != nil {
+				t.Errorf("Close failed: %v", err)
+			}
+
+			if _, err := cachedpath.StreamFromArchive(tt.archive, "missing.txt"); !errors.Is(err, cachedpath.ErrFileNotFound) {
+				t.Errorf("Expected ErrFileNotFound for a missing member, got %v", err)
+			}
+		})
+	}
+
+	// Nothing is extracted to disk
+	entries, _ := os.ReadDir(tmpDir)
+	if len(entries) != 4 {
+		t.Errorf("Expected only the 4 archives in %s, found %d entries", tmpDir, len(entries))
+	}
+}
+
+func TestStreamingExtract(t *testing.T) {
+	tmpDir := t.TempDir()
+	tarGzPath := filepath.Join(tmpDir, "data.tar.gz")
+	writeTarGz(t, tarGzPath, map[string]string{"dir/a.txt": "alpha", "b.txt": "beta"})
+	zipPath := filepath.Join(tmpDir, "data.zip")
+	writeZip(t, zipPath, map[string]string{"z.txt": "zeta"})
+
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			atomic.AddInt32(&gets, 1)
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeFile(w, r, filepath.Join(tmpDir, filepath.Base(r.URL.Path)))
+	}))
+	defer server.Close()
+
+	cacheDir := filepath.Join(tmpDir, "cache")
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(cacheDir),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithExtractArchive(true),
+		cachedpath.WithStreamingExtract(true),
+	}
+
+	dir1, err := cachedpath.CachedPath(server.URL+"/data.tar.gz", opts...)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	for name, want := range map[string]string{"dir/a.txt": "alpha", "b.txt": "beta"} {
+		if data, err := os.ReadFile(filepath.Join(dir1, name)); err != nil || string(data) != want {
+			t.Errorf("%s: got %q, %v; want %q", name, data, err, want)
+		}
+	}
+
+	// Only the metadata and the extracted files are cached, not the archive
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && !strings.HasSuffix(name, ".meta.json") && !strings.HasSuffix(name, ".lock") {
+			t.Errorf("Unexpected file in the cache: %s", name)
+		}
+	}
+
+	// Cache hits, online and offline, reuse the extracted files
+	dir2, err := cachedpath.CachedPath(server.URL+"/data.tar.gz", opts...)
+	if err != nil || dir2 != dir1 {
+		t.Errorf("Second CachedPath = %s, %v; want %s", dir2, err, dir1)
+	}
+	dir3, err := cachedpath.CachedPath(server.URL+"/data.tar.gz", append(opts, cachedpath.WithOfflineMode(true))...)
+	if err != nil || dir3 != dir1 {
+		t.Errorf("Offline CachedPath = %s, %v; want %s", dir3, err, dir1)
+	}
+	if n := atomic.LoadInt32(&gets); n != 1 {
+		t.Errorf("Expected 1 GET, got %d", n)
+	}
+
+	// Zip archives are downloaded first
+	zipDir, err := cachedpath.CachedPath(server.URL+"/data.zip", opts...)
+	if err != nil {
+		t.Fatalf("CachedPath for zip failed: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(zipDir, "z.txt")); err != nil || string(data) != "zeta" {
+		t.Errorf("z.txt: got %q, %v", data, err)
+	}
+	if result, err := cachedpath.CachedPathResult(server.URL+"/data.zip", opts...); err != nil || !cachedpath.FileExists(result.ArchivePath) {
+		t.Errorf("Expected the zip archive to be cached, got %+v, %v", result, err)
+	}
+}
+
+func TestContentDispositionFilename(t *testing.T) {
+	tmpDir := t.TempDir()
+	tarGzPath := filepath.Join(tmpDir, "model.tar.gz")
+	writeTarGz(t, tarGzPath, map[string]string{"weights.bin": "w"})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/download" {
+			w.Header().Set("Content-Disposition", `attachment; filename="../model.tar.gz"`)
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeFile(w, r, tarGzPath)
+	}))
+	defer server.Close()
+
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(filepath.Join(tmpDir, "cache")),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithExtractArchive(true),
+	}
+
+	// The extension comes from Content-Disposition when the URL has none,
+	// and compound extensions from the URL are kept whole
+	for _, url := range []string{server.URL + "/download?id=123", server.URL + "/files/model.tar.gz"} {
+		result, err := cachedpath.CachedPathResult(url, opts...)
+		if err != nil {
+			t.Fatalf("%s: CachedPathResult failed: %v", url, err)
+		}
+		if !strings.HasSuffix(result.ArchivePath, ".tar.gz") {
+			t.Errorf("%s: expected a .tar.gz cache file, got %s", url, result.ArchivePath)
+		}
+		if data, err := os.ReadFile(filepath.Join(result.Path, "weights.bin")); err != nil || string(data) != "w" {
+			t.Errorf("%s: expected the archive to be extracted, got %q, %v", url, data, err)
+		}
+	}
+
+	result, err := cachedpath.CachedPathResult(server.URL+"/download?id=123", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := cachedpath.LoadMetaFromFile(cachedpath.MetaFilePath(result.ArchivePath))
+	if err != nil || meta.Filename != "model.tar.gz" {
+		t.Errorf("Expected filename model.tar.gz in the metadata, got %+v, %v", meta, err)
+	}
+}
+
+func TestContentTypeExtension(t *testing.T) {
+	tmpDir := t.TempDir()
+	zipPath := filepath.Join(tmpDir, "bundle.zip")
+	writeZip(t, zipPath, map[string]string{"z.txt": "zeta"})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeFile(w, r, zipPath)
+	}))
+	defer server.Close()
+
+	// Without an extension or Content-Disposition, the media type decides
+	result, err := cachedpath.CachedPathResult(server.URL+"/api/v2/artifact",
+		cachedpath.WithCacheDir(filepath.Join(tmpDir, "cache")),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithExtractArchive(true),
+	)
+	if err != nil {
+		t.Fatalf("CachedPathResult failed: %v", err)
+	}
+	if !strings.HasSuffix(result.ArchivePath, ".zip") {
+		t.Errorf("Expected a .zip cache file, got %s", result.ArchivePath)
+	}
+	if data, err := os.ReadFile(filepath.Join(result.Path, "z.txt")); err != nil || string(data) != "zeta" {
+		t.Errorf("Expected the archive to be extracted, got %q, %v", data, err)
+	}
+}
+
+func TestEnsureDownloadedAndExtracted(t *testing.T) {
+	tmpDir := t.TempDir()
+	tarGzPath := filepath.Join(tmpDir, "data.tar.gz")
+	writeTarGz(t, tarGzPath, map[string]string{"dir/a.txt": "alpha"})
+
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			atomic.AddInt32(&gets, 1)
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeFile(w, r, tarGzPath)
+	}))
+	defer server.Close()
+
+	cacheDir := filepath.Join(tmpDir, "cache")
+	opts := []cachedpath.Option{cachedpath.WithCacheDir(cacheDir), cachedpath.WithQuiet(true)}
+	url := server.URL + "/data.tar.gz"
+
+	// Downloading never extracts, even when extraction is requested
+	archive, err := cachedpath.EnsureDownloaded(url, append(opts, cachedpath.WithExtractArchive(true))...)
+	if err != nil {
+		t.Fatalf("EnsureDownloaded failed: %v", err)
+	}
+	if !strings.HasSuffix(archive, ".tar.gz") || filepath.Dir(archive) != cacheDir {
+		t.Errorf("Unexpected archive path %s", archive)
+	}
+	wantDir, err := cachedpath.ExtractionDirFor(url, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cachedpath.FileExists(wantDir) {
+		t.Error("EnsureDownloaded should not extract")
+	}
+
+	dir, err := cachedpath.EnsureExtracted(archive, opts...)
+	if err != nil || dir != wantDir {
+		t.Fatalf("EnsureExtracted = %s, %v; want %s", dir, err, wantDir)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "dir", "a.txt")); err != nil || string(data) != "alpha" {
+		t.Errorf("Unexpected extracted content %q, %v", data, err)
+	}
+
+	// CachedPath composes the same steps and finds both done
+	if path, err := cachedpath.CachedPath(url, append(opts, cachedpath.WithExtractArchive(true), cachedpath.WithOfflineMode(true))...); err != nil || path != dir {
+		t.Errorf("CachedPath = %s, %v; want %s", path, err, dir)
+	}
+	if n := atomic.LoadInt32(&gets); n != 1 {
+		t.Errorf("Expected 1 GET, got %d", n)
+	}
+
+	// Any local archive can be extracted, once for concurrent callers
+	var wg sync.WaitGroup
+	dirs := make([]string, 8)
+	for i := range dirs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dirs[i], _ = cachedpath.EnsureExtracted(tarGzPath, opts...)
+		}(i)
+	}
+	wg.Wait()
+	for _, d := range dirs {
+		if data, err := os.ReadFile(filepath.Join(d, "dir", "a.txt")); err != nil || string(data) != "alpha" {
+			t.Errorf("Concurrent extraction to %q: %q, %v", d, data, err)
+		}
+	}
+
+	if _, err := cachedpath.EnsureExtracted(filepath.Join(tmpDir, "missing.zip"), opts...); !errors.Is(err, cachedpath.ErrFileNotFound) {
+		t.Errorf("Expected ErrFileNotFound, got %v", err)
+	}
+}
+
+func TestForceDownloadReextracts(t *testing.T) {
+	tmpDir := t.TempDir()
+	archive := filepath.Join(tmpDir, "served.tar.gz")
+	writeTarGz(t, archive, map[string]string{"model.txt": "corrupt"})
+
+	// The ETag stays the same while the archive is replaced
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeFile(w, r, archive)
+	}))
+	defer server.Close()
+
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(filepath.Join(tmpDir, "cache")),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithExtractArchive(true),
+	}
+	dir1, err := cachedpath.CachedPath(server.URL+"/model.tar.gz", opts...)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+
+	writeTarGz(t, archive, map[string]string{"model.txt": "fixed"})
+
+	dir2, err := cachedpath.CachedPath(server.URL+"/model.tar.gz", append(opts, cachedpath.WithForceDownload(true))...)
+	if err != nil {
+		t.Fatalf("Forced CachedPath failed: %v", err)
+	}
+	if dir1 != dir2 {
+		t.Errorf("Forced download should overwrite the cached version: %s vs %s", dir1, dir2)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir2, "model.txt")); err != nil || string(data) != "fixed" {
+		t.Errorf("Expected the archive to be extracted again, got %q, %v", data, err)
+	}
+}
+
+func TestProbingMissingMembers(t *testing.T) {
+	tmpDir := t.TempDir()
+	cacheDir := filepath.Join(tmpDir, "cache")
+	archivePath := filepath.Join(tmpDir, "model.tar.gz")
+	writeTarGz(t, archivePath, map[string]string{"weights.bin": "w"})
+	zipPath := filepath.Join(tmpDir, "model.zip")
+	writeZip(t, zipPath, map[string]string{"weights.bin": "w"})
+
+	countEntries := func() int {
+		n := 0
+		filepath.WalkDir(cacheDir, func(path string, d os.DirEntry, err error) error {
+			if err == nil {
+				n++
+			}
+			return nil
+		})
+		return n
+	}
+	opts := []cachedpath.Option{cachedpath.WithCacheDir(cacheDir), cachedpath.WithQuiet(true)}
+
+	before := countEntries()
+	for i := 0; i < 100; i++ {
+		for _, archive := range []string{archivePath, zipPath} {
+			if _, err := cachedpath.CachedPath(fmt.Sprintf("%s!candidate-%d.bin", archive, i), opts...); err == nil {
+				t.Fatal("Expected missing member to fail")
+			}
+		}
+	}
+	if after := countEntries(); after != before {
+		t.Errorf("Probing missing members changed the cache from %d to %d entries", before, after)
+	}
+
+	if _, err := cachedpath.CachedPath(archivePath+"!weights.bin", opts...); err != nil {
+		t.Fatalf("Extracting an existing member failed: %v", err)
+	}
+
+	// Eviction removes empty extraction directories left behind
+	stale := filepath.Join(cacheDir, "extracted", "stale.tar.gz")
+	if err := os.MkdirAll(stale, 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(stale, old, old)
+	if _, err := cachedpath.LRUEvict(cacheDir, 1<<30); err != nil {
+		t.Fatalf("LRUEvict failed: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("Empty extraction directory should be removed: %v", err)
+	}
+}
+
+func TestVerifyArchive(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := strings.Repeat("0123456789", 10000)
+
+	tarPath := filepath.Join(tmpDir, "data.tar.gz")
+	writeTarGz(t, tarPath, map[string]string{"a.txt": "first", "b.bin": content})
+	truncated := filepath.Join(tmpDir, "truncated.tar.gz")
+	data, _ := os.ReadFile(tarPath)
+	os.WriteFile(truncated, data[:len(data)/2], 0644)
+
+	// A stored member whose bytes no longer match its CRC-32
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.CreateHeader(&zip.FileHeader{Name: "b.bin", Method: zip.Store})
+	w.Write([]byte(content))
+	zw.Close()
+	zipData := bytes.Replace(buf.Bytes(), []byte("0123456789"), []byte("0123456780"), 1)
+	badZip := filepath.Join(tmpDir, "bad.zip")
+	os.WriteFile(badZip, zipData, 0644)
+
+	if err := cachedpath.VerifyArchive(tarPath); err != nil {
+		t.Errorf("Intact archive failed verification: %v", err)
+	}
+
+	for _, archive := range []string{truncated, badZip} {
+		if err := cachedpath.VerifyArchive(archive); !errors.Is(err, cachedpath.ErrArchiveCorrupted) {
+			t.Errorf("%s: expected ErrArchiveCorrupted, got %v", archive, err)
+		}
+
+		for _, verify := range []bool{true, false} {
+			destDir := filepath.Join(tmpDir, fmt.Sprintf("out-%s-%v", filepath.Base(archive), verify))
+			err := cachedpath.ExtractArchive(archive, destDir, cachedpath.WithVerifyBeforeExtract(verify))
+			if !errors.Is(err, cachedpath.ErrArchiveCorrupted) {
+				t.Errorf("%s (verify=%v): expected ErrArchiveCorrupted, got %v", archive, verify, err)
+			}
+			if _, err := os.Stat(destDir); !os.IsNotExist(err) {
+				t.Errorf("%s (verify=%v): partial extraction left behind", archive, verify)
+			}
+		}
+	}
+
+	// An existing destination is kept
+	existing := filepath.Join(tmpDir, "existing")
+	os.MkdirAll(existing, 0755)
+	cachedpath.ExtractArchive(truncated, existing)
+	if _, err := os.Stat(existing); err != nil {
+		t.Errorf("Existing destination should be kept: %v", err)
+	}
+}
+
+func TestWalkArchive(t *testing.T) {
+	tmpDir := t.TempDir()
+	files := map[string]string{"a.txt": "alpha", "b.txt": "beta", "c.txt": "gamma"}
+	tarPath := filepath.Join(tmpDir, "data.tar.gz")
+	writeTarGz(t, tarPath, files)
+	zipPath := filepath.Join(tmpDir, "data.zip")
+	writeZip(t, zipPath, files)
+
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			atomic.AddInt32(&downloads, 1)
+		}
+		http.ServeFile(w, r, tarPath)
+	}))
+	defer server.Close()
+
+	opts := []cachedpath.Option{cachedpath.WithCacheDir(filepath.Join(tmpDir, "cache")), cachedpath.WithQuiet(true)}
+
+	for _, archive := range []string{tarPath, zipPath, server.URL + "/data.tar.gz"} {
+		got := map[string]string{}
+		err := cachedpath.WalkArchive(archive, func(entry cachedpath.ArchiveEntry, open func() (io.ReadCloser, error)) error {
+			if entry.Name == "b.txt" {
+				return nil // skipped without reading
+			}
+			r, err := open()
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			if int64(len(data)) != entry.Size {
+				t.Errorf("%s: size %d, read %d bytes", entry.Name, entry.Size, len(data))
+			}
+			got[entry.Name] = string(data)
+			return nil
+		}, opts...)
+		if err != nil {
+			t.Fatalf("WalkArchive(%s) failed: %v", archive, err)
+		}
+		if len(got) != 2 || got["a.txt"] != "alpha" || got["c.txt"] != "gamma" {
+			t.Errorf("%s: unexpected contents %v", archive, got)
+		}
+	}
+	if n := atomic.LoadInt32(&downloads); n != 1 {
+		t.Errorf("Expected the remote archive to be downloaded once, got %d", n)
+	}
+
+	// fs.SkipAll stops the walk without an error
+	visited := 0
+	var keep func() (io.ReadCloser, error)
+	err := cachedpath.WalkArchive(tarPath, func(entry cachedpath.ArchiveEntry, open func() (io.ReadCloser, error)) error {
+		visited++
+		keep = open
+		return fs.SkipAll
+	})
+	if err != nil || visited != 1 {
+		t.Errorf("Expected the walk to stop after one entry, got %d entries, %v", visited, err)
+	}
+	if _, err := keep(); err == nil {
+		t.Error("Opening a tar entry after its callback should fail")
+	}
+
+	stop := errors.New("stop")
+	if err := cachedpath.WalkArchive(zipPath, func(cachedpath.ArchiveEntry, func() (io.ReadCloser, error)) error {
+		return stop
+	}); !errors.Is(err, stop) {
+		t.Errorf("Expected the callback error, got %v", err)
+	}
+}
+
+func TestLockfile(t *testing.T) {
+	srvDir := t.TempDir()
+	writeTarGz(t, filepath.Join(srvDir, "data.tar.gz"), map[string]string{"a.txt": "alpha", "b.txt": "beta"})
+	os.WriteFile(filepath.Join(srvDir, "plain.txt"), []byte("plain"), 0644)
+	server := httptest.NewServer(http.FileServer(http.Dir(srvDir)))
+	defer server.Close()
+
+	opts := []cachedpath.Option{cachedpath.WithCacheDir(t.TempDir()), cachedpath.WithQuiet(true)}
+	lockPath := filepath.Join(t.TempDir(), "artifacts.lock.json")
+
+	lock := &cachedpath.Lockfile{Artifacts: map[string]cachedpath.LockedArtifact{
+		"archive": {URL: server.URL + "/data.tar.gz", Extract: true},
+		"member":  {URL: server.URL + "/data.tar.gz", Path: "b.txt"},
+		"plain":   {URL: server.URL + "/plain.txt"},
+	}}
+	if err := cachedpath.WriteLockfile(lockPath, lock, opts...); err != nil {
+		t.Fatalf("WriteLockfile failed: %v", err)
+	}
+	data, err := os.ReadFile(lockPath)
+	if err != nil {
+		t.Fatalf("Failed to read lockfile: %v", err)
+	}
+	if !strings.Contains(string(data), sha256Hex("plain")) {
+		t.Errorf("Lockfile does not pin the digest of plain.txt:\n%s", data)
+	}
+
+	paths, err := cachedpath.FetchLockfile(lockPath, opts...)
+	if err != nil {
+		t.Fatalf("FetchLockfile failed: %v", err)
+	}
+	for file, want := range map[string]string{
+		filepath.Join(paths["archive"], "a.txt"): "alpha",
+		paths["member"]:                          "beta",
+		paths["plain"]:                           "plain",
+	} {
+		if got, err := os.ReadFile(file); err != nil || string(got) != want {
+			t.Errorf("Unexpected content of %s: %q, %v", file, got, err)
+		}
+	}
+
+	// Content that no longer matches the lockfile fails only that artifact
+	os.WriteFile(filepath.Join(srvDir, "plain.txt"), []byte("changed"), 0644)
+	paths, err = cachedpath.FetchLockfile(lockPath, append(opts, cachedpath.WithForceDownload(true))...)
+	if !errors.Is(err, cachedpath.ErrChecksumMismatch) {
+		t.Fatalf("Expected ErrChecksumMismatch, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "plain") {
+		t.Errorf("Error does not name the artifact: %v", err)
+	}
+	if _, ok := paths["plain"]; ok || paths["member"] == "" {
+		t.Errorf("Unexpected paths %v", paths)
+	}
+}
@@ -0,0 +1,69 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/CezarGarrido/cachedpath"
+)
+
+// BenchmarkConcurrentDownloads downloads 64 files of 4 MiB from separate
+// servers at once and reports the peak heap seen during the batch
+func BenchmarkConcurrentDownloads(b *testing.B) {
+	const downloads = 64
+	content := bytes.Repeat([]byte("x"), 4<<20)
+
+	urls := make([]string, downloads)
+	for i := range urls {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+			if r.Method == "GET" {
+				// Small writes so the client copies in many reads
+				for off := 0; off < len(content); off += 16 << 10 {
+					w.Write(content[off : off+16<<10])
+				}
+			}
+		}))
+		defer server.Close()
+		urls[i] = server.URL + fmt.Sprintf("/file%d.bin", i)
+	}
+
+	var peak atomic.Uint64
+	done := make(chan struct{})
+	go func() {
+		var stats runtime.MemStats
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+				runtime.ReadMemStats(&stats)
+				if stats.HeapAlloc > peak.Load() {
+					peak.Store(stats.HeapAlloc)
+				}
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := cachedpath.CachedPaths(urls,
+			cachedpath.WithCacheDir(b.TempDir()),
+			cachedpath.WithQuiet(true),
+			cachedpath.WithMaxConcurrency(downloads),
+		)
+		if err != nil {
+			b.Fatalf("CachedPaths failed: %v", err)
+		}
+	}
+	b.StopTimer()
+	close(done)
+
+	b.ReportMetric(float64(peak.Load())/(1<<20), "peak-heap-MiB")
+}
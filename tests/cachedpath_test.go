@@ -1,9 +1,14 @@
 package tests
 
 import (
+	"errors"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -21,6 +26,10 @@ func TestIsURL(t *testing.T) {
 		{"/local/path/file.txt", false},
 		{"./relative/path", false},
 		{"file.txt", false},
+		{"https://example.com/file name.txt", false},
+		{"https://example.com/file%20name.txt", true},
+		{"https://example.com/file.txt\n", false},
+		{"https://example.com/\tfile.txt", false},
 	}
 
 	for _, tt := range tests {
@@ -31,6 +40,83 @@ func TestIsURL(t *testing.T) {
 	}
 }
 
+func TestURLWhitespace(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			paths = append(paths, r.URL.EscapedPath())
+		}
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	opts := []cachedpath.Option{cachedpath.WithCacheDir(t.TempDir()), cachedpath.WithQuiet(true)}
+	want, err := cachedpath.CachedPath(server.URL+"/file%20name.txt", opts...)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		valid bool
+	}{
+		{"already encoded", server.URL + "/file%20name.txt", true},
+		{"space", server.URL + "/file name.txt", true},
+		{"trailing newline", server.URL + "/file name.txt\n", true},
+		{"surrounding whitespace", " \t" + server.URL + "/file%20name.txt \r\n", true},
+		{"tab", server.URL + "/file\tname.txt", false},
+		{"newline", server.URL + "/file\nname.txt", false},
+		{"nul", server.URL + "/file\x00name.txt", false},
+	}
+	for _, tt := range tests {
+		paths = nil
+		path, err := cachedpath.CachedPath(tt.input, append(opts, cachedpath.WithForceDownload(true))...)
+		if !tt.valid {
+			if !errors.Is(err, cachedpath.ErrInvalidURL) {
+				t.Errorf("%s: expected ErrInvalidURL, got %v", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: CachedPath failed: %v", tt.name, err)
+			continue
+		}
+		if path != want {
+			t.Errorf("%s: expected cache path %s, got %s", tt.name, want, path)
+		}
+		if len(paths) != 1 || paths[0] != "/file%20name.txt" {
+			t.Errorf("%s: unexpected requests %v", tt.name, paths)
+		}
+	}
+}
+
+func TestRegisterScheme(t *testing.T) {
+	cachedpath.RegisterScheme(memClient{})
+	defer cachedpath.UnregisterScheme("mem")
+
+	supported := strings.Join(cachedpath.SupportedSchemes(), " ")
+	for _, scheme := range []string{"data", "file", "http", "https", "mem"} {
+		if !strings.Contains(" "+supported+" ", " "+scheme+" ") {
+			t.Errorf("%s missing from supported schemes: %s", scheme, supported)
+		}
+	}
+
+	opts := []cachedpath.Option{cachedpath.WithCacheDir(t.TempDir()), cachedpath.WithQuiet(true)}
+	path, err := cachedpath.CachedPath("mem://bucket/file.txt", opts...)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "in memory" {
+		t.Errorf("Unexpected content %q, %v", data, err)
+	}
+
+	cachedpath.UnregisterScheme("mem")
+	if _, err := cachedpath.CachedPath("mem://bucket/other.txt", opts...); !errors.Is(err, cachedpath.ErrUnsupportedScheme) {
+		t.Errorf("Expected ErrUnsupportedScheme after unregistering, got %v", err)
+	}
+}
+
 func TestGetScheme(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -362,3 +448,260 @@ func TestMultipleOptions(t *testing.T) {
 		t.Errorf("CachedPath returned wrong path: %s", path)
 	}
 }
+
+func TestCachedReader(t *testing.T) {
+	tmpDir := t.TempDir()
+	localFile := filepath.Join(tmpDir, "local.txt")
+	if err := os.WriteFile(localFile, []byte("local content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archivePath := filepath.Join(tmpDir, "data.tar.gz")
+	writeTarGz(t, archivePath, map[string]string{"dir/member.txt": "member content"})
+
+	cacheDir := filepath.Join(tmpDir, "cache")
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"local file", localFile, "local content"},
+		{"archive member", archivePath + "!dir/member.txt", "member content"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := cachedpath.CachedReader(tt.path, cachedpath.WithCacheDir(cacheDir))
+			if err != nil {
+				t.Fatalf("CachedReader failed: %v", err)
+			}
+			defer r.Close()
+
+			data, err := io.ReadAll(r)
+			if err != nil || string(data) != tt.want {
+				t.Errorf("Expected %q, got %q, %v", tt.want, data, err)
+			}
+		})
+	}
+
+	// An extracted archive is a directory, not a stream
+	if _, err := cachedpath.CachedReader(archivePath, cachedpath.WithCacheDir(cacheDir), cachedpath.WithExtractArchive(true)); err == nil {
+		t.Error("Expected an error for an extracted directory")
+	}
+}
+
+func TestFileURL(t *testing.T) {
+	tmpDir := t.TempDir()
+	localFile := filepath.Join(tmpDir, "my data%.txt")
+	if err := os.WriteFile(localFile, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archivePath := filepath.Join(tmpDir, "data.tar.gz")
+	writeTarGz(t, archivePath, map[string]string{"member.txt": "member"})
+
+	escaped := (&url.URL{Path: filepath.ToSlash(localFile)}).EscapedPath()
+	cacheDir := filepath.Join(tmpDir, "cache")
+
+	for _, u := range []string{"file://" + escaped, "file://localhost" + escaped} {
+		path, err := cachedpath.CachedPath(u, cachedpath.WithCacheDir(cacheDir))
+		if err != nil {
+			t.Fatalf("CachedPath(%s) failed: %v", u, err)
+		}
+		if path != localFile {
+			t.Errorf("CachedPath(%s) = %s, want %s", u, path, localFile)
+		}
+	}
+
+	path, err := cachedpath.CachedPath("file://"+filepath.ToSlash(archivePath)+"!member.txt", cachedpath.WithCacheDir(cacheDir))
+	if err != nil {
+		t.Fatalf("CachedPath with archive member failed: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "member" {
+		t.Errorf("Unexpected member content %q, %v", data, err)
+	}
+
+	if _, err := cachedpath.CachedPath("file://fileserver/share/data.txt", cachedpath.WithCacheDir(cacheDir)); !errors.Is(err, cachedpath.ErrInvalidURL) {
+		t.Errorf("Expected ErrInvalidURL for a remote file host, got %v", err)
+	}
+	if _, err := cachedpath.CachedPath("file:///does/not/exist", cachedpath.WithCacheDir(cacheDir)); !errors.Is(err, cachedpath.ErrFileNotFound) {
+		t.Errorf("Expected ErrFileNotFound, got %v", err)
+	}
+}
+
+func TestInvalidCacheDir(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	regularFile := filepath.Join(tmpDir, "file")
+	if err := os.WriteFile(regularFile, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dangling := filepath.Join(tmpDir, "dangling")
+	if err := os.Symlink(filepath.Join(tmpDir, "missing"), dangling); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		cacheDir string
+		want     string
+	}{
+		{"regular file", regularFile, "regular file"},
+		{"parent is a file", filepath.Join(regularFile, "cache"), "regular file"},
+		{"dangling symlink", dangling, "dangling symlink"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := cachedpath.CachedPath(server.URL+"/file.txt", cachedpath.WithCacheDir(tt.cacheDir), cachedpath.WithQuiet(true))
+			if !errors.Is(err, cachedpath.ErrInvalidCacheDir) {
+				t.Fatalf("Expected ErrInvalidCacheDir, got %v", err)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Error %q does not mention %q", err, tt.want)
+			}
+		})
+	}
+
+	// The error names the environment variable the directory came from
+	t.Setenv("CACHED_PATH_CACHE_ROOT", regularFile)
+	_, err := cachedpath.CachedPath(server.URL+"/file.txt", cachedpath.WithQuiet(true))
+	if !errors.Is(err, cachedpath.ErrInvalidCacheDir) || !strings.Contains(err.Error(), "CACHED_PATH_CACHE_ROOT") {
+		t.Errorf("Expected ErrInvalidCacheDir naming CACHED_PATH_CACHE_ROOT, got %v", err)
+	}
+}
+
+func TestDataURI(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"data:text/plain;base64,aGVsbG8gd29ybGQ=", "hello world"},
+		{"data:;base64,aGVsbG8gd29ybGQ", "hello world"},
+		{"data:,hello%20world%21", "hello world!"},
+		{"data:text/plain;charset=utf-8,a!b", "a!b"},
+	}
+
+	for _, tt := range tests {
+		path, err := cachedpath.CachedPath(tt.uri, cachedpath.WithCacheDir(cacheDir))
+		if err != nil {
+			t.Fatalf("CachedPath(%s) failed: %v", tt.uri, err)
+		}
+		if filepath.Dir(path) != cacheDir {
+			t.Errorf("CachedPath(%s) = %s, want a file in %s", tt.uri, path, cacheDir)
+		}
+		if data, err := os.ReadFile(path); err != nil || string(data) != tt.want {
+			t.Errorf("CachedPath(%s) content = %q, %v; want %q", tt.uri, data, err, tt.want)
+		}
+
+		again, err := cachedpath.CachedPath(tt.uri, cachedpath.WithCacheDir(cacheDir))
+		if err != nil || again != path {
+			t.Errorf("Second CachedPath(%s) = %s, %v; want %s", tt.uri, again, err, path)
+		}
+	}
+
+	for _, uri := range []string{"data:text/plain", "data:;base64,***"} {
+		if _, err := cachedpath.CachedPath(uri, cachedpath.WithCacheDir(cacheDir)); !errors.Is(err, cachedpath.ErrInvalidURL) {
+			t.Errorf("CachedPath(%s): expected ErrInvalidURL, got %v", uri, err)
+		}
+	}
+}
+
+func TestExtractionDirFor(t *testing.T) {
+	tmpDir := t.TempDir()
+	tarGzPath := filepath.Join(tmpDir, "data.tar.gz")
+	writeTarGz(t, tarGzPath, map[string]string{"dir/a.txt": "alpha"})
+	zipPath := filepath.Join(tmpDir, "data.zip")
+	writeZip(t, zipPath, map[string]string{"z.txt": "zeta"})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeFile(w, r, filepath.Join(tmpDir, filepath.Base(r.URL.Path)))
+	}))
+	defer server.Close()
+
+	cacheDir := filepath.Join(tmpDir, "cache")
+	base := []cachedpath.Option{cachedpath.WithCacheDir(cacheDir), cachedpath.WithQuiet(true), cachedpath.WithExtractArchive(true)}
+	streaming := append(base[:len(base):len(base)], cachedpath.WithStreamingExtract(true))
+
+	tests := []struct {
+		input string
+		opts  []cachedpath.Option
+	}{
+		{tarGzPath, base},
+		{"file://" + filepath.ToSlash(zipPath), base},
+		{tarGzPath + "!dir/a.txt", base},
+		{server.URL + "/data.zip", base},
+		{server.URL + "/data.zip!z.txt", base},
+		{server.URL + "/data.tar.gz", streaming},
+	}
+
+	for _, tt := range tests {
+		result, err := cachedpath.CachedPathResult(tt.input, tt.opts...)
+		if err != nil {
+			t.Fatalf("CachedPathResult(%s) failed: %v", tt.input, err)
+		}
+		dir, err := cachedpath.ExtractionDirFor(tt.input, tt.opts...)
+		if err != nil {
+			t.Fatalf("ExtractionDirFor(%s) failed: %v", tt.input, err)
+		}
+		if dir != result.ExtractedDir {
+			t.Errorf("ExtractionDirFor(%s) = %s, CachedPath extracted into %s", tt.input, dir, result.ExtractedDir)
+		}
+	}
+
+	if _, err := cachedpath.ExtractionDirFor(server.URL+"/missing.zip", base...); !errors.Is(err, cachedpath.ErrFileNotFound) {
+		t.Errorf("Expected ErrFileNotFound for an uncached URL, got %v", err)
+	}
+}
+
+func TestFilenameStrategy(t *testing.T) {
+	etag := `"v1"`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		w.Write([]byte("content " + etag))
+	}))
+	defer server.Close()
+
+	cacheDir := t.TempDir()
+	readable := func(rawURL, etag string) string {
+		u, _ := url.Parse(rawURL)
+		return strings.TrimSuffix(filepath.Base(u.Path), ".txt") + "@" + strings.Trim(etag, `"`) + ".txt"
+	}
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(cacheDir),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithFilenameStrategy(readable),
+	}
+
+	path, err := cachedpath.CachedPath(server.URL+"/data.txt", opts...)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	if want := filepath.Join(cacheDir, "data@v1.txt"); path != want {
+		t.Errorf("Expected %s, got %s", want, path)
+	}
+
+	// Custom names are found without a request in offline mode
+	offline, err := cachedpath.CachedPath(server.URL+"/data.txt", append(opts, cachedpath.WithOfflineMode(true))...)
+	if err != nil || offline != path {
+		t.Errorf("Offline CachedPath = %s, %v; want %s", offline, err, path)
+	}
+
+	etag = `"v2"`
+	if path, err := cachedpath.CachedPath(server.URL+"/data.txt", opts...); err != nil || filepath.Base(path) != "data@v2.txt" {
+		t.Errorf("Expected a new file for the new version, got %s, %v", path, err)
+	}
+
+	// Names that are paths fall back to the default naming
+	path, err = cachedpath.CachedPath(server.URL+"/other.txt", append(opts, cachedpath.WithFilenameStrategy(func(u, e string) string {
+		return "../escape.txt"
+	}))...)
+	if err != nil || filepath.Dir(path) != cacheDir || strings.Contains(path, "escape") {
+		t.Errorf("Expected a default name inside the cache, got %s, %v", path, err)
+	}
+}
@@ -0,0 +1,439 @@
+package tests
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/CezarGarrido/cachedpath"
+)
+
+func TestMaxCacheSizeEvictsLRU(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"`+r.URL.Path+`"`)
+		w.Write([]byte(strings.Repeat("x", 1000)))
+	}))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(tmpDir),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithMaxCacheSize(3000),
+	}
+
+	get := func(name string) string {
+		path, err := cachedpath.CachedPath(server.URL+"/"+name, opts...)
+		if err != nil {
+			t.Fatalf("CachedPath(%s) failed: %v", name, err)
+		}
+		return path
+	}
+
+	pathA := get("a.bin")
+	pathB := get("b.bin")
+
+	// Touch a so that b becomes the least recently used entry
+	get("a.bin")
+	pathC := get("c.bin")
+
+	if !cachedpath.FileExists(pathA) {
+		t.Error("Recently used entry a was evicted")
+	}
+	if cachedpath.FileExists(pathB) || cachedpath.FileExists(cachedpath.MetaFilePath(pathB)) {
+		t.Error("Least recently used entry b was not evicted")
+	}
+	if !cachedpath.FileExists(pathC) {
+		t.Error("New entry c was evicted")
+	}
+}
+
+func TestMaxCacheSizeWithoutDigest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"`+r.URL.Path+`"`)
+		w.Write([]byte(strings.Repeat("x", 1000)))
+	}))
+	defer server.Close()
+
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithMaxCacheSize(2500),
+		cachedpath.WithContentDigest(false),
+	}
+
+	var paths []string
+	for _, name := range []string{"a.bin", "b.bin", "c.bin", "d.bin"} {
+		path, err := cachedpath.CachedPath(server.URL+"/"+name, opts...)
+		if err != nil {
+			t.Fatalf("CachedPath(%s) failed: %v", name, err)
+		}
+		paths = append(paths, path)
+	}
+
+	for _, path := range paths[:2] {
+		if cachedpath.FileExists(path) {
+			t.Errorf("Old entry %s was not evicted", filepath.Base(path))
+		}
+	}
+	for _, path := range paths[2:] {
+		if !cachedpath.FileExists(path) {
+			t.Errorf("Recent entry %s was evicted", filepath.Base(path))
+		}
+	}
+}
+
+func TestMemoryCacheForgetsEvicted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"`+r.URL.Path+`"`)
+		w.Write([]byte(strings.Repeat("x", 1000)))
+	}))
+	defer server.Close()
+
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithMemoryCache(8),
+		cachedpath.WithMaxCacheSize(2500),
+	}
+	get := func(name string) string {
+		path, err := cachedpath.CachedPath(server.URL+"/"+name, opts...)
+		if err != nil {
+			t.Fatalf("CachedPath(%s) failed: %v", name, err)
+		}
+		return path
+	}
+
+	pathA := get("a.bin")
+	get("b.bin")
+	get("c.bin")
+	if cachedpath.FileExists(pathA) {
+		t.Fatal("Expected a to be evicted")
+	}
+
+	// The evicted entry is downloaded again instead of served from memory
+	if path := get("a.bin"); !cachedpath.FileExists(path) {
+		t.Errorf("CachedPath returned the evicted path %s", path)
+	}
+}
+
+func TestLRUEvict(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	var paths []string
+	for _, name := range []string{"a.txt", "b.txt"} {
+		path, err := cachedpath.CachedPath(server.URL+"/"+name, cachedpath.WithCacheDir(tmpDir), cachedpath.WithQuiet(true))
+		if err != nil {
+			t.Fatalf("CachedPath failed: %v", err)
+		}
+		paths = append(paths, path)
+	}
+
+	evicted, err := cachedpath.LRUEvict(tmpDir, 0)
+	if err != nil {
+		t.Fatalf("LRUEvict failed: %v", err)
+	}
+	if evicted != 2 {
+		t.Errorf("Expected 2 evicted entries, got %d", evicted)
+	}
+	for _, path := range paths {
+		if cachedpath.FileExists(path) {
+			t.Errorf("Entry not evicted: %s", path)
+		}
+	}
+}
+
+func TestCacheHitTouchesMeta(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	url := server.URL + "/file.txt"
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(tmpDir),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithMaxCacheSize(1 << 20),
+	}
+
+	path, err := cachedpath.CachedPath(url, opts...)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	before, err := cachedpath.LoadMetaFromFile(cachedpath.MetaFilePath(path))
+	if err != nil {
+		t.Fatalf("Failed to load metadata: %v", err)
+	}
+
+	for _, extra := range []cachedpath.Option{cachedpath.WithOfflineMode(false), cachedpath.WithOfflineMode(true)} {
+		time.Sleep(10 * time.Millisecond)
+		if _, err := cachedpath.CachedPath(url, append(opts, extra)...); err != nil {
+			t.Fatalf("CachedPath hit failed: %v", err)
+		}
+
+		after, err := cachedpath.LoadMetaFromFile(cachedpath.MetaFilePath(path))
+		if err != nil {
+			t.Fatalf("Failed to load metadata: %v", err)
+		}
+		if !after.LastAccessedAt.After(before.LastAccessedAt) {
+			t.Errorf("LastAccessedAt not updated on hit: %v -> %v", before.LastAccessedAt, after.LastAccessedAt)
+		}
+		if !after.CreatedAt.Equal(before.CreatedAt) {
+			t.Errorf("CreatedAt changed on hit: %v -> %v", before.CreatedAt, after.CreatedAt)
+		}
+		before = after
+	}
+}
+
+func TestCorruptMetaIsDiscarded(t *testing.T) {
+	var version atomic.Value
+	version.Store(`"v1"`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", version.Load().(string))
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	opts := []cachedpath.Option{cachedpath.WithCacheDir(t.TempDir()), cachedpath.WithQuiet(true)}
+	oldPath, err := cachedpath.CachedPath(server.URL+"/file.txt", opts...)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	oldMeta := cachedpath.MetaFilePath(oldPath)
+	os.WriteFile(oldMeta, []byte(`{"url": "trunc`), 0644)
+
+	_, err = cachedpath.LoadMetaFromFile(oldMeta)
+	if !errors.Is(err, cachedpath.ErrCorruptMetadata) {
+		t.Fatalf("Expected ErrCorruptMetadata, got %v", err)
+	}
+
+	// A new version is downloaded and the broken metadata of the old one removed
+	version.Store(`"v2"`)
+	newPath, err := cachedpath.CachedPath(server.URL+"/file.txt", opts...)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	if newPath == oldPath {
+		t.Fatalf("Expected a new cache entry for the new version")
+	}
+	if cachedpath.FileExists(oldMeta) {
+		t.Errorf("Corrupt metadata was not removed")
+	}
+	if _, err := cachedpath.LoadMetaFromFile(cachedpath.MetaFilePath(newPath)); err != nil {
+		t.Errorf("New metadata can't be loaded: %v", err)
+	}
+
+	// The same version is downloaded again and its metadata rewritten
+	os.WriteFile(cachedpath.MetaFilePath(newPath), []byte("not json"), 0644)
+	if _, err := cachedpath.CachedPath(server.URL+"/file.txt", opts...); err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	if _, err := cachedpath.LoadMetaFromFile(cachedpath.MetaFilePath(newPath)); err != nil {
+		t.Errorf("Metadata was not rewritten: %v", err)
+	}
+}
+
+func TestRepairCache(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"`+r.URL.Path+`"`)
+		w.Write([]byte("content of " + r.URL.Path))
+	}))
+	defer server.Close()
+
+	cacheDir := t.TempDir()
+	opts := []cachedpath.Option{cachedpath.WithCacheDir(cacheDir), cachedpath.WithQuiet(true)}
+	get := func(path string) string {
+		p, err := cachedpath.CachedPath(path, opts...)
+		if err != nil {
+			t.Fatalf("CachedPath(%s) failed: %v", path, err)
+		}
+		return p
+	}
+
+	healthy := get(server.URL + "/healthy.txt")
+	corrupt := get(server.URL + "/corrupt.txt")
+	noData := get(server.URL + "/nodata.txt")
+	noMeta := get(server.URL + "/nometa.txt")
+	dataURI := get("data:text/plain,hello")
+
+	os.WriteFile(cachedpath.MetaFilePath(corrupt), []byte("{"), 0644)
+	os.Remove(noData)
+	os.Remove(cachedpath.MetaFilePath(noMeta))
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(noMeta, old, old)
+
+	// A fresh file without metadata may be a download in progress
+	fresh := filepath.Join(cacheDir, "fresh.txt")
+	os.WriteFile(fresh, []byte("fresh"), 0644)
+
+	report, err := cachedpath.RepairCache(cacheDir)
+	if err != nil {
+		t.Fatalf("RepairCache failed: %v", err)
+	}
+
+	check := func(kind string, got []string, want string) {
+		if len(got) != 1 || got[0] != want {
+			t.Errorf("Expected %s %v, got %v", kind, []string{want}, got)
+		}
+	}
+	check("corrupt metadata", report.CorruptMeta, cachedpath.MetaFilePath(corrupt))
+	check("orphaned metadata", report.OrphanedMeta, cachedpath.MetaFilePath(noData))
+	check("orphaned data", report.OrphanedData, noMeta)
+
+	for _, path := range []string{corrupt, cachedpath.MetaFilePath(corrupt), cachedpath.MetaFilePath(noData), noMeta} {
+		if cachedpath.FileExists(path) {
+			t.Errorf("Not removed: %s", path)
+		}
+	}
+	for _, path := range []string{healthy, cachedpath.MetaFilePath(healthy), dataURI, fresh} {
+		if !cachedpath.FileExists(path) {
+			t.Errorf("Removed: %s", path)
+		}
+	}
+}
+
+func TestMaxCacheAge(t *testing.T) {
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := `"` + r.URL.Path + `"`
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if r.Method == "GET" {
+			atomic.AddInt32(&downloads, 1)
+		}
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	cacheDir := t.TempDir()
+	opts := []cachedpath.Option{cachedpath.WithCacheDir(cacheDir), cachedpath.WithQuiet(true)}
+	get := func(name string, extra ...cachedpath.Option) string {
+		path, err := cachedpath.CachedPath(server.URL+"/"+name, append(opts, extra...)...)
+		if err != nil {
+			t.Fatalf("CachedPath(%s) failed: %v", name, err)
+		}
+		return path
+	}
+	age := func(path string, d time.Duration) {
+		meta, err := cachedpath.LoadMetaFromFile(cachedpath.MetaFilePath(path))
+		if err != nil {
+			t.Fatalf("Failed to load metadata: %v", err)
+		}
+		meta.CreatedAt = time.Now().Add(-d)
+		meta.LastAccessedAt = time.Now()
+		if err := meta.SaveToFile(cachedpath.MetaFilePath(path)); err != nil {
+			t.Fatalf("Failed to save metadata: %v", err)
+		}
+	}
+
+	oldPath, newPath := get("old.txt"), get("new.txt")
+	age(oldPath, 2*time.Hour)
+
+	// The option evicts the old entry, which is then downloaded again
+	atomic.StoreInt32(&downloads, 0)
+	get("new.txt", cachedpath.WithMaxCacheAge(time.Hour))
+	if cachedpath.FileExists(oldPath) || cachedpath.FileExists(cachedpath.LockFilePath(oldPath)) {
+		t.Errorf("Old entry was not evicted")
+	}
+	if !cachedpath.FileExists(newPath) {
+		t.Errorf("Recent entry was evicted")
+	}
+	get("old.txt", cachedpath.WithMaxCacheAge(time.Hour))
+	if n := atomic.LoadInt32(&downloads); n != 1 {
+		t.Errorf("Expected the evicted entry to be downloaded again, got %d downloads", n)
+	}
+
+	age(newPath, 2*time.Hour)
+	evicted, err := cachedpath.EvictOldEntries(cacheDir, time.Hour)
+	if err != nil {
+		t.Fatalf("EvictOldEntries failed: %v", err)
+	}
+	if evicted != 1 {
+		t.Errorf("Expected 1 evicted entry, got %d", evicted)
+	}
+	if cachedpath.FileExists(newPath) || cachedpath.FileExists(cachedpath.MetaFilePath(newPath)) {
+		t.Errorf("Entry was not evicted")
+	}
+	if !cachedpath.FileExists(oldPath) {
+		t.Errorf("Fresh download was evicted")
+	}
+
+	// Only the remaining entry keeps a lock file
+	locks, err := filepath.Glob(filepath.Join(cacheDir, "*.lock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, lock := range locks {
+		if lock != cachedpath.LockFilePath(oldPath) {
+			t.Errorf("Lock file %s of an evicted entry remains", filepath.Base(lock))
+		}
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	cacheDir := filepath.Join(t.TempDir(), "new", "cache")
+	err := cachedpath.SelfTest(
+		cachedpath.WithCacheDir(cacheDir),
+		cachedpath.WithMinFreeSpace(1),
+		cachedpath.WithProbeURL(server.URL+"/"),
+	)
+	if err != nil {
+		t.Fatalf("SelfTest failed: %v", err)
+	}
+	entries, _ := os.ReadDir(cacheDir)
+	if len(entries) != 0 {
+		t.Errorf("SelfTest should leave the cache directory empty, found %d entries", len(entries))
+	}
+
+	// Every failed check is reported at once
+	server.Close()
+	err = cachedpath.SelfTest(
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithMinFreeSpace(1<<62),
+		cachedpath.WithProbeURL(server.URL+"/"),
+		cachedpath.WithMaxRetries(0),
+	)
+	var selfTest *cachedpath.SelfTestError
+	if !errors.As(err, &selfTest) {
+		t.Fatalf("Expected a *SelfTestError, got %v", err)
+	}
+	var checks []string
+	for _, f := range selfTest.Failures {
+		checks = append(checks, f.Check)
+	}
+	if strings.Join(checks, ",") != "free space,probe" {
+		t.Errorf("Expected the free space and probe checks to fail, got %v", checks)
+	}
+
+	// A cache directory that can't be created skips the checks that need it
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0644)
+	err = cachedpath.SelfTest(cachedpath.WithCacheDir(filepath.Join(file, "cache")))
+	if !errors.As(err, &selfTest) || len(selfTest.Failures) != 1 || !errors.Is(err, cachedpath.ErrInvalidCacheDir) {
+		t.Errorf("Expected a single cache directory failure, got %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+package tests
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/CezarGarrido/cachedpath"
+)
+
+// ftpServer is a minimal passive-mode FTP server serving files from memory
+type ftpServer struct {
+	listener net.Listener
+	user     string
+	pass     string
+
+	mu       sync.Mutex
+	files    map[string]string
+	mdtm     map[string]string
+	sessions int
+}
+
+func newFTPServer(t *testing.T, user, pass string) *ftpServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := &ftpServer{
+		listener: l,
+		user:     user,
+		pass:     pass,
+		files:    make(map[string]string),
+		mdtm:     make(map[string]string),
+	}
+	go s.serve()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *ftpServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *ftpServer) setFile(path, content, mdtm string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[path] = content
+	s.mdtm[path] = mdtm
+}
+
+func (s *ftpServer) sessionCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions
+}
+
+func (s *ftpServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *ftpServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...any) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+
+	reply("220 ready")
+	var user string
+	var passive net.Listener
+	defer func() {
+		if passive != nil {
+			passive.Close()
+		}
+	}()
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+
+		s.mu.Lock()
+		content, exists := s.files[arg]
+		mdtm := s.mdtm[arg]
+		s.mu.Unlock()
+
+		switch strings.ToUpper(cmd) {
+		case "USER":
+			s.mu.Lock()
+			s.sessions++
+			s.mu.Unlock()
+			user = arg
+			reply("331 password required")
+		case "PASS":
+			if (s.user == "" && user == "anonymous") || (user == s.user && arg == s.pass) {
+				reply("230 logged in")
+			} else {
+				reply("530 login incorrect")
+			}
+		case "TYPE":
+			reply("200 type set")
+		case "SIZE":
+			if !exists {
+				reply("550 not found")
+				continue
+			}
+			reply("213 %d", len(content))
+		case "MDTM":
+			if !exists {
+				reply("550 not found")
+				continue
+			}
+			reply("213 %s", mdtm)
+		case "EPSV":
+			// Force the PASV fallback
+			reply("502 not implemented")
+		case "PASV":
+			passive, err = net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				reply("425 cannot open data connection")
+				continue
+			}
+			port := passive.Addr().(*net.TCPAddr).Port
+			reply("227 Entering Passive Mode (127,0,0,1,%d,%d)", port>>8, port&0xff)
+		case "RETR":
+			if !exists || passive == nil {
+				reply("550 not found")
+				continue
+			}
+			reply("150 opening data connection")
+			data, err := passive.Accept()
+			if err != nil {
+				return
+			}
+			data.Write([]byte(content))
+			data.Close()
+			passive.Close()
+			passive = nil
+			reply("226 transfer complete")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func TestFTPAnonymous(t *testing.T) {
+	server := newFTPServer(t, "", "")
+	server.setFile("pub/data.txt", "ftp content", "20240102030405")
+
+	tmpDir := t.TempDir()
+	url := "ftp://" + server.addr() + "/pub/data.txt"
+	opts := []cachedpath.Option{cachedpath.WithCacheDir(tmpDir), cachedpath.WithQuiet(true)}
+
+	path1, err := cachedpath.CachedPath(url, opts...)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	data, err := os.ReadFile(path1)
+	if err != nil || string(data) != "ftp content" {
+		t.Fatalf("Unexpected cached content %q, %v", data, err)
+	}
+
+	// Same MDTM: cache hit
+	path2, err := cachedpath.CachedPath(url, opts...)
+	if err != nil {
+		t.Fatalf("Second CachedPath call failed: %v", err)
+	}
+	if path1 != path2 {
+		t.Errorf("Unchanged file returned different path: %s vs %s", path1, path2)
+	}
+
+	// New MDTM: a new version
+	server.setFile("pub/data.txt", "updated", "20240203040506")
+	path3, err := cachedpath.CachedPath(url, opts...)
+	if err != nil {
+		t.Fatalf("Third CachedPath call failed: %v", err)
+	}
+	if path3 == path1 {
+		t.Error("Modified file should be cached under a new path")
+	}
+	data, err = os.ReadFile(path3)
+	if err != nil || string(data) != "updated" {
+		t.Errorf("Unexpected cached content %q, %v", data, err)
+	}
+}
+
+func TestFTPCredentials(t *testing.T) {
+	server := newFTPServer(t, "alice", "secret")
+	server.setFile("data.txt", "private", "20240102030405")
+
+	tmpDir := t.TempDir()
+	opts := []cachedpath.Option{cachedpath.WithCacheDir(tmpDir), cachedpath.WithQuiet(true)}
+
+	if _, err := cachedpath.CachedPath("ftp://"+server.addr()+"/data.txt", opts...); err == nil {
+		t.Error("Expected anonymous login to be rejected")
+	}
+
+	path, err := cachedpath.CachedPath("ftp://alice:secret@"+server.addr()+"/data.txt", opts...)
+	if err != nil {
+		t.Fatalf("CachedPath with credentials failed: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "private" {
+		t.Errorf("Unexpected cached content %q, %v", data, err)
+	}
+}
+
+func TestFTPSingleMetadataSession(t *testing.T) {
+	server := newFTPServer(t, "", "")
+	server.setFile("data.txt", "content", "20240102030405")
+
+	tmpDir := t.TempDir()
+	_, err := cachedpath.CachedPath("ftp://"+server.addr()+"/data.txt", cachedpath.WithCacheDir(tmpDir), cachedpath.WithQuiet(true))
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+
+	// One session for MDTM and SIZE, one for RETR
+	if sessions := server.sessionCount(); sessions != 2 {
+		t.Errorf("Expected 2 FTP sessions for a cold download, got %d", sessions)
+	}
+}
@@ -0,0 +1,2024 @@
+package tests
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/CezarGarrido/cachedpath"
+	"github.com/CezarGarrido/cachedpath/schemes"
+)
+
+// requestLog records the HTTP methods received by a test server
+type requestLog struct {
+	mu      sync.Mutex
+	methods []string
+}
+
+func (l *requestLog) add(method string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.methods = append(l.methods, method)
+}
+
+func (l *requestLog) reset() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	methods := l.methods
+	l.methods = nil
+	return methods
+}
+
+func TestConditionalGet(t *testing.T) {
+	etag := `"v1"`
+	content := "version one"
+	var mu sync.Mutex
+	log := &requestLog{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.add(r.Method)
+		mu.Lock()
+		defer mu.Unlock()
+
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	url := server.URL + "/file.txt"
+
+	path1, err := cachedpath.CachedPath(url, cachedpath.WithCacheDir(tmpDir), cachedpath.WithQuiet(true))
+	if err != nil {
+		t.Fatalf("First CachedPath call failed: %v", err)
+	}
+	log.reset()
+
+	// Warm cache: a single conditional GET answered with 304
+	path2, err := cachedpath.CachedPath(url, cachedpath.WithCacheDir(tmpDir), cachedpath.WithQuiet(true))
+	if err != nil {
+		t.Fatalf("Second CachedPath call failed: %v", err)
+	}
+	if path1 != path2 {
+		t.Errorf("Second call returned different path: %s vs %s", path1, path2)
+	}
+	if methods := log.reset(); len(methods) != 1 || methods[0] != "GET" {
+		t.Errorf("Expected a single GET on warm cache, got %v", methods)
+	}
+
+	// Changed resource: the conditional GET downloads the new version
+	mu.Lock()
+	etag = `"v2"`
+	content = "version two"
+	mu.Unlock()
+
+	path3, err := cachedpath.CachedPath(url, cachedpath.WithCacheDir(tmpDir), cachedpath.WithQuiet(true))
+	if err != nil {
+		t.Fatalf("Third CachedPath call failed: %v", err)
+	}
+	if path3 == path1 {
+		t.Error("Changed resource should be cached under a new path")
+	}
+	if methods := log.reset(); len(methods) != 1 || methods[0] != "GET" {
+		t.Errorf("Expected a single GET for changed resource, got %v", methods)
+	}
+
+	data, err := os.ReadFile(path3)
+	if err != nil {
+		t.Fatalf("Failed to read cached file: %v", err)
+	}
+	if string(data) != "version two" {
+		t.Errorf("Cached file has wrong content: %q", data)
+	}
+}
+
+func TestConditionalGetIgnoredByServer(t *testing.T) {
+	log := &requestLog{}
+	var ifNoneMatch []string
+
+	// Server that always answers 200, ignoring If-None-Match
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.add(r.Method)
+		if r.Method == "GET" {
+			ifNoneMatch = append(ifNoneMatch, r.Header.Get("If-None-Match"))
+		}
+		w.Header().Set("ETag", `"stable"`)
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	url := server.URL + "/file.bin"
+
+	path1, err := cachedpath.CachedPath(url, cachedpath.WithCacheDir(tmpDir), cachedpath.WithQuiet(true))
+	if err != nil {
+		t.Fatalf("First CachedPath call failed: %v", err)
+	}
+	log.reset()
+
+	path2, err := cachedpath.CachedPath(url, cachedpath.WithCacheDir(tmpDir), cachedpath.WithQuiet(true))
+	if err != nil {
+		t.Fatalf("Second CachedPath call failed: %v", err)
+	}
+	if path1 != path2 {
+		t.Errorf("Unchanged ETag should reuse cached path: %s vs %s", path1, path2)
+	}
+	if methods := log.reset(); len(methods) != 1 {
+		t.Errorf("Expected a single request on warm cache, got %v", methods)
+	}
+	if got := ifNoneMatch[len(ifNoneMatch)-1]; got != `"stable"` {
+		t.Errorf("Expected If-None-Match with stored ETag, got %q", got)
+	}
+}
+
+func TestConditionalGetLastModified(t *testing.T) {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	log := &requestLog{}
+	var ifModifiedSince string
+
+	// Server without ETags, only Last-Modified
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.add(r.Method)
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+		if r.Method == "GET" {
+			ifModifiedSince = r.Header.Get("If-Modified-Since")
+			if since, err := http.ParseTime(ifModifiedSince); err == nil && !modified.After(since) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	url := server.URL + "/file.txt"
+
+	path1, err := cachedpath.CachedPath(url, cachedpath.WithCacheDir(tmpDir), cachedpath.WithQuiet(true))
+	if err != nil {
+		t.Fatalf("First CachedPath call failed: %v", err)
+	}
+
+	meta, err := cachedpath.LoadMetaFromFile(cachedpath.MetaFilePath(path1))
+	if err != nil {
+		t.Fatalf("Failed to load metadata: %v", err)
+	}
+	if meta.ETag != "" || !meta.LastModified.Equal(modified) {
+		t.Errorf("Expected LastModified %v and empty ETag, got %v and %q", modified, meta.LastModified, meta.ETag)
+	}
+	log.reset()
+
+	path2, err := cachedpath.CachedPath(url, cachedpath.WithCacheDir(tmpDir), cachedpath.WithQuiet(true))
+	if err != nil {
+		t.Fatalf("Second CachedPath call failed: %v", err)
+	}
+	if path1 != path2 {
+		t.Errorf("Second call returned different path: %s vs %s", path1, path2)
+	}
+	if methods := log.reset(); len(methods) != 1 {
+		t.Errorf("Expected a single request on warm cache, got %v", methods)
+	}
+	if ifModifiedSince != modified.Format(http.TimeFormat) {
+		t.Errorf("Expected If-Modified-Since %q, got %q", modified.Format(http.TimeFormat), ifModifiedSince)
+	}
+}
+
+func TestETagChangedBetweenHeadAndGet(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  cachedpath.ETagMismatchPolicy
+		methods int
+	}{
+		{"rekey", cachedpath.ETagMismatchRekey, 2},
+		{"retry", cachedpath.ETagMismatchRetry, 4},
+	}
+
+	for _, tt := range tests {
+		log := &requestLog{}
+		heads := 0
+
+		// The first HEAD reports the old version, everything after reports the new one
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			log.add(r.Method)
+			if r.Method == "HEAD" {
+				heads++
+				if heads == 1 {
+					w.Header().Set("ETag", `"old"`)
+					return
+				}
+			}
+			w.Header().Set("ETag", `"new"`)
+			w.Write([]byte("new content"))
+		}))
+
+		tmpDir := t.TempDir()
+		url := server.URL + "/file.txt"
+
+		path, err := cachedpath.CachedPath(
+			url,
+			cachedpath.WithCacheDir(tmpDir),
+			cachedpath.WithQuiet(true),
+			cachedpath.WithETagMismatch(tt.policy),
+		)
+		server.Close()
+		if err != nil {
+			t.Fatalf("%s: CachedPath failed: %v", tt.name, err)
+		}
+
+		if expected := cachedpath.ResourceToFilename(url, `"new"`); filepath.Base(path) != expected {
+			t.Errorf("%s: expected file keyed by new ETag %s, got %s", tt.name, expected, filepath.Base(path))
+		}
+
+		meta, err := cachedpath.LoadMetaFromFile(cachedpath.MetaFilePath(path))
+		if err != nil {
+			t.Fatalf("%s: failed to load metadata: %v", tt.name, err)
+		}
+		if meta.ETag != `"new"` {
+			t.Errorf("%s: expected metadata ETag %q, got %q", tt.name, `"new"`, meta.ETag)
+		}
+
+		if methods := log.reset(); len(methods) != tt.methods {
+			t.Errorf("%s: expected %d requests, got %v", tt.name, tt.methods, methods)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	var mu sync.Mutex
+	limited := 0
+
+	// Rate limit the first two GETs, then serve the file
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			mu.Lock()
+			defer mu.Unlock()
+			if limited < 2 {
+				limited++
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+		}
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	path, err := cachedpath.CachedPath(
+		server.URL+"/file.txt",
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithRetryDelay(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 2*time.Second {
+		t.Errorf("Expected to wait for Retry-After twice, took %v", elapsed)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "content" {
+		t.Errorf("Unexpected cached content %q, %v", data, err)
+	}
+}
+
+func TestRetryAfterCapped(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	start := time.Now()
+	_, err := cachedpath.CachedPath(
+		server.URL+"/file.txt",
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithMaxRetries(2),
+		cachedpath.WithRetryDelay(time.Millisecond),
+		cachedpath.WithMaxRetryWait(10*time.Millisecond),
+	)
+	if err == nil {
+		t.Error("Expected error for unavailable server")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Retry-After should have been capped, took %v", elapsed)
+	}
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	log := &requestLog{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.add(r.Method)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	_, err := cachedpath.CachedPath(
+		server.URL+"/missing.txt",
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithRetryDelay(time.Millisecond),
+	)
+	if err == nil {
+		t.Error("Expected error for missing file")
+	}
+	if methods := log.reset(); len(methods) != 2 {
+		t.Errorf("Expected one HEAD and one GET without retries, got %v", methods)
+	}
+}
+
+func TestOfflineMode(t *testing.T) {
+	log := &requestLog{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.add(r.Method)
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	url := server.URL + "/file.txt"
+
+	// Not cached yet
+	_, err := cachedpath.CachedPath(url, cachedpath.WithCacheDir(tmpDir), cachedpath.WithOfflineMode(true))
+	if !errors.Is(err, cachedpath.ErrOfflineAndNotCached) {
+		t.Errorf("Expected ErrOfflineAndNotCached, got %v", err)
+	}
+
+	path1, err := cachedpath.CachedPath(url, cachedpath.WithCacheDir(tmpDir), cachedpath.WithQuiet(true))
+	if err != nil {
+		t.Fatalf("Online CachedPath call failed: %v", err)
+	}
+	log.reset()
+
+	path2, err := cachedpath.CachedPath(url, cachedpath.WithCacheDir(tmpDir), cachedpath.WithOfflineMode(true))
+	if err != nil {
+		t.Fatalf("Offline CachedPath call failed: %v", err)
+	}
+	if path1 != path2 {
+		t.Errorf("Offline call returned different path: %s vs %s", path1, path2)
+	}
+	if methods := log.reset(); len(methods) != 0 {
+		t.Errorf("Offline mode made network requests: %v", methods)
+	}
+}
+
+// recordingLogger collects log messages for assertions
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) record(level, format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, level+": "+fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) Debugf(format string, args ...any) { l.record("debug", format, args...) }
+func (l *recordingLogger) Infof(format string, args ...any)  { l.record("info", format, args...) }
+func (l *recordingLogger) Warnf(format string, args ...any)  { l.record("warn", format, args...) }
+
+func TestWithLogger(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	logger := &recordingLogger{}
+	tmpDir := t.TempDir()
+	url := server.URL + "/file.txt"
+
+	for i := 0; i < 2; i++ {
+		_, err := cachedpath.CachedPath(
+			url,
+			cachedpath.WithCacheDir(tmpDir),
+			cachedpath.WithQuiet(true),
+			cachedpath.WithLogger(logger),
+		)
+		if err != nil {
+			t.Fatalf("CachedPath failed: %v", err)
+		}
+	}
+
+	if len(logger.messages) != 2 {
+		t.Fatalf("Expected a download and a cache hit message, got %v", logger.messages)
+	}
+	if !strings.HasPrefix(logger.messages[0], "info: downloaded") {
+		t.Errorf("Unexpected first message: %q", logger.messages[0])
+	}
+	if !strings.HasPrefix(logger.messages[1], "debug: cache hit") {
+		t.Errorf("Unexpected second message: %q", logger.messages[1])
+	}
+}
+
+func TestRetryableStatusCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []cachedpath.Option
+		status  int
+		success bool
+	}{
+		{"default set", nil, 520, false},
+		{"custom set", []cachedpath.Option{cachedpath.WithRetryableStatusCodes(520, 522)}, 520, true},
+		{"added status", []cachedpath.Option{cachedpath.WithRetryOnStatus(520)}, 520, true},
+		{"added status keeps defaults", []cachedpath.Option{cachedpath.WithRetryOnStatus(520)}, 503, true},
+		{"replaced set drops defaults", []cachedpath.Option{cachedpath.WithRetryableStatusCodes(520)}, 503, false},
+		{"added status survives a later set", []cachedpath.Option{cachedpath.WithRetryOnStatus(520), cachedpath.WithRetryableStatusCodes(522)}, 520, true},
+		{"added status joins an earlier set", []cachedpath.Option{cachedpath.WithRetryableStatusCodes(522), cachedpath.WithRetryOnStatus(520)}, 522, true},
+	}
+
+	for _, tt := range tests {
+		var mu sync.Mutex
+		failed := false
+
+		// Fail the first GET, e.g. with a Cloudflare-style 520
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if r.Method == "GET" && !failed {
+				failed = true
+				w.WriteHeader(tt.status)
+				return
+			}
+			w.Write([]byte("content"))
+		}))
+
+		opts := append([]cachedpath.Option{
+			cachedpath.WithCacheDir(t.TempDir()),
+			cachedpath.WithQuiet(true),
+			cachedpath.WithRetryDelay(time.Millisecond),
+		}, tt.opts...)
+
+		_, err := cachedpath.CachedPath(server.URL+"/file.txt", opts...)
+		server.Close()
+		if tt.success && err != nil {
+			t.Errorf("%s: expected retry to succeed, got %v", tt.name, err)
+		}
+		if !tt.success && err == nil {
+			t.Errorf("%s: expected %d not to be retried", tt.name, tt.status)
+		}
+	}
+}
+
+func TestContextCancelsRetries(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	fetch := func(ctx context.Context) (time.Duration, error) {
+		start := time.Now()
+		_, err := cachedpath.CachedPath(server.URL+"/file.txt",
+			cachedpath.WithCacheDir(t.TempDir()),
+			cachedpath.WithQuiet(true),
+			cachedpath.WithMaxRetries(5),
+			cachedpath.WithRetryDelay(10*time.Second),
+			cachedpath.WithContext(ctx),
+		)
+		return time.Since(start), err
+	}
+
+	// The deadline passes during the wait before a retry
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	elapsed, err := fetch(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline error, got %v", err)
+	}
+	if elapsed > 5*time.Second {
+		t.Errorf("Retries should stop at the deadline, took %v", elapsed)
+	}
+
+	// Cancelling stops the wait as well
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	before := atomic.LoadInt32(&requests)
+	elapsed, err = fetch(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the cancellation error, got %v", err)
+	}
+	if elapsed > 5*time.Second {
+		t.Errorf("Retries should stop when cancelled, took %v", elapsed)
+	}
+	if n := atomic.LoadInt32(&requests) - before; n > 2 {
+		t.Errorf("Expected no retries after cancelling, got %d requests", n)
+	}
+}
+
+func TestStallTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.Write([]byte("start"))
+		w.(http.Flusher).Flush()
+		if r.URL.Path == "/stalled.bin" {
+			// Send nothing more until the client gives up
+			<-r.Context().Done()
+			return
+		}
+		// Slow but steady, for longer than the request timeout
+		for i := 0; i < 8; i++ {
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte("."))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithMaxRetries(0),
+		cachedpath.WithTimeout(200 * time.Millisecond),
+		cachedpath.WithStallTimeout(200 * time.Millisecond),
+	}
+
+	path, err := cachedpath.CachedPath(server.URL+"/slow.bin", opts...)
+	if err != nil {
+		t.Fatalf("Slow download failed: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "start........" {
+		t.Errorf("Unexpected content %q", data)
+	}
+
+	start := time.Now()
+	_, err = cachedpath.CachedPath(server.URL+"/stalled.bin", opts...)
+	if !errors.Is(err, cachedpath.ErrStalled) {
+		t.Fatalf("Expected ErrStalled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Stalled download took %s to fail", elapsed)
+	}
+}
+
+func TestRetryIf(t *testing.T) {
+	content := strings.Repeat("real content ", 100)
+	var gets, warming int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			return
+		}
+		atomic.AddInt32(&gets, 1)
+		switch {
+		case r.URL.Path == "/forbidden.txt":
+			w.WriteHeader(http.StatusForbidden)
+		case r.URL.Path == "/always-warming.txt" || atomic.AddInt32(&warming, 1) <= 2:
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html>Please wait, the file is warming up</html>"))
+		default:
+			w.Write([]byte(content))
+		}
+	}))
+	defer server.Close()
+
+	retryIf := func(resp *http.Response, err error) bool {
+		if err != nil {
+			return true
+		}
+		if resp.StatusCode == http.StatusForbidden {
+			return false
+		}
+		prefix, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode >= 500 || bytes.Contains(prefix, []byte("Please wait"))
+	}
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithRetryDelay(time.Millisecond),
+		cachedpath.WithRetryIf(retryIf),
+	}
+
+	// The warming page is retried and the real body is downloaded whole
+	path, err := cachedpath.CachedPath(server.URL+"/file.txt", opts...)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != content {
+		t.Errorf("Unexpected content %q", data)
+	}
+	if n := atomic.LoadInt32(&gets); n != 3 {
+		t.Errorf("Expected 3 GETs, got %d", n)
+	}
+
+	// 403 is not retried
+	atomic.StoreInt32(&gets, 0)
+	_, err = cachedpath.CachedPath(server.URL+"/forbidden.txt", opts...)
+	var httpErr *cachedpath.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a 403 HTTPError, got %v", err)
+	}
+	if n := atomic.LoadInt32(&gets); n != 1 {
+		t.Errorf("Expected a single GET, got %d", n)
+	}
+
+	// A page that stays rejected is never cached
+	_, err = cachedpath.CachedPath(server.URL+"/always-warming.txt", append(opts, cachedpath.WithMaxRetries(1))...)
+	if !errors.Is(err, cachedpath.ErrResponseRejected) {
+		t.Errorf("Expected ErrResponseRejected, got %v", err)
+	}
+}
+
+func TestForceRefresh(t *testing.T) {
+	var mu sync.Mutex
+	content := "first"
+	log := &requestLog{}
+
+	// Same ETag for different content, like an overwritten CI artifact
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.add(r.Method)
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("ETag", `"same"`)
+		if r.Header.Get("If-None-Match") == `"same"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	url := server.URL + "/artifact.bin"
+
+	path1, err := cachedpath.CachedPath(url, cachedpath.WithCacheDir(tmpDir), cachedpath.WithQuiet(true))
+	if err != nil {
+		t.Fatalf("First CachedPath call failed: %v", err)
+	}
+
+	mu.Lock()
+	content = "second"
+	mu.Unlock()
+
+	path2, err := cachedpath.CachedPath(
+		url,
+		cachedpath.WithCacheDir(tmpDir),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithForceRefresh(true),
+	)
+	if err != nil {
+		t.Fatalf("Forced CachedPath call failed: %v", err)
+	}
+	if path1 != path2 {
+		t.Errorf("Forced refresh should overwrite the cached version: %s vs %s", path1, path2)
+	}
+
+	data, err := os.ReadFile(path2)
+	if err != nil || string(data) != "second" {
+		t.Errorf("Expected refreshed content, got %q, %v", data, err)
+	}
+}
+
+func TestWithProgressFunc(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "7")
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	var lastWritten, lastTotal int64
+	calls := 0
+	_, err := cachedpath.CachedPath(
+		server.URL+"/file.txt",
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithProgressFunc(func(written, total int64, elapsed time.Duration) {
+			calls++
+			lastWritten, lastTotal = written, total
+			if elapsed < 0 {
+				t.Errorf("Negative elapsed time: %v", elapsed)
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+
+	if calls == 0 {
+		t.Fatal("Progress function was never called")
+	}
+	if lastWritten != 7 || lastTotal != 7 {
+		t.Errorf("Expected 7/7 bytes, got %d/%d", lastWritten, lastTotal)
+	}
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", "7")
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	var events []string
+	url := server.URL + "/file.txt"
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithOnCacheHit(func(u, path string, lockWait time.Duration) {
+			events = append(events, fmt.Sprintf("hit %s", filepath.Base(path)))
+		}),
+		cachedpath.WithOnDownloadStart(func(u string, size int64) {
+			events = append(events, fmt.Sprintf("start %d", size))
+		}),
+		cachedpath.WithOnDownloadComplete(func(u, path string, size int64, dur, lockWait time.Duration) {
+			if u != url || dur < 0 {
+				t.Errorf("Unexpected completion of %s after %v", u, dur)
+			}
+			events = append(events, fmt.Sprintf("complete %s %d", filepath.Base(path), size))
+		}),
+	}
+
+	path, err := cachedpath.CachedPath(url, opts...)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	if _, err := cachedpath.CachedPath(url, opts...); err != nil {
+		t.Fatalf("Second CachedPath call failed: %v", err)
+	}
+
+	base := filepath.Base(path)
+	expected := []string{"start 7", "complete " + base + " 7", "hit " + base}
+	if fmt.Sprint(events) != fmt.Sprint(expected) {
+		t.Errorf("Expected events %v, got %v", expected, events)
+	}
+}
+
+func TestDownloadHooks(t *testing.T) {
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if r.Method == "GET" {
+			atomic.AddInt32(&gets, 1)
+		}
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	var events []string
+	denied := errors.New("not on the allow list")
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithBeforeDownload(func(url string) error {
+			events = append(events, "before "+filepath.Base(url))
+			if strings.HasSuffix(url, "/denied.txt") {
+				return denied
+			}
+			return nil
+		}),
+		cachedpath.WithAfterDownload(func(url, localPath string, cached bool) error {
+			if data, err := os.ReadFile(localPath); err != nil || string(data) != "content" {
+				t.Errorf("After hook got %s: %q, %v", localPath, data, err)
+			}
+			events = append(events, fmt.Sprintf("after %s cached=%v", filepath.Base(url), cached))
+			return nil
+		}),
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := cachedpath.CachedPath(server.URL+"/file.txt", opts...); err != nil {
+			t.Fatalf("CachedPath failed: %v", err)
+		}
+	}
+	_, err := cachedpath.CachedPath(server.URL+"/denied.txt", opts...)
+	if !errors.Is(err, cachedpath.ErrDownloadAborted) || !errors.Is(err, denied) {
+		t.Errorf("Expected the hook to abort the download, got %v", err)
+	}
+
+	expected := []string{
+		"before file.txt", "after file.txt cached=false",
+		"before file.txt", "after file.txt cached=true",
+		"before denied.txt",
+	}
+	if fmt.Sprint(events) != fmt.Sprint(expected) {
+		t.Errorf("Expected events %v, got %v", expected, events)
+	}
+	if n := atomic.LoadInt32(&gets); n != 1 {
+		t.Errorf("Expected a single download, got %d", n)
+	}
+
+	// An error from the after hook fails the call
+	failing := cachedpath.WithAfterDownload(func(url, localPath string, cached bool) error {
+		return denied
+	})
+	if _, err := cachedpath.CachedPath(server.URL+"/file.txt", append(opts, failing)...); !errors.Is(err, denied) {
+		t.Errorf("Expected the after hook error, got %v", err)
+	}
+}
+
+func TestContentEncodingGzip(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "data.tar.gz")
+	writeTarGz(t, archive, map[string]string{"data.txt": strings.Repeat("compressible data ", 1000)})
+	content, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(content)
+	gz.Close()
+
+	// The server compresses whatever the client asks for, HEAD included
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(compressed.Len()))
+		w.Write(compressed.Bytes())
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		opts     []cachedpath.Option
+		expected []byte
+	}{
+		{"decompressed", nil, content},
+		{"raw bytes", []cachedpath.Option{cachedpath.WithDisableCompression(true)}, compressed.Bytes()},
+		{"streaming extraction", []cachedpath.Option{
+			cachedpath.WithExtractArchive(true),
+			cachedpath.WithStreamingExtract(true),
+		}, nil},
+	}
+	for _, tt := range tests {
+		var maxWritten, maxTotal int64
+		path, err := cachedpath.CachedPath(server.URL+"/data.tar.gz", append([]cachedpath.Option{
+			cachedpath.WithCacheDir(t.TempDir()),
+			cachedpath.WithProgressFunc(func(written, total int64, elapsed time.Duration) {
+				maxWritten, maxTotal = max(maxWritten, written), max(maxTotal, total)
+			}),
+		}, tt.opts...)...)
+		if err != nil {
+			t.Fatalf("%s: CachedPath failed: %v", tt.name, err)
+		}
+		if tt.expected != nil {
+			data, err := os.ReadFile(path)
+			if err != nil || !bytes.Equal(data, tt.expected) {
+				t.Errorf("%s: unexpected content (%d bytes), %v", tt.name, len(data), err)
+			}
+		}
+		if maxTotal > 0 && maxWritten > maxTotal {
+			t.Errorf("%s: progress went past its total: %d of %d", tt.name, maxWritten, maxTotal)
+		}
+	}
+}
+
+func TestHeadNotAllowed(t *testing.T) {
+	content := "content served without HEAD support"
+	log := &requestLog{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.add(r.Method + " " + r.Header.Get("Range"))
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "file.txt", time.Time{}, strings.NewReader(content))
+	}))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	url := server.URL + "/file.txt"
+
+	var total int64
+	path1, err := cachedpath.CachedPath(
+		url,
+		cachedpath.WithCacheDir(tmpDir),
+		cachedpath.WithProgressFunc(func(written, size int64, elapsed time.Duration) { total = size }),
+	)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	if total != int64(len(content)) {
+		t.Errorf("Expected total size %d, got %d", len(content), total)
+	}
+
+	methods := log.reset()
+	expected := []string{"HEAD ", "GET bytes=0-0", "GET "}
+	if strings.Join(methods, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected requests %v, got %v", expected, methods)
+	}
+
+	meta, err := cachedpath.LoadMetaFromFile(cachedpath.MetaFilePath(path1))
+	if err != nil || meta.ETag != `"v1"` {
+		t.Errorf("Expected ETag from ranged GET in metadata, got %+v, %v", meta, err)
+	}
+
+	// Cache validation keeps working without HEAD
+	path2, err := cachedpath.CachedPath(url, cachedpath.WithCacheDir(tmpDir), cachedpath.WithQuiet(true))
+	if err != nil {
+		t.Fatalf("Second CachedPath call failed: %v", err)
+	}
+	if path1 != path2 {
+		t.Errorf("Second call returned different path: %s vs %s", path1, path2)
+	}
+	if methods := log.reset(); len(methods) != 1 {
+		t.Errorf("Expected a single request on warm cache, got %v", methods)
+	}
+}
+
+func TestHeadForbiddenFallback(t *testing.T) {
+	content := "presigned object"
+	log := &requestLog{}
+
+	// Presigned URLs are signed for GET only: HEAD fails the signature check
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.add(r.Method + " " + r.Header.Get("Range"))
+		if r.Method == "HEAD" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set("ETag", `"signed"`)
+		http.ServeContent(w, r, "object.bin", time.Time{}, strings.NewReader(content))
+	}))
+	defer server.Close()
+
+	client := schemes.NewHTTPClient()
+	size, err := client.GetSize(server.URL+"/object.bin", nil)
+	if err != nil || size != int64(len(content)) {
+		t.Errorf("Expected size %d from Content-Range, got %d, %v", len(content), size, err)
+	}
+	etag, err := client.GetETag(server.URL+"/object.bin", nil)
+	if err != nil || etag != `"signed"` {
+		t.Errorf("Expected the ETag of the ranged GET, got %q, %v", etag, err)
+	}
+	expected := []string{"HEAD ", "GET bytes=0-0", "HEAD ", "GET bytes=0-0"}
+	if methods := log.reset(); strings.Join(methods, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected requests %v, got %v", expected, methods)
+	}
+}
+
+func TestMaxDownloadSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/chunked.bin" {
+			// No Content-Length: the size is only known while downloading
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(tmpDir),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithMaxDownloadSize(50),
+	}
+
+	_, err := cachedpath.CachedPath(server.URL+"/sized.bin", opts...)
+	var sizeErr *cachedpath.SizeLimitError
+	if !errors.Is(err, cachedpath.ErrFileTooLarge) || !errors.As(err, &sizeErr) {
+		t.Errorf("Expected ErrFileTooLarge for a known size, got %v", err)
+	} else if sizeErr.Reported != 100 || sizeErr.Received != 0 || sizeErr.Limit != 50 {
+		t.Errorf("Expected a rejection before downloading, got %+v", sizeErr)
+	}
+
+	_, err = cachedpath.CachedPath(server.URL+"/chunked.bin", cachedpath.WithCacheDir(tmpDir),
+		cachedpath.WithQuiet(true), cachedpath.WithMaxSize(50))
+	if !errors.Is(err, cachedpath.ErrSizeLimitExceeded) || !errors.As(err, &sizeErr) {
+		t.Errorf("Expected ErrSizeLimitExceeded for an unknown size, got %v", err)
+	} else if sizeErr.Received <= 50 || !strings.Contains(err.Error(), strconv.FormatInt(sizeErr.Received, 10)) {
+		t.Errorf("Expected the bytes received in the error, got %+v: %v", sizeErr, err)
+	}
+
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to read cache dir: %v", err)
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".lock") {
+			t.Errorf("Unexpected file left in cache: %s", entry.Name())
+		}
+	}
+
+	path, err := cachedpath.CachedPath(server.URL+"/sized.bin", append(opts, cachedpath.WithMaxDownloadSize(100))...)
+	if err != nil {
+		t.Fatalf("Download at the limit failed: %v", err)
+	}
+	if data, _ := os.ReadFile(path); len(data) != 100 {
+		t.Errorf("Expected 100 bytes, got %d", len(data))
+	}
+}
+
+func TestTrailingSlashURLs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/data" || r.URL.Path == "/data/" {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte("raw"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("ETag", `"page"`)
+		w.Write([]byte("<html>" + r.URL.Path + "</html>"))
+	}))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	get := func(url string, opts ...cachedpath.Option) string {
+		t.Helper()
+		path, err := cachedpath.CachedPath(url, append([]cachedpath.Option{cachedpath.WithCacheDir(tmpDir), cachedpath.WithQuiet(true)}, opts...)...)
+		if err != nil {
+			t.Fatalf("CachedPath(%s) failed: %v", url, err)
+		}
+		return path
+	}
+
+	root, rootSlash := get(server.URL), get(server.URL+"/")
+	if root != rootSlash {
+		t.Errorf("Root with and without slash cached separately: %s vs %s", root, rootSlash)
+	}
+
+	doc, docSlash := get(server.URL+"/doc"), get(server.URL+"/doc/")
+	if doc != docSlash {
+		t.Errorf("/doc and /doc/ cached separately: %s vs %s", doc, docSlash)
+	}
+	if doc == root {
+		t.Error("/doc and / share a cache entry")
+	}
+
+	for _, path := range []string{root, doc} {
+		if filepath.Ext(path) != ".html" {
+			t.Errorf("HTML page cached without .html extension: %s", path)
+		}
+	}
+	if data := get(server.URL + "/data/"); filepath.Ext(data) == ".html" {
+		t.Errorf("Non-HTML resource cached with .html extension: %s", data)
+	}
+
+	kept := get(server.URL+"/doc/", cachedpath.WithKeepTrailingSlash(true))
+	if kept == doc {
+		t.Error("WithKeepTrailingSlash should cache /doc/ separately")
+	}
+}
+
+func TestDomainRateLimit(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithDomainRateLimit(20),
+	}
+
+	// Concurrent downloads share the limit of their host
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := cachedpath.CachedPath(fmt.Sprintf("%s/file%d.txt", server.URL, i), opts...); err != nil {
+				t.Errorf("CachedPath failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// The first request passes immediately, each later one waits 50ms
+	n := atomic.LoadInt32(&requests)
+	if minimum := time.Duration(n-1) * 50 * time.Millisecond; time.Since(start) < minimum*9/10 {
+		t.Errorf("%d requests took %s, expected at least %s", n, time.Since(start), minimum)
+	}
+}
+
+func TestExpectedContentType(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/data.json":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Write([]byte(`{"ok": true}`))
+		case "/data.csv":
+			w.Header().Set("Content-Type", "text/csv")
+			w.Write([]byte("a,b\n"))
+		case "/bare.json":
+			// No Content-Type: the content decides
+			w.Header()["Content-Type"] = nil
+			w.Write([]byte(`{"ok": true}`))
+		case "/bare.parquet":
+			w.Header()["Content-Type"] = nil
+			w.Write([]byte("<!DOCTYPE html><html>Object is being restored</html>"))
+		default:
+			// A login page served with 200 instead of the requested file
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html>Please log in</html>"))
+		}
+	}))
+	defer server.Close()
+
+	cacheDir := t.TempDir()
+	opts := func(types ...string) []cachedpath.Option {
+		return []cachedpath.Option{
+			cachedpath.WithCacheDir(cacheDir),
+			cachedpath.WithQuiet(true),
+			cachedpath.WithExpectedContentType(types...),
+		}
+	}
+
+	if _, err := cachedpath.CachedPath(server.URL+"/data.json", opts("application/json")...); err != nil {
+		t.Errorf("Expected application/json to be accepted: %v", err)
+	}
+	if _, err := cachedpath.CachedPath(server.URL+"/data.csv", opts("application/json", "text/*")...); err != nil {
+		t.Errorf("Expected text/* to accept text/csv: %v", err)
+	}
+
+	if _, err := cachedpath.CachedPath(server.URL+"/data.json", opts("application/*")...); err != nil {
+		t.Errorf("Expected application/* to accept application/json: %v", err)
+	}
+	if _, err := cachedpath.CachedPath(server.URL+"/bare.json", opts("application/json")...); err != nil {
+		t.Errorf("Content detected as plain text should be accepted: %v", err)
+	}
+
+	_, err := cachedpath.CachedPath(server.URL+"/other.json", opts("application/json")...)
+	var typeErr *cachedpath.ContentTypeError
+	if !errors.Is(err, cachedpath.ErrUnexpectedContentType) || !errors.As(err, &typeErr) {
+		t.Fatalf("Expected ErrUnexpectedContentType, got %v", err)
+	}
+	if typeErr.Actual != "text/html" || typeErr.Sniffed || len(typeErr.Expected) != 1 || typeErr.Expected[0] != "application/json" {
+		t.Errorf("Expected the actual and expected types in the error, got %+v", typeErr)
+	}
+
+	// An HTML page without a Content-Type is detected from its content
+	_, err = cachedpath.CachedPath(server.URL+"/bare.parquet", opts("application/*")...)
+	if !errors.As(err, &typeErr) || !typeErr.Sniffed || typeErr.Actual != "text/html" {
+		t.Fatalf("Expected a sniffed text/html mismatch, got %v", err)
+	}
+	if metas, _ := filepath.Glob(filepath.Join(cacheDir, "*.meta.json")); len(metas) != 3 {
+		t.Errorf("Rejected downloads should not leave metadata, found %d entries", len(metas))
+	}
+	matches, _ := filepath.Glob(filepath.Join(cacheDir, "*"))
+	for _, match := range matches {
+		if data, err := os.ReadFile(match); err == nil && strings.Contains(string(data), "Please log in") {
+			t.Errorf("Rejected page was cached in %s", match)
+		}
+	}
+}
+
+func TestS3StyleErrorDetection(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing.bin":
+			w.Header().Set("Content-Type", "application/xml")
+			fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message><Key>missing.bin</Key></Error>`)
+		case "/missing.json":
+			fmt.Fprint(w, `{"error": {"code": 404, "message": "No such object: bucket/missing.json"}}`)
+		case "/custom.bin":
+			fmt.Fprint(w, "ERROR 42: object expired")
+		default:
+			fmt.Fprint(w, `<Error>not an error document, just data</Error>`)
+		}
+	}))
+	defer server.Close()
+
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithS3StyleErrorDetection(true),
+	}
+
+	_, err := cachedpath.CachedPath(server.URL+"/missing.bin", opts...)
+	var docErr *cachedpath.ErrorDocumentError
+	if !errors.Is(err, cachedpath.ErrErrorDocument) || !errors.As(err, &docErr) {
+		t.Fatalf("Expected an ErrorDocumentError, got %v", err)
+	}
+	if docErr.Code != "NoSuchKey" || docErr.Message != "The specified key does not exist." {
+		t.Errorf("Unexpected code %q and message %q", docErr.Code, docErr.Message)
+	}
+
+	_, err = cachedpath.CachedPath(server.URL+"/missing.json", opts...)
+	if !errors.As(err, &docErr) || docErr.Code != "404" || !strings.Contains(docErr.Message, "No such object") {
+		t.Errorf("Expected the JSON error document, got %v", err)
+	}
+
+	// Data that merely looks like XML is cached
+	if _, err := cachedpath.CachedPath(server.URL+"/data.xml", opts...); err != nil {
+		t.Errorf("Unexpected error for data: %v", err)
+	}
+
+	// Without the option the error document is cached like any file
+	path, err := cachedpath.CachedPath(server.URL+"/missing.bin", cachedpath.WithCacheDir(t.TempDir()), cachedpath.WithQuiet(true))
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	if data, _ := os.ReadFile(path); !strings.Contains(string(data), "NoSuchKey") {
+		t.Errorf("Expected the document to be cached, got %q", data)
+	}
+
+	// Other formats can be recognized with a detector
+	detector := func(body []byte) (string, string, bool) {
+		code, message, ok := strings.Cut(strings.TrimPrefix(string(body), "ERROR "), ": ")
+		return code, message, ok && strings.HasPrefix(string(body), "ERROR ")
+	}
+	_, err = cachedpath.CachedPath(server.URL+"/custom.bin", append(opts, cachedpath.WithErrorDocumentDetector(detector))...)
+	if !errors.As(err, &docErr) || docErr.Code != "42" || docErr.Message != "object expired" {
+		t.Errorf("Expected the custom error document, got %v", err)
+	}
+}
+
+func TestCookieJar(t *testing.T) {
+	// The portal sets a session cookie and redirects to the download
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "s3cret", Path: "/"})
+			http.Redirect(w, r, "/files/"+r.URL.Query().Get("file"), http.StatusFound)
+			return
+		}
+		if c, err := r.Cookie("session"); err != nil || c.Value != "s3cret" {
+			http.Error(w, "login required", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("members only"))
+	}))
+	defer server.Close()
+
+	opts := func(extra ...cachedpath.Option) []cachedpath.Option {
+		return append([]cachedpath.Option{
+			cachedpath.WithCacheDir(t.TempDir()),
+			cachedpath.WithQuiet(true),
+			cachedpath.WithMaxRetries(0),
+		}, extra...)
+	}
+
+	if _, err := cachedpath.CachedPath(server.URL+"/login?file=a.txt", opts()...); err == nil {
+		t.Error("Expected the download to fail without a cookie jar")
+	}
+
+	path, err := cachedpath.CachedPath(server.URL+"/login?file=a.txt", opts(cachedpath.WithCookieJar(nil))...)
+	if err != nil {
+		t.Fatalf("CachedPath with a cookie jar failed: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "members only" {
+		t.Errorf("Unexpected cached content %q, %v", data, err)
+	}
+
+	// A jar shared between calls keeps the session
+	jar, _ := cookiejar.New(nil)
+	if _, err := cachedpath.CachedPath(server.URL+"/login?file=a.txt", opts(cachedpath.WithCookieJar(jar))...); err != nil {
+		t.Fatalf("Login failed: %v", err)
+	}
+	if _, err := cachedpath.CachedPath(server.URL+"/files/b.txt", opts(cachedpath.WithCookieJar(jar))...); err != nil {
+		t.Errorf("Shared jar should keep the session: %v", err)
+	}
+	if _, err := cachedpath.CachedPath(server.URL+"/files/b.txt", opts(cachedpath.WithCookieJar(nil))...); err == nil {
+		t.Error("A new jar should not have the session")
+	}
+
+	// Custom HTTP clients get the jar without being modified
+	client := &http.Client{}
+	if _, err := cachedpath.CachedPath(server.URL+"/files/c.txt", opts(cachedpath.WithHTTPClient(client), cachedpath.WithCookieJar(jar))...); err != nil {
+		t.Errorf("Custom client should use the jar: %v", err)
+	}
+	if client.Jar != nil {
+		t.Error("The custom client should not be modified")
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/gone.txt":
+			http.NotFound(w, r)
+		case "/private.txt":
+			if r.Header.Get("Authorization") == "" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte("secret"))
+		default:
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	fetch := func(path string, opts ...cachedpath.Option) (int32, error) {
+		before := atomic.LoadInt32(&requests)
+		_, err := cachedpath.CachedPath(server.URL+path, append([]cachedpath.Option{
+			cachedpath.WithCacheDir(t.TempDir()),
+			cachedpath.WithQuiet(true),
+			cachedpath.WithMaxRetries(0),
+			cachedpath.WithNegativeCacheTTL(200 * time.Millisecond),
+		}, opts...)...)
+		return atomic.LoadInt32(&requests) - before, err
+	}
+
+	// A 404 is remembered: the second call fails without a request
+	n, err1 := fetch("/gone.txt")
+	if err1 == nil || n == 0 {
+		t.Fatalf("Expected a failed request, got %d requests, %v", n, err1)
+	}
+	if n, err2 := fetch("/gone.txt"); n != 0 || err2 == nil || err2.Error() != err1.Error() {
+		t.Errorf("Expected the remembered error without requests, got %d requests, %v", n, err2)
+	}
+	if n, _ := fetch("/gone.txt", cachedpath.WithNegativeCacheTTL(0)); n == 0 {
+		t.Error("A disabled negative cache should not be consulted")
+	}
+
+	// Different headers, such as credentials, are a different request
+	if _, err := fetch("/private.txt"); err == nil {
+		t.Fatal("Expected 401 without credentials")
+	}
+	if _, err := fetch("/private.txt", cachedpath.WithAuth("token")); err != nil {
+		t.Errorf("Request with credentials should not be short-circuited: %v", err)
+	}
+
+	// Transient failures are never remembered
+	fetch("/busy.txt")
+	if n, _ := fetch("/busy.txt"); n == 0 {
+		t.Error("5xx failures should not be negatively cached")
+	}
+
+	// The failure expires after the TTL
+	time.Sleep(300 * time.Millisecond)
+	if n, _ := fetch("/gone.txt"); n == 0 {
+		t.Error("Expired failure should be retried")
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var requests int32
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch {
+		case r.URL.Path == "/missing.txt":
+			http.NotFound(w, r)
+		case healthy.Load():
+			w.Write([]byte("ok"))
+		default:
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	fetch := func(path string) (int32, error) {
+		before := atomic.LoadInt32(&requests)
+		_, err := cachedpath.CachedPath(server.URL+path,
+			cachedpath.WithCacheDir(t.TempDir()),
+			cachedpath.WithQuiet(true),
+			cachedpath.WithMaxRetries(0),
+			cachedpath.WithNegativeCacheTTL(0),
+			cachedpath.WithCircuitBreaker(2, 200*time.Millisecond),
+		)
+		return atomic.LoadInt32(&requests) - before, err
+	}
+
+	// A 404 comes from a reachable host and doesn't count
+	fetch("/missing.txt")
+	fetch("/file.txt")
+	if _, err := fetch("/missing.txt"); errors.Is(err, cachedpath.ErrCircuitOpen) {
+		t.Fatal("A 404 should not count as a host failure")
+	}
+
+	// Two consecutive 5xx open the circuit for the whole host
+	fetch("/file.txt")
+	fetch("/file.txt")
+	if n, err := fetch("/other.txt"); !errors.Is(err, cachedpath.ErrCircuitOpen) || n != 0 {
+		t.Fatalf("Expected ErrCircuitOpen without requests, got %d requests, %v", n, err)
+	}
+
+	// After the reset timeout a failed probe opens it again
+	time.Sleep(250 * time.Millisecond)
+	if n, err := fetch("/file.txt"); n == 0 || errors.Is(err, cachedpath.ErrCircuitOpen) {
+		t.Fatalf("Expected a probe request, got %d requests, %v", n, err)
+	}
+	if _, err := fetch("/file.txt"); !errors.Is(err, cachedpath.ErrCircuitOpen) {
+		t.Fatalf("A failed probe should open the circuit again, got %v", err)
+	}
+
+	// A successful probe closes it
+	healthy.Store(true)
+	time.Sleep(250 * time.Millisecond)
+	if _, err := fetch("/file.txt"); err != nil {
+		t.Fatalf("Probe failed: %v", err)
+	}
+	if _, err := fetch("/other.txt"); err != nil {
+		t.Errorf("Closed circuit should let calls through: %v", err)
+	}
+}
+
+func TestCircuitBreakerStates(t *testing.T) {
+	breaker := cachedpath.NewCircuitBreaker(2, 50*time.Millisecond)
+	const host = "example.com"
+
+	breaker.RecordFailure(host)
+	if err := breaker.Allow(host); err != nil || breaker.State(host) != cachedpath.CircuitClosed {
+		t.Fatalf("One failure should keep the circuit closed, got %v, %v", breaker.State(host), err)
+	}
+	breaker.RecordFailure(host)
+	if err := breaker.Allow(host); !errors.Is(err, cachedpath.ErrCircuitOpen) || breaker.State(host) != cachedpath.CircuitOpen {
+		t.Fatalf("Expected an open circuit, got %v, %v", breaker.State(host), err)
+	}
+	if breaker.State("other.com") != cachedpath.CircuitClosed {
+		t.Error("Other hosts should not be affected")
+	}
+
+	// A single probe is let through once half-open
+	time.Sleep(60 * time.Millisecond)
+	if breaker.State(host) != cachedpath.CircuitHalfOpen {
+		t.Fatalf("Expected half-open, got %v", breaker.State(host))
+	}
+	if err := breaker.Allow(host); err != nil {
+		t.Fatalf("Probe should be allowed: %v", err)
+	}
+	if err := breaker.Allow(host); !errors.Is(err, cachedpath.ErrCircuitOpen) {
+		t.Fatalf("Only one probe should be allowed, got %v", err)
+	}
+	breaker.RecordSuccess(host)
+	if err := breaker.Allow(host); err != nil || breaker.State(host) != cachedpath.CircuitClosed {
+		t.Errorf("A successful probe should close the circuit, got %v, %v", breaker.State(host), err)
+	}
+}
+
+func TestMemoryCacheLayer(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("vocab"))
+	}))
+	defer server.Close()
+
+	url := server.URL + "/vocab.txt"
+	hits := 0
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithMemoryCache(8),
+		cachedpath.WithOnCacheHit(func(u, path string, lockWait time.Duration) { hits++ }),
+	}
+	fetch := func(opts ...cachedpath.Option) (string, int32) {
+		t.Helper()
+		before := atomic.LoadInt32(&requests)
+		path, err := cachedpath.CachedPath(url, opts...)
+		if err != nil {
+			t.Fatalf("CachedPath failed: %v", err)
+		}
+		return path, atomic.LoadInt32(&requests) - before
+	}
+
+	path1, _ := fetch(opts...)
+	path2, n := fetch(opts...)
+	if n != 0 || path2 != path1 || hits != 1 {
+		t.Errorf("Expected a memory hit without requests, got %d requests, %d hits", n, hits)
+	}
+
+	// Other headers are another entry
+	if _, n := fetch(append(opts, cachedpath.WithHeader("X-Tenant", "a"))...); n == 0 {
+		t.Error("A call with other headers should not be answered from memory")
+	}
+
+	// So are credentials only sent to the host or read from .netrc
+	host := strings.TrimPrefix(server.URL, "http://")
+	if _, n := fetch(append(opts, cachedpath.WithHostAuth(host, "secret"))...); n == 0 {
+		t.Error("A call with host credentials should not be answered from memory")
+	}
+	if _, n := fetch(append(opts, cachedpath.WithHostAuth(host, "secret"))...); n != 0 {
+		t.Error("A repeated call with host credentials should be answered from memory")
+	}
+	if _, n := fetch(append(opts, cachedpath.WithNetrcAuth())...); n == 0 {
+		t.Error("A call with .netrc credentials should not be answered from memory")
+	}
+
+	// After invalidation the server is asked again
+	cachedpath.InvalidateCache(url)
+	if _, n := fetch(opts...); n == 0 {
+		t.Error("Invalidated URL should be revalidated")
+	}
+}
+
+func TestConcurrentCallersShareDownload(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("ETag", `"v1"`)
+		if r.Method == "GET" {
+			<-release
+			w.Write([]byte("config"))
+		}
+	}))
+	defer server.Close()
+
+	var completed int32
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithOnDownloadComplete(func(url, path string, size int64, dur, lockWait time.Duration) {
+			atomic.AddInt32(&completed, 1)
+		}),
+	}
+
+	const callers = 50
+	paths := make([]string, callers)
+	var wg sync.WaitGroup
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path, err := cachedpath.CachedPath(server.URL+"/config.json", opts...)
+			if err != nil {
+				t.Errorf("CachedPath failed: %v", err)
+			}
+			paths[i] = path
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	// One HEAD and one GET, however many callers
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Expected a single fetch, got %d requests", n)
+	}
+	if n := atomic.LoadInt32(&completed); n != 1 {
+		t.Errorf("Expected one completed download, got %d", n)
+	}
+	for _, path := range paths {
+		if path != paths[0] {
+			t.Fatalf("Callers got different paths: %s and %s", paths[0], path)
+		}
+	}
+}
+
+func TestConcurrentCallersKeepTheirChecks(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "1000")
+		if r.Method == "GET" {
+			<-release
+			w.Write([]byte(strings.Repeat("x", 1000)))
+		}
+	}))
+	defer server.Close()
+
+	base := []cachedpath.Option{cachedpath.WithCacheDir(t.TempDir()), cachedpath.WithQuiet(true)}
+	calls := [][]cachedpath.Option{
+		nil,
+		{cachedpath.WithMaxDownloadSize(10)},
+		{cachedpath.WithExpectedContentType("application/json")},
+	}
+	errs := make([]error, len(calls))
+	var wg sync.WaitGroup
+	for i, opts := range calls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = cachedpath.CachedPath(server.URL+"/data.txt", append(base, opts...)...)
+		}()
+		// Let the unrestricted call start the download first
+		time.Sleep(50 * time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if errs[0] != nil {
+		t.Errorf("Unrestricted call failed: %v", errs[0])
+	}
+	if !errors.Is(errs[1], cachedpath.ErrSizeLimitExceeded) {
+		t.Errorf("Expected the size limit of the second call, got %v", errs[1])
+	}
+	if !errors.Is(errs[2], cachedpath.ErrUnexpectedContentType) {
+		t.Errorf("Expected the content type check of the third call, got %v", errs[2])
+	}
+}
+
+func TestHTTPError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-Id", "abc123")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"error": "token expired"}`+strings.Repeat(" ", 2000))
+	}))
+	defer server.Close()
+
+	_, err := cachedpath.CachedPath(
+		server.URL+"/private.bin",
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+	)
+	if !errors.Is(err, cachedpath.ErrDownloadFailed) {
+		t.Fatalf("Expected ErrDownloadFailed, got %v", err)
+	}
+
+	var httpErr *cachedpath.HTTPError
+	if !errors.As(err, &httpErr) {
+		t.Fatalf("Expected an HTTPError, got %T: %v", err, err)
+	}
+	if httpErr.StatusCode != http.StatusForbidden || httpErr.Status != "403 Forbidden" {
+		t.Errorf("Unexpected status %d %q", httpErr.StatusCode, httpErr.Status)
+	}
+	if httpErr.URL != server.URL+"/private.bin" {
+		t.Errorf("Unexpected URL %q", httpErr.URL)
+	}
+	if httpErr.Header.Get("X-Request-Id") != "abc123" {
+		t.Errorf("Response headers missing: %v", httpErr.Header)
+	}
+	if len(httpErr.Body) != 1024 || !strings.HasPrefix(string(httpErr.Body), `{"error": "token expired"}`) {
+		t.Errorf("Expected the first KB of the body, got %d bytes", len(httpErr.Body))
+	}
+	if strings.Contains(err.Error(), "403 403") {
+		t.Errorf("Status repeated in %q", err)
+	}
+}
+
+func TestStructuredErrors(t *testing.T) {
+	var gets atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			return
+		}
+		gets.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL + "/file.bin")
+	u.User = url.UserPassword("user", "secret")
+	_, err := cachedpath.CachedPath(
+		u.String(),
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithMaxRetries(2),
+		cachedpath.WithRetryDelay(time.Millisecond),
+	)
+	var downloadErr *cachedpath.DownloadError
+	if !errors.As(err, &downloadErr) || !errors.Is(err, cachedpath.ErrDownloadFailed) {
+		t.Fatalf("Expected a DownloadError, got %T: %v", err, err)
+	}
+	if downloadErr.StatusCode != http.StatusServiceUnavailable || downloadErr.Attempt != int(gets.Load()) || downloadErr.Attempt != 3 {
+		t.Errorf("Unexpected status %d after %d attempts (%d requests)", downloadErr.StatusCode, downloadErr.Attempt, gets.Load())
+	}
+	if strings.Contains(downloadErr.URL, "secret") || !strings.HasSuffix(downloadErr.URL, "/file.bin") {
+		t.Errorf("Unexpected URL %q", downloadErr.URL)
+	}
+	var httpErr *cachedpath.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected the HTTPError under the DownloadError, got %v", err)
+	}
+
+	// Extraction failures name the archive and the failed entry
+	tmpDir := t.TempDir()
+	archivePath := filepath.Join(tmpDir, "data.tar.gz")
+	writeTarGz(t, archivePath, map[string]string{"big.bin": strings.Repeat("x", 4096)})
+	_, err = cachedpath.CachedPath(
+		archivePath,
+		cachedpath.WithCacheDir(filepath.Join(tmpDir, "cache")),
+		cachedpath.WithExtractArchive(true),
+		cachedpath.WithMaxExtractFileSize(1024),
+	)
+	var extractErr *cachedpath.ExtractionError
+	if !errors.As(err, &extractErr) || !errors.Is(err, cachedpath.ErrExtractionFailed) || !errors.Is(err, cachedpath.ErrArchiveTooLarge) {
+		t.Fatalf("Expected an ExtractionError, got %T: %v", err, err)
+	}
+	if extractErr.ArchivePath != archivePath || extractErr.Entry != "big.bin" {
+		t.Errorf("Unexpected archive %q and entry %q", extractErr.ArchivePath, extractErr.Entry)
+	}
+
+	// A lock file that can't be created is a LockError too
+	lockPath := filepath.Join(tmpDir, "missing", "file.lock")
+	err = cachedpath.WithLock(lockPath, func() error { return nil })
+	var lockErr *cachedpath.LockError
+	if !errors.As(err, &lockErr) || !errors.Is(err, cachedpath.ErrLockFailed) || !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected a LockError, got %T: %v", err, err)
+	}
+	if lockErr.Path != lockPath {
+		t.Errorf("Unexpected lock path %q", lockErr.Path)
+	}
+}
+
+// lockMetrics collects the lock waits observed through WithMetrics
+type lockMetrics struct {
+	mu    sync.Mutex
+	waits []float64
+}
+
+func (m *lockMetrics) Observe(name string, value float64) {
+	if name != cachedpath.MetricLockWait {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.waits = append(m.waits, value)
+}
+
+func TestLockContention(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("locked content"))
+	}))
+	defer server.Close()
+
+	cacheDir := t.TempDir()
+	url := server.URL + "/file.txt"
+	path, err := cachedpath.CachedPath(url, cachedpath.WithCacheDir(cacheDir), cachedpath.WithQuiet(true))
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+
+	// Another process holds the lock of the entry
+	held := cachedpath.NewFileLock(cachedpath.LockFilePath(path))
+	if err := held.Lock(); err != nil {
+		t.Fatalf("Lock failed: %v", err)
+	}
+
+	// Past the lock timeout the call fails, naming the holder
+	metrics := &lockMetrics{}
+	_, err = cachedpath.CachedPath(url,
+		cachedpath.WithCacheDir(cacheDir),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithForceDownload(true),
+		cachedpath.WithLockTimeout(200*time.Millisecond),
+		cachedpath.WithMetrics(metrics),
+	)
+	var lockErr *cachedpath.LockError
+	if !errors.As(err, &lockErr) || !errors.Is(err, cachedpath.ErrLockFailed) {
+		t.Fatalf("Expected a LockError, got %T: %v", err, err)
+	}
+	if lockErr.Waited < 200*time.Millisecond {
+		t.Errorf("Expected a wait of at least 200ms, got %v", lockErr.Waited)
+	}
+	if !strings.Contains(lockErr.Holder, fmt.Sprintf("pid=%d", os.Getpid())) {
+		t.Errorf("Expected the holder to be this process, got %q", lockErr.Holder)
+	}
+	if len(metrics.waits) != 1 || metrics.waits[0] < 0.2 {
+		t.Errorf("Expected one observed wait of at least 0.2s, got %v", metrics.waits)
+	}
+
+	// Released in time, the wait is reported with the result
+	time.AfterFunc(300*time.Millisecond, func() { held.Unlock() })
+	metrics = &lockMetrics{}
+	var hookWait time.Duration
+	result, err := cachedpath.CachedPathResult(url,
+		cachedpath.WithCacheDir(cacheDir),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithForceDownload(true),
+		cachedpath.WithMetrics(metrics),
+		cachedpath.WithOnDownloadComplete(func(u, path string, size int64, dur, lockWait time.Duration) {
+			hookWait = lockWait
+		}),
+	)
+	if err != nil {
+		t.Fatalf("CachedPathResult failed: %v", err)
+	}
+	if result.LockWait < 300*time.Millisecond {
+		t.Errorf("Expected a lock wait of at least 300ms, got %v", result.LockWait)
+	}
+	if hookWait != result.LockWait {
+		t.Errorf("Expected OnDownloadComplete to get the lock wait %v, got %v", result.LockWait, hookWait)
+	}
+	if len(metrics.waits) == 0 || metrics.waits[0] < 0.3 {
+		t.Errorf("Expected an observed wait of at least 0.3s, got %v", metrics.waits)
+	}
+
+	// Without contention a cache hit waits for nothing
+	hookWait = -1
+	result, err = cachedpath.CachedPathResult(url,
+		cachedpath.WithCacheDir(cacheDir),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithOnCacheHit(func(u, path string, lockWait time.Duration) {
+			hookWait = lockWait
+		}),
+	)
+	if err != nil {
+		t.Fatalf("CachedPathResult failed: %v", err)
+	}
+	if hookWait != result.LockWait || result.LockWait > 100*time.Millisecond {
+		t.Errorf("Unexpected lock wait %v (hook: %v) for an uncontended hit", result.LockWait, hookWait)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		mu.Lock()
+		seen = append(seen, r.Method+" "+user+":"+pass+" "+r.Header.Get("X-Trace"))
+		mu.Unlock()
+		if !ok || user != "alice" || pass != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("private"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		opts []cachedpath.Option
+		ok   bool
+	}{
+		{"basic auth", []cachedpath.Option{cachedpath.WithBasicAuth("alice", "s3cret")}, true},
+		{"with header", []cachedpath.Option{cachedpath.WithHeader("X-Trace", "1"), cachedpath.WithBasicAuth("alice", "s3cret")}, true},
+		{"replaces token", []cachedpath.Option{cachedpath.WithAuth("token"), cachedpath.WithBasicAuth("alice", "s3cret")}, true},
+		{"replaced by token", []cachedpath.Option{cachedpath.WithBasicAuth("alice", "s3cret"), cachedpath.WithAuth("token")}, false},
+		{"wrong password", []cachedpath.Option{cachedpath.WithBasicAuth("alice", "nope")}, false},
+	}
+
+	for _, tt := range tests {
+		mu.Lock()
+		seen = nil
+		mu.Unlock()
+
+		opts := append([]cachedpath.Option{
+			cachedpath.WithCacheDir(t.TempDir()),
+			cachedpath.WithQuiet(true),
+			cachedpath.WithMaxRetries(0),
+			cachedpath.WithNegativeCacheTTL(0),
+		}, tt.opts...)
+		path, err := cachedpath.CachedPath(server.URL+"/file.txt", opts...)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: unexpected result %q, %v", tt.name, path, err)
+			continue
+		}
+
+		mu.Lock()
+		for _, request := range seen {
+			if tt.ok && !strings.Contains(request, "alice:s3cret") {
+				t.Errorf("%s: request without credentials: %q", tt.name, request)
+			}
+			if tt.name == "with header" && !strings.HasSuffix(request, " 1") {
+				t.Errorf("%s: custom header lost: %q", tt.name, request)
+			}
+		}
+		if tt.ok && len(seen) != 2 {
+			t.Errorf("%s: expected a HEAD and a GET, got %v", tt.name, seen)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestCachedPathsBatchError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/private.txt":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/missing.txt":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Write([]byte("content of " + r.URL.Path))
+		}
+	}))
+	defer server.Close()
+
+	urls := []string{
+		server.URL + "/a.txt",
+		server.URL + "/private.txt",
+		server.URL + "/b.txt",
+		server.URL + "/missing.txt",
+	}
+	paths, err := cachedpath.CachedPaths(urls,
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithMaxRetries(0),
+	)
+
+	var batchErr *cachedpath.BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("Expected a BatchError, got %T: %v", err, err)
+	}
+	if len(paths) != len(urls) || paths[1] != "" || paths[3] != "" {
+		t.Fatalf("Unexpected paths %v", paths)
+	}
+	for _, i := range []int{0, 2} {
+		if data, err := os.ReadFile(paths[i]); err != nil || !strings.HasSuffix(string(data), filepath.Base(urls[i])) {
+			t.Errorf("Unexpected content of %s: %q, %v", urls[i], data, err)
+		}
+	}
+
+	succeeded, failed := batchErr.Succeeded(), batchErr.Failed()
+	if len(succeeded) != 2 || succeeded[0].Index != 0 || succeeded[1].Index != 2 {
+		t.Errorf("Unexpected succeeded results %+v", succeeded)
+	}
+	if len(failed) != 2 || failed[0].URL != urls[1] || failed[1].URL != urls[3] {
+		t.Errorf("Unexpected failed results %+v", failed)
+	}
+
+	// The category of each failure is still visible through the batch
+	if !errors.Is(err, cachedpath.ErrDownloadFailed) {
+		t.Error("errors.Is should find ErrDownloadFailed in the batch")
+	}
+	var httpErr *cachedpath.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("errors.As should find the 401, got %v", httpErr)
+	}
+
+	if paths, err := cachedpath.CachedPaths(urls[:1], cachedpath.WithCacheDir(t.TempDir()), cachedpath.WithQuiet(true)); err != nil || len(paths) != 1 {
+		t.Errorf("Expected a successful batch, got %v, %v", paths, err)
+	}
+}
+
+func TestMultipartDownload(t *testing.T) {
+	content := make([]byte, 100*1024+7)
+	for i := range content {
+		content[i] = byte(i * 31 % 251)
+	}
+
+	var ranged, whole int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Method == "GET" {
+			if r.Header.Get("Range") != "" {
+				atomic.AddInt32(&ranged, 1)
+			} else {
+				atomic.AddInt32(&whole, 1)
+			}
+		}
+		if strings.HasPrefix(r.URL.Path, "/plain/") {
+			// No range support: the whole body, whatever was asked for
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			if r.Method == "GET" {
+				w.Write(content)
+			}
+			return
+		}
+		http.ServeContent(w, r, "data.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	cacheDir := t.TempDir()
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(cacheDir),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithMultipartDownload(16*1024, 3),
+	}
+
+	path, err := cachedpath.CachedPath(server.URL+"/ranged/data.bin", opts...)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read cached file: %v", err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Errorf("Cached file differs from the resource (%d bytes, want %d)", len(data), len(content))
+	}
+	if n := atomic.LoadInt32(&ranged); n != 7 {
+		t.Errorf("Expected 7 range requests, got %d", n)
+	}
+	if n := atomic.LoadInt32(&whole); n != 0 {
+		t.Errorf("Expected no full GET, got %d", n)
+	}
+
+	// No temporary parts are left behind
+	entries, _ := os.ReadDir(cacheDir)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".part-") {
+			t.Errorf("Temporary part left in cache: %s", entry.Name())
+		}
+	}
+
+	t.Run("NoRangeSupport", func(t *testing.T) {
+		atomic.StoreInt32(&ranged, 0)
+		atomic.StoreInt32(&whole, 0)
+		path, err := cachedpath.CachedPath(server.URL+"/plain/data.bin", opts...)
+		if err != nil {
+			t.Fatalf("CachedPath failed: %v", err)
+		}
+		data, _ := os.ReadFile(path)
+		if !bytes.Equal(data, content) {
+			t.Errorf("Cached file differs from the resource")
+		}
+		if r, w := atomic.LoadInt32(&ranged), atomic.LoadInt32(&whole); r != 0 || w != 1 {
+			t.Errorf("Expected a single full GET, got %d ranged and %d full", r, w)
+		}
+	})
+}
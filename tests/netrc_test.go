@@ -0,0 +1,76 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/CezarGarrido/cachedpath"
+)
+
+func TestNetrcAuth(t *testing.T) {
+	var mu sync.Mutex
+	var users []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		mu.Lock()
+		users = append(users, user+":"+pass)
+		mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("private"))
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	netrc := filepath.Join(t.TempDir(), "netrc")
+	content := "# credentials\n" +
+		"machine other.example.com login nobody password nothing\n" +
+		"macdef init\ncd /pub\n\n" +
+		"machine " + u.Hostname() + "\n  login alice\n  password s3cret\n" +
+		"default login anonymous password guest\n"
+	if err := os.WriteFile(netrc, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("NETRC", netrc)
+
+	tests := []struct {
+		name string
+		opts []cachedpath.Option
+		want string
+	}{
+		{"netrc", []cachedpath.Option{cachedpath.WithNetrcAuth()}, "alice:s3cret"},
+		{"explicit header wins", []cachedpath.Option{cachedpath.WithNetrcAuth(), cachedpath.WithHeader("Authorization", "Basic Ym9iOnB3")}, "bob:pw"},
+		{"disabled", nil, ":"},
+	}
+
+	for _, tt := range tests {
+		mu.Lock()
+		users = nil
+		mu.Unlock()
+
+		opts := append([]cachedpath.Option{
+			cachedpath.WithCacheDir(t.TempDir()),
+			cachedpath.WithQuiet(true),
+			cachedpath.WithMaxRetries(0),
+		}, tt.opts...)
+		cachedpath.CachedPath(server.URL+"/file.txt", opts...)
+
+		mu.Lock()
+		if len(users) == 0 {
+			t.Errorf("%s: no request reached the server", tt.name)
+		}
+		for _, got := range users {
+			if got != tt.want {
+				t.Errorf("%s: server got credentials %q, want %q", tt.name, got, tt.want)
+			}
+		}
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,123 @@
+package tests
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/CezarGarrido/cachedpath"
+	"github.com/CezarGarrido/cachedpath/schemes"
+)
+
+// disableNetwork disables network access for the rest of the test
+func disableNetwork(t *testing.T) {
+	t.Helper()
+	cachedpath.SetNetworkAllowed(false)
+	t.Cleanup(func() { cachedpath.SetNetworkAllowed(true) })
+}
+
+// memClient is a scheme client serving resources from memory
+type memClient struct{}
+
+func (memClient) GetResource(url string, w io.Writer, headers map[string]string) error {
+	_, err := w.Write([]byte("in memory"))
+	return err
+}
+func (memClient) GetSize(url string, headers map[string]string) (int64, error)  { return 9, nil }
+func (memClient) GetETag(url string, headers map[string]string) (string, error) { return "v1", nil }
+func (memClient) Scheme() string                                                { return "mem" }
+
+// roundTripFunc routes requests of a custom HTTP client to a handler
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestNetworkDisabled(t *testing.T) {
+	disableNetwork(t)
+	cacheDir := t.TempDir()
+
+	urls := []string{
+		"https://example.com/file.txt",
+		"ftp://example.com/file.txt",
+		"sftp://user@example.com/file.txt",
+	}
+	for _, url := range urls {
+		start := time.Now()
+		_, err := cachedpath.CachedPath(url,
+			cachedpath.WithCacheDir(cacheDir),
+			cachedpath.WithQuiet(true),
+			cachedpath.WithMaxRetries(3),
+			cachedpath.WithRetryDelay(time.Second),
+		)
+		if !errors.Is(err, cachedpath.ErrNetworkDisabled) {
+			t.Errorf("CachedPath(%s): expected ErrNetworkDisabled, got %v", url, err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("CachedPath(%s) took %s, expected to fail immediately", url, elapsed)
+		}
+	}
+}
+
+func TestNetworkDisabledAllowsLocalSources(t *testing.T) {
+	tmpDir := t.TempDir()
+	cacheDir := t.TempDir()
+
+	// A resource cached while the network was available
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Etag": []string{`"v1"`}},
+			Body:       io.NopCloser(bytes.NewReader([]byte("cached"))),
+			Request:    req,
+		}, nil
+	})}
+	url := "https://example.com/data.txt"
+	cachedPath, err := cachedpath.CachedPath(url, cachedpath.WithCacheDir(cacheDir), cachedpath.WithQuiet(true), cachedpath.WithHTTPClient(client))
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+
+	disableNetwork(t)
+
+	// Cache hits
+	path, err := cachedpath.CachedPath(url, cachedpath.WithCacheDir(cacheDir), cachedpath.WithQuiet(true))
+	if err != nil || path != cachedPath {
+		t.Errorf("Cached URL = %s, %v; want %s", path, err, cachedPath)
+	}
+
+	// Local paths and data: URIs
+	localFile := tmpDir + "/local.txt"
+	if err := os.WriteFile(localFile, []byte("local"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, input := range []string{localFile, "file://" + localFile, "data:,inline"} {
+		if _, err := cachedpath.CachedPath(input, cachedpath.WithCacheDir(cacheDir)); err != nil {
+			t.Errorf("CachedPath(%s) failed: %v", input, err)
+		}
+	}
+
+	// Loopback test servers
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("loopback"))
+	}))
+	defer server.Close()
+	if _, err := cachedpath.CachedPath(server.URL+"/file.txt", cachedpath.WithCacheDir(cacheDir), cachedpath.WithQuiet(true)); err != nil {
+		t.Errorf("CachedPath from a loopback server failed: %v", err)
+	}
+
+	// Fake scheme clients
+	schemes.Register(memClient{})
+	defer schemes.Unregister("mem")
+	path, err = cachedpath.CachedPath("mem://bucket/file.txt", cachedpath.WithCacheDir(cacheDir), cachedpath.WithQuiet(true))
+	if err != nil {
+		t.Fatalf("CachedPath with a fake scheme client failed: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "in memory" {
+		t.Errorf("Unexpected cached content %q, %v", data, err)
+	}
+}
@@ -0,0 +1,306 @@
+package tests
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/CezarGarrido/cachedpath"
+)
+
+// newAuthProxy starts a forward proxy that requires the given basic credentials
+func newAuthProxy(t *testing.T, user, pass string) (*httptest.Server, *int32) {
+	t.Helper()
+
+	var requests int32
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+	proxy := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.Header.Del("Proxy-Authorization")
+		},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("Proxy-Authorization") != expected {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &requests
+}
+
+func TestProxyAuth(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+	}))
+	defer origin.Close()
+
+	proxy, requests := newAuthProxy(t, "user", "secret")
+
+	// Correct credentials go through the proxy
+	_, err := cachedpath.CachedPath(
+		origin.URL+"/file.txt",
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithProxy(proxy.URL),
+		cachedpath.WithProxyAuth("user", "secret"),
+	)
+	if err != nil {
+		t.Fatalf("CachedPath through proxy failed: %v", err)
+	}
+	if atomic.LoadInt32(requests) == 0 {
+		t.Error("Request did not go through the proxy")
+	}
+
+	// Wrong credentials fail fast with ErrProxyAuthRequired
+	atomic.StoreInt32(requests, 0)
+	_, err = cachedpath.CachedPath(
+		origin.URL+"/file.txt",
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithProxy(proxy.URL),
+		cachedpath.WithProxyAuth("user", "wrong"),
+		cachedpath.WithRetryDelay(time.Millisecond),
+	)
+	if !errors.Is(err, cachedpath.ErrProxyAuthRequired) {
+		t.Errorf("Expected ErrProxyAuthRequired, got %v", err)
+	}
+	if n := atomic.LoadInt32(requests); n != 2 {
+		t.Errorf("Expected one HEAD and one GET without retries, got %d requests", n)
+	}
+}
+
+func TestNoProxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+	}))
+	defer origin.Close()
+
+	proxy, requests := newAuthProxy(t, "user", "secret")
+
+	_, err := cachedpath.CachedPath(
+		origin.URL+"/file.txt",
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithProxy(proxy.URL),
+		cachedpath.WithNoProxy("internal.example.com", "127.0.0.0/8"),
+	)
+	if err != nil {
+		t.Fatalf("CachedPath bypassing proxy failed: %v", err)
+	}
+	if n := atomic.LoadInt32(requests); n != 0 {
+		t.Errorf("Expected proxy to be bypassed, got %d proxy requests", n)
+	}
+}
+
+// newSOCKS5Proxy starts a SOCKS5 proxy requiring username/password
+// authentication (RFC 1928 and RFC 1929), counting the connections it relays
+func newSOCKS5Proxy(t *testing.T, user, pass string) (string, *int32) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var relayed int32
+	handle := func(conn net.Conn) {
+		defer conn.Close()
+		buf := make([]byte, 512)
+
+		// Greeting: only username/password authentication is offered back
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+			return
+		}
+		conn.Write([]byte{5, 2})
+
+		// Username/password sub-negotiation
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		gotUser := make([]byte, buf[1])
+		io.ReadFull(conn, gotUser)
+		io.ReadFull(conn, buf[:1])
+		gotPass := make([]byte, buf[0])
+		io.ReadFull(conn, gotPass)
+		if string(gotUser) != user || string(gotPass) != pass {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+
+		// CONNECT request
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return
+		}
+		var host string
+		switch buf[3] {
+		case 1:
+			io.ReadFull(conn, buf[:4])
+			host = net.IP(buf[:4]).String()
+		case 3:
+			io.ReadFull(conn, buf[:1])
+			name := make([]byte, buf[0])
+			io.ReadFull(conn, name)
+			host = string(name)
+		default:
+			return
+		}
+		io.ReadFull(conn, buf[:2])
+		port := int(buf[0])<<8 | int(buf[1])
+
+		target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			conn.Write([]byte{5, 4, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer target.Close()
+		conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		atomic.AddInt32(&relayed, 1)
+
+		go io.Copy(target, conn)
+		io.Copy(conn, target)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+
+	return l.Addr().String(), &relayed
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+	}))
+	defer origin.Close()
+
+	addr, relayed := newSOCKS5Proxy(t, "user", "secret")
+
+	path, err := cachedpath.CachedPath(
+		origin.URL+"/file.txt",
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithTimeout(5*time.Second),
+		cachedpath.WithProxy("socks5://user:secret@"+addr),
+	)
+	if err != nil {
+		t.Fatalf("CachedPath through SOCKS5 proxy failed: %v", err)
+	}
+	if atomic.LoadInt32(relayed) == 0 {
+		t.Error("Request did not go through the SOCKS5 proxy")
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "content" {
+		t.Errorf("Unexpected cached content %q, %v", data, err)
+	}
+
+	// Wrong credentials are rejected by the proxy
+	_, err = cachedpath.CachedPath(
+		origin.URL+"/other.txt",
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithMaxRetries(0),
+		cachedpath.WithProxy("socks5://user:wrong@"+addr),
+	)
+	if err == nil {
+		t.Error("Expected SOCKS5 authentication failure")
+	}
+}
+
+func TestInvalidProxyScheme(t *testing.T) {
+	_, err := cachedpath.CachedPath(
+		"http://example.com/file.txt",
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithProxy("ftp://proxy:21"),
+	)
+	if !errors.Is(err, cachedpath.ErrInvalidURL) {
+		t.Errorf("Expected ErrInvalidURL for an unsupported proxy scheme, got %v", err)
+	}
+}
+
+// envProxyTestEnv marks the subprocess of TestEnvironmentProxy. net/http
+// reads the proxy environment once per process, so the test runs itself
+// again with HTTP_PROXY set from the start.
+const envProxyTestEnv = "CACHEDPATH_TEST_ENV_PROXY"
+
+func TestEnvironmentProxy(t *testing.T) {
+	if os.Getenv(envProxyTestEnv) == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestEnvironmentProxy$", "-test.v")
+		cmd.Env = append(os.Environ(), envProxyTestEnv+"=1", "HTTP_PROXY=", "http_proxy=", "NO_PROXY=", "no_proxy=")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("Subprocess failed: %v\n%s", err, out)
+		}
+		return
+	}
+
+	var requests int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Host != "example.invalid" {
+			http.Error(w, "unexpected host", http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte("via proxy"))
+	}))
+	defer proxy.Close()
+	os.Setenv("HTTP_PROXY", proxy.URL)
+
+	// The request only reaches the proxy, which answers for any host
+	cachedpath.SetNetworkAllowed(true)
+	path, err := cachedpath.CachedPath(
+		"http://example.invalid/file.txt",
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithMaxRetries(0),
+	)
+	if err != nil {
+		t.Fatalf("CachedPath through the environment proxy failed: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "via proxy" {
+		t.Errorf("Unexpected cached content %q, %v", data, err)
+	}
+	if atomic.LoadInt32(&requests) == 0 {
+		t.Error("Request did not go through the environment proxy")
+	}
+
+	// WithNoProxy() ignores the environment proxy: the direct connection
+	// fails because .invalid names never resolve
+	before := atomic.LoadInt32(&requests)
+	_, err = cachedpath.CachedPath(
+		"http://example.invalid/other.txt",
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithMaxRetries(0),
+		cachedpath.WithNoProxy(),
+	)
+	if err == nil {
+		t.Error("Expected the direct connection to fail")
+	}
+	if atomic.LoadInt32(&requests) != before {
+		t.Error("WithNoProxy() request went through the environment proxy")
+	}
+}
@@ -0,0 +1,277 @@
+package tests
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/CezarGarrido/cachedpath"
+)
+
+func TestRedirectStripsAuthorization(t *testing.T) {
+	var mu sync.Mutex
+	var cdnAuth []string
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		cdnAuth = append(cdnAuth, r.Header.Get("Authorization"))
+		mu.Unlock()
+		w.Write([]byte("content"))
+	}))
+	defer cdn.Close()
+
+	var apiAuth []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		apiAuth = append(apiAuth, r.Header.Get("Authorization"))
+		mu.Unlock()
+		if r.URL.Path == "/old" {
+			// Same-host redirect keeps the credentials
+			http.Redirect(w, r, "/download", http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, cdn.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer api.Close()
+
+	tests := []struct {
+		name     string
+		opt      cachedpath.Option
+		wantAuth string
+	}{
+		{"stripped", cachedpath.WithForwardAuthOnRedirect(false), ""},
+		{"forwarded", cachedpath.WithForwardAuthOnRedirect(true), "Bearer secret"},
+		{"forward policy", cachedpath.WithRedirectPolicy(cachedpath.RedirectForwardAuth), "Bearer secret"},
+		{"forward undone", func(o *cachedpath.Options) {
+			cachedpath.WithForwardAuthOnRedirect(true)(o)
+			cachedpath.WithForwardAuthOnRedirect(false)(o)
+		}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			cdnAuth, apiAuth = nil, nil
+			mu.Unlock()
+
+			_, err := cachedpath.CachedPath(
+				api.URL+"/old",
+				cachedpath.WithCacheDir(t.TempDir()),
+				cachedpath.WithQuiet(true),
+				cachedpath.WithAuth("secret"),
+				tt.opt,
+			)
+			if err != nil {
+				t.Fatalf("CachedPath failed: %v", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, auth := range apiAuth {
+				if auth != "Bearer secret" {
+					t.Errorf("API host got Authorization %q", auth)
+				}
+			}
+			if len(cdnAuth) == 0 {
+				t.Fatal("CDN was never reached")
+			}
+			for _, auth := range cdnAuth {
+				if auth != tt.wantAuth {
+					t.Errorf("CDN host got Authorization %q, want %q", auth, tt.wantAuth)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxRedirects(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Redirect(w, r, r.URL.Path, http.StatusFound)
+	}))
+	defer server.Close()
+
+	_, err := cachedpath.CachedPath(
+		server.URL+"/loop",
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithMaxRedirects(2),
+	)
+	if !errors.Is(err, cachedpath.ErrTooManyRedirects) {
+		t.Fatalf("Expected ErrTooManyRedirects, got %v", err)
+	}
+
+	// HEAD and GET each follow two redirects, without retries
+	if n := atomic.LoadInt32(&requests); n != 6 {
+		t.Errorf("Expected 6 requests, got %d", n)
+	}
+}
+
+func TestRedirectSameHost(t *testing.T) {
+	var cdnRequests int32
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&cdnRequests, 1)
+		w.Write([]byte("content"))
+	}))
+	defer cdn.Close()
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/old":
+			http.Redirect(w, r, "/new", http.StatusFound)
+		case "/new":
+			w.Write([]byte("content"))
+		default:
+			http.Redirect(w, r, cdn.URL+r.URL.Path, http.StatusFound)
+		}
+	}))
+	defer api.Close()
+
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithRedirectPolicy(cachedpath.RedirectSameHost),
+	}
+
+	if _, err := cachedpath.CachedPath(api.URL+"/old", opts...); err != nil {
+		t.Errorf("Same-host redirect failed: %v", err)
+	}
+
+	_, err := cachedpath.CachedPath(api.URL+"/file.bin", opts...)
+	if !errors.Is(err, cachedpath.ErrRedirectNotAllowed) {
+		t.Errorf("Expected ErrRedirectNotAllowed, got %v", err)
+	}
+	if n := atomic.LoadInt32(&cdnRequests); n != 0 {
+		t.Errorf("Cross-host redirect was followed %d times", n)
+	}
+}
+
+func TestOnRedirect(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest" {
+			http.Redirect(w, r, "/releases/v2.bin", http.StatusFound)
+			return
+		}
+		w.Header().Set("ETag", `"v2"`)
+		w.Write([]byte("release"))
+	}))
+	defer server.Close()
+
+	for _, client := range []*http.Client{nil, {}} {
+		var mu sync.Mutex
+		var seen []string
+		opts := []cachedpath.Option{
+			cachedpath.WithCacheDir(t.TempDir()),
+			cachedpath.WithQuiet(true),
+			cachedpath.WithOnRedirect(func(req *http.Request, via []*http.Request) error {
+				mu.Lock()
+				defer mu.Unlock()
+				seen = append(seen, via[len(via)-1].URL.Path+" -> "+req.URL.Path)
+				return nil
+			}),
+		}
+		if client != nil {
+			opts = append(opts, cachedpath.WithHTTPClient(client))
+		}
+
+		path, err := cachedpath.CachedPath(server.URL+"/latest", opts...)
+		if err != nil {
+			t.Fatalf("CachedPath failed: %v", err)
+		}
+		mu.Lock()
+		if len(seen) == 0 || seen[0] != "/latest -> /releases/v2.bin" {
+			t.Errorf("Unexpected redirects seen: %v", seen)
+		}
+		mu.Unlock()
+
+		// The metadata records where the file came from
+		meta, err := cachedpath.LoadMetaFromFile(cachedpath.MetaFilePath(path))
+		if err != nil || meta.FinalURL != server.URL+"/releases/v2.bin" {
+			t.Errorf("Expected the final URL in the metadata, got %+v, %v", meta, err)
+		}
+		if client != nil && client.CheckRedirect != nil {
+			t.Error("The custom client should not be modified")
+		}
+	}
+
+	// An error from the callback stops the download
+	errBlocked := errors.New("blocked")
+	_, err := cachedpath.CachedPath(server.URL+"/latest",
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithMaxRetries(0),
+		cachedpath.WithOnRedirect(func(req *http.Request, via []*http.Request) error { return errBlocked }),
+	)
+	if !errors.Is(err, errBlocked) {
+		t.Errorf("Expected the callback error, got %v", err)
+	}
+}
+
+func TestHostHeaders(t *testing.T) {
+	var mu sync.Mutex
+	seen := map[string][]string{}
+	record := func(name string, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen[name] = append(seen[name], r.URL.Path+" "+r.Header.Get("Authorization")+" "+r.Header.Get("X-Team")+" "+r.Header.Get("X-Global"))
+	}
+
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record("internal", r)
+		w.Write([]byte("internal"))
+	}))
+	defer internal.Close()
+
+	github := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record("github", r)
+		switch r.URL.Path {
+		case "/moved":
+			http.Redirect(w, r, "/release.bin", http.StatusFound)
+		case "/elsewhere":
+			http.Redirect(w, r, internal.URL+"/from-github.bin", http.StatusFound)
+		default:
+			w.Write([]byte("github"))
+		}
+	}))
+	defer github.Close()
+
+	githubHost := strings.TrimPrefix(github.URL, "http://")
+	internalHost := strings.TrimPrefix(internal.URL, "http://")
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithHeader("X-Global", "g"),
+		cachedpath.WithAuth("global"),
+		cachedpath.WithHostHeader(githubHost, "Authorization", "token gh"),
+		cachedpath.WithHostHeader(githubHost, "X-Team", "ml"),
+		cachedpath.WithHostAuth(internalHost, "internal"),
+	}
+
+	if _, err := cachedpath.CachedPaths([]string{
+		github.URL + "/moved",
+		internal.URL + "/data.bin",
+		github.URL + "/elsewhere",
+	}, opts...); err != nil {
+		t.Fatalf("CachedPaths failed: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, request := range seen["github"] {
+		if !strings.HasSuffix(request, " token gh ml g") {
+			t.Errorf("GitHub request without its headers: %q", request)
+		}
+	}
+	for _, request := range seen["internal"] {
+		if !strings.HasSuffix(request, " Bearer internal  g") {
+			t.Errorf("Internal request with wrong headers: %q", request)
+		}
+	}
+	if len(seen["internal"]) < 3 {
+		t.Errorf("Expected direct and redirected requests to the internal server, got %v", seen["internal"])
+	}
+}
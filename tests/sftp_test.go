@@ -0,0 +1,285 @@
+package tests
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/CezarGarrido/cachedpath"
+)
+
+// sftpServer is a minimal SSH server whose sftp subsystem serves files
+// from memory
+type sftpServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.PublicKey
+
+	mu    sync.Mutex
+	files map[string]string
+	mtime map[string]uint32
+}
+
+// newSFTPServer starts a server accepting the given client key
+func newSFTPServer(t *testing.T, clientKey ssh.PublicKey) *sftpServer {
+	t.Helper()
+
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "deploy" && string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := &sftpServer{
+		listener: l,
+		config:   config,
+		hostKey:  hostSigner.PublicKey(),
+		files:    make(map[string]string),
+		mtime:    make(map[string]uint32),
+	}
+	go s.serve()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *sftpServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *sftpServer) setFile(path, content string, mtime uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[path] = content
+	s.mtime[path] = mtime
+}
+
+func (s *sftpServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *sftpServer) handleConn(netConn net.Conn) {
+	conn, chans, reqs, err := ssh.NewServerConn(netConn, s.config)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go s.handleSFTP(channel)
+				}
+			}
+		}()
+	}
+}
+
+// handleSFTP answers INIT, STAT, OPEN, READ and CLOSE
+func (s *sftpServer) handleSFTP(channel ssh.Channel) {
+	defer channel.Close()
+
+	reply := func(typ byte, id uint32, payload []byte) {
+		body := []byte{typ}
+		if typ != 2 {
+			body = binary.BigEndian.AppendUint32(body, id)
+		}
+		body = append(body, payload...)
+		channel.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(body))), body...))
+	}
+	str := func(s string) []byte {
+		return append(binary.BigEndian.AppendUint32(nil, uint32(len(s))), s...)
+	}
+	status := func(id, code uint32) {
+		reply(101, id, append(append(binary.BigEndian.AppendUint32(nil, code), str("")...), str("")...))
+	}
+
+	for {
+		var length [4]byte
+		if _, err := io.ReadFull(channel, length[:]); err != nil {
+			return
+		}
+		packet := make([]byte, binary.BigEndian.Uint32(length[:]))
+		if _, err := io.ReadFull(channel, packet); err != nil {
+			return
+		}
+
+		typ, body := packet[0], packet[1:]
+		if typ == 1 { // INIT
+			reply(2, 0, binary.BigEndian.AppendUint32(nil, 3))
+			continue
+		}
+
+		id := binary.BigEndian.Uint32(body)
+		body = body[4:]
+		nameLen := binary.BigEndian.Uint32(body)
+		name := string(body[4 : 4+nameLen])
+		rest := body[4+nameLen:]
+
+		s.mu.Lock()
+		content, exists := s.files[name]
+		mtime := s.mtime[name]
+		s.mu.Unlock()
+
+		switch typ {
+		case 17: // STAT
+			if !exists {
+				status(id, 2) // no such file
+				continue
+			}
+			attrs := binary.BigEndian.AppendUint32(nil, 0x1|0x8)
+			attrs = binary.BigEndian.AppendUint64(attrs, uint64(len(content)))
+			attrs = binary.BigEndian.AppendUint32(attrs, mtime)
+			attrs = binary.BigEndian.AppendUint32(attrs, mtime)
+			reply(105, id, attrs)
+		case 3: // OPEN: the handle is the path
+			if !exists {
+				status(id, 2)
+				continue
+			}
+			reply(102, id, str(name))
+		case 5: // READ
+			offset := binary.BigEndian.Uint64(rest)
+			size := uint64(binary.BigEndian.Uint32(rest[8:]))
+			if offset >= uint64(len(content)) {
+				status(id, 1) // EOF
+				continue
+			}
+			end := min(offset+size, uint64(len(content)))
+			reply(103, id, str(content[offset:end]))
+		case 4: // CLOSE
+			status(id, 0)
+		default:
+			status(id, 8) // unsupported
+		}
+	}
+}
+
+// newSSHKey returns a PEM encoded private key and its public key
+func newSSHKey(t *testing.T) ([]byte, ssh.PublicKey) {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(block), signer.PublicKey()
+}
+
+func TestSFTP(t *testing.T) {
+	keyPEM, pub := newSSHKey(t)
+	server := newSFTPServer(t, pub)
+	server.setFile("/srv/artifacts/model.bin", strings.Repeat("m", 100000), 1700000000)
+
+	tmpDir := t.TempDir()
+	knownHosts := filepath.Join(tmpDir, "known_hosts")
+	line := knownhosts.Line([]string{server.addr()}, server.hostKey)
+	if err := os.WriteFile(knownHosts, []byte(line+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	url := "sftp://deploy@" + server.addr() + "/srv/artifacts/model.bin"
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(filepath.Join(tmpDir, "cache")),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithSSHKey(keyPEM),
+		cachedpath.WithKnownHostsFile(knownHosts),
+	}
+
+	path1, err := cachedpath.CachedPath(url, opts...)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	data, err := os.ReadFile(path1)
+	if err != nil || len(data) != 100000 {
+		t.Fatalf("Unexpected cached content (%d bytes), %v", len(data), err)
+	}
+
+	// A new modification time is a new version
+	server.setFile("/srv/artifacts/model.bin", "retrained", 1700000100)
+	path2, err := cachedpath.CachedPath(url, opts...)
+	if err != nil {
+		t.Fatalf("Second CachedPath call failed: %v", err)
+	}
+	if path2 == path1 {
+		t.Error("Modified file should be cached under a new path")
+	}
+	if data, err := os.ReadFile(path2); err != nil || string(data) != "retrained" {
+		t.Errorf("Unexpected cached content %q, %v", data, err)
+	}
+}
+
+func TestSFTPUnknownHost(t *testing.T) {
+	keyPEM, pub := newSSHKey(t)
+	server := newSFTPServer(t, pub)
+	server.setFile("/data.txt", "content", 1700000000)
+
+	tmpDir := t.TempDir()
+	knownHosts := filepath.Join(tmpDir, "known_hosts")
+	if err := os.WriteFile(knownHosts, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := cachedpath.CachedPath(
+		"sftp://deploy@"+server.addr()+"/data.txt",
+		cachedpath.WithCacheDir(filepath.Join(tmpDir, "cache")),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithSSHKey(keyPEM),
+		cachedpath.WithKnownHostsFile(knownHosts),
+	)
+	if err == nil {
+		t.Fatal("Expected host key verification to fail")
+	}
+}
@@ -0,0 +1,954 @@
+package tests
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/CezarGarrido/cachedpath"
+	"github.com/CezarGarrido/cachedpath/internal/fsys"
+	"github.com/CezarGarrido/cachedpath/schemes"
+)
+
+func TestCacheIOFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		op   fsys.Op
+		err  error
+	}{
+		{"disk full", fsys.OpWrite, syscall.ENOSPC},
+		{"deferred write error", fsys.OpClose, syscall.EIO},
+		{"cross-device rename", fsys.OpRename, syscall.EXDEV},
+		{"permission denied", fsys.OpCreateTemp, syscall.EACCES},
+		{"cache dir not creatable", fsys.OpMkdirAll, syscall.EACCES},
+	}
+
+	for _, tt := range tests {
+		tmpDir := t.TempDir()
+		fs := fsys.NewFaultFS(nil)
+		fs.Fail(tt.op, tt.err)
+
+		_, err := cachedpath.CachedPath(
+			server.URL+"/file.txt",
+			cachedpath.WithCacheDir(tmpDir),
+			cachedpath.WithQuiet(true),
+			cachedpath.WithCacheBackend(fs),
+		)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.err, err)
+		}
+
+		// No temporary files may be left behind
+		leftovers, _ := filepath.Glob(filepath.Join(tmpDir, ".download-*"))
+		if len(leftovers) != 0 {
+			t.Errorf("%s: temporary files left behind: %v", tt.name, leftovers)
+		}
+	}
+}
+
+func TestCacheIORecovers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	fs := fsys.NewFaultFS(nil)
+	fs.Fail(fsys.OpRename, syscall.EXDEV)
+
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(tmpDir),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithCacheBackend(fs),
+	}
+
+	if _, err := cachedpath.CachedPath(server.URL+"/file.txt", opts...); err == nil {
+		t.Fatal("Expected rename failure")
+	}
+
+	fs.Fail(fsys.OpRename, nil)
+	path, err := cachedpath.CachedPath(server.URL+"/file.txt", opts...)
+	if err != nil {
+		t.Fatalf("CachedPath failed after clearing fault: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "content" {
+		t.Errorf("Unexpected cached content %q, %v", data, err)
+	}
+}
+
+// crossDeviceFS fails renames out of dir with EXDEV, as if dir were a
+// separate mount
+type crossDeviceFS struct {
+	fsys.OS
+	dir string
+}
+
+func (f crossDeviceFS) Rename(oldpath, newpath string) error {
+	if filepath.Dir(oldpath) == f.dir && filepath.Dir(newpath) != f.dir {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EXDEV}
+	}
+	return f.OS.Rename(oldpath, newpath)
+}
+
+func TestTempDir(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	for _, crossDevice := range []bool{false, true} {
+		cacheDir := t.TempDir()
+		tempDir := filepath.Join(t.TempDir(), "downloads")
+		opts := []cachedpath.Option{
+			cachedpath.WithCacheDir(cacheDir),
+			cachedpath.WithTempDir(tempDir),
+			cachedpath.WithQuiet(true),
+		}
+		if crossDevice {
+			opts = append(opts, cachedpath.WithCacheBackend(crossDeviceFS{dir: tempDir}))
+		}
+
+		path, err := cachedpath.CachedPath(server.URL+"/file.txt", opts...)
+		if err != nil {
+			t.Fatalf("cross-device %v: CachedPath failed: %v", crossDevice, err)
+		}
+		if filepath.Dir(path) != cacheDir {
+			t.Errorf("cross-device %v: file cached at %s", crossDevice, path)
+		}
+		if data, err := os.ReadFile(path); err != nil || string(data) != "content" {
+			t.Errorf("cross-device %v: unexpected content %q, %v", crossDevice, data, err)
+		}
+
+		// Nothing is left in either directory
+		leftovers, _ := filepath.Glob(filepath.Join(tempDir, "*"))
+		cacheLeftovers, _ := filepath.Glob(filepath.Join(cacheDir, ".download-*"))
+		if len(leftovers)+len(cacheLeftovers) != 0 {
+			t.Errorf("cross-device %v: temporary files left behind: %v %v", crossDevice, leftovers, cacheLeftovers)
+		}
+	}
+}
+
+func TestCrossDeviceTempDir(t *testing.T) {
+	// A real separate mount, rather than a simulated EXDEV
+	shm, err := os.MkdirTemp("/dev/shm", "cachedpath-*")
+	if err != nil {
+		t.Skipf("no /dev/shm: %v", err)
+	}
+	defer os.RemoveAll(shm)
+	cacheDir := t.TempDir()
+	var shmStat, cacheStat syscall.Stat_t
+	if syscall.Stat(shm, &shmStat) != nil || syscall.Stat(cacheDir, &cacheStat) != nil || shmStat.Dev == cacheStat.Dev {
+		t.Skip("/dev/shm is on the same file system as the cache")
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	path, err := cachedpath.CachedPath(
+		server.URL+"/file.txt",
+		cachedpath.WithCacheDir(cacheDir),
+		cachedpath.WithTempDir(shm),
+		cachedpath.WithQuiet(true),
+	)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "content" {
+		t.Errorf("Unexpected content %q, %v", data, err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(shm, "*")); len(leftovers) != 0 {
+		t.Errorf("Temporary files left behind: %v", leftovers)
+	}
+}
+
+func TestAtomicMetaWrite(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("content"))
+	}))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	fs := fsys.NewFaultFS(nil)
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(tmpDir),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithCacheBackend(fs),
+		cachedpath.WithMaxCacheSize(1 << 20), // Hits rewrite the metadata
+	}
+
+	path, err := cachedpath.CachedPath(server.URL+"/file.txt", opts...)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	before, err := os.ReadFile(cachedpath.MetaFilePath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes stop halfway through, or the replacement fails
+	for _, op := range []fsys.Op{fsys.OpWrite, fsys.OpRename} {
+		fs.Fail(op, syscall.ENOSPC)
+		if _, err := cachedpath.CachedPath(server.URL+"/file.txt", opts...); err != nil {
+			t.Fatalf("%s: cache hit failed: %v", op, err)
+		}
+		fs.Fail(op, nil)
+
+		after, err := os.ReadFile(cachedpath.MetaFilePath(path))
+		if err != nil || string(after) != string(before) {
+			t.Errorf("%s: metadata changed by a failed write:\n%s", op, after)
+		}
+	}
+
+	// A successful write replaces the metadata whole
+	if _, err := cachedpath.CachedPath(server.URL+"/file.txt", opts...); err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	meta, err := cachedpath.LoadMetaFromFile(cachedpath.MetaFilePath(path))
+	if err != nil || meta.ETag != `"v1"` {
+		t.Errorf("Unexpected metadata %+v, %v", meta, err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(tmpDir, ".meta-*")); len(leftovers) != 0 {
+		t.Errorf("Temporary files left behind: %v", leftovers)
+	}
+}
+
+// snapshotTree records every file and directory below root with its
+// modification time
+func snapshotTree(t *testing.T, root string) map[string]time.Time {
+	t.Helper()
+	tree := make(map[string]time.Time)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		tree[path] = info.ModTime()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk %s: %v", root, err)
+	}
+	return tree
+}
+
+func TestCacheHitIsZeroWrite(t *testing.T) {
+	tests := []struct {
+		name string
+		etag string
+	}{
+		{"conditional", `"v1"`},
+		{"head", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.etag != "" {
+					w.Header().Set("ETag", tt.etag)
+					if r.Header.Get("If-None-Match") == tt.etag {
+						w.WriteHeader(http.StatusNotModified)
+						return
+					}
+				}
+				w.Write([]byte("content"))
+			}))
+			defer server.Close()
+
+			tmpDir := t.TempDir()
+			opts := []cachedpath.Option{cachedpath.WithCacheDir(tmpDir), cachedpath.WithQuiet(true)}
+
+			path1, err := cachedpath.CachedPath(server.URL+"/file.txt", opts...)
+			if err != nil {
+				t.Fatalf("First CachedPath call failed: %v", err)
+			}
+			before := snapshotTree(t, tmpDir)
+
+			path2, err := cachedpath.CachedPath(server.URL+"/file.txt", opts...)
+			if err != nil {
+				t.Fatalf("Second CachedPath call failed: %v", err)
+			}
+			if path1 != path2 {
+				t.Errorf("Cache hit returned different path: %s vs %s", path1, path2)
+			}
+			if after := snapshotTree(t, tmpDir); !reflect.DeepEqual(before, after) {
+				t.Errorf("Cache hit modified the cache directory:\nbefore: %v\nafter:  %v", before, after)
+			}
+		})
+	}
+}
+
+func TestExtractedHitIsZeroWrite(t *testing.T) {
+	tmpDir := t.TempDir()
+	archivePath := filepath.Join(tmpDir, "data.tar.gz")
+	writeTarGz(t, archivePath, map[string]string{"dir/file.txt": "inside"})
+
+	cacheDir := filepath.Join(tmpDir, "cache")
+	opts := []cachedpath.Option{cachedpath.WithCacheDir(cacheDir), cachedpath.WithQuiet(true)}
+
+	// Local files that need no extraction do not create the cache directory
+	if _, err := cachedpath.CachedPath(archivePath, opts...); err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	if _, err := os.Stat(cacheDir); !os.IsNotExist(err) {
+		t.Errorf("Cache directory should not be created for a plain local file: %v", err)
+	}
+
+	path1, err := cachedpath.CachedPath(archivePath+"!dir/file.txt", opts...)
+	if err != nil {
+		t.Fatalf("First extraction failed: %v", err)
+	}
+	before := snapshotTree(t, cacheDir)
+
+	path2, err := cachedpath.CachedPath(archivePath+"!dir/file.txt", opts...)
+	if err != nil {
+		t.Fatalf("Second extraction failed: %v", err)
+	}
+	if path1 != path2 {
+		t.Errorf("Extraction hit returned different path: %s vs %s", path1, path2)
+	}
+	if after := snapshotTree(t, cacheDir); !reflect.DeepEqual(before, after) {
+		t.Errorf("Extraction hit modified the cache directory:\nbefore: %v\nafter:  %v", before, after)
+	}
+}
+
+// checkMode fails the test unless path has all the mode bits in want
+func checkMode(t *testing.T, path string, want os.FileMode) {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Errorf("Stat(%s): %v", path, err)
+		return
+	}
+	if got := info.Mode() & (os.ModePerm | os.ModeSetgid); got&want != want {
+		t.Errorf("%s: mode %v, want at least %v", filepath.Base(path), got, want)
+	}
+}
+
+func TestFileModes(t *testing.T) {
+	// A restrictive umask must not make cache entries private
+	defer syscall.Umask(syscall.Umask(077))
+
+	tmpDir := t.TempDir()
+	archivePath := filepath.Join(tmpDir, "data.tar.gz")
+	writeTarGz(t, archivePath, map[string]string{"dir/file.txt": "inside"})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeFile(w, r, archivePath)
+	}))
+	defer server.Close()
+
+	cacheDir := filepath.Join(tmpDir, "private")
+	path, err := cachedpath.CachedPath(server.URL+"/data.tar.gz", cachedpath.WithCacheDir(cacheDir), cachedpath.WithQuiet(true))
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	checkMode(t, cacheDir, 0755)
+	for _, p := range []string{path, cachedpath.MetaFilePath(path), cachedpath.LockFilePath(path)} {
+		checkMode(t, p, 0644)
+	}
+
+	// On a setgid group cache every entry is group-writable and keeps the
+	// group of the cache directory, streamed or not
+	for _, streaming := range []bool{false, true} {
+		sharedDir := filepath.Join(tmpDir, "shared", map[bool]string{false: "download", true: "stream"}[streaming])
+		if err := os.MkdirAll(sharedDir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(sharedDir, 0770|os.ModeSetgid); err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := cachedpath.CachedPathResult(server.URL+"/data.tar.gz",
+			cachedpath.WithCacheDir(sharedDir),
+			cachedpath.WithQuiet(true),
+			cachedpath.WithGroupCache(true),
+			cachedpath.WithExtractArchive(true),
+			cachedpath.WithStreamingExtract(streaming),
+		)
+		if err != nil {
+			t.Fatalf("CachedPathResult (streaming %v) failed: %v", streaming, err)
+		}
+
+		entries, err := os.ReadDir(sharedDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				checkMode(t, filepath.Join(sharedDir, entry.Name()), 0664)
+			}
+		}
+		checkMode(t, filepath.Dir(result.ExtractedDir), 0770|os.ModeSetgid)
+		checkMode(t, result.ExtractedDir, 0770|os.ModeSetgid)
+		checkMode(t, filepath.Join(result.ExtractedDir, "dir"), 0770|os.ModeSetgid)
+		checkMode(t, filepath.Join(result.ExtractedDir, "dir", "file.txt"), 0664)
+
+		var cacheStat, fileStat syscall.Stat_t
+		syscall.Stat(sharedDir, &cacheStat)
+		syscall.Stat(filepath.Join(result.ExtractedDir, "dir", "file.txt"), &fileStat)
+		if fileStat.Gid != cacheStat.Gid {
+			t.Errorf("Extracted file group %d, want the cache group %d", fileStat.Gid, cacheStat.Gid)
+		}
+	}
+}
+
+// shortClient reports a size larger than the data it sends
+type shortClient struct{}
+
+func (shortClient) GetResource(url string, w io.Writer, headers map[string]string) error {
+	_, err := w.Write([]byte("truncated"))
+	return err
+}
+func (shortClient) GetSize(url string, headers map[string]string) (int64, error)  { return 100, nil }
+func (shortClient) GetETag(url string, headers map[string]string) (string, error) { return "v1", nil }
+func (shortClient) Scheme() string                                                { return "short" }
+
+func TestIncompleteDownload(t *testing.T) {
+	schemes.Register(shortClient{})
+	defer schemes.Unregister("short")
+
+	cacheDir := t.TempDir()
+	_, err := cachedpath.CachedPath("short://host/file.bin", cachedpath.WithCacheDir(cacheDir), cachedpath.WithQuiet(true))
+	var incomplete *cachedpath.IncompleteDownloadError
+	if !errors.As(err, &incomplete) || !errors.Is(err, cachedpath.ErrIncompleteDownload) {
+		t.Fatalf("Expected IncompleteDownloadError, got %v", err)
+	}
+	if incomplete.Expected != 100 || incomplete.Written != 9 {
+		t.Errorf("Expected 9 of 100 bytes, got %d of %d", incomplete.Written, incomplete.Expected)
+	}
+
+	// Nothing is cached, so the next call downloads again
+	files, _ := filepath.Glob(filepath.Join(cacheDir, "*.bin"))
+	if len(files) != 0 {
+		t.Errorf("Truncated download was cached: %v", files)
+	}
+}
+
+// capClient is a scheme client that declares its capabilities and counts
+// the calls it gets
+type capClient struct {
+	caps  schemes.Capabilities
+	calls *capCalls
+}
+
+// capCalls records the calls to a capClient
+type capCalls struct {
+	mu      sync.Mutex
+	methods []string
+	config  schemes.Config
+}
+
+func (c capClient) record(method string) {
+	c.calls.mu.Lock()
+	defer c.calls.mu.Unlock()
+	c.calls.methods = append(c.calls.methods, method)
+}
+
+func (c capClient) GetResource(url string, w io.Writer, headers map[string]string) error {
+	c.record("GetResource")
+	_, err := w.Write([]byte("immutable"))
+	return err
+}
+func (c capClient) GetSize(url string, headers map[string]string) (int64, error) {
+	c.record("GetSize")
+	return 9, nil
+}
+func (c capClient) GetETag(url string, headers map[string]string) (string, error) {
+	c.record("GetETag")
+	return "v1", nil
+}
+func (c capClient) GetMetadata(url string, headers map[string]string) (schemes.ResourceInfo, error) {
+	c.record("GetMetadata")
+	return schemes.ResourceInfo{ETag: "v1", Size: 9}, nil
+}
+func (c capClient) Scheme() string                     { return "caps" }
+func (c capClient) Capabilities() schemes.Capabilities { return c.caps }
+func (c capClient) Configure(cfg schemes.Config) schemes.SchemeClient {
+	c.calls.mu.Lock()
+	defer c.calls.mu.Unlock()
+	c.calls.config = cfg
+	return c
+}
+
+func TestSchemeCapabilities(t *testing.T) {
+	run := func(caps schemes.Capabilities, opts ...cachedpath.Option) []string {
+		calls := &capCalls{}
+		schemes.Register(capClient{caps: caps, calls: calls})
+		defer schemes.Unregister("caps")
+
+		opts = append([]cachedpath.Option{cachedpath.WithCacheDir(t.TempDir()), cachedpath.WithQuiet(true)}, opts...)
+		for i := 0; i < 2; i++ {
+			path, err := cachedpath.CachedPath("caps://store/file.bin", opts...)
+			if err != nil {
+				t.Fatalf("CachedPath failed: %v", err)
+			}
+			if data, _ := os.ReadFile(path); string(data) != "immutable" {
+				t.Errorf("Unexpected content %q", data)
+			}
+		}
+		if calls.config.MaxRetries != 7 {
+			t.Errorf("Client was not configured: %+v", calls.config)
+		}
+		return calls.methods
+	}
+
+	// GetMetadata is implemented but not declared, so it is not used
+	methods := run(0, cachedpath.WithMaxRetries(7))
+	if expected := []string{"GetETag", "GetSize", "GetResource", "GetETag"}; !reflect.DeepEqual(methods, expected) {
+		t.Errorf("Expected calls %v, got %v", expected, methods)
+	}
+
+	methods = run(schemes.CapMetadata, cachedpath.WithMaxRetries(7))
+	if expected := []string{"GetMetadata", "GetResource", "GetMetadata"}; !reflect.DeepEqual(methods, expected) {
+		t.Errorf("Expected calls %v, got %v", expected, methods)
+	}
+
+	// Cached copies from immutable stores are used without any request
+	methods = run(schemes.CapMetadata|schemes.CapImmutable, cachedpath.WithMaxRetries(7))
+	if expected := []string{"GetMetadata", "GetResource"}; !reflect.DeepEqual(methods, expected) {
+		t.Errorf("Expected calls %v, got %v", expected, methods)
+	}
+}
+
+func TestMemoryCache(t *testing.T) {
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if r.Method == "GET" {
+			atomic.AddInt32(&downloads, 1)
+		}
+		w.Write([]byte("kept in memory"))
+	}))
+	defer server.Close()
+
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	cache := cachedpath.NewMemoryCache()
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(cacheDir),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithCacheBackend(cache),
+	}
+
+	// Concurrent callers share one download
+	var wg sync.WaitGroup
+	paths := make([]string, 4)
+	for i := range paths {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if paths[i], err = cachedpath.CachedPath(server.URL+"/file.txt", opts...); err != nil {
+				t.Errorf("CachedPath failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&downloads); n != 1 {
+		t.Errorf("Expected 1 download, got %d", n)
+	}
+	if _, err := os.Stat(cacheDir); !os.IsNotExist(err) {
+		t.Errorf("Memory cache should not touch the disk: %v", err)
+	}
+
+	for _, extra := range [][]cachedpath.Option{nil, {cachedpath.WithOfflineMode(true)}} {
+		r, err := cachedpath.CachedReader(server.URL+"/file.txt", append(opts, extra...)...)
+		if err != nil {
+			t.Fatalf("CachedReader failed: %v", err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || string(data) != "kept in memory" {
+			t.Errorf("Unexpected content %q, %v", data, err)
+		}
+	}
+
+	// Each memory cache is independent
+	if _, err := cachedpath.CachedPath(server.URL+"/file.txt", cachedpath.WithQuiet(true), cachedpath.WithCacheBackend(cachedpath.NewMemoryCache())); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&downloads); n != 2 {
+		t.Errorf("Expected a new download for a new cache, got %d downloads", n)
+	}
+
+	_, err := cachedpath.CachedPath(server.URL+"/data.tar.gz", append(opts, cachedpath.WithExtractArchive(true))...)
+	if !errors.Is(err, cachedpath.ErrUnsupportedByCache) {
+		t.Errorf("Expected ErrUnsupportedByCache for extraction, got %v", err)
+	}
+}
+
+func TestVerifyOnHit(t *testing.T) {
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if r.Method == "GET" {
+			atomic.AddInt32(&downloads, 1)
+		}
+		w.Write([]byte("model weights"))
+	}))
+	defer server.Close()
+
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+	}
+	path, err := cachedpath.CachedPath(server.URL+"/model.bin", opts...)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	meta, err := cachedpath.LoadMetaFromFile(cachedpath.MetaFilePath(path))
+	if err != nil || meta.SHA256 != sha256Hex("model weights") {
+		t.Fatalf("Expected the digest in the metadata, got %+v, %v", meta, err)
+	}
+
+	// Bit rot goes unnoticed without verification
+	if err := os.WriteFile(path, []byte("model weighXs"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cachedpath.CachedPath(server.URL+"/model.bin", opts...); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&downloads); n != 1 {
+		t.Errorf("Expected a hit without verification, got %d downloads", n)
+	}
+
+	offline := append(opts, cachedpath.WithVerifyOnHit(true), cachedpath.WithOfflineMode(true))
+	if _, err := cachedpath.CachedPath(server.URL+"/model.bin", offline...); !errors.Is(err, cachedpath.ErrChecksumMismatch) {
+		t.Errorf("Expected ErrChecksumMismatch offline, got %v", err)
+	}
+
+	path2, err := cachedpath.CachedPath(server.URL+"/model.bin", append(opts, cachedpath.WithVerifyOnHit(true))...)
+	if err != nil {
+		t.Fatalf("Verified CachedPath failed: %v", err)
+	}
+	if n := atomic.LoadInt32(&downloads); n != 2 {
+		t.Errorf("Expected the corrupt file to be downloaded again, got %d downloads", n)
+	}
+	if data, err := os.ReadFile(path2); err != nil || string(data) != "model weights" {
+		t.Errorf("Expected the repaired file, got %q, %v", data, err)
+	}
+
+	// An intact file is a hit
+	if _, err := cachedpath.CachedPath(server.URL+"/model.bin", append(opts, cachedpath.WithVerifyOnHit(true))...); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&downloads); n != 2 {
+		t.Errorf("Expected an intact file to be a hit, got %d downloads", n)
+	}
+}
+
+// sha256Hex returns the hex SHA-256 digest of s
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestParseChecksumFile(t *testing.T) {
+	a, b := sha256Hex("a"), sha256Hex("b")
+	tests := []struct {
+		name     string
+		content  string
+		expected map[string]string
+	}{
+		{"sha256sum", a + "  a.tar.gz\n" + b + " *b.zip\n", map[string]string{"a.tar.gz": a, "b.zip": b}},
+		{"bare hash", strings.ToUpper(a) + "\n", map[string]string{"": a}},
+		{"comments", "# release 1.0\n\n" + a + "  a.tar.gz\n", map[string]string{"a.tar.gz": a}},
+		{"name with spaces", a + "  my file.txt\n", map[string]string{"my file.txt": a}},
+		{"not a checksum", "<html>Not Found</html>\n", nil},
+		{"md5", "d41d8cd98f00b204e9800998ecf8427e  a.tar.gz\n", nil},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "SHA256SUMS")
+		os.WriteFile(path, []byte(tt.content), 0644)
+		sums, err := cachedpath.ParseChecksumFile(path)
+		if tt.expected == nil {
+			if !errors.Is(err, cachedpath.ErrInvalidChecksumFile) {
+				t.Errorf("%s: expected ErrInvalidChecksumFile, got %v", tt.name, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(sums, tt.expected) {
+			t.Errorf("%s: expected %v, got %v, %v", tt.name, tt.expected, sums, err)
+		}
+	}
+}
+
+func TestChecksumFile(t *testing.T) {
+	files := map[string]string{
+		"/release.tar.gz": "release",
+		"/other.bin":      "other",
+	}
+	files["/release.tar.gz.sha256"] = sha256Hex("release") + "  release.tar.gz\n"
+	files["/bare.sha256"] = sha256Hex("release") + "\n"
+	files["/SHA256SUMS"] = sha256Hex("other") + "  other.bin\n" + sha256Hex("release") + "  release.tar.gz\n"
+	files["/wrong.sha256"] = sha256Hex("tampered") + "  release.tar.gz\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		url      string
+		checksum string
+		err      error
+	}{
+		{"sha256 file", "/release.tar.gz", "/release.tar.gz.sha256", nil},
+		{"bare hash", "/release.tar.gz", "/bare.sha256", nil},
+		{"SHA256SUMS", "/other.bin", "/SHA256SUMS", nil},
+		{"mismatch", "/release.tar.gz", "/wrong.sha256", cachedpath.ErrChecksumMismatch},
+		{"not listed", "/unlisted.bin", "/SHA256SUMS", cachedpath.ErrInvalidChecksumFile},
+		{"missing checksum file", "/release.tar.gz", "/missing.sha256", cachedpath.ErrDownloadFailed},
+	}
+
+	for _, tt := range tests {
+		path, err := cachedpath.CachedPath(server.URL+tt.url,
+			cachedpath.WithCacheDir(t.TempDir()),
+			cachedpath.WithQuiet(true),
+			cachedpath.WithMaxRetries(0),
+			cachedpath.WithChecksumFile(server.URL+tt.checksum),
+			cachedpath.WithExpectedContentType("application/octet-stream"),
+		)
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%s: expected %v, got %v", tt.name, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: CachedPath failed: %v", tt.name, err)
+			continue
+		}
+		if data, _ := os.ReadFile(path); string(data) != files[tt.url] {
+			t.Errorf("%s: unexpected content %q", tt.name, data)
+		}
+	}
+}
+
+func TestManifest(t *testing.T) {
+	var requests int32
+	content := map[string]string{"/a.txt": "alpha", "/b.txt": "beta", "/c.txt": "gamma"}
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("ETag", `"`+sha256Hex(content[r.URL.Path])+`"`)
+		w.Write([]byte(content[r.URL.Path]))
+	}))
+	defer server.Close()
+
+	tmpDir := t.TempDir()
+	manifest := filepath.Join(tmpDir, "manifest.json")
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(filepath.Join(tmpDir, "cache")),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithManifest(manifest),
+	}
+
+	// Recording from several goroutines keeps every URL
+	record := append(opts, cachedpath.WithManifestMode(cachedpath.ManifestRecord))
+	if _, err := cachedpath.CachedPaths([]string{server.URL + "/a.txt", server.URL + "/b.txt"}, record...); err != nil {
+		t.Fatalf("Recording failed: %v", err)
+	}
+	data, err := os.ReadFile(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m cachedpath.Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	expected := []cachedpath.ManifestEntry{
+		{URL: server.URL + "/a.txt", SHA256: sha256Hex("alpha")},
+		{URL: server.URL + "/b.txt", SHA256: sha256Hex("beta")},
+	}
+	if !reflect.DeepEqual(m.Entries, expected) {
+		t.Fatalf("Expected manifest %v, got %v", expected, m.Entries)
+	}
+
+	// Enforcing allows the recorded URLs only
+	if _, err := cachedpath.CachedPath(server.URL+"/a.txt", opts...); err != nil {
+		t.Errorf("Listed URL failed: %v", err)
+	}
+	before := atomic.LoadInt32(&requests)
+	_, err = cachedpath.CachedPath(server.URL+"/c.txt", opts...)
+	if !errors.Is(err, cachedpath.ErrNotInManifest) {
+		t.Errorf("Expected ErrNotInManifest, got %v", err)
+	}
+	if atomic.LoadInt32(&requests) != before {
+		t.Error("Unlisted URL should fail before any request")
+	}
+
+	// A new version with another digest is rejected
+	mu.Lock()
+	content["/b.txt"] = "beta v2"
+	mu.Unlock()
+	_, err = cachedpath.CachedPath(server.URL+"/b.txt", opts...)
+	if !errors.Is(err, cachedpath.ErrManifestDigestMismatch) {
+		t.Errorf("Expected ErrManifestDigestMismatch, got %v", err)
+	}
+}
+
+func TestContentAddressable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/other/weights.bin" {
+			w.Write([]byte("other weights"))
+			return
+		}
+		w.Write([]byte("shared weights"))
+	}))
+	defer server.Close()
+
+	cacheDir := t.TempDir()
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(cacheDir),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithContentAddressable(true),
+	}
+
+	path1, err := cachedpath.CachedPath(server.URL+"/mirror1/weights.bin", opts...)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	path2, err := cachedpath.CachedPath(server.URL+"/mirror2/weights.bin", opts...)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	if path1 != path2 {
+		t.Errorf("Identical content should share a path, got %s and %s", path1, path2)
+	}
+	if expected := sha256Hex("shared weights") + ".bin"; filepath.Base(path1) != expected {
+		t.Errorf("Expected content-addressed name %s, got %s", expected, filepath.Base(path1))
+	}
+
+	path3, err := cachedpath.CachedPath(server.URL+"/other/weights.bin", opts...)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	if path3 == path1 {
+		t.Error("Different content should not share a path")
+	}
+
+	// Hits return the content-addressed path too
+	if hit, err := cachedpath.CachedPath(server.URL+"/mirror1/weights.bin", opts...); err != nil || hit != path1 {
+		t.Errorf("Expected hit at %s, got %s, %v", path1, hit, err)
+	}
+
+	// The shared file goes once no URL refers to it
+	if _, err := cachedpath.LRUEvict(cacheDir, 0); err != nil {
+		t.Fatalf("LRUEvict failed: %v", err)
+	}
+	if _, err := os.Stat(path1); !os.IsNotExist(err) {
+		t.Errorf("Content file should be removed with its last entry, got %v", err)
+	}
+}
+
+// staleFS reports a size of 0 for a file the first times it is stat'ed,
+// as an NFS client with cached attributes does after another node's rename
+type staleFS struct {
+	fsys.FS
+	stale atomic.Int32
+}
+
+func (s *staleFS) Stat(name string) (os.FileInfo, error) {
+	info, err := s.FS.Stat(name)
+	if err == nil && !info.IsDir() && !strings.HasSuffix(name, ".json") && s.stale.Add(-1) >= 0 {
+		return staleInfo{info}, nil
+	}
+	return info, err
+}
+
+type staleInfo struct{ os.FileInfo }
+
+func (staleInfo) Size() int64 { return 0 }
+
+func TestNFSSafe(t *testing.T) {
+	var gets int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if r.Method == "GET" {
+			atomic.AddInt32(&gets, 1)
+		}
+		w.Write([]byte("model weights"))
+	}))
+	defer server.Close()
+
+	fs := &staleFS{FS: fsys.OS{}}
+	opts := []cachedpath.Option{
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithCacheBackend(fs),
+		cachedpath.WithNFSSafe(true),
+	}
+	path, err := cachedpath.CachedPath(server.URL+"/model.bin", opts...)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+
+	// Stale attributes are revalidated instead of causing a download
+	fs.stale.Store(3)
+	if _, err := cachedpath.CachedPath(server.URL+"/model.bin", opts...); err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	if n := atomic.LoadInt32(&gets); n != 1 {
+		t.Errorf("Stale attributes should not cause a download, got %d downloads", n)
+	}
+
+	// A file that really is truncated is downloaded again
+	if err := os.WriteFile(path, []byte("model"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cachedpath.CachedPath(server.URL+"/model.bin", opts...); err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	if n := atomic.LoadInt32(&gets); n != 2 {
+		t.Errorf("Truncated file should be downloaded again, got %d downloads", n)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "model weights" {
+		t.Errorf("Unexpected content %q", data)
+	}
+}
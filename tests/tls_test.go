@@ -0,0 +1,233 @@
+package tests
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CezarGarrido/cachedpath"
+)
+
+func TestTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	tests := []struct {
+		name    string
+		opts    []cachedpath.Option
+		success bool
+	}{
+		{"unknown CA", nil, false},
+		{"custom roots", []cachedpath.Option{cachedpath.WithTLSConfig(&tls.Config{RootCAs: roots})}, true},
+		{"skip verify", []cachedpath.Option{cachedpath.WithInsecureSkipVerify(true)}, true},
+	}
+
+	for _, tt := range tests {
+		opts := append([]cachedpath.Option{
+			cachedpath.WithCacheDir(t.TempDir()),
+			cachedpath.WithQuiet(true),
+			cachedpath.WithMaxRetries(0),
+		}, tt.opts...)
+
+		_, err := cachedpath.CachedPath(server.URL+"/file.txt", opts...)
+		if tt.success && err != nil {
+			t.Errorf("%s: CachedPath failed: %v", tt.name, err)
+		}
+		if !tt.success && err == nil {
+			t.Errorf("%s: expected certificate verification to fail", tt.name)
+		}
+	}
+}
+
+func TestTLSConfigIgnoredWithCustomClient(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	defer server.Close()
+
+	logger := &recordingLogger{}
+	_, err := cachedpath.CachedPath(server.URL+"/file.txt",
+		cachedpath.WithCacheDir(t.TempDir()),
+		cachedpath.WithQuiet(true),
+		cachedpath.WithLogger(logger),
+		cachedpath.WithHTTPClient(server.Client()),
+		cachedpath.WithInsecureSkipVerify(false),
+	)
+	if err != nil {
+		t.Fatalf("CachedPath with a custom client failed: %v", err)
+	}
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	for _, msg := range logger.messages {
+		if strings.HasPrefix(msg, "warn: TLS config ignored") {
+			return
+		}
+	}
+	t.Errorf("Expected a warning about the ignored TLS config, got %v", logger.messages)
+}
+
+// writeClientCert writes a self-signed client certificate and its key as
+// PEM files and returns their paths and the certificate
+func writeClientCert(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ci-runner"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile, cert
+}
+
+func TestCACertFileAndClientCert(t *testing.T) {
+	tmpDir := t.TempDir()
+	certFile, keyFile, clientCert := writeClientCert(t, tmpDir)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(tmpDir, "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+
+	tests := []struct {
+		name    string
+		opts    []cachedpath.Option
+		success bool
+	}{
+		{"no client certificate", []cachedpath.Option{cachedpath.WithCACertFile(caFile)}, false},
+		{"no CA", []cachedpath.Option{cachedpath.WithClientCert(certFile, keyFile)}, false},
+		{"CA and client certificate", []cachedpath.Option{
+			cachedpath.WithCACertFile(caFile),
+			cachedpath.WithClientCert(certFile, keyFile),
+			cachedpath.WithTimeout(5 * time.Second),
+			cachedpath.WithProxy("http://proxy.invalid:3128"),
+			cachedpath.WithNoProxy("127.0.0.1"),
+		}, true},
+		{"missing CA file", []cachedpath.Option{cachedpath.WithCACertFile(filepath.Join(tmpDir, "missing.pem"))}, false},
+	}
+
+	for _, tt := range tests {
+		opts := append([]cachedpath.Option{
+			cachedpath.WithCacheDir(t.TempDir()),
+			cachedpath.WithQuiet(true),
+			cachedpath.WithMaxRetries(0),
+		}, tt.opts...)
+
+		_, err := cachedpath.CachedPath(server.URL+"/file.txt", opts...)
+		if tt.success && err != nil {
+			t.Errorf("%s: CachedPath failed: %v", tt.name, err)
+		}
+		if !tt.success && err == nil {
+			t.Errorf("%s: expected the TLS handshake to fail", tt.name)
+		}
+	}
+}
+
+func TestPinnedCertificates(t *testing.T) {
+	// A server with its own key, which the pins below don't cover
+	certFile, keyFile, _ := writeClientCert(t, t.TempDir())
+	otherCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("weights from elsewhere"))
+	}))
+	other.TLS = &tls.Config{Certificates: []tls.Certificate{otherCert}}
+	other.Config.ErrorLog = log.New(io.Discard, "", 0)
+	other.StartTLS()
+	defer other.Close()
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect.bin" {
+			http.Redirect(w, r, other.URL+"/weights.bin", http.StatusFound)
+			return
+		}
+		w.Write([]byte("weights"))
+	}))
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	spki := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+	pin := "sha256/" + base64.StdEncoding.EncodeToString(spki[:])
+
+	tests := []struct {
+		name    string
+		path    string
+		pins    []string
+		wantErr error
+	}{
+		{"pinned key", "/weights.bin", []string{pin}, nil},
+		{"hex pin", "/weights.bin", []string{strings.Repeat("00", 32), hex.EncodeToString(spki[:])}, nil},
+		{"other key", "/weights.bin", []string{strings.Repeat("00", 32)}, cachedpath.ErrCertificatePinMismatch},
+		{"redirect to unpinned host", "/redirect.bin", []string{pin}, cachedpath.ErrCertificatePinMismatch},
+	}
+
+	for _, tt := range tests {
+		_, err := cachedpath.CachedPath(server.URL+tt.path,
+			cachedpath.WithCacheDir(t.TempDir()),
+			cachedpath.WithQuiet(true),
+			cachedpath.WithMaxRetries(0),
+			cachedpath.WithInsecureSkipVerify(true),
+			cachedpath.WithPinnedCertificates(tt.pins...),
+		)
+		if tt.wantErr == nil && err != nil {
+			t.Errorf("%s: CachedPath failed: %v", tt.name, err)
+		}
+		if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+}
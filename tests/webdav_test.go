@@ -0,0 +1,105 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/CezarGarrido/cachedpath"
+)
+
+// newWebDAVServer starts a WebDAV server over an in-memory file system and
+// returns its webdav:// URL. It counts the requests by method.
+func newWebDAVServer(t *testing.T, files map[string]string) (string, webdav.FileSystem, map[string]int, *sync.Mutex) {
+	t.Helper()
+	fs := webdav.NewMemFS()
+	for name, content := range files {
+		writeWebDAVFile(t, fs, name, content)
+	}
+
+	var mu sync.Mutex
+	methods := make(map[string]int)
+	handler := &webdav.Handler{FileSystem: fs, LockSystem: webdav.NewMemLS()}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "alice" || pass != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="dav"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		methods[r.Method]++
+		mu.Unlock()
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return "webdav://alice:secret@" + strings.TrimPrefix(server.URL, "http://"), fs, methods, &mu
+}
+
+func writeWebDAVFile(t *testing.T, fs webdav.FileSystem, name, content string) {
+	t.Helper()
+	f, err := fs.OpenFile(context.Background(), name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatalf("Failed to create %s: %v", name, err)
+	}
+	f.Write([]byte(content))
+	f.Close()
+}
+
+func TestWebDAV(t *testing.T) {
+	baseURL, fs, methods, mu := newWebDAVServer(t, map[string]string{"/data.csv": "a,b\n1,2\n"})
+	fs.Mkdir(context.Background(), "/folder", 0755)
+	cacheDir := t.TempDir()
+	opts := []cachedpath.Option{cachedpath.WithCacheDir(cacheDir), cachedpath.WithQuiet(true)}
+
+	path, err := cachedpath.CachedPath(baseURL+"/data.csv", opts...)
+	if err != nil {
+		t.Fatalf("CachedPath failed: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "a,b\n1,2\n" {
+		t.Errorf("Unexpected content %q", data)
+	}
+	meta, err := cachedpath.LoadMetaFromFile(cachedpath.MetaFilePath(path))
+	if err != nil || meta.ETag == "" || meta.Size != 8 {
+		t.Errorf("Expected the ETag and size from PROPFIND in the metadata, got %+v, %v", meta, err)
+	}
+	mu.Lock()
+	if methods["PROPFIND"] != 1 || methods["GET"] != 1 {
+		t.Errorf("Expected a PROPFIND and a GET, got %v", methods)
+	}
+	mu.Unlock()
+
+	// An unchanged file is revalidated without downloading it again
+	again, err := cachedpath.CachedPath(baseURL+"/data.csv", opts...)
+	if err != nil || again != path {
+		t.Errorf("Expected the cached copy, got %s, %v", again, err)
+	}
+
+	// A new version gets a new cache entry
+	writeWebDAVFile(t, fs, "/data.csv", "a,b\n3,4\n5,6\n")
+	updated, err := cachedpath.CachedPath(baseURL+"/data.csv", opts...)
+	if err != nil || updated == path {
+		t.Fatalf("Expected a new version, got %s, %v", updated, err)
+	}
+	if data, _ := os.ReadFile(updated); string(data) != "a,b\n3,4\n5,6\n" {
+		t.Errorf("Unexpected content %q", data)
+	}
+
+	// Collections and missing files are errors
+	if _, err := cachedpath.CachedPath(baseURL+"/folder", opts...); err == nil {
+		t.Error("Expected an error for a collection")
+	}
+	if _, err := cachedpath.CachedPath(baseURL+"/missing.csv", opts...); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+	if _, err := cachedpath.CachedPath(strings.Replace(baseURL, "secret", "wrong", 1)+"/data.csv", opts...); err == nil {
+		t.Error("Expected an error with wrong credentials")
+	}
+}
@@ -0,0 +1,100 @@
+package cachedpath
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// tlsConfig returns TLSConfig with the CA certificates of WithCACertFile,
+// the client certificate of WithClientCert and the pins of
+// WithPinnedCertificates added. TLSConfig itself is not modified.
+func (o *Options) tlsConfig() (*tls.Config, error) {
+	if o.CACertFile == "" && o.ClientCertFile == "" && len(o.PinnedCertificates) == 0 {
+		return o.TLSConfig, nil
+	}
+
+	cfg := o.TLSConfig.Clone()
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+
+	if o.CACertFile != "" {
+		pem, err := os.ReadFile(o.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificates: %w", err)
+		}
+		// Trust the CA in addition to the configured or system roots
+		var roots *x509.CertPool
+		if cfg.RootCAs != nil {
+			roots = cfg.RootCAs.Clone()
+		} else if roots, err = x509.SystemCertPool(); err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.CACertFile)
+		}
+		cfg.RootCAs = roots
+	}
+
+	if o.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.ClientCertFile, o.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		cfg.Certificates = append(cfg.Certificates[:len(cfg.Certificates):len(cfg.Certificates)], cert)
+	}
+
+	if len(o.PinnedCertificates) > 0 {
+		pins, err := parsePins(o.PinnedCertificates)
+		if err != nil {
+			return nil, err
+		}
+		// VerifyConnection also runs on resumed sessions, unlike VerifyPeerCertificate
+		verify := cfg.VerifyConnection
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verify != nil {
+				if err := verify(cs); err != nil {
+					return err
+				}
+			}
+			return checkPins(cs, pins)
+		}
+	}
+
+	return cfg, nil
+}
+
+// parsePins decodes SPKI SHA-256 pins given in hex or base64, optionally
+// prefixed with "sha256/"
+func parsePins(pins []string) (map[[sha256.Size]byte]bool, error) {
+	parsed := make(map[[sha256.Size]byte]bool, len(pins))
+	for _, pin := range pins {
+		s := strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+		sum, err := hex.DecodeString(s)
+		if err != nil {
+			sum, err = base64.StdEncoding.DecodeString(s)
+		}
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid certificate pin %q: expected a SHA-256 in hex or base64", pin)
+		}
+		parsed[[sha256.Size]byte(sum)] = true
+	}
+	return parsed, nil
+}
+
+// checkPins fails with ErrCertificatePinMismatch unless the public key of
+// a certificate presented by the server is pinned
+func checkPins(cs tls.ConnectionState, pins map[[sha256.Size]byte]bool) error {
+	for _, cert := range cs.PeerCertificates {
+		if pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrCertificatePinMismatch, cs.ServerName)
+}
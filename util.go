@@ -3,15 +3,33 @@ package cachedpath
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
+	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"syscall"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/CezarGarrido/cachedpath/internal/bufpool"
+	"github.com/CezarGarrido/cachedpath/internal/fsys"
+	"github.com/CezarGarrido/cachedpath/schemes"
 )
 
-// IsURL checks if a string is a valid URL
+// IsURL checks if a string is a valid URL. Strings containing whitespace
+// or control characters are not; CachedPath trims surrounding whitespace
+// and encodes spaces before checking.
 func IsURL(path string) bool {
+	if strings.ContainsFunc(path, isSpaceOrControl) {
+		return false
+	}
 	u, err := url.Parse(path)
 	if err != nil {
 		return false
@@ -19,6 +37,83 @@ func IsURL(path string) bool {
 	return u.Scheme != "" && u.Host != ""
 }
 
+// isSpaceOrControl reports whether r can't appear unescaped in a URL
+func isSpaceOrControl(r rune) bool {
+	return unicode.IsSpace(r) || unicode.IsControl(r)
+}
+
+// hasScheme reports whether s starts with a URL scheme followed by "://"
+func hasScheme(s string) bool {
+	for i, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z':
+		case i > 0 && (r >= '0' && r <= '9' || r == '+' || r == '-' || r == '.'):
+		case i > 0 && r == ':':
+			return strings.HasPrefix(s[i:], "://")
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// normalizeURL trims the whitespace around urlOrPath. URLs are also checked
+// for control characters, which fail with ErrInvalidURL, and their spaces
+// are percent-encoded, so the cache key and the request always agree.
+// Local paths, data: URIs and paths inside archives ("archive!path") keep
+// their spaces.
+func normalizeURL(urlOrPath string) (string, error) {
+	urlOrPath = strings.TrimSpace(urlOrPath)
+	if isDataURI(urlOrPath) || !hasScheme(urlOrPath) {
+		return urlOrPath, nil
+	}
+
+	archivePath, internalPath, hasInternalPath := ParseArchivePath(urlOrPath)
+	if i := strings.IndexFunc(archivePath, unicode.IsControl); i >= 0 {
+		r, _ := utf8.DecodeRuneInString(archivePath[i:])
+		return "", fmt.Errorf("%w: control character %q at offset %d of %q", ErrInvalidURL, r, i, archivePath)
+	}
+	archivePath = strings.ReplaceAll(archivePath, " ", "%20")
+	if strings.ContainsFunc(archivePath, unicode.IsSpace) {
+		return "", fmt.Errorf("%w: whitespace in %q", ErrInvalidURL, archivePath)
+	}
+
+	if hasInternalPath {
+		return archivePath + "!" + internalPath, nil
+	}
+	return archivePath, nil
+}
+
+// fileURLPath converts a file:// URL into a local path, decoding
+// percent-escapes. ok is false when rawURL is not a file URL; only local
+// hosts ("" or "localhost") are accepted.
+func fileURLPath(rawURL string) (path string, ok bool, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || !strings.EqualFold(u.Scheme, "file") {
+		return "", false, nil
+	}
+
+	// file:relative/path
+	if u.Opaque != "" {
+		path, err := url.PathUnescape(u.Opaque)
+		if err != nil {
+			return "", true, fmt.Errorf("%w: %s", ErrInvalidURL, rawURL)
+		}
+		return filepath.FromSlash(path), true, nil
+	}
+
+	if u.Host != "" && !strings.EqualFold(u.Host, "localhost") {
+		return "", true, fmt.Errorf("%w: file URL with remote host %q", ErrInvalidURL, u.Host)
+	}
+
+	path = u.Path
+	// file:///C:/dir on Windows
+	if runtime.GOOS == "windows" && len(path) >= 3 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+	return filepath.FromSlash(path), true, nil
+}
+
 // GetScheme extracts the scheme from a URL
 func GetScheme(urlStr string) string {
 	u, err := url.Parse(urlStr)
@@ -28,24 +123,266 @@ func GetScheme(urlStr string) string {
 	return u.Scheme
 }
 
-// ResourceToFilename converts a URL and ETag into a unique filename
+// ResourceToFilename converts a URL and ETag into a unique filename.
+// The name starts with the hash of the URL so every cached version of a
+// resource can be found without knowing its ETag.
 func ResourceToFilename(resourceURL, etag string) string {
-	// Create a hash of URL + ETag to generate unique name
-	hash := sha256.New()
-	hash.Write([]byte(resourceURL))
+	hashStr := urlHash(resourceURL)
 	if etag != "" {
-		hash.Write([]byte(etag))
+		etagHash := sha256.Sum256([]byte(etag))
+		hashStr += "." + hex.EncodeToString(etagHash[:])
 	}
-	hashStr := hex.EncodeToString(hash.Sum(nil))
 
 	// Extract extension from URL if possible
 	u, _ := url.Parse(resourceURL)
-	ext := filepath.Ext(u.Path)
+	return hashStr + fileExt(path.Base(u.Path))
+}
 
-	if ext != "" {
-		return hashStr + ext
+// compoundExts are multi-part extensions kept whole so archives stay recognizable
+var compoundExts = []string{".tar.gz", ".tar.bz2", ".tar.xz"}
+
+// fileExt returns the extension of a file name, keeping compound archive
+// extensions such as ".tar.gz" whole
+func fileExt(name string) string {
+	lower := strings.ToLower(name)
+	for _, ext := range compoundExts {
+		if strings.HasSuffix(lower, ext) && len(name) > len(ext) {
+			return name[len(name)-len(ext):]
+		}
 	}
-	return hashStr
+	return path.Ext(name)
+}
+
+// safeExt reports whether a server-provided extension can be used in a
+// cache file name
+func safeExt(ext string) bool {
+	if len(ext) < 2 || len(ext) > 16 {
+		return false
+	}
+	for _, r := range ext[1:] {
+		if !(r == '.' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// cacheKey returns the URL used to key the cache. Unless KeepTrailingSlash
+// is set, a trailing slash is dropped from the path ("/doc/" and "/doc" share
+// an entry) and an empty path becomes "/".
+func (o *Options) cacheKey(resourceURL string) string {
+	if o.KeepTrailingSlash {
+		return resourceURL
+	}
+	u, err := url.Parse(resourceURL)
+	if err != nil {
+		return resourceURL
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = strings.TrimRight(u.RawPath, "/")
+	if u.Path == "" {
+		u.Path, u.RawPath = "/", ""
+	}
+	return u.String()
+}
+
+// contentTypeExts are the extensions given to cache files without one,
+// by media type, so archives and HTML pages are recognized
+var contentTypeExts = map[string]string{
+	"text/html":                    ".html",
+	"application/zip":              ".zip",
+	"application/x-zip-compressed": ".zip",
+	"application/x-compressed-tar": ".tar.gz",
+	"application/x-tgz":            ".tgz",
+}
+
+// cacheFilename returns the cache filename of a version of a resource.
+// When the name has no extension, the extension of the file name from
+// Content-Disposition is used, or one matching the Content-Type.
+func cacheFilename(resourceURL string, info schemes.ResourceInfo, opts *Options) string {
+	key := opts.cacheKey(resourceURL)
+	filename := opts.resourceFilename(key, info.Version())
+
+	// Default names end with the extension of the URL path, if any
+	ext := path.Ext(filename)
+	if opts.FilenameStrategy == nil {
+		ext = ""
+		if u, err := url.Parse(key); err == nil {
+			ext = path.Ext(u.Path)
+		}
+	}
+	if ext == "" {
+		if suggested := fileExt(info.Filename); safeExt(suggested) {
+			return filename + suggested
+		}
+		if mediaType, _, err := mime.ParseMediaType(info.ContentType); err == nil {
+			filename += contentTypeExts[mediaType]
+		}
+	}
+	return filename
+}
+
+// resourceFilename names a version of a resource with FilenameStrategy,
+// falling back to ResourceToFilename
+func (o *Options) resourceFilename(key, version string) string {
+	if o.FilenameStrategy == nil {
+		return ResourceToFilename(key, version)
+	}
+	name := o.FilenameStrategy(key, version)
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		o.Logger.Warnf("invalid cache filename %q for %s, using the default", name, key)
+		return ResourceToFilename(key, version)
+	}
+	return name
+}
+
+// checkContentType returns a *ContentTypeError if contentType is known and
+// doesn't match any of the expected media types
+func checkContentType(url, contentType string, opts *Options) error {
+	if len(opts.ExpectedContentTypes) == 0 || contentType == "" || expectedContentType(contentType, opts) {
+		return nil
+	}
+	return &ContentTypeError{URL: url, Expected: opts.ExpectedContentTypes, Actual: contentType}
+}
+
+// checkSniffedContentType checks the media type detected from head, the
+// start of a download whose response had no Content-Type. Binary and plain
+// text data are too generic to reject.
+func checkSniffedContentType(url string, head []byte, opts *Options) error {
+	detected := http.DetectContentType(head)
+	mediaType, _, _ := mime.ParseMediaType(detected)
+	if mediaType == "application/octet-stream" || mediaType == "text/plain" || expectedContentType(detected, opts) {
+		return nil
+	}
+	return &ContentTypeError{URL: url, Expected: opts.ExpectedContentTypes, Actual: mediaType, Sniffed: true}
+}
+
+// expectedContentType reports whether contentType matches one of the
+// expected media types, which may be glob patterns such as "application/*"
+func expectedContentType(contentType string, opts *Options) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	for _, expected := range opts.ExpectedContentTypes {
+		expected = strings.ToLower(strings.TrimSpace(expected))
+		if matched, err := path.Match(expected, mediaType); matched || (err != nil && expected == mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// sniffLen is how much of a download is kept to detect its media type
+const sniffLen = 512
+
+// sniffWriter keeps the first sniffLen bytes written to it
+type sniffWriter struct {
+	head []byte
+}
+
+func (w *sniffWriter) Write(p []byte) (int, error) {
+	if n := sniffLen - len(w.head); n > 0 {
+		w.head = append(w.head, p[:min(n, len(p))]...)
+	}
+	return len(p), nil
+}
+
+// urlHash returns the hex encoded SHA-256 hash of a URL
+func urlHash(resourceURL string) string {
+	hash := sha256.Sum256([]byte(resourceURL))
+	return hex.EncodeToString(hash[:])
+}
+
+// fileSHA256 returns the hex encoded SHA-256 digest of a file read through fs
+func fileSHA256(fs fsys.FS, path string) (string, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place. A new file gets perm; an existing file keeps its mode.
+func writeFileAtomic(fs fsys.FS, path string, data []byte, perm os.FileMode) error {
+	if info, err := fs.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	tmpFile, err := fs.CreateTemp(filepath.Dir(path), ".meta-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	defer fs.Remove(tmpPath) // Remove on error
+
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := fs.Chmod(tmpPath, perm); err != nil {
+		return err
+	}
+	return fs.Rename(tmpPath, path)
+}
+
+// tempDirFor returns the directory of the temporary files of a download to
+// destPath: TempDir, or the directory of destPath
+func (o *Options) tempDirFor(destPath string) string {
+	if o.TempDir == "" || o.virtual() {
+		return filepath.Dir(destPath)
+	}
+	return o.TempDir
+}
+
+// moveFile renames src to dst. When they are on different file systems, as
+// a TempDir on another mount can be, src is copied to a temporary file next
+// to dst that is renamed into place, so dst never holds a partial copy, and
+// then removed. The copy gets perm.
+func moveFile(fs fsys.FS, src, dst string, perm os.FileMode) error {
+	err := fs.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmpFile, err := fs.CreateTemp(filepath.Dir(dst), ".download-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+	defer fs.Remove(tmpPath) // Remove on error
+
+	_, err = bufpool.Copy(tmpFile, in)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := fs.Chmod(tmpPath, perm); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmpPath, dst); err != nil {
+		return err
+	}
+	fs.Remove(src)
+	return nil
 }
 
 // ParseArchivePath parses paths in the format "file.tar.gz!internal/path"
@@ -60,7 +397,7 @@ func ParseArchivePath(path string) (archivePath, internalPath string, ok bool) {
 // GetDefaultCacheDir returns the default cache directory
 func GetDefaultCacheDir() (string, error) {
 	// Check environment variable
-	if dir := os.Getenv("CACHED_PATH_CACHE_ROOT"); dir != "" {
+	if dir := os.Getenv(cacheRootEnv); dir != "" {
 		return dir, nil
 	}
 
@@ -73,6 +410,70 @@ func GetDefaultCacheDir() (string, error) {
 	return filepath.Join(home, ".cache", "cached_path"), nil
 }
 
+// cacheRootEnv is the environment variable that sets the default cache directory
+const cacheRootEnv = "CACHED_PATH_CACHE_ROOT"
+
+// validateCacheDir checks that the cache directory is a directory, or can be
+// created as one, without creating anything. Errors name the offending path,
+// its type and, when the directory came from CACHED_PATH_CACHE_ROOT, the
+// variable.
+func validateCacheDir(dir string) error {
+	invalid := func(path, problem string) error {
+		err := fmt.Errorf("%w: %s %s", ErrInvalidCacheDir, path, problem)
+		if env := os.Getenv(cacheRootEnv); env != "" && env == dir {
+			err = fmt.Errorf("%w (set by %s)", err, cacheRootEnv)
+		}
+		return err
+	}
+
+	// Find the nearest existing path: MkdirAll can only create what's below it
+	path := dir
+	for {
+		info, err := os.Lstat(path)
+		if err == nil {
+			if info.Mode()&os.ModeSymlink != 0 {
+				target, _ := os.Readlink(path)
+				resolved, err := os.Stat(path)
+				if err != nil {
+					return invalid(path, fmt.Sprintf("is a dangling symlink to %s", target))
+				}
+				info = resolved
+			}
+			if !info.IsDir() {
+				return invalid(path, "is a "+fileTypeName(info.Mode()))
+			}
+			return nil
+		}
+		// A file in the middle of the path reports ENOTDIR
+		if !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTDIR) {
+			// Permission problems are reported when the directory is used
+			return nil
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return nil
+		}
+		path = parent
+	}
+}
+
+// fileTypeName describes the type of a file for error messages
+func fileTypeName(mode os.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "regular file"
+	case mode&os.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeDevice != 0:
+		return "device"
+	default:
+		return "non-directory file"
+	}
+}
+
 // EnsureDir ensures a directory exists
 func EnsureDir(dir string) error {
 	return os.MkdirAll(dir, 0755)
@@ -80,7 +481,12 @@ func EnsureDir(dir string) error {
 
 // FileExists checks if a file exists
 func FileExists(path string) bool {
-	_, err := os.Stat(path)
+	return fileExists(fsys.OS{}, path)
+}
+
+// fileExists checks if a file exists through fs
+func fileExists(fs fsys.FS, path string) bool {
+	_, err := fs.Stat(path)
 	return err == nil
 }
 
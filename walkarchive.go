@@ -0,0 +1,135 @@
+package cachedpath
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+// ArchiveEntry describes a member of an archive visited by WalkArchive
+type ArchiveEntry struct {
+	// Name is the member path inside the archive
+	Name string
+
+	// Size is the uncompressed size in bytes
+	Size int64
+
+	// Mode holds the permission and type bits
+	Mode os.FileMode
+
+	// ModTime is the modification time recorded in the archive
+	ModTime time.Time
+
+	// Linkname is the target of a symbolic or hard link
+	Linkname string
+}
+
+// IsDir reports whether the entry is a directory
+func (e ArchiveEntry) IsDir() bool {
+	return e.Mode.IsDir()
+}
+
+// errEntryClosed is returned by an open function called after its callback returned
+var errEntryClosed = errors.New("archive entry opened after its callback returned")
+
+// WalkArchive calls fn for each member of a zip or tar archive (.tar.gz,
+// .tar.bz2 or .tar.xz), one at a time and without extracting anything.
+// open returns the member's contents and is only valid until fn returns;
+// members that are not opened are skipped without being read. Zip archives
+// are walked through their central directory, tar archives sequentially.
+//
+// If fn returns fs.SkipAll the walk stops and WalkArchive returns nil; any
+// other error stops the walk and is returned. Remote archives are cached
+// first, as with EnsureDownloaded.
+func WalkArchive(urlOrPath string, fn func(entry ArchiveEntry, open func() (io.ReadCloser, error)) error, opts ...Option) error {
+	options := defaultOptions()
+	for _, opt := range opts {
+		opt(options)
+	}
+	if options.virtual() {
+		return fmt.Errorf("%w: walking %s", ErrUnsupportedByCache, urlOrPath)
+	}
+
+	archivePath, err := EnsureDownloaded(urlOrPath, opts...)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(strings.ToLower(archivePath), ".zip") {
+		err = walkZip(archivePath, fn)
+	} else {
+		err = walkTar(archivePath, fn)
+	}
+	if errors.Is(err, fs.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+// walkZip implements WalkArchive for zip archives
+func walkZip(zipPath string, fn func(ArchiveEntry, func() (io.ReadCloser, error)) error) error {
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return fmt.Errorf("failed to open zip: %w", err)
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		entry := ArchiveEntry{
+			Name:    f.Name,
+			Size:    int64(f.UncompressedSize64),
+			Mode:    f.Mode(),
+			ModTime: f.Modified,
+		}
+		if err := fn(entry, f.Open); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkTar implements WalkArchive for tar archives
+func walkTar(archivePath string, fn func(ArchiveEntry, func() (io.ReadCloser, error)) error) error {
+	tr, closeAll, err := openTar(archivePath)
+	if err != nil {
+		return err
+	}
+	defer closeAll()
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar: %w", err)
+		}
+
+		entry := ArchiveEntry{
+			Name:     header.Name,
+			Size:     header.Size,
+			Mode:     header.FileInfo().Mode(),
+			ModTime:  header.ModTime,
+			Linkname: header.Linkname,
+		}
+
+		// The tar reader moves on to the next member after fn returns
+		valid := true
+		open := func() (io.ReadCloser, error) {
+			if !valid {
+				return nil, errEntryClosed
+			}
+			return io.NopCloser(tr), nil
+		}
+		err = fn(entry, open)
+		valid = false
+		if err != nil {
+			return err
+		}
+	}
+}